@@ -542,7 +542,11 @@ func searchStore(c *Command, r *http.Request, user *auth.UserState) Response {
 	case store.ErrUnauthenticated, store.ErrInvalidCredentials:
 		return Unauthorized(err.Error())
 	default:
-		if e, ok := err.(*url.Error); ok {
+		lastErr := err
+		if e, ok := err.(*httputil.RetriesExhaustedError); ok {
+			lastErr = e.Err
+		}
+		if e, ok := lastErr.(*url.Error); ok {
 			if neterr, ok := e.Err.(*net.OpError); ok {
 				if dnserr, ok := neterr.Err.(*net.DNSError); ok {
 					return SyncResponse(&resp{
@@ -2107,7 +2111,7 @@ func postBuy(c *Command, r *http.Request, user *auth.UserState) Response {
 
 	s := getStore(c)
 
-	buyResult, err := s.Buy(&opts, user)
+	buyResult, err := s.Buy(r.Context(), &opts, user)
 
 	if resp := convertBuyError(err); resp != nil {
 		return resp
@@ -30,6 +30,7 @@ import (
 	"io/ioutil"
 	"math"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -52,6 +53,7 @@ import (
 	"github.com/snapcore/snapd/client"
 	"github.com/snapcore/snapd/cmd"
 	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/httputil"
 	"github.com/snapcore/snapd/interfaces"
 	"github.com/snapcore/snapd/interfaces/builtin"
 	"github.com/snapcore/snapd/interfaces/ifacetest"
@@ -173,7 +175,7 @@ func (s *apiBaseSuite) SuggestedCurrency() string {
 	return s.suggestedCurrency
 }
 
-func (s *apiBaseSuite) Buy(options *client.BuyOptions, user *auth.UserState) (*client.BuyResult, error) {
+func (s *apiBaseSuite) Buy(ctx context.Context, options *client.BuyOptions, user *auth.UserState) (*client.BuyResult, error) {
 	s.pokeStateLock()
 
 	s.buyOptions = options
@@ -2126,6 +2128,46 @@ func (s *apiSuite) TestFindBadQueryReturnsCorrectErrorKind(c *check.C) {
 	c.Check(rsp.Result.(*errorResult).Kind, check.Equals, errorKindBadQuery)
 }
 
+func (s *apiSuite) TestFindNetworkTimeoutOnLastAttempt(c *check.C) {
+	s.daemon(c)
+
+	// the store gave up retrying after a timeout
+	s.err = &httputil.RetriesExhaustedError{
+		Err:      &url.Error{Op: "Get", URL: "https://api.snapcraft.io/", Err: fakeNetError{message: "timeout", timeout: true}},
+		Attempts: 5,
+	}
+	req, err := http.NewRequest("GET", "/v2/find?q=hello", nil)
+	c.Assert(err, check.IsNil)
+
+	rsp := searchStore(findCmd, req, nil).(*resp)
+	c.Check(rsp.Type, check.Equals, ResponseTypeError)
+	c.Check(rsp.Status, check.Equals, 400)
+	c.Check(rsp.Result.(*errorResult).Message, check.Matches, `.*timeout \(gave up after 5 attempts in .*\)`)
+	c.Check(rsp.Result.(*errorResult).Kind, check.Equals, errorKindNetworkTimeout)
+}
+
+func (s *apiSuite) TestFindDNSFailureOnLastAttempt(c *check.C) {
+	s.daemon(c)
+
+	dnsErr := &net.DNSError{Err: "some dns failure", Name: "api.snapcraft.io", IsTemporary: true}
+	s.err = &httputil.RetriesExhaustedError{
+		Err: &url.Error{Op: "Get", URL: "https://api.snapcraft.io/", Err: &net.OpError{
+			Op:  "dial",
+			Net: "tcp",
+			Err: dnsErr,
+		}},
+		Attempts: 5,
+	}
+	req, err := http.NewRequest("GET", "/v2/find?q=hello", nil)
+	c.Assert(err, check.IsNil)
+
+	rsp := searchStore(findCmd, req, nil).(*resp)
+	c.Check(rsp.Type, check.Equals, ResponseTypeError)
+	c.Check(rsp.Status, check.Equals, 400)
+	c.Check(rsp.Result.(*errorResult).Message, check.Equals, dnsErr.Error())
+	c.Check(rsp.Result.(*errorResult).Kind, check.Equals, errorKindDNSFailure)
+}
+
 func (s *apiSuite) TestFindPriced(c *check.C) {
 	s.daemon(c)
 
@@ -7462,6 +7504,8 @@ func (s *apiSuite) TestErrToResponse(c *check.C) {
 	netoe := fakeNetError{message: "other"}
 	nettoute := fakeNetError{message: "timeout", timeout: true}
 	nettmpe := fakeNetError{message: "temp", temporary: true}
+	nettoutexhe := &httputil.RetriesExhaustedError{Err: nettoute, Attempts: 5}
+	rbe := &store.RevisionBlockedError{Revision: snap.R(42)}
 
 	e := errors.New("other error")
 
@@ -7488,6 +7532,7 @@ func (s *apiSuite) TestErrToResponse(c *check.C) {
 	}{
 		{store.ErrSnapNotFound, SnapNotFound("foo", store.ErrSnapNotFound)},
 		{store.ErrNoUpdateAvailable, makeErrorRsp(errorKindSnapNoUpdateAvailable, store.ErrNoUpdateAvailable, "")},
+		{rbe, makeErrorRsp(errorKindSnapNoUpdateAvailable, rbe, "")},
 		{store.ErrLocalSnap, makeErrorRsp(errorKindSnapLocal, store.ErrLocalSnap, "")},
 		{aie, makeErrorRsp(errorKindSnapAlreadyInstalled, aie, "foo")},
 		{nie, makeErrorRsp(errorKindSnapNotInstalled, nie, "foo")},
@@ -7497,6 +7542,7 @@ func (s *apiSuite) TestErrToResponse(c *check.C) {
 		{ncse, makeErrorRsp(errorKindSnapNeedsClassicSystem, ncse, "foo")},
 		{cce, SnapChangeConflict(cce)},
 		{nettoute, makeErrorRsp(errorKindNetworkTimeout, nettoute, "")},
+		{nettoutexhe, makeErrorRsp(errorKindNetworkTimeout, nettoutexhe, "")},
 		{netoe, BadRequest("ERR: %v", netoe)},
 		{nettmpe, BadRequest("ERR: %v", nettmpe)},
 		{e, BadRequest("ERR: %v", e)},
@@ -582,6 +582,8 @@ func errToResponse(err error, snaps []string, fallback func(format string, v ...
 			default:
 				return InternalError("store.RevisionNotAvailable with %d snaps", len(snaps))
 			}
+		case *store.RevisionBlockedError:
+			kind = errorKindSnapNoUpdateAvailable
 		case *snap.AlreadyInstalledError:
 			kind = errorKindSnapAlreadyInstalled
 			snapName = err.Snap
@@ -20,6 +20,7 @@
 package httputil
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -28,6 +29,7 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"runtime"
 	"time"
 
 	"github.com/snapcore/snapd/logger"
@@ -73,71 +75,53 @@ func (e *ExtraSSLCertsFromDir) Certs() ([]*CertData, error) {
 	return extraCerts, nil
 }
 
-// dialTLS holds a tls.Config that is used by the dialTLS.dialTLS()
-// function.
-type dialTLS struct {
-	conf          *tls.Config
-	extraSSLCerts ExtraSSLCerts
+// dialer dials the connections on top of which net/http does the tls
+// handshake, if any.
+type dialer struct {
+	unixSocket string
 }
 
-// dialTLS will use it's tls.Config and use that to do a tls connection.
-func (d *dialTLS) dialTLS(network, addr string) (net.Conn, error) {
-	if d.conf == nil {
-		// c.f. go source: crypto/tls/common.go
-		var emptyConfig tls.Config
-		d.conf = &emptyConfig
-	}
-
-	// ensure we never use anything lower than TLS v1.2, see
-	// https://github.com/snapcore/snapd/pull/8100/files#r384046667
-	if d.conf.MinVersion < tls.VersionTLS12 {
-		d.conf.MinVersion = tls.VersionTLS12
-	}
-
-	// add extraSSLCerts if needed
-	if err := d.addLocalSSLCertificates(); err != nil {
-		logger.Noticef("cannot add local ssl certificates: %v", err)
+// dialContext connects to addr, or to the unix socket instead if set,
+// within the deadline and cancellation of ctx. The tls handshake, if
+// any, is left to net/http so that it is traced like the rest of the
+// connection setup.
+func (d *dialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.unixSocket != "" {
+		network, addr = "unix", d.unixSocket
 	}
-
-	return tls.Dial(network, addr, d.conf)
+	return origDefaultTransport.DialContext(ctx, network, addr)
 }
 
-// addLocalSSLCertificates() is an internal helper that is called by
-// dialTLS to add an extra certificates.
-func (d *dialTLS) addLocalSSLCertificates() (err error) {
-	if d.extraSSLCerts == nil {
-		// nothing to add
-		return nil
-	}
-
-	var allCAs *x509.CertPool
+// rootCAsWithExtraCerts returns a new pool with the given root CAs, or
+// the system ones if nil, and the extra certificates.
+func rootCAsWithExtraCerts(rootCAs *x509.CertPool, extraSSLCerts ExtraSSLCerts) (allCAs *x509.CertPool, err error) {
 	// start with all our current certs
-	if d.conf.RootCAs != nil {
-		allCAs = d.conf.RootCAs
+	if rootCAs != nil {
+		allCAs = copyCertPool(rootCAs)
+		if allCAs == nil {
+			return nil, fmt.Errorf("cannot copy the root certificates with %s", runtime.Version())
+		}
 	} else {
 		allCAs, err = x509.SystemCertPool()
 		if err != nil {
-			return fmt.Errorf("cannot read system certificates: %v", err)
+			return nil, fmt.Errorf("cannot read system certificates: %v", err)
 		}
 	}
 	if allCAs == nil {
-		return fmt.Errorf("cannot use empty certificate pool")
+		return nil, fmt.Errorf("cannot use empty certificate pool")
 	}
 
 	// and now collect any new ones
-	extraCerts, err := d.extraSSLCerts.Certs()
+	extraCerts, err := extraSSLCerts.Certs()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, cert := range extraCerts {
 		if ok := allCAs.AppendCertsFromPEM(cert.Raw); !ok {
 			logger.Noticef("cannot load ssl certificate: %v", cert.Origin)
 		}
 	}
-
-	// and add them
-	d.conf.RootCAs = allCAs
-	return nil
+	return allCAs, nil
 }
 
 type ClientOptions struct {
@@ -149,6 +133,12 @@ type ClientOptions struct {
 	ProxyConnectHeader http.Header
 
 	ExtraSSLCerts ExtraSSLCerts
+
+	// UnixSocket, if set, is the path of a unix socket through which
+	// all connections are made, regardless of the host and port of
+	// the request URL (which are still used for the Host header and
+	// for the TLS server name).
+	UnixSocket string
 }
 
 // NewHTTPCLient returns a new http.Client with a LoggedTransport, a
@@ -163,16 +153,37 @@ func NewHTTPClient(opts *ClientOptions) *http.Client {
 		transport.Proxy = opts.Proxy
 	}
 	transport.ProxyConnectHeader = opts.ProxyConnectHeader
-	// Remember the original ClientOptions.TLSConfig when making
-	// tls connection.
-	// Note that we only set TLSClientConfig here because it's extracted
-	// by the cmd/snap-repair/runner_test.go
-	transport.TLSClientConfig = opts.TLSConfig
-	dialTLS := &dialTLS{
-		conf:          opts.TLSConfig,
-		extraSSLCerts: opts.ExtraSSLCerts,
+
+	var tlsConfig *tls.Config
+	if opts.TLSConfig != nil {
+		// the config of the caller is left alone
+		tlsConfig = opts.TLSConfig.Clone()
+	} else {
+		// c.f. go source: crypto/tls/common.go
+		tlsConfig = &tls.Config{}
+	}
+	// ensure we never use anything lower than TLS v1.2, see
+	// https://github.com/snapcore/snapd/pull/8100/files#r384046667
+	if tlsConfig.MinVersion < tls.VersionTLS12 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	// add the extra certificates to a pool of our own, as net/http
+	// uses the config concurrently
+	if opts.ExtraSSLCerts != nil {
+		rootCAs, err := rootCAsWithExtraCerts(tlsConfig.RootCAs, opts.ExtraSSLCerts)
+		if err != nil {
+			logger.Noticef("cannot add local ssl certificates: %v", err)
+		} else {
+			tlsConfig.RootCAs = rootCAs
+		}
+	}
+	// Note that net/http uses TLSClientConfig for the tls handshake,
+	// and that it's also extracted by the cmd/snap-repair/runner_test.go
+	transport.TLSClientConfig = tlsConfig
+	dialer := &dialer{
+		unixSocket: opts.UnixSocket,
 	}
-	transport.DialTLS = dialTLS.dialTLS
+	transport.DialContext = dialer.dialContext
 
 	return &http.Client{
 		Transport: &LoggedTransport{
@@ -21,6 +21,7 @@ package httputil_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -36,6 +37,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"gopkg.in/check.v1"
@@ -100,6 +102,34 @@ func (s *clientSuite) TestClientProxyTakesUserAgent(c *check.C) {
 	c.Assert(called, check.Equals, true)
 }
 
+func (s *clientSuite) TestClientOptionsWithUnixSocket(c *check.C) {
+	sock := filepath.Join(c.MkDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	c.Assert(err, check.IsNil)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Host, check.Equals, "store.example.com:8080")
+		c.Check(r.URL.Path, check.Equals, "/foo")
+		io.WriteString(w, "hello")
+	}))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	cli := httputil.NewHTTPClient(&httputil.ClientOptions{
+		UnixSocket: sock,
+	})
+	c.Assert(cli, check.NotNil)
+
+	resp, err := cli.Get("http://store.example.com:8080/foo")
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	c.Check(string(body), check.Equals, "hello")
+}
+
 var privKey, _ = rsa.GenerateKey(rand.Reader, 768)
 
 // see crypto/tls/generate_cert.go
@@ -230,3 +260,142 @@ func (s *tlsSuite) TestClientExtraSSLCertIntegration(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(res.StatusCode, check.Equals, 200)
 }
+
+func (s *tlsSuite) TestClientExtraSSLCertViaUnixSocket(c *check.C) {
+	sock := filepath.Join(c.MkDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	c.Assert(err, check.IsNil)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Host, check.Equals, "localhost:8443")
+		io.WriteString(w, `all good`)
+	}))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.TLS = s.srv.TLS.Clone()
+	srv.StartTLS()
+	defer srv.Close()
+
+	cli := httputil.NewHTTPClient(&httputil.ClientOptions{
+		ExtraSSLCerts: &httputil.ExtraSSLCertsFromDir{
+			Dir: dirs.SnapdStoreSSLCertsDir,
+		},
+		UnixSocket: sock,
+	})
+	c.Assert(cli, check.NotNil)
+
+	// the certificate is checked against the host of the url
+	res, err := cli.Get("https://localhost:8443/")
+	c.Assert(err, check.IsNil)
+	res.Body.Close()
+	c.Check(res.StatusCode, check.Equals, 200)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequest("GET", "https://localhost:8443/", nil)
+	c.Assert(err, check.IsNil)
+	_, err = cli.Do(req.WithContext(ctx))
+	c.Check(err, check.ErrorMatches, ".*context canceled")
+}
+
+func (s *tlsSuite) TestClientExtraSSLCertOnTopOfRootCAs(c *check.C) {
+	if !httputil.CanCopyCertPool {
+		c.Skip("cannot copy certificate pools with this go version")
+	}
+	// a server whose certificate is only in the root CAs of the caller
+	otherSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `all good`)
+	}))
+	defer otherSrv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(otherSrv.Certificate())
+
+	tlsConfig := &tls.Config{RootCAs: roots}
+	cli := httputil.NewHTTPClient(&httputil.ClientOptions{
+		TLSConfig: tlsConfig,
+		ExtraSSLCerts: &httputil.ExtraSSLCertsFromDir{
+			Dir: dirs.SnapdStoreSSLCertsDir,
+		},
+	})
+	c.Assert(cli, check.NotNil)
+
+	// both the root CAs of the caller and the extra certs are trusted
+	for _, u := range []string{otherSrv.URL, s.srv.URL} {
+		res, err := cli.Get(u)
+		c.Assert(err, check.IsNil)
+		res.Body.Close()
+		c.Check(res.StatusCode, check.Equals, 200)
+	}
+	c.Check(s.logbuf.String(), check.Equals, "")
+	// the client uses a pool of its own
+	clientRoots := httputil.BaseTransport(cli).TLSClientConfig.RootCAs
+	c.Check(clientRoots, check.Not(check.Equals), roots)
+	c.Check(clientRoots.Subjects(), check.HasLen, 2)
+	// and the config of the caller is left alone
+	c.Check(tlsConfig.RootCAs, check.Equals, roots)
+	c.Check(roots.Subjects(), check.HasLen, 1)
+	c.Check(tlsConfig.MinVersion, check.Equals, uint16(0))
+}
+
+func (s *tlsSuite) TestClientExtraSSLCertsAddedOnce(c *check.C) {
+	cli := httputil.NewHTTPClient(&httputil.ClientOptions{
+		ExtraSSLCerts: &httputil.ExtraSSLCertsFromDir{
+			Dir: dirs.SnapdStoreSSLCertsDir,
+		},
+	})
+	c.Assert(cli, check.NotNil)
+	tlsConfig := httputil.BaseTransport(cli).TLSClientConfig
+	rootCAs := tlsConfig.RootCAs
+	c.Assert(rootCAs, check.NotNil)
+
+	// concurrent requests on new connections leave the pool alone
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := cli.Get(s.srv.URL)
+			c.Check(err, check.IsNil)
+			if err == nil {
+				res.Body.Close()
+			}
+			httputil.BaseTransport(cli).CloseIdleConnections()
+		}()
+	}
+	wg.Wait()
+	c.Check(tlsConfig.RootCAs, check.Equals, rootCAs)
+}
+
+func (s *tlsSuite) TestClientTLSConfigOfCallerLeftAlone(c *check.C) {
+	tlsConfig := &tls.Config{}
+	cli := httputil.NewHTTPClient(&httputil.ClientOptions{
+		TLSConfig: tlsConfig,
+		ExtraSSLCerts: &httputil.ExtraSSLCertsFromDir{
+			Dir: dirs.SnapdStoreSSLCertsDir,
+		},
+	})
+	c.Assert(cli, check.NotNil)
+
+	res, err := cli.Get(s.srv.URL)
+	c.Assert(err, check.IsNil)
+	res.Body.Close()
+
+	c.Check(tlsConfig.MinVersion, check.Equals, uint16(0))
+	c.Check(tlsConfig.RootCAs, check.IsNil)
+	clientConfig := httputil.BaseTransport(cli).TLSClientConfig
+	c.Check(clientConfig, check.Not(check.Equals), tlsConfig)
+	c.Check(clientConfig.MinVersion, check.Equals, uint16(tls.VersionTLS12))
+}
+
+func (s *tlsSuite) TestClientRootCAsOnlyWithoutExtraSSLCerts(c *check.C) {
+	roots := x509.NewCertPool()
+	cli := httputil.NewHTTPClient(&httputil.ClientOptions{
+		TLSConfig: &tls.Config{RootCAs: roots},
+		ExtraSSLCerts: &httputil.ExtraSSLCertsFromDir{
+			Dir: c.MkDir(),
+		},
+	})
+
+	_, err := cli.Get(s.srv.URL)
+	c.Assert(err, check.ErrorMatches, ".* certificate signed by unknown authority")
+}
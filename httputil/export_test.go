@@ -22,3 +22,5 @@ package httputil
 var (
 	GetFlags = (*LoggedTransport).getFlags
 )
+
+const CanCopyCertPool = canCopyCertPool
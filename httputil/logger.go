@@ -77,6 +77,17 @@ func (tr *LoggedTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	return rsp, err
 }
 
+// CloseIdleConnections closes the idle connections of the wrapped
+// transport, if it supports it.
+func (tr *LoggedTransport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if ci, ok := tr.Transport.(closeIdler); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
 func (tr *LoggedTransport) getFlags() debugflag {
 	flags, err := strconv.Atoi(os.Getenv(tr.Key))
 	if err != nil {
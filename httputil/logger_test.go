@@ -82,6 +82,32 @@ func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return t.rsp, nil
 }
 
+type closeIdleTransport struct {
+	fakeTransport
+	closed int
+}
+
+func (t *closeIdleTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+func (s loggerSuite) TestCloseIdleConnections(c *check.C) {
+	inner := &closeIdleTransport{}
+	tr := &httputil.LoggedTransport{
+		Transport: inner,
+		Key:       "TEST_FOO",
+	}
+	tr.CloseIdleConnections()
+	c.Check(inner.closed, check.Equals, 1)
+
+	// transports without idle connections are fine too
+	tr = &httputil.LoggedTransport{
+		Transport: &fakeTransport{},
+		Key:       "TEST_FOO",
+	}
+	tr.CloseIdleConnections()
+}
+
 func (s loggerSuite) TestLogging(c *check.C) {
 	req, err := http.NewRequest("WAT", "http://example.com/", nil)
 	c.Assert(err, check.IsNil)
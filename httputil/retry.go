@@ -20,6 +20,7 @@
 package httputil
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -44,9 +45,87 @@ func (e *PerstistentNetworkError) Error() string {
 	return fmt.Sprintf("persistent network error: %v", e.Err)
 }
 
+// RetriesExhaustedError wraps the error of the last attempt of a
+// retry loop that gave up because its strategy did not allow for
+// more attempts, even though the error was worth retrying. It is a
+// net.Error reporting Timeout and Temporary as the wrapped error does.
+type RetriesExhaustedError struct {
+	Err      error
+	Attempts int
+	Elapsed  time.Duration
+}
+
+func (e *RetriesExhaustedError) Error() string {
+	return fmt.Sprintf("%v (gave up after %d attempts in %v)", e.Err, e.Attempts, e.Elapsed)
+}
+
+func (e *RetriesExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RetriesExhaustedError) Timeout() bool {
+	netErr, ok := e.Err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (e *RetriesExhaustedError) Temporary() bool {
+	netErr, ok := e.Err.(net.Error)
+	return ok && netErr.Temporary()
+}
+
+// Timer is a timer started by AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing, see time.Timer.Stop.
+	Stop() bool
+}
+
+// AfterFuncClock is a retry.Clock that also runs timers, like
+// time.AfterFunc.
+type AfterFuncClock interface {
+	retry.Clock
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time                         { return time.Now() }
+func (wallClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (wallClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+var clock retry.Clock = wallClock{}
+
+// Clock returns the clock used by the retry loops, for their delays and
+// for measuring elapsed times.
+func Clock() retry.Clock {
+	return clock
+}
+
+// AfterFunc calls f in its own goroutine once d has elapsed on the
+// clock, unless the returned Timer is stopped first. A mocked clock
+// that is not an AfterFuncClock leaves it to the wall clock.
+func AfterFunc(d time.Duration, f func()) Timer {
+	if c, ok := clock.(AfterFuncClock); ok {
+		return c.AfterFunc(d, f)
+	}
+	return time.AfterFunc(d, f)
+}
+
+// MockClock replaces the clock used by the retry loops, so that tests
+// can check their timing without actually waiting.
+func MockClock(c retry.Clock) (restore func()) {
+	old := clock
+	clock = c
+	return func() {
+		clock = old
+	}
+}
+
 func MaybeLogRetryAttempt(url string, attempt *retry.Attempt, startTime time.Time) {
 	if osutil.GetenvBool("SNAPD_DEBUG") || attempt.Count() > 1 {
-		logger.Debugf("Retrying %s, attempt %d, elapsed time=%v", url, attempt.Count(), time.Since(startTime))
+		logger.Debugf("Retrying %s, attempt %d, elapsed time=%v", url, attempt.Count(), clock.Now().Sub(startTime))
 	}
 }
 
@@ -58,7 +137,7 @@ func maybeLogRetrySummary(startTime time.Time, url string, attempt *retry.Attemp
 		} else if resp != nil {
 			status = fmt.Sprintf("%d", resp.StatusCode)
 		}
-		logger.Debugf("The retry loop for %s finished after %d retries, elapsed time=%v, status: %s", url, attempt.Count(), time.Since(startTime), status)
+		logger.Debugf("The retry loop for %s finished after %d retries, elapsed time=%v, status: %s", url, attempt.Count(), clock.Now().Sub(startTime), status)
 	}
 }
 
@@ -115,6 +194,10 @@ func ShouldRetryError(err error) (b bool) {
 	if urlErr, ok := err.(*url.Error); ok {
 		err = urlErr.Err
 	}
+	// there is no point in retrying once the context is done
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
 	if netErr, ok := err.(net.Error); ok {
 		if netErr.Timeout() {
 			logger.Debugf("Retrying because of: %s", netErr)
@@ -252,9 +335,22 @@ func isDnsUnavailable(err error) bool {
 
 // RetryRequest calls doRequest and read the response body in a retry loop using the given retryStrategy.
 func RetryRequest(endpoint string, doRequest func() (*http.Response, error), readResponseBody func(resp *http.Response) error, retryStrategy retry.Strategy) (resp *http.Response, err error) {
+	return retryRequest(endpoint, doRequest, readResponseBody, retryStrategy, false)
+}
+
+// RetryRequestReportExhausted is like RetryRequest but if the error of
+// the last attempt would have been retried were it not for the retry
+// strategy running out, it is returned wrapped in a
+// RetriesExhaustedError. Responses with an error status are still
+// returned as is.
+func RetryRequestReportExhausted(endpoint string, doRequest func() (*http.Response, error), readResponseBody func(resp *http.Response) error, retryStrategy retry.Strategy) (resp *http.Response, err error) {
+	return retryRequest(endpoint, doRequest, readResponseBody, retryStrategy, true)
+}
+
+func retryRequest(endpoint string, doRequest func() (*http.Response, error), readResponseBody func(resp *http.Response) error, retryStrategy retry.Strategy, reportExhausted bool) (resp *http.Response, err error) {
 	var attempt *retry.Attempt
-	startTime := time.Now()
-	for attempt = retry.Start(retryStrategy, nil); attempt.Next(); {
+	startTime := clock.Now()
+	for attempt = retry.Start(retryStrategy, clock); attempt.Next(); {
 		MaybeLogRetryAttempt(endpoint, attempt, startTime)
 
 		resp, err = doRequest()
@@ -265,6 +361,8 @@ func RetryRequest(endpoint string, doRequest func() (*http.Response, error), rea
 
 			if isNetworkDown(err) || isDnsUnavailable(err) {
 				err = &PerstistentNetworkError{Err: err}
+			} else if reportExhausted {
+				err = maybeExhausted(attempt, startTime, err)
 			}
 			break
 		}
@@ -279,6 +377,9 @@ func RetryRequest(endpoint string, doRequest func() (*http.Response, error), rea
 				if ShouldRetryAttempt(attempt, err) {
 					continue
 				} else {
+					if reportExhausted {
+						err = maybeExhausted(attempt, startTime, err)
+					}
 					maybeLogRetrySummary(startTime, endpoint, attempt, resp, err)
 					return nil, err
 				}
@@ -291,3 +392,16 @@ func RetryRequest(endpoint string, doRequest func() (*http.Response, error), rea
 
 	return resp, err
 }
+
+// maybeExhausted wraps err in a RetriesExhaustedError if it is worth
+// retrying but the attempts ran out.
+func maybeExhausted(attempt *retry.Attempt, startTime time.Time, err error) error {
+	if attempt.More() || attempt.Stopped() || !ShouldRetryError(err) {
+		return err
+	}
+	return &RetriesExhaustedError{
+		Err:      err,
+		Attempts: attempt.Count(),
+		Elapsed:  clock.Now().Sub(startTime),
+	}
+}
@@ -20,16 +20,20 @@
 package httputil_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/xerrors"
 	. "gopkg.in/check.v1"
 	"gopkg.in/retry.v1"
 
@@ -150,6 +154,126 @@ func (s *retrySuite) TestRetryRequestFailWithEOF(c *C) {
 	c.Assert(n.Count(), Equals, 5)
 }
 
+func (s *retrySuite) TestRetryRequestReportExhaustedFailWithEOF(c *C) {
+	n := new(counter)
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Inc()
+		io.WriteString(w, "{")
+		mockServer.CloseClientConnections()
+		return
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	cli := httputil.NewHTTPClient(nil)
+
+	doRequest := func() (*http.Response, error) {
+		return cli.Get(mockServer.URL)
+	}
+	readResponseBody := func(resp *http.Response) error {
+		return nil
+	}
+
+	_, err := httputil.RetryRequestReportExhausted("endp", doRequest, readResponseBody, testRetryStrategy)
+	c.Assert(err, ErrorMatches, `^Get \"?http://127.0.0.1:.*?\"?: EOF \(gave up after 5 attempts in .*\)$`)
+	exhaustedErr, ok := err.(*httputil.RetriesExhaustedError)
+	c.Assert(ok, Equals, true)
+	c.Check(exhaustedErr.Attempts, Equals, 5)
+	c.Check(exhaustedErr.Elapsed > 0, Equals, true)
+	// the last error is reachable through the usual unwrapping
+	c.Check(xerrors.Unwrap(err), ErrorMatches, `^Get \"?http://127.0.0.1:.*?\"?: EOF$`)
+	var urlErr *url.Error
+	c.Check(xerrors.As(err, &urlErr), Equals, true)
+
+	c.Assert(n.Count(), Equals, 5)
+}
+
+func (s *retrySuite) TestRetryRequestReportExhaustedNotRetried(c *C) {
+	n := 0
+	doRequest := func() (*http.Response, error) {
+		n++
+		return nil, fmt.Errorf("hard failure")
+	}
+	readResponseBody := func(resp *http.Response) error {
+		return nil
+	}
+
+	// an error that is not worth retrying is returned as is
+	_, err := httputil.RetryRequestReportExhausted("endp", doRequest, readResponseBody, testRetryStrategy)
+	c.Assert(err, ErrorMatches, "hard failure")
+	_, ok := err.(*httputil.RetriesExhaustedError)
+	c.Check(ok, Equals, false)
+	c.Check(n, Equals, 1)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (s *retrySuite) TestRetryRequestReportExhaustedTimeoutIsNetError(c *C) {
+	n := 0
+	doRequest := func() (*http.Response, error) {
+		n++
+		return nil, &url.Error{Op: "Get", URL: "http://example.com", Err: timeoutError{}}
+	}
+	readResponseBody := func(resp *http.Response) error {
+		return nil
+	}
+
+	_, err := httputil.RetryRequestReportExhausted("endp", doRequest, readResponseBody, testRetryStrategy)
+	c.Assert(err, ErrorMatches, `Get "?http://example.com"?: i/o timeout \(gave up after 5 attempts in .*\)`)
+	c.Check(n, Equals, 5)
+	_, ok := err.(*httputil.RetriesExhaustedError)
+	c.Assert(ok, Equals, true)
+	// the wrapped timeout is still reported as such
+	netErr, ok := err.(net.Error)
+	c.Assert(ok, Equals, true)
+	c.Check(netErr.Timeout(), Equals, true)
+	c.Check(netErr.Temporary(), Equals, true)
+
+	// and an error that is not a net.Error is neither
+	exhaustedErr := &httputil.RetriesExhaustedError{Err: io.EOF}
+	c.Check(exhaustedErr.Timeout(), Equals, false)
+	c.Check(exhaustedErr.Temporary(), Equals, false)
+}
+
+func (s *retrySuite) TestRetryRequestReportExhaustedSuccessAfterRetries(c *C) {
+	n := 0
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n < 5 {
+			io.WriteString(w, "{")
+			mockServer.CloseClientConnections()
+			return
+		}
+		io.WriteString(w, `{"ok": true}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	cli := httputil.NewHTTPClient(nil)
+
+	doRequest := func() (*http.Response, error) {
+		return cli.Get(mockServer.URL)
+	}
+	var got interface{}
+	readResponseBody := func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&got)
+	}
+
+	// the last attempt succeeded
+	_, err := httputil.RetryRequestReportExhausted("endp", doRequest, readResponseBody, testRetryStrategy)
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, map[string]interface{}{"ok": true})
+	c.Assert(n, Equals, 5)
+}
+
 func (s *retrySuite) TestRetryRequestOn500(c *C) {
 	n := 0
 	var mockServer *httptest.Server
@@ -448,6 +572,26 @@ func (s *retrySuite) TestRetryDoesNotFailForPermanentDNSErrors(c *C) {
 	c.Assert(n, Equals, 1)
 }
 
+func (s *retrySuite) TestRetryDoesNotRetryDoneContext(c *C) {
+	for _, ctxErr := range []error{context.Canceled, context.DeadlineExceeded} {
+		n := 0
+		doRequest := func() (*http.Response, error) {
+			n++
+			return nil, &url.Error{
+				Op:  "Get",
+				URL: "http://...",
+				Err: ctxErr,
+			}
+		}
+		readResponseBody := func(resp *http.Response) error {
+			return nil
+		}
+		_, err := httputil.RetryRequest("endp", doRequest, readResponseBody, testRetryStrategy)
+		c.Assert(err, NotNil)
+		c.Check(n, Equals, 1, Commentf("%v", ctxErr))
+	}
+}
+
 func (s *retrySuite) TestRetryOnTemporaryDNSfailure(c *C) {
 	n := 0
 	doRequest := func() (*http.Response, error) {
@@ -503,3 +647,118 @@ func (s *retrySuite) TestRetryOnHttp2ProtocolErrors(c *C) {
 	c.Assert(err, NotNil)
 	c.Assert(n > 1, Equals, true, Commentf("%v not > 1", n))
 }
+
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.sleeps = append(fc.sleeps, d)
+	fc.now = fc.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- fc.now
+	return ch
+}
+
+func (s *retrySuite) TestRetryRequestBackoffWithMockedClock(c *C) {
+	fc := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	restore := httputil.MockClock(fc)
+	defer restore()
+
+	var attemptTimes []time.Time
+	doRequest := func() (*http.Response, error) {
+		attemptTimes = append(attemptTimes, fc.Now())
+		return &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+	readResponseBody := func(resp *http.Response) error {
+		return nil
+	}
+
+	strategy := retry.LimitCount(4, retry.Exponential{
+		Initial: 10 * time.Second,
+		Factor:  2,
+	})
+	start := time.Now()
+	resp, err := httputil.RetryRequest("endp", doRequest, readResponseBody, strategy)
+	c.Assert(err, IsNil)
+	c.Check(resp.StatusCode, Equals, 500)
+	// no real waiting happened
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+
+	c.Assert(attemptTimes, HasLen, 4)
+	c.Check(fc.sleeps, Not(HasLen), 0)
+	// the delays between attempts back off
+	var prev time.Duration
+	for i := 1; i < len(attemptTimes); i++ {
+		delay := attemptTimes[i].Sub(attemptTimes[i-1])
+		c.Check(delay >= prev, Equals, true, Commentf("delay %v shorter than previous one %v", delay, prev))
+		prev = delay
+	}
+	c.Check(prev >= 20*time.Second, Equals, true, Commentf("last delay %v", prev))
+}
+
+type fakeTimer struct {
+	f       func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.stopped = true
+	return true
+}
+
+type fakeAfterFuncClock struct {
+	fakeClock
+	timers []*fakeTimer
+}
+
+func (fc *fakeAfterFuncClock) AfterFunc(d time.Duration, f func()) httputil.Timer {
+	t := &fakeTimer{f: f}
+	fc.timers = append(fc.timers, t)
+	return t
+}
+
+func (s *retrySuite) TestAfterFunc(c *C) {
+	fired := make(chan struct{})
+	timer := httputil.AfterFunc(time.Millisecond, func() { close(fired) })
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timer did not fire")
+	}
+	c.Check(timer.Stop(), Equals, false)
+}
+
+func (s *retrySuite) TestAfterFuncMockedClock(c *C) {
+	fc := &fakeAfterFuncClock{}
+	restore := httputil.MockClock(fc)
+	defer restore()
+
+	n := 0
+	timer := httputil.AfterFunc(time.Hour, func() { n++ })
+	c.Assert(fc.timers, HasLen, 1)
+	c.Check(n, Equals, 0)
+	// the timer fires whenever the clock says so
+	fc.timers[0].f()
+	c.Check(n, Equals, 1)
+	c.Check(timer.Stop(), Equals, true)
+	c.Check(fc.timers[0].stopped, Equals, true)
+}
+
+func (s *retrySuite) TestAfterFuncMockedClockWithoutTimers(c *C) {
+	restore := httputil.MockClock(&fakeClock{})
+	defer restore()
+
+	// the wall clock runs the timer
+	timer := httputil.AfterFunc(time.Hour, func() {})
+	c.Check(timer, FitsTypeOf, &time.Timer{})
+	c.Check(timer.Stop(), Equals, true)
+}
@@ -52,7 +52,7 @@ type StoreService interface {
 	Assertion(assertType *asserts.AssertionType, primaryKey []string, user *auth.UserState) (asserts.Assertion, error)
 
 	SuggestedCurrency() string
-	Buy(options *client.BuyOptions, user *auth.UserState) (*client.BuyResult, error)
+	Buy(ctx context.Context, options *client.BuyOptions, user *auth.UserState) (*client.BuyResult, error)
 	ReadyToBuy(*auth.UserState) error
 	ConnectivityCheck() (map[string]bool, error)
 	CreateCohorts(context.Context, []string) (map[string]string, error)
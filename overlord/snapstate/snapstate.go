@@ -1446,6 +1446,10 @@ func UpdateWithDeviceContext(st *state.State, name string, opts *RevisionOptions
 
 	var updates []*snap.Info
 	info, infoErr := infoForUpdate(st, &snapst, name, opts, userID, flags, deviceCtx)
+	if _, ok := infoErr.(*store.RevisionBlockedError); ok {
+		// the update is withheld, which is the same as having none
+		infoErr = store.ErrNoUpdateAvailable
+	}
 	switch infoErr {
 	case nil:
 		updates = append(updates, info)
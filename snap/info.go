@@ -297,12 +297,32 @@ type Info struct {
 
 	StoreURL string
 
+	// Advisory notes attached to the snap by the store, e.g. about
+	// its deprecation
+	StoreNotes []StoreNote
+
+	// AgeRating is the content rating of the snap as given by the
+	// store, empty if the snap is unrated
+	AgeRating string
+
+	// ReleaseNotes are the notes the publisher attached to this
+	// revision, i.e. what's new in it, if any
+	ReleaseNotes string
+
+	// StoreETag is the entity tag the store sent along with the
+	// details, it can be passed back to only get them again once
+	// they changed
+	StoreETag string
+
 	// The flattended channel map with $track/$risk
 	Channels map[string]*ChannelSnapInfo
 
 	// The ordered list of tracks that contain channels
 	Tracks []string
 
+	// The components (resources) available for this revision
+	Components []StoreComponent
+
 	Layout map[string]*Layout
 
 	// The list of common-ids from all apps of the snap
@@ -374,6 +394,8 @@ type ChannelSnapInfo struct {
 	Epoch       Epoch           `json:"epoch"`
 	Size        int64           `json:"size"`
 	ReleasedAt  time.Time       `json:"released-at"`
+	// ReleaseNotes of the revision in the channel, if any
+	ReleaseNotes string `json:"release-notes,omitempty"`
 }
 
 // InstanceName returns the blessed name of the snap decorated with instance
@@ -622,6 +644,9 @@ type DeltaInfo struct {
 	DownloadURL     string `json:"download-url,omitempty"`
 	Size            int64  `json:"size,omitempty"`
 	Sha3_384        string `json:"sha3-384,omitempty"`
+	// FromSha3_384 is the sha3-384 of the baseline revision the
+	// delta applies to, if known.
+	FromSha3_384 string `json:"from-sha3-384,omitempty"`
 }
 
 // sanity check that Info is a PlaceInfo
@@ -888,6 +913,14 @@ type MediaInfo struct {
 
 type MediaInfos []MediaInfo
 
+// StoreNote is an advisory note the store attached to a snap, for
+// example to warn that it is deprecated in favour of another one.
+type StoreNote struct {
+	// Type is the kind of note, e.g. "deprecation"
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
 func (mis MediaInfos) IconURL() string {
 	for _, mi := range mis {
 		if mi.Type == "icon" {
@@ -897,6 +930,18 @@ func (mis MediaInfos) IconURL() string {
 	return ""
 }
 
+// StoreComponent holds the store information about a component
+// (resource) that is available for a snap revision.
+type StoreComponent struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Revision    Revision `json:"revision"`
+	Version     string   `json:"version,omitempty"`
+	Description string   `json:"description,omitempty"`
+
+	DownloadInfo
+}
+
 // HookInfo provides information about a hook.
 type HookInfo struct {
 	Snap *Info
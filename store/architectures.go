@@ -0,0 +1,96 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+
+	"github.com/snapcore/snapd/overlord/auth"
+	"github.com/snapcore/snapd/snap/channel"
+)
+
+// SnapArchitectures returns the sorted list of architectures for which
+// the given snap has a revision released in the given channel (which
+// defaults to "stable"). If the snap exists but nothing is released in
+// the channel an empty list is returned.
+func (s *Store) SnapArchitectures(ctx context.Context, snapName, channelName string, user *auth.UserState) ([]string, error) {
+	if snapName == "" {
+		return nil, fmt.Errorf("internal error: cannot query architectures without a snap name")
+	}
+	if channelName == "" {
+		channelName = "stable"
+	}
+	wanted, err := channel.Parse(channelName, "")
+	if err != nil {
+		return nil, err
+	}
+	wantedFull := wanted.Full()
+
+	// no architecture, so that the channel map covers all of them
+	q := url.Values{}
+	q.Set("fields", "revision")
+
+	reqOptions := &requestOptions{
+		Method:   "GET",
+		URL:      s.endpointURL(path.Join(snapInfoEndpPath, snapName), q),
+		APILevel: apiV2Endps,
+	}
+
+	var remote storeInfo
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &remote, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		// OK
+	case 404:
+		return nil, ErrSnapNotFound
+	default:
+		return nil, respToError(resp, fmt.Sprintf("get architectures for snap %q", snapName))
+	}
+
+	seen := make(map[string]bool)
+	archs := []string{}
+	for _, ch := range remote.ChannelMap {
+		arch := ch.Channel.Architecture
+		if arch == "" || seen[arch] {
+			continue
+		}
+		released, err := channel.Parse(ch.Channel.Name, arch)
+		if err != nil {
+			// not something we can match against
+			continue
+		}
+		if released.Full() != wantedFull {
+			continue
+		}
+		seen[arch] = true
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+
+	return archs, nil
+}
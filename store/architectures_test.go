@@ -0,0 +1,125 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/store"
+)
+
+const archsInfoPathPattern = "/v2/snaps/info/.*"
+
+func channelMapEntry(arch, name string, rev int) string {
+	return fmt.Sprintf(`{"revision": %d, "channel": {"architecture": %q, "name": %q, "released-at": "2020-01-01T00:00:00.000000+00:00"}}`, rev, arch, name)
+}
+
+func (s *storeTestSuite) mockArchitecturesServer(c *C, entries ...string) *url.URL {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", archsInfoPathPattern)
+		c.Check(r.URL.Path, Matches, ".*/info/some-snap")
+		// all architectures are wanted
+		c.Check(r.URL.Query(), DeepEquals, url.Values{"fields": {"revision"}})
+
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name": "some-snap", "snap-id": "some-snap-id", "channel-map": [`)
+		for i, entry := range entries {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, entry)
+		}
+		io.WriteString(w, `]}`)
+	}))
+	c.Assert(mockServer, NotNil)
+	s.AddCleanup(mockServer.Close)
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	return mockServerURL
+}
+
+func (s *storeTestSuite) TestSnapArchitecturesMultiArch(c *C) {
+	mockServerURL := s.mockArchitecturesServer(c,
+		channelMapEntry("arm64", "stable", 11),
+		channelMapEntry("amd64", "stable", 10),
+		channelMapEntry("amd64", "beta", 12),
+		channelMapEntry("s390x", "2.0/stable", 5),
+	)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	for _, ch := range []string{"", "stable", "latest/stable"} {
+		archs, err := sto.SnapArchitectures(s.ctx, "some-snap", ch, nil)
+		c.Assert(err, IsNil)
+		c.Check(archs, DeepEquals, []string{"amd64", "arm64"}, Commentf("%q", ch))
+	}
+
+	archs, err := sto.SnapArchitectures(s.ctx, "some-snap", "beta", nil)
+	c.Assert(err, IsNil)
+	c.Check(archs, DeepEquals, []string{"amd64"})
+
+	archs, err = sto.SnapArchitectures(s.ctx, "some-snap", "2.0", nil)
+	c.Assert(err, IsNil)
+	c.Check(archs, DeepEquals, []string{"s390x"})
+
+	archs, err = sto.SnapArchitectures(s.ctx, "some-snap", "edge", nil)
+	c.Assert(err, IsNil)
+	c.Check(archs, HasLen, 0)
+}
+
+func (s *storeTestSuite) TestSnapArchitecturesSingleArch(c *C) {
+	mockServerURL := s.mockArchitecturesServer(c,
+		channelMapEntry("amd64", "stable", 1),
+		channelMapEntry("amd64", "candidate", 1),
+	)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	archs, err := sto.SnapArchitectures(s.ctx, "some-snap", "stable", nil)
+	c.Assert(err, IsNil)
+	c.Check(archs, DeepEquals, []string{"amd64"})
+}
+
+func (s *storeTestSuite) TestSnapArchitecturesNotFound(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", archsInfoPathPattern)
+		w.WriteHeader(404)
+		io.WriteString(w, MockNoDetailsJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	_, err := sto.SnapArchitectures(s.ctx, "some-snap", "stable", nil)
+	c.Check(err, Equals, store.ErrSnapNotFound)
+}
+
+func (s *storeTestSuite) TestSnapArchitecturesInvalidChannel(c *C) {
+	sto := store.New(&store.Config{}, nil)
+
+	_, err := sto.SnapArchitectures(s.ctx, "some-snap", "a/b/c/d", nil)
+	c.Check(err, ErrorMatches, "channel name has too many components: a/b/c/d")
+}
@@ -0,0 +1,113 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/overlord/auth"
+)
+
+// maxAssertionChainDepth bounds how far FetchAssertionChain follows
+// prerequisites and signing keys; actual chains (e.g. snap-revision,
+// account, account-key, account) are much shorter.
+var maxAssertionChainDepth = 10
+
+// FetchAssertionChain fetches the assertion with the given type and
+// primary key together with what is needed to validate it: its
+// prerequisites and the account-keys it was signed with, recursively.
+// Each assertion is fetched only once. The assertions are returned
+// ordered such that prerequisites and signing keys come before the
+// assertions depending on them, so they can be added to a database
+// in order. Self-signed (root) account-keys end the chain, they and
+// their own prerequisites are expected to be trusted by the consumer.
+func (s *Store) FetchAssertionChain(ctx context.Context, startType *asserts.AssertionType, startKey []string, user *auth.UserState) ([]asserts.Assertion, error) {
+	chain := &assertionChain{
+		ctx:     ctx,
+		sto:     s,
+		user:    user,
+		fetched: make(map[string]bool),
+	}
+	if err := chain.chase(&asserts.Ref{Type: startType, PrimaryKey: startKey}, 0); err != nil {
+		return nil, err
+	}
+	return chain.assertions, nil
+}
+
+type assertionChain struct {
+	ctx  context.Context
+	sto  *Store
+	user *auth.UserState
+
+	// fetched maps the unique refs of the assertions seen so far to
+	// whether they were completed, i.e. their own chain was fetched
+	fetched    map[string]bool
+	assertions []asserts.Assertion
+}
+
+func (chain *assertionChain) chase(ref *asserts.Ref, depth int) error {
+	u := ref.Unique()
+	if done, ok := chain.fetched[u]; ok {
+		if !done {
+			return fmt.Errorf("cannot fetch assertion chain: circular reference to %s", ref)
+		}
+		return nil
+	}
+	if depth > maxAssertionChainDepth {
+		return fmt.Errorf("cannot fetch assertion chain: %s is more than %d levels deep", ref, maxAssertionChainDepth)
+	}
+
+	a, err := chain.sto.assertion(chain.ctx, ref.Type, ref.PrimaryKey, chain.user, nil)
+	if err != nil {
+		return err
+	}
+	chain.fetched[u] = false
+
+	if isSelfSignedKey(a) {
+		// a root of trust, what it needs must be trusted already
+		chain.fetched[u] = true
+		chain.assertions = append(chain.assertions, a)
+		return nil
+	}
+
+	for _, preref := range a.Prerequisites() {
+		if err := chain.chase(preref, depth+1); err != nil {
+			return err
+		}
+	}
+	keyRef := &asserts.Ref{
+		Type:       asserts.AccountKeyType,
+		PrimaryKey: []string{a.SignKeyID()},
+	}
+	if err := chain.chase(keyRef, depth+1); err != nil {
+		return err
+	}
+
+	chain.fetched[u] = true
+	chain.assertions = append(chain.assertions, a)
+	return nil
+}
+
+func isSelfSignedKey(a asserts.Assertion) bool {
+	accKey, ok := a.(*asserts.AccountKey)
+	return ok && accKey.PublicKeyID() == accKey.SignKeyID()
+}
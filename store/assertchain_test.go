@@ -0,0 +1,234 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+	"github.com/snapcore/snapd/store"
+)
+
+type assertionChainFixture struct {
+	storeStack *assertstest.StoreStack
+	devAcct    *asserts.Account
+	// uploader is the account of the developer of the revision if
+	// it is not devAcct, the publisher
+	uploader *asserts.Account
+	snapDecl asserts.Assertion
+	snapRev  asserts.Assertion
+	// extra are further assertions to serve
+	extra []asserts.Assertion
+}
+
+func newAssertionChainFixture(c *C) *assertionChainFixture {
+	return newSnapAssertionsFixture(c, strings.Repeat("B", 64), false)
+}
+
+// newSnapAssertionsFixture returns a fixture with the assertions of a
+// snap with the given digest, with its revision uploaded by another
+// developer than its publisher if otherUploader is set.
+func newSnapAssertionsFixture(c *C, snapSHA3_384 string, otherUploader bool) *assertionChainFixture {
+	storeStack := assertstest.NewStoreStack("canonical", nil)
+	devAcct := assertstest.NewAccount(storeStack, "developer1", map[string]interface{}{
+		"account-id": "developer1",
+	}, "")
+	developer := devAcct
+	var uploader *asserts.Account
+	if otherUploader {
+		uploader = assertstest.NewAccount(storeStack, "developer2", map[string]interface{}{
+			"account-id": "developer2",
+		}, "")
+		developer = uploader
+	}
+
+	snapDecl, err := storeStack.Sign(asserts.SnapDeclarationType, map[string]interface{}{
+		"series":       "16",
+		"snap-id":      "snap-id-1",
+		"snap-name":    "foo",
+		"publisher-id": devAcct.AccountID(),
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+	}, nil, "")
+	c.Assert(err, IsNil)
+
+	snapRev, err := storeStack.Sign(asserts.SnapRevisionType, map[string]interface{}{
+		"snap-sha3-384": snapSHA3_384,
+		"snap-size":     "1000",
+		"snap-id":       "snap-id-1",
+		"developer-id":  developer.AccountID(),
+		"snap-revision": "1",
+		"timestamp":     time.Now().UTC().Format(time.RFC3339),
+	}, nil, "")
+	c.Assert(err, IsNil)
+
+	return &assertionChainFixture{
+		storeStack: storeStack,
+		devAcct:    devAcct,
+		uploader:   uploader,
+		snapDecl:   snapDecl,
+		snapRev:    snapRev,
+	}
+}
+
+// addSeriesSnapDecl adds a snap-declaration of the snap for the
+// given series, published by the account with the given ID, a new
+// one unless it is the one of devAcct.
+func (f *assertionChainFixture) addSeriesSnapDecl(c *C, series, publisherID string) {
+	publisher := f.devAcct
+	if publisherID != f.devAcct.AccountID() {
+		publisher = assertstest.NewAccount(f.storeStack, publisherID, map[string]interface{}{
+			"account-id": publisherID,
+		}, "")
+		f.extra = append(f.extra, publisher)
+	}
+	snapDecl, err := f.storeStack.Sign(asserts.SnapDeclarationType, map[string]interface{}{
+		"series":       series,
+		"snap-id":      "snap-id-1",
+		"snap-name":    "foo",
+		"publisher-id": publisher.AccountID(),
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+	}, nil, "")
+	c.Assert(err, IsNil)
+	f.extra = append(f.extra, snapDecl)
+}
+
+// serve serves the assertions of the fixture, counting the requests
+// for each of them.
+func (f *assertionChainFixture) serve(c *C, seen map[string]int) *httptest.Server {
+	all := []asserts.Assertion{
+		f.storeStack.TrustedAccount,
+		f.storeStack.TrustedKey,
+		f.storeStack.StoreAccountKey(""),
+		f.devAcct,
+		f.snapDecl,
+		f.snapRev,
+	}
+	if f.uploader != nil {
+		all = append(all, f.uploader)
+	}
+	all = append(all, f.extra...)
+	byPath := make(map[string]asserts.Assertion, len(all))
+	for _, a := range all {
+		ref := a.Ref()
+		byPath["/api/v1/snaps/assertions/"+ref.Type.Name+"/"+strings.Join(ref.PrimaryKey, "/")] = a
+	}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		a, ok := byPath[r.URL.Path]
+		if !ok {
+			c.Errorf("unexpected assertion request: %s", r.URL.Path)
+			w.WriteHeader(404)
+			return
+		}
+		seen[a.Ref().Unique()]++
+		w.Header().Set("Content-Type", asserts.MediaType)
+		w.Write(asserts.Encode(a))
+	}))
+	c.Assert(mockServer, NotNil)
+	return mockServer
+}
+
+func (s *storeTestSuite) TestFetchAssertionChain(c *C) {
+	f := newAssertionChainFixture(c)
+	seen := make(map[string]int)
+	mockServer := f.serve(c, seen)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	chain, err := sto.FetchAssertionChain(s.ctx, asserts.SnapRevisionType, f.snapRev.Ref().PrimaryKey, nil)
+	c.Assert(err, IsNil)
+
+	refs := make([]string, len(chain))
+	for i, a := range chain {
+		refs[i] = a.Ref().Unique()
+	}
+	// everything needed is there, once; the chain goes through the
+	// store key to the self-signed root key
+	c.Check(refs, DeepEquals, []string{
+		f.storeStack.TrustedKey.Ref().Unique(),
+		f.storeStack.TrustedAccount.Ref().Unique(),
+		f.storeStack.StoreAccountKey("").Ref().Unique(),
+		f.devAcct.Ref().Unique(),
+		f.snapDecl.Ref().Unique(),
+		f.snapRev.Ref().Unique(),
+	})
+	for _, u := range refs {
+		c.Check(seen[u], Equals, 1, Commentf("%s", u))
+	}
+	// the chain can be added in order to a database that only
+	// trusts the root key
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: asserts.NewMemoryBackstore(),
+		Trusted:   f.storeStack.Trusted,
+	})
+	c.Assert(err, IsNil)
+	trusted := make(map[string]bool)
+	for _, a := range f.storeStack.Trusted {
+		trusted[a.Ref().Unique()] = true
+	}
+	for _, a := range chain {
+		if trusted[a.Ref().Unique()] {
+			continue
+		}
+		err := db.Add(a)
+		c.Assert(err, IsNil, Commentf("%s", a.Ref()))
+	}
+}
+
+func (s *storeTestSuite) TestFetchAssertionChainTooDeep(c *C) {
+	defer store.MockMaxAssertionChainDepth(1)()
+
+	f := newAssertionChainFixture(c)
+	mockServer := f.serve(c, make(map[string]int))
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	_, err := sto.FetchAssertionChain(s.ctx, asserts.SnapRevisionType, f.snapRev.Ref().PrimaryKey, nil)
+	c.Assert(err, ErrorMatches, `cannot fetch assertion chain: .* is more than 1 levels deep`)
+}
+
+func (s *storeTestSuite) TestFetchAssertionChainNotFound(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(404)
+		w.Write([]byte(`{"status": 404}`))
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	_, err := sto.FetchAssertionChain(s.ctx, asserts.SnapRevisionType, []string{strings.Repeat("B", 64)}, nil)
+	c.Check(asserts.IsNotFound(err), Equals, true)
+}
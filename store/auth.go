@@ -36,8 +36,10 @@ import (
 var (
 	developerAPIBase = storeDeveloperURL()
 	// macaroonACLAPI points to Developer API endpoint to get an ACL macaroon
-	MacaroonACLAPI   = developerAPIBase + "dev/api/acl/"
-	ubuntuoneAPIBase = authURL()
+	MacaroonACLAPI = developerAPIBase + "dev/api/acl/"
+	// DeveloperSnapsAPI points to the Developer API endpoint for managing snaps
+	DeveloperSnapsAPI = developerAPIBase + "dev/api/snaps/"
+	ubuntuoneAPIBase  = authURL()
 	// UbuntuoneLocation is the Ubuntuone location as defined in the store macaroon
 	UbuntuoneLocation = authLocation()
 	// UbuntuoneDischargeAPI points to SSO endpoint to discharge a macaroon
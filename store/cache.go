@@ -20,11 +20,13 @@
 package store
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"syscall"
 	"time"
 
@@ -39,10 +41,16 @@ var osRemove = os.Remove
 type downloadCache interface {
 	// Get gets the given cacheKey content and puts it into targetPath
 	Get(cacheKey, targetPath string) error
-	// Put adds a new file to the cache
-	Put(cacheKey, sourcePath string) error
+	// Put adds a new file to the cache, giving up on it once ctx
+	// is done
+	Put(ctx context.Context, cacheKey, sourcePath string) error
 	// Get full path of the file in cache
 	GetPath(cacheKey string) string
+	// Open opens the given cacheKey content for reading, keeping it
+	// from being evicted until closed
+	Open(cacheKey string) (*CachedFile, error)
+	// Remove evicts the given cacheKey content from the cache
+	Remove(cacheKey string) error
 }
 
 // nullCache is cache that does not cache
@@ -54,7 +62,11 @@ func (cm *nullCache) Get(cacheKey, targetPath string) error {
 func (cm *nullCache) GetPath(cacheKey string) string {
 	return ""
 }
-func (cm *nullCache) Put(cacheKey, sourcePath string) error { return nil }
+func (cm *nullCache) Open(cacheKey string) (*CachedFile, error) {
+	return nil, os.ErrNotExist
+}
+func (cm *nullCache) Put(ctx context.Context, cacheKey, sourcePath string) error { return nil }
+func (cm *nullCache) Remove(cacheKey string) error                               { return nil }
 
 // changesByMtime sorts by the mtime of files
 type changesByMtime []os.FileInfo
@@ -67,6 +79,37 @@ func (s changesByMtime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].
 type CacheManager struct {
 	cacheDir string
 	maxItems int
+	maxBytes int64
+
+	// mu orders opening items against evicting them
+	mu sync.Mutex
+	// the number of readers of the items, by cache key
+	inUse map[string]int
+}
+
+// CachedFile is an item of the cache opened for reading; it is not
+// evicted from the cache before being closed.
+type CachedFile struct {
+	*os.File
+	release func()
+}
+
+// Close closes the file and lets the item be evicted again.
+func (f *CachedFile) Close() error {
+	err := f.File.Close()
+	f.release()
+	return err
+}
+
+// CacheManagerOptions controls the eviction policy of a CacheManager.
+// When both limits are set the cache is kept within both.
+type CacheManagerOptions struct {
+	// MaxItems is the maximum number of items kept in the cache, if
+	// non-zero
+	MaxItems int
+	// MaxBytes is the maximum total size in bytes of the items kept
+	// in the cache, if non-zero
+	MaxBytes int64
 }
 
 // NewCacheManager returns a new CacheManager with the given cacheDir
@@ -84,9 +127,21 @@ type CacheManager struct {
 // The caching part is done here, the downloading happens in the store.go
 // code.
 func NewCacheManager(cacheDir string, maxItems int) *CacheManager {
+	return NewCacheManagerWithOptions(cacheDir, &CacheManagerOptions{
+		MaxItems: maxItems,
+	})
+}
+
+// NewCacheManagerWithOptions returns a new CacheManager with the given
+// cacheDir that evicts the oldest items following the given options.
+// Items that are also referenced from outside of the cache do not count
+// towards the limits as they take no extra space.
+func NewCacheManagerWithOptions(cacheDir string, opts *CacheManagerOptions) *CacheManager {
 	return &CacheManager{
 		cacheDir: cacheDir,
-		maxItems: maxItems,
+		maxItems: opts.MaxItems,
+		maxBytes: opts.MaxBytes,
+		inUse:    make(map[string]int),
 	}
 }
 
@@ -109,8 +164,58 @@ func (cm *CacheManager) Get(cacheKey, targetPath string) error {
 	return os.Chtimes(targetPath, now, now)
 }
 
-// Put adds a new file to the cache with the given cacheKey
-func (cm *CacheManager) Put(cacheKey, sourcePath string) error {
+// Open opens the given cacheKey content for reading, returning an error
+// satisfying os.IsNotExist if it is not in the cache. Until the file is
+// closed the content is not evicted to make room for new items, so that
+// it can be read in full even on filesystems where removing an open
+// file would affect its readers.
+func (cm *CacheManager) Open(cacheKey string) (*CachedFile, error) {
+	if cacheKey == "" {
+		return nil, os.ErrNotExist
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	f, err := os.Open(cm.path(cacheKey))
+	if err != nil {
+		return nil, err
+	}
+	cm.inUse[cacheKey]++
+	// mark it as recently used
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+
+	var once sync.Once
+	return &CachedFile{
+		File: f,
+		release: func() {
+			once.Do(func() {
+				cm.mu.Lock()
+				defer cm.mu.Unlock()
+				if cm.inUse[cacheKey]--; cm.inUse[cacheKey] == 0 {
+					delete(cm.inUse, cacheKey)
+				}
+			})
+		},
+	}, nil
+}
+
+// Remove removes the given cacheKey content from the cache, if present
+func (cm *CacheManager) Remove(cacheKey string) error {
+	if err := os.Remove(cm.path(cacheKey)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Put adds a new file to the cache with the given cacheKey. Once ctx
+// is done, Put returns its error without evicting any more of the
+// older items to keep within the limits; the file itself is linked
+// into the cache at once, if at all.
+func (cm *CacheManager) Put(ctx context.Context, cacheKey, sourcePath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// always try to create the cache dir first or the following
 	// osutil.IsWritable will always fail if the dir is missing
 	_ = os.MkdirAll(cm.cacheDir, 0700)
@@ -135,35 +240,66 @@ func (cm *CacheManager) Put(cacheKey, sourcePath string) error {
 	if err != nil {
 		return err
 	}
-	return cm.cleanup()
+	return cm.cleanup(ctx)
 }
 
 // count returns the number of items in the cache
 func (cm *CacheManager) count() int {
 	// TODO: Use something more effective than a list of all entries
 	//       here. This will waste a lot of memory on large dirs.
-	if l, err := ioutil.ReadDir(cm.cacheDir); err == nil {
+	if l, err := cm.entries(); err == nil {
 		return len(l)
 	}
 	return 0
 }
 
+// entries returns the items in the cache; directories are skipped as
+// they are the caches of other namespaces sharing this cache dir.
+func (cm *CacheManager) entries() ([]os.FileInfo, error) {
+	fil, err := ioutil.ReadDir(cm.cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	items := fil[:0]
+	for _, fi := range fil {
+		if fi.IsDir() {
+			continue
+		}
+		items = append(items, fi)
+	}
+	return items, nil
+}
+
 // path returns the full path of the given content in the cache
 func (cm *CacheManager) path(cacheKey string) string {
 	return filepath.Join(cm.cacheDir, cacheKey)
 }
 
-// cleanup ensures that only maxItems are stored in the cache
-func (cm *CacheManager) cleanup() error {
-	fil, err := ioutil.ReadDir(cm.cacheDir)
+// overLimits returns whether the given number and total size of items
+// exceed the limits of the cache
+func (cm *CacheManager) overLimits(items int, size int64) bool {
+	if cm.maxItems > 0 && items > cm.maxItems {
+		return true
+	}
+	if cm.maxBytes > 0 && size > cm.maxBytes {
+		return true
+	}
+	return false
+}
+
+// cleanup ensures that only maxItems and/or maxBytes are stored in the
+// cache, unless ctx is done first
+func (cm *CacheManager) cleanup(ctx context.Context) error {
+	fil, err := cm.entries()
 	if err != nil {
 		return err
 	}
-	if len(fil) <= cm.maxItems {
+	if cm.maxBytes == 0 && len(fil) <= cm.maxItems {
 		return nil
 	}
 
 	numOwned := 0
+	var sizeOwned int64
 	for _, fi := range fil {
 		n, err := hardLinkCount(fi)
 		if err != nil {
@@ -172,17 +308,24 @@ func (cm *CacheManager) cleanup() error {
 		// Only count the file if it is not referenced elsewhere in the filesystem
 		if n <= 1 {
 			numOwned++
+			sizeOwned += fi.Size()
 		}
 	}
 
-	if numOwned <= cm.maxItems {
+	if !cm.overLimits(numOwned, sizeOwned) {
 		return nil
 	}
 
+	// items being read must not be evicted meanwhile
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
 	var lastErr error
 	sort.Sort(changesByMtime(fil))
-	deleted := 0
 	for _, fi := range fil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		path := cm.path(fi.Name())
 		n, err := hardLinkCount(fi)
 		if err != nil {
@@ -194,6 +337,9 @@ func (cm *CacheManager) cleanup() error {
 		if n > 1 {
 			continue
 		}
+		if cm.inUse[fi.Name()] > 0 {
+			continue
+		}
 		if err := osRemove(path); err != nil {
 			if !os.IsNotExist(err) {
 				logger.Noticef("cannot cleanup cache: %s", err)
@@ -201,8 +347,9 @@ func (cm *CacheManager) cleanup() error {
 			}
 			continue
 		}
-		deleted++
-		if numOwned-deleted <= cm.maxItems {
+		numOwned--
+		sizeOwned -= fi.Size()
+		if !cm.overLimits(numOwned, sizeOwned) {
 			break
 		}
 	}
@@ -20,11 +20,14 @@
 package store_test
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -71,7 +74,7 @@ func (s *cacheSuite) TestPutMany(c *C) {
 
 	for i := 1; i < s.maxItems+10; i++ {
 		p := s.makeTestFileInDir(c, dataDir.Name(), fmt.Sprintf("f%d", i), fmt.Sprintf("%d", i))
-		err := s.cm.Put(fmt.Sprintf("cacheKey-%d", i), p)
+		err := s.cm.Put(context.TODO(), fmt.Sprintf("cacheKey-%d", i), p)
 		c.Check(err, IsNil)
 
 		// Remove the test file again, it is now only in the cache
@@ -104,7 +107,7 @@ func (s *cacheSuite) TestGetNotExistant(c *C) {
 func (s *cacheSuite) TestGet(c *C) {
 	canary := "some content"
 	p := s.makeTestFile(c, "foo", canary)
-	err := s.cm.Put("some-cache-key", p)
+	err := s.cm.Put(context.TODO(), "some-cache-key", p)
 	c.Assert(err, IsNil)
 
 	targetPath := filepath.Join(s.tmp, "new-location")
@@ -114,6 +117,72 @@ func (s *cacheSuite) TestGet(c *C) {
 	c.Assert(targetPath, testutil.FileEquals, canary)
 }
 
+func (s *cacheSuite) TestRemove(c *C) {
+	p := s.makeTestFile(c, "foo", "some content")
+	err := s.cm.Put(context.TODO(), "some-cache-key", p)
+	c.Assert(err, IsNil)
+	c.Check(s.cm.GetPath("some-cache-key"), Not(Equals), "")
+
+	err = s.cm.Remove("some-cache-key")
+	c.Check(err, IsNil)
+	c.Check(s.cm.GetPath("some-cache-key"), Equals, "")
+	// the original is untouched
+	c.Check(p, testutil.FileEquals, "some content")
+
+	// removing what is not there is fine
+	err = s.cm.Remove("some-cache-key")
+	c.Check(err, IsNil)
+}
+
+func (s *cacheSuite) TestOpen(c *C) {
+	p := s.makeTestFile(c, "foo", "some content")
+	c.Assert(s.cm.Put(context.TODO(), "some-cache-key", p), IsNil)
+	c.Assert(os.Remove(p), IsNil)
+
+	f, err := s.cm.Open("some-cache-key")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(f)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "some content")
+	c.Check(f.Close(), IsNil)
+
+	_, err = s.cm.Open("other-cache-key")
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = s.cm.Open("")
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *cacheSuite) TestOpenItemsAreNotEvicted(c *C) {
+	cm := store.NewCacheManager(c.MkDir(), 1)
+
+	p := s.makeTestFile(c, "foo", "some content")
+	c.Assert(cm.Put(context.TODO(), "foo-key", p), IsNil)
+	c.Assert(os.Remove(p), IsNil)
+
+	f, err := cm.Open("foo-key")
+	c.Assert(err, IsNil)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(f, buf)
+	c.Assert(err, IsNil)
+
+	// the cache is full, but the open item stays
+	p = s.makeTestFile(c, "bar", "other content")
+	c.Assert(cm.Put(context.TODO(), "bar-key", p), IsNil)
+	c.Assert(os.Remove(p), IsNil)
+	c.Check(cm.GetPath("foo-key"), Not(Equals), "")
+
+	rest, err := ioutil.ReadAll(f)
+	c.Assert(err, IsNil)
+	c.Check(string(buf)+string(rest), Equals, "some content")
+	c.Check(f.Close(), IsNil)
+	// closing again is harmless
+	f.Close()
+
+	// once closed it can be evicted
+	c.Assert(cm.Cleanup(), IsNil)
+	c.Check(cm.Count(), Equals, 1)
+}
+
 func (s *cacheSuite) makeTestFiles(c *C, n int) (cacheKeys []string, testFiles []string) {
 	cacheKeys = make([]string, n)
 	testFiles = make([]string, n)
@@ -121,7 +190,7 @@ func (s *cacheSuite) makeTestFiles(c *C, n int) (cacheKeys []string, testFiles [
 		p := s.makeTestFile(c, fmt.Sprintf("f%d", i), strconv.Itoa(i))
 		cacheKey := fmt.Sprintf("cacheKey-%d", i)
 		cacheKeys[i] = cacheKey
-		s.cm.Put(cacheKey, p)
+		s.cm.Put(context.TODO(), cacheKey, p)
 
 		// keep track of the test files
 		testFiles[i] = p
@@ -183,6 +252,124 @@ func (s *cacheSuite) TestClenaupContinuesOnError(c *C) {
 	c.Check(osutil.FileExists(filepath.Join(s.cm.CacheDir(), cacheKeys[0])), Equals, true)
 }
 
+func (s *cacheSuite) TestPutCancelled(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := s.makeTestFile(c, "foo", "some content")
+	err := s.cm.Put(ctx, "some-cache-key", p)
+	c.Check(err, Equals, context.Canceled)
+	c.Check(s.cm.GetPath("some-cache-key"), Equals, "")
+}
+
+func (s *cacheSuite) TestPutCancelledDuringCleanup(c *C) {
+	_, testFiles := s.makeTestFiles(c, s.maxItems+2)
+	for _, p := range testFiles {
+		c.Assert(os.Remove(p), IsNil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	removed := 0
+	restore := store.MockOsRemove(func(name string) error {
+		removed++
+		// cancelled after the first eviction
+		cancel()
+		return os.Remove(name)
+	})
+	defer restore()
+
+	p := s.makeTestFile(c, "foo", "some content")
+	err := s.cm.Put(ctx, "some-cache-key", p)
+	c.Check(err, Equals, context.Canceled)
+	// the file was cached, but the cleanup stopped early
+	c.Check(s.cm.GetPath("some-cache-key"), Not(Equals), "")
+	c.Check(removed, Equals, 1)
+	c.Check(s.cm.Count(), Equals, s.maxItems+2)
+}
+
+func (s *cacheSuite) putOwned(c *C, cm *store.CacheManager, cacheKey string, size int) {
+	p := s.makeTestFile(c, cacheKey, strings.Repeat("x", size))
+	c.Assert(cm.Put(context.TODO(), cacheKey, p), IsNil)
+	// remove the test file, it is now only in the cache
+	c.Assert(os.Remove(p), IsNil)
+	// mtime is not very granular
+	time.Sleep(10 * time.Millisecond)
+}
+
+func (s *cacheSuite) TestCleanupMaxBytes(c *C) {
+	cm := store.NewCacheManagerWithOptions(c.MkDir(), &store.CacheManagerOptions{
+		MaxBytes: 1000,
+	})
+
+	for i := 0; i < 4; i++ {
+		s.putOwned(c, cm, fmt.Sprintf("cacheKey-%d", i), 300)
+	}
+	// 1200 bytes are over the limit, so the oldest gets evicted
+	c.Assert(cm.Cleanup(), IsNil)
+	c.Check(cm.Count(), Equals, 3)
+	c.Check(osutil.FileExists(filepath.Join(cm.CacheDir(), "cacheKey-0")), Equals, false)
+
+	// a big item evicts as many as needed to fit
+	s.putOwned(c, cm, "big", 900)
+	c.Assert(cm.Cleanup(), IsNil)
+	c.Check(cm.Count(), Equals, 1)
+	c.Check(osutil.FileExists(filepath.Join(cm.CacheDir(), "big")), Equals, true)
+}
+
+func (s *cacheSuite) TestCleanupMaxBytesIgnoresSharedFiles(c *C) {
+	cm := store.NewCacheManagerWithOptions(c.MkDir(), &store.CacheManagerOptions{
+		MaxBytes: 500,
+	})
+
+	// this one is still referenced outside of the cache so it is free
+	p := s.makeTestFile(c, "shared", strings.Repeat("x", 1000))
+	c.Assert(cm.Put(context.TODO(), "shared", p), IsNil)
+	s.putOwned(c, cm, "owned", 400)
+
+	c.Assert(cm.Cleanup(), IsNil)
+	c.Check(cm.Count(), Equals, 2)
+}
+
+func (s *cacheSuite) TestCleanupMaxItemsAndMaxBytes(c *C) {
+	cm := store.NewCacheManagerWithOptions(c.MkDir(), &store.CacheManagerOptions{
+		MaxItems: 3,
+		MaxBytes: 1000,
+	})
+
+	// the count limit is hit first
+	for i := 0; i < 5; i++ {
+		s.putOwned(c, cm, fmt.Sprintf("small-%d", i), 10)
+	}
+	c.Assert(cm.Cleanup(), IsNil)
+	c.Check(cm.Count(), Equals, 3)
+
+	// the size limit is hit first
+	s.putOwned(c, cm, "big-0", 600)
+	s.putOwned(c, cm, "big-1", 600)
+	c.Assert(cm.Cleanup(), IsNil)
+	c.Check(cm.Count(), Equals, 1)
+	c.Check(osutil.FileExists(filepath.Join(cm.CacheDir(), "big-1")), Equals, true)
+}
+
+func (s *cacheSuite) TestCleanupIgnoresNamespaces(c *C) {
+	root := c.MkDir()
+	cm := store.NewCacheManager(root, 2)
+	nsCm := store.NewCacheManager(filepath.Join(root, "some-namespace"), 2)
+
+	for i := 0; i < 2; i++ {
+		s.putOwned(c, nsCm, fmt.Sprintf("ns-cacheKey-%d", i), 10)
+	}
+	for i := 0; i < 3; i++ {
+		s.putOwned(c, cm, fmt.Sprintf("cacheKey-%d", i), 10)
+	}
+	// the namespace dir is neither counted nor evicted
+	c.Assert(cm.Cleanup(), IsNil)
+	c.Check(cm.Count(), Equals, 2)
+	c.Check(osutil.FileExists(filepath.Join(root, "cacheKey-0")), Equals, false)
+	c.Check(nsCm.Count(), Equals, 2)
+}
+
 func (s *cacheSuite) TestHardLinkCount(c *C) {
 	p := filepath.Join(s.tmp, "foo")
 	err := ioutil.WriteFile(p, nil, 0644)
@@ -0,0 +1,73 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/auth"
+)
+
+// Category is a store category (section) of snaps.
+type Category struct {
+	Name string `json:"name"`
+	// DisplayName is the localized name to show to users, if the
+	// store provides one.
+	DisplayName string `json:"display-name,omitempty"`
+	// Featured is set for the categories the store wants to highlight.
+	Featured bool `json:"featured,omitempty"`
+}
+
+type categoriesResults struct {
+	Categories []Category `json:"categories"`
+}
+
+// Categories retrieves the list of available store categories with
+// their metadata. Stores without the v2 categories API are asked for
+// their sections instead, which only carry names.
+func (s *Store) Categories(ctx context.Context, user *auth.UserState) ([]Category, error) {
+	reqOptions := &requestOptions{
+		Method:         "GET",
+		URL:            s.endpointURL(categoriesEndpPath, nil),
+		Accept:         jsonContentType,
+		APILevel:       apiV2Endps,
+		DeviceAuthNeed: deviceAuthCustomStoreOnly,
+	}
+	s.setLocale(reqOptions)
+
+	var categoriesData categoriesResults
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &categoriesData, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		// OK
+	case 404:
+		logger.Debugf("Categories are not available from %q, falling back to sections.", resp.Request.URL)
+		return s.sectionsV1(ctx, user)
+	default:
+		return nil, respToError(resp, "categories")
+	}
+
+	return categoriesData.Categories, nil
+}
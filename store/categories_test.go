@@ -0,0 +1,136 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/store"
+)
+
+const categoriesPath = "/v2/snaps/categories"
+
+const mockCategoriesJSON = `{
+  "categories": [
+    {
+      "name": "featured",
+      "display-name": "Featured",
+      "featured": true
+    },
+    {
+      "name": "database",
+      "display-name": "Databases",
+      "unknown-field": "ignored"
+    },
+    {
+      "name": "games"
+    }
+  ]
+}`
+
+func (s *storeTestSuite) TestCategories(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", categoriesPath)
+		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, "")
+		n++
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		io.WriteString(w, mockCategoriesJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	categories, err := sto.Categories(s.ctx, s.user)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+	c.Check(categories, DeepEquals, []store.Category{
+		{Name: "featured", DisplayName: "Featured", Featured: true},
+		{Name: "database", DisplayName: "Databases"},
+		{Name: "games"},
+	})
+}
+
+func (s *storeTestSuite) TestCategoriesFallbackToSections(c *C) {
+	var paths []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case categoriesPath:
+			w.WriteHeader(404)
+		case sectionsPath:
+			w.Header().Set("Content-Type", "application/hal+json")
+			w.WriteHeader(200)
+			io.WriteString(w, MockSectionsJSON)
+		default:
+			c.Errorf("unexpected request to %q", r.URL.Path)
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	categories, err := sto.Categories(s.ctx, s.user)
+	c.Assert(err, IsNil)
+	c.Check(paths, DeepEquals, []string{categoriesPath, sectionsPath})
+	c.Check(categories, DeepEquals, []store.Category{
+		{Name: "featured"},
+		{Name: "database"},
+	})
+}
+
+func (s *storeTestSuite) TestCategoriesTooMany(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", categoriesPath)
+		w.WriteHeader(429)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	categories, err := sto.Categories(s.ctx, s.user)
+	c.Check(err, Equals, store.ErrTooManyRequests)
+	c.Check(categories, IsNil)
+}
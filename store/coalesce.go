@@ -0,0 +1,122 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// requestGroup coalesces identical concurrent requests, so that they
+// share a single round trip to the store.
+type requestGroup struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+type inflightCall struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do calls f once for all the concurrent calls with the same key, and
+// returns its result to all of them. f is called with a context
+// carrying the values and the deadline of the context of the first
+// caller, which is cancelled only once all the callers gave up waiting
+// (with their own context being done).
+func (g *requestGroup) do(ctx context.Context, key string, f func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*inflightCall)
+	}
+	call := g.calls[key]
+	if call == nil {
+		var callCtx context.Context = valuesOnlyContext{ctx}
+		var cancel context.CancelFunc
+		if deadline, ok := ctx.Deadline(); ok {
+			callCtx, cancel = context.WithDeadline(callCtx, deadline)
+		} else {
+			callCtx, cancel = context.WithCancel(callCtx)
+		}
+		call = &inflightCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		g.calls[key] = call
+		go func() {
+			call.val, call.err = f(callCtx)
+			g.forget(key, call)
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		abandoned := call.waiters == 0
+		g.mu.Unlock()
+		if abandoned {
+			// later callers must not join a cancelled call
+			g.forget(key, call)
+			call.cancel()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (g *requestGroup) forget(key string, call *inflightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// valuesOnlyContext carries the values of its context, but neither its
+// deadline nor its cancellation.
+type valuesOnlyContext struct {
+	context.Context
+}
+
+func (valuesOnlyContext) Deadline() (deadline time.Time, ok bool) {
+	return time.Time{}, false
+}
+
+func (valuesOnlyContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valuesOnlyContext) Err() error {
+	return nil
+}
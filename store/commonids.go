@@ -0,0 +1,141 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/auth"
+	"github.com/snapcore/snapd/release"
+	"github.com/snapcore/snapd/snap"
+)
+
+// maxCommonIDsQueryLen bounds the length, once escaped for the URL
+// query, of the list of common-ids sent with a single find request, to
+// keep within URL length limits.
+var maxCommonIDsQueryLen = 1500
+
+// FindByCommonIDs finds the (installable) snaps with apps having any
+// of the given common-ids, e.g. to resolve .desktop files to snaps. The
+// results are grouped by common-id; common-ids without matches are
+// left out.
+func (s *Store) FindByCommonIDs(ctx context.Context, commonIDs []string, user *auth.UserState) (map[string][]*snap.Info, error) {
+	found := make(map[string][]*snap.Info, len(commonIDs))
+	for _, chunk := range chunkCommonIDs(commonIDs, maxCommonIDsQueryLen) {
+		if err := s.findByCommonIDs(ctx, chunk, user, found); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// chunkCommonIDs splits commonIDs into chunks whose comma-separated
+// lists, escaped as in the URL query, are at most maxLen long (unless a
+// single common-id is longer).
+func chunkCommonIDs(commonIDs []string, maxLen int) [][]string {
+	// the separating comma gets escaped too
+	sepLen := len(url.QueryEscape(","))
+	var chunks [][]string
+	var chunk []string
+	chunkLen := 0
+	for _, commonID := range commonIDs {
+		if commonID == "" {
+			continue
+		}
+		idLen := len(url.QueryEscape(commonID))
+		if len(chunk) > 0 && chunkLen+sepLen+idLen > maxLen {
+			chunks = append(chunks, chunk)
+			chunk = nil
+			chunkLen = 0
+		}
+		if len(chunk) > 0 {
+			chunkLen += sepLen
+		}
+		chunk = append(chunk, commonID)
+		chunkLen += idLen
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func (s *Store) findByCommonIDs(ctx context.Context, commonIDs []string, user *auth.UserState, found map[string][]*snap.Info) error {
+	_, findFields := s.v2Fields()
+	q := url.Values{}
+	q.Set("fields", strings.Join(findFields, ","))
+	q.Set("architecture", s.architecture)
+	q.Set("common-id", strings.Join(commonIDs, ","))
+	q.Set("channel", "stable")
+	if release.OnClassic {
+		q.Set("confinement", "strict,classic")
+	} else {
+		q.Set("confinement", "strict")
+	}
+
+	reqOptions := &requestOptions{
+		Method:   "GET",
+		URL:      s.endpointURL(findEndpPath, q),
+		Accept:   jsonContentType,
+		APILevel: apiV2Endps,
+	}
+	s.setLocale(reqOptions)
+
+	var searchData searchV2Results
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &searchData, nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return respToError(resp, "find snaps by common-id")
+	}
+
+	requested := make(map[string]bool, len(commonIDs))
+	for _, commonID := range commonIDs {
+		requested[commonID] = true
+	}
+
+	snaps := make([]*snap.Info, len(searchData.Results))
+	for i, res := range searchData.Results {
+		info, err := infoFromStoreSearchResult(res)
+		if err != nil {
+			return err
+		}
+		snaps[i] = info
+	}
+
+	err = s.decorateOrders(snaps, user)
+	if err != nil {
+		logger.Noticef("cannot get user orders: %v", err)
+	}
+
+	for _, info := range snaps {
+		for _, commonID := range info.CommonIDs {
+			if requested[commonID] {
+				found[commonID] = append(found[commonID], info)
+			}
+		}
+	}
+	return nil
+}
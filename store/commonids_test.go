@@ -0,0 +1,188 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/store"
+)
+
+const commonIDsSearchJSON = `{
+  "results": [
+    {
+      "name": "foo",
+      "snap-id": "foo-id",
+      "snap": {
+        "name": "foo",
+        "snap-id": "foo-id",
+        "version": "1.0",
+        "common-ids": ["org.example.Foo", "org.example.FooViewer"],
+        "publisher": {"id": "foo-dev-id", "username": "foo-dev"}
+      },
+      "revision": {"revision": 3, "channel": "stable"}
+    },
+    {
+      "name": "bar",
+      "snap-id": "bar-id",
+      "snap": {
+        "name": "bar",
+        "snap-id": "bar-id",
+        "version": "2.0",
+        "common-ids": ["org.example.Bar", "org.example.Foo"],
+        "publisher": {"id": "bar-dev-id", "username": "bar-dev"}
+      },
+      "revision": {"revision": 7, "channel": "stable"}
+    }
+  ]
+}`
+
+func (s *storeTestSuite) TestFindByCommonIDs(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		c.Check(r.URL.Query().Get("common-id"), Equals, "org.example.Foo,org.example.Bar,org.example.Missing")
+		c.Check(r.URL.Query().Get("channel"), Equals, "stable")
+		n++
+
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, commonIDsSearchJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	found, err := sto.FindByCommonIDs(s.ctx, []string{"org.example.Foo", "org.example.Bar", "org.example.Missing"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+
+	// org.example.FooViewer was not asked for, org.example.Missing
+	// has no match
+	c.Assert(found, HasLen, 2)
+	c.Assert(found["org.example.Foo"], HasLen, 2)
+	c.Check(found["org.example.Foo"][0].InstanceName(), Equals, "foo")
+	c.Check(found["org.example.Foo"][1].InstanceName(), Equals, "bar")
+	c.Assert(found["org.example.Bar"], HasLen, 1)
+	c.Check(found["org.example.Bar"][0].InstanceName(), Equals, "bar")
+	c.Check(found["org.example.Bar"][0].SnapID, Equals, "bar-id")
+	c.Check(found["org.example.Missing"], IsNil)
+}
+
+func (s *storeTestSuite) TestFindByCommonIDsChunked(c *C) {
+	restore := store.MockMaxCommonIDsQueryLen(len(url.QueryEscape("org.example.Foo,org.example.Bar")))
+	defer restore()
+
+	var queries []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		queries = append(queries, r.URL.Query().Get("common-id"))
+
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, commonIDsSearchJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	found, err := sto.FindByCommonIDs(s.ctx, []string{"org.example.Foo", "org.example.Bar", "org.example.FooViewer"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(queries, DeepEquals, []string{"org.example.Foo,org.example.Bar", "org.example.FooViewer"})
+
+	// no duplicates from the two requests
+	c.Check(found, HasLen, 3)
+	c.Check(found["org.example.Foo"], HasLen, 2)
+	c.Check(found["org.example.Bar"], HasLen, 1)
+	c.Assert(found["org.example.FooViewer"], HasLen, 1)
+	c.Check(found["org.example.FooViewer"][0].InstanceName(), Equals, "foo")
+}
+
+func (s *storeTestSuite) TestFindByCommonIDsChunkedEscaped(c *C) {
+	// long enough for the unescaped list
+	restore := store.MockMaxCommonIDsQueryLen(len("org.example.Föo,org.example.Bar"))
+	defer restore()
+
+	var queries []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		queries = append(queries, r.URL.Query().Get("common-id"))
+
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, commonIDsSearchJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	_, err := sto.FindByCommonIDs(s.ctx, []string{"org.example.Föo", "org.example.Bar"}, nil)
+	c.Assert(err, IsNil)
+	// but not once escaped
+	c.Check(queries, DeepEquals, []string{"org.example.Föo", "org.example.Bar"})
+}
+
+func (s *storeTestSuite) TestFindByCommonIDsNone(c *C) {
+	sto := store.New(&store.Config{StoreBaseURL: new(url.URL)}, nil)
+
+	found, err := sto.FindByCommonIDs(s.ctx, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(found, HasLen, 0)
+}
+
+func (s *storeTestSuite) TestFindByCommonIDsError(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		w.WriteHeader(418)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, err := sto.FindByCommonIDs(s.ctx, []string{"org.example.Foo"}, nil)
+	c.Check(err, ErrorMatches, `cannot find snaps by common-id: got unexpected HTTP status code 418 via GET to "http://.*/v2/snaps/find.*"`)
+	c.Check(strings.Contains(err.Error(), "common-id=org.example.Foo"), Equals, true)
+}
@@ -60,6 +60,14 @@ type storeSnap struct {
 	Media []storeSnapMedia `json:"media"`
 
 	CommonIDs []string `json:"common-ids"`
+
+	// advisory notes, e.g. deprecation warnings
+	Notes []storeSnapNote `json:"notes"`
+
+	AgeRating string `json:"age-rating"`
+
+	// what's new in the revision
+	ReleaseNotes safejson.Paragraph `json:"release-notes"`
 }
 
 type storeSnapDownload struct {
@@ -70,12 +78,28 @@ type storeSnapDownload struct {
 }
 
 type storeSnapDelta struct {
-	Format   string `json:"format"`
-	Sha3_384 string `json:"sha3-384"`
-	Size     int64  `json:"size"`
-	Source   int    `json:"source"`
-	Target   int    `json:"target"`
-	URL      string `json:"url"`
+	Format         string `json:"format"`
+	Sha3_384       string `json:"sha3-384"`
+	Size           int64  `json:"size"`
+	Source         int    `json:"source"`
+	SourceSha3_384 string `json:"source-sha3-384"`
+	Target         int    `json:"target"`
+	URL            string `json:"url"`
+}
+
+// storeSnapResource is a component (resource) of a snap revision
+type storeSnapResource struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Revision    int               `json:"revision"`
+	Version     string            `json:"version"`
+	Description string            `json:"description"`
+	Download    storeSnapDownload `json:"download"`
+}
+
+type storeSnapNote struct {
+	Type    string          `json:"type"`
+	Message safejson.String `json:"message"`
 }
 
 type storeSnapMedia struct {
@@ -97,7 +121,8 @@ type storeInfoChannel struct {
 // storeInfoChannelSnap is the snap-in-a-channel of which the channel map is made
 type storeInfoChannelSnap struct {
 	storeSnap
-	Channel storeInfoChannel `json:"channel"`
+	Channel   storeInfoChannel    `json:"channel"`
+	Resources []storeSnapResource `json:"resources"`
 }
 
 // storeInfo is the result of v2/info calls
@@ -129,6 +154,7 @@ func infoFromStoreInfo(si *storeInfo) (*snap.Info, error) {
 		return nil, err
 	}
 	info.Channel = thisOne.Channel.Name
+	addComponents(info, thisOne.Resources)
 	info.Channels = make(map[string]*snap.ChannelSnapInfo, len(si.ChannelMap))
 	seen := make(map[string]bool, len(si.ChannelMap))
 	for _, s := range si.ChannelMap {
@@ -142,6 +168,9 @@ func infoFromStoreInfo(si *storeInfo) (*snap.Info, error) {
 			Epoch:       s.Epoch,
 			Size:        s.Download.Size,
 			ReleasedAt:  ch.ReleasedAt.UTC(),
+			// release notes are per revision, so they come
+			// with the channel map entries
+			ReleaseNotes: s.ReleaseNotes.Clean(),
 		}
 		if !seen[ch.Track] {
 			seen[ch.Track] = true
@@ -229,6 +258,15 @@ func copyNonZeroFrom(src, dst *storeSnap) {
 	if len(src.Website) > 0 {
 		dst.Website = src.Website
 	}
+	if len(src.Notes) > 0 {
+		dst.Notes = src.Notes
+	}
+	if src.AgeRating != "" {
+		dst.AgeRating = src.AgeRating
+	}
+	if src.ReleaseNotes.Clean() != "" {
+		dst.ReleaseNotes = src.ReleaseNotes
+	}
 }
 
 func infoFromStoreSnap(d *storeSnap) (*snap.Info, error) {
@@ -265,6 +303,7 @@ func infoFromStoreSnap(d *storeSnap) (*snap.Info, error) {
 				DownloadURL:  d.URL,
 				Size:         d.Size,
 				Sha3_384:     d.Sha3_384,
+				FromSha3_384: d.SourceSha3_384,
 			}
 		}
 		info.Deltas = deltas
@@ -272,6 +311,8 @@ func infoFromStoreSnap(d *storeSnap) (*snap.Info, error) {
 	info.CommonIDs = d.CommonIDs
 	info.Website = d.Website
 	info.StoreURL = d.StoreURL
+	info.AgeRating = d.AgeRating
+	info.ReleaseNotes = d.ReleaseNotes.Clean()
 
 	// fill in the plug/slot data
 	if rawYamlInfo, err := snap.InfoFromSnapYaml([]byte(d.SnapYAML)); err == nil {
@@ -308,9 +349,24 @@ func infoFromStoreSnap(d *storeSnap) (*snap.Info, error) {
 	// media
 	addMedia(info, d.Media)
 
+	addNotes(info, d.Notes)
+
 	return info, nil
 }
 
+func addNotes(info *snap.Info, notes []storeSnapNote) {
+	for _, note := range notes {
+		msg := note.Message.Clean()
+		if msg == "" {
+			continue
+		}
+		info.StoreNotes = append(info.StoreNotes, snap.StoreNote{
+			Type:    note.Type,
+			Message: msg,
+		})
+	}
+}
+
 func addMedia(info *snap.Info, media []storeSnapMedia) {
 	if len(media) == 0 {
 		return
@@ -323,3 +379,24 @@ func addMedia(info *snap.Info, media []storeSnapMedia) {
 		info.Media[i].Height = mediaObj.Height
 	}
 }
+
+func addComponents(info *snap.Info, resources []storeSnapResource) {
+	if len(resources) == 0 {
+		return
+	}
+	info.Components = make([]snap.StoreComponent, len(resources))
+	for i, res := range resources {
+		info.Components[i] = snap.StoreComponent{
+			Name:        res.Name,
+			Type:        res.Type,
+			Revision:    snap.R(res.Revision),
+			Version:     res.Version,
+			Description: res.Description,
+			DownloadInfo: snap.DownloadInfo{
+				DownloadURL: res.Download.URL,
+				Size:        res.Download.Size,
+				Sha3_384:    res.Download.Sha3_384,
+			},
+		}
+	}
+}
@@ -30,6 +30,7 @@ import (
 
 	"github.com/snapcore/snapd/jsonutil/safejson"
 	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/strutil"
 	"github.com/snapcore/snapd/testutil"
 )
 
@@ -101,7 +102,8 @@ const (
          "target": 21,
          "url": "https://api.snapcraft.io/api/v1/snaps/download/XYZEfjn4WJYnm0FzDKwqqRZZI77awQEV_19_21_xdelta3.delta",
          "size": 9999,
-         "sha3-384": "29f8d894c92ad19bb943764eb845c6bd7300f555ee9b9dbb460599fecf712775c0f3e2117b5c56b08fcb9d78fc8ae4df"
+         "sha3-384": "29f8d894c92ad19bb943764eb845c6bd7300f555ee9b9dbb460599fecf712775c0f3e2117b5c56b08fcb9d78fc8ae4df",
+         "source-sha3-384": "9f8d894c92ad19bb943764eb845c6bd7300f555ee9b9dbb460599fecf712775c0f3e2117b5c56b08fcb9d78fc8ae4df2"
        }
      ]
   },
@@ -132,7 +134,12 @@ const (
      {"type": "icon", "url": "https://dashboard.snapcraft.io/site_media/appmedia/2017/12/Thingy.png"},
      {"type": "screenshot", "url": "https://dashboard.snapcraft.io/site_media/appmedia/2018/01/Thingy_01.png"},
      {"type": "screenshot", "url": "https://dashboard.snapcraft.io/site_media/appmedia/2018/01/Thingy_02.png", "width": 600, "height": 200}
-  ]
+  ],
+  "notes": [
+     {"type": "deprecation", "message": "thingy is deprecated, use thingy2 instead"}
+  ],
+  "age-rating": "12",
+  "release-notes": "Thingy now does more things."
 }`
 )
 
@@ -243,6 +250,7 @@ func (s *detailsV2Suite) TestInfoFromStoreSnap(c *C) {
 					DownloadURL:  "https://api.snapcraft.io/api/v1/snaps/download/XYZEfjn4WJYnm0FzDKwqqRZZI77awQEV_19_21_xdelta3.delta",
 					Size:         9999,
 					Sha3_384:     "29f8d894c92ad19bb943764eb845c6bd7300f555ee9b9dbb460599fecf712775c0f3e2117b5c56b08fcb9d78fc8ae4df",
+					FromSha3_384: "9f8d894c92ad19bb943764eb845c6bd7300f555ee9b9dbb460599fecf712775c0f3e2117b5c56b08fcb9d78fc8ae4df2",
 				},
 			},
 		},
@@ -257,6 +265,11 @@ func (s *detailsV2Suite) TestInfoFromStoreSnap(c *C) {
 		CommonIDs: []string{"org.thingy"},
 		Website:   "http://example.com/thingy",
 		StoreURL:  "https://snapcraft.io/thingy",
+		StoreNotes: []snap.StoreNote{
+			{Type: "deprecation", Message: "thingy is deprecated, use thingy2 instead"},
+		},
+		AgeRating:    "12",
+		ReleaseNotes: "Thingy now does more things.",
 	})
 
 	// validate the plugs/slots
@@ -301,12 +314,14 @@ func (s *detailsV2Suite) TestInfoFromStoreSnap(c *C) {
 		"BadInterfaces",
 		"Broken",
 		"MustBuy",
-		"Channels", // handled at a different level (see TestInfo)
-		"Tracks",   // handled at a different level (see TestInfo)
+		"Channels",   // handled at a different level (see TestInfo)
+		"Tracks",     // handled at a different level (see TestInfo)
+		"Components", // handled at a different level (see TestInfoComponents)
 		"Layout",
 		"SideInfo.Channel",
 		"DownloadInfo.AnonDownloadURL", // TODO: going away at some point
 		"SystemUsernames",
+		"StoreETag", // from the response headers (see TestInfoETagNotModified)
 	}
 	var checker func(string, reflect.Value)
 	checker = func(pfx string, x reflect.Value) {
@@ -333,6 +348,216 @@ func (s *detailsV2Suite) TestInfoFromStoreSnap(c *C) {
 }
 
 // arg must be a pointer to a struct
+const mediaStoreJSON = `[
+  {"type": "icon", "url": "https://dashboard.snapcraft.io/site_media/appmedia/2018/01/thingy.png", "width": 256, "height": 256},
+  {"type": "screenshot", "url": "https://dashboard.snapcraft.io/site_media/appmedia/2018/01/Thingy_01.png"},
+  {"type": "screenshot", "url": "https://dashboard.snapcraft.io/site_media/appmedia/2018/01/Thingy_02.png", "width": 600, "height": 200}
+]`
+
+var expectedMedia = snap.MediaInfos{
+	{Type: "icon", URL: "https://dashboard.snapcraft.io/site_media/appmedia/2018/01/thingy.png", Width: 256, Height: 256},
+	{Type: "screenshot", URL: "https://dashboard.snapcraft.io/site_media/appmedia/2018/01/Thingy_01.png"},
+	{Type: "screenshot", URL: "https://dashboard.snapcraft.io/site_media/appmedia/2018/01/Thingy_02.png", Width: 600, Height: 200},
+}
+
+func (s *detailsV2Suite) TestInfoFromStoreSnapMedia(c *C) {
+	var snp storeSnap
+	err := json.Unmarshal([]byte(coreStoreJSON), &snp)
+	c.Assert(err, IsNil)
+
+	// no media
+	info, err := infoFromStoreSnap(&snp)
+	c.Assert(err, IsNil)
+	c.Check(info.Media, IsNil)
+	c.Check(info.Media.IconURL(), Equals, "")
+
+	err = json.Unmarshal([]byte(mediaStoreJSON), &snp.Media)
+	c.Assert(err, IsNil)
+	info, err = infoFromStoreSnap(&snp)
+	c.Assert(err, IsNil)
+	c.Check(info.Media, DeepEquals, expectedMedia)
+	c.Check(info.Media.IconURL(), Equals, "https://dashboard.snapcraft.io/site_media/appmedia/2018/01/thingy.png")
+}
+
+func (s *detailsV2Suite) TestInfoFromStoreSearchResultMedia(c *C) {
+	var snp storeSnap
+	err := json.Unmarshal([]byte(coreStoreJSON), &snp)
+	c.Assert(err, IsNil)
+
+	// no media
+	res := &storeSearchResult{
+		Name:   "core",
+		SnapID: "99T7MUlRhtI3U0QFgl5mXXESAiSwt776",
+		Snap:   snp,
+	}
+	info, err := infoFromStoreSearchResult(res)
+	c.Assert(err, IsNil)
+	c.Check(info.Media, IsNil)
+
+	// media from the snap
+	err = json.Unmarshal([]byte(mediaStoreJSON), &res.Snap.Media)
+	c.Assert(err, IsNil)
+	info, err = infoFromStoreSearchResult(res)
+	c.Assert(err, IsNil)
+	c.Check(info.Media, DeepEquals, expectedMedia)
+
+	// media from the revision wins
+	res.Revision.Media = []storeSnapMedia{{Type: "icon", URL: "https://example.com/rev-icon.png"}}
+	info, err = infoFromStoreSearchResult(res)
+	c.Assert(err, IsNil)
+	c.Check(info.Media, DeepEquals, snap.MediaInfos{{Type: "icon", URL: "https://example.com/rev-icon.png"}})
+}
+
+func (s *detailsV2Suite) TestMediaInDefaultFields(c *C) {
+	c.Check(strutil.ListContains(defaultConfig.InfoFields, "media"), Equals, true)
+	c.Check(strutil.ListContains(defaultConfig.FindFields, "media"), Equals, true)
+}
+
+func (s *detailsV2Suite) TestInfoFromStoreInfoNotes(c *C) {
+	const infoJSON = `{
+  "name": "old-thing",
+  "snap-id": "old-thing-id",
+  "channel-map": [
+    {
+      "channel": {"architecture": "amd64", "name": "stable", "risk": "stable", "track": "latest", "released-at": "2020-01-01T00:00:00.000000+00:00"},
+      "revision": 3,
+      "version": "1.0",
+      "type": "app",
+      "confinement": "strict",
+      "download": {"url": "https://example.com/old-thing_3.snap", "size": 4096, "sha3-384": "abcd"}
+    }
+  ],
+  "snap": {
+    "name": "old-thing",
+    "snap-id": "old-thing-id",
+    "summary": "an old thing",
+    "notes": [
+      {"type": "deprecation", "message": "old-thing is deprecated, use new-thing instead"},
+      {"type": "something-new", "message": "unknown kinds are kept too"},
+      {"type": "empty", "message": ""}
+    ]
+  }
+}`
+	var remote storeInfo
+	err := json.Unmarshal([]byte(infoJSON), &remote)
+	c.Assert(err, IsNil)
+
+	info, err := infoFromStoreInfo(&remote)
+	c.Assert(err, IsNil)
+	c.Check(info.StoreNotes, DeepEquals, []snap.StoreNote{
+		{Type: "deprecation", Message: "old-thing is deprecated, use new-thing instead"},
+		{Type: "something-new", Message: "unknown kinds are kept too"},
+	})
+}
+
+func (s *detailsV2Suite) TestInfoFromStoreSnapNoNotes(c *C) {
+	var snp storeSnap
+	err := json.Unmarshal([]byte(coreStoreJSON), &snp)
+	c.Assert(err, IsNil)
+
+	info, err := infoFromStoreSnap(&snp)
+	c.Assert(err, IsNil)
+	c.Check(info.StoreNotes, IsNil)
+	c.Check(strutil.ListContains(defaultConfig.InfoFields, "notes"), Equals, true)
+}
+
+func (s *detailsV2Suite) TestInfoFromStoreSnapPrices(c *C) {
+	for _, t := range []struct {
+		prices string
+		paid   bool
+		info   map[string]float64
+	}{
+		{`{"EUR": "0.99", "USD": "1.23", "GBP": "0.89"}`, true, map[string]float64{"EUR": 0.99, "USD": 1.23, "GBP": 0.89}},
+		// free snaps
+		{`{}`, false, nil},
+		{`null`, false, nil},
+	} {
+		var snp storeSnap
+		err := json.Unmarshal([]byte(`{"name": "thingy", "prices": `+t.prices+`}`), &snp)
+		c.Assert(err, IsNil)
+
+		info, err := infoFromStoreSnap(&snp)
+		c.Assert(err, IsNil)
+		c.Check(info.Paid, Equals, t.paid, Commentf(t.prices))
+		c.Check(info.Prices, DeepEquals, t.info, Commentf(t.prices))
+	}
+}
+
+func (s *detailsV2Suite) TestInfoFromStoreSnapUnrated(c *C) {
+	var snp storeSnap
+	err := json.Unmarshal([]byte(coreStoreJSON), &snp)
+	c.Assert(err, IsNil)
+
+	info, err := infoFromStoreSnap(&snp)
+	c.Assert(err, IsNil)
+	c.Check(info.AgeRating, Equals, "")
+	c.Check(strutil.ListContains(defaultConfig.InfoFields, "age-rating"), Equals, true)
+}
+
+func (s *detailsV2Suite) TestInfoFromStoreInfoReleaseNotes(c *C) {
+	const infoJSON = `{
+  "name": "new-thing",
+  "snap-id": "new-thing-id",
+  "channel-map": [
+    {
+      "channel": {"architecture": "amd64", "name": "stable", "risk": "stable", "track": "latest", "released-at": "2020-01-01T00:00:00.000000+00:00"},
+      "revision": 3,
+      "version": "1.0",
+      "type": "app",
+      "confinement": "strict",
+      "download": {"url": "https://example.com/new-thing_3.snap", "size": 4096, "sha3-384": "abcd"},
+      "release-notes": "Fixed the frobnicator."
+    },
+    {
+      "channel": {"architecture": "amd64", "name": "candidate", "risk": "candidate", "track": "latest", "released-at": "2020-02-01T00:00:00.000000+00:00"},
+      "revision": 4,
+      "version": "1.1",
+      "type": "app",
+      "confinement": "strict",
+      "download": {"url": "https://example.com/new-thing_4.snap", "size": 4096, "sha3-384": "abcd"},
+      "release-notes": "Frobnicates faster.\n\nAlso fixes the frobnicator again."
+    },
+    {
+      "channel": {"architecture": "amd64", "name": "edge", "risk": "edge", "track": "latest", "released-at": "2020-03-01T00:00:00.000000+00:00"},
+      "revision": 5,
+      "version": "1.2",
+      "type": "app",
+      "confinement": "strict",
+      "download": {"url": "https://example.com/new-thing_5.snap", "size": 4096, "sha3-384": "abcd"}
+    }
+  ],
+  "snap": {
+    "name": "new-thing",
+    "snap-id": "new-thing-id",
+    "summary": "a new thing"
+  }
+}`
+	var remote storeInfo
+	err := json.Unmarshal([]byte(infoJSON), &remote)
+	c.Assert(err, IsNil)
+
+	info, err := infoFromStoreInfo(&remote)
+	c.Assert(err, IsNil)
+	c.Check(info.ReleaseNotes, Equals, "Fixed the frobnicator.")
+	c.Check(info.Channels["latest/stable"].ReleaseNotes, Equals, "Fixed the frobnicator.")
+	c.Check(info.Channels["latest/candidate"].ReleaseNotes, Equals, "Frobnicates faster.\n\nAlso fixes the frobnicator again.")
+	// revisions without notes are fine too
+	c.Check(info.Channels["latest/edge"].ReleaseNotes, Equals, "")
+}
+
+func (s *detailsV2Suite) TestInfoFromStoreSnapNoReleaseNotes(c *C) {
+	var snp storeSnap
+	err := json.Unmarshal([]byte(coreStoreJSON), &snp)
+	c.Assert(err, IsNil)
+
+	info, err := infoFromStoreSnap(&snp)
+	c.Assert(err, IsNil)
+	c.Check(info.ReleaseNotes, Equals, "")
+	c.Check(strutil.ListContains(defaultConfig.InfoFields, "release-notes"), Equals, true)
+	// only useful for details of a given snap
+	c.Check(strutil.ListContains(defaultConfig.FindFields, "release-notes"), Equals, false)
+}
+
 func fillStruct(a interface{}, c *C) {
 	if t := reflect.TypeOf(a); t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
 		k := t.Kind()
@@ -387,6 +612,13 @@ func fillStruct(a interface{}, c *C) {
 				Type: "potato",
 				URL:  "http://example.com/foo.pot",
 			}}
+		case []storeSnapNote:
+			var msg safejson.String
+			c.Assert(json.Unmarshal([]byte(`"foo"`), &msg), IsNil)
+			x = []storeSnapNote{{
+				Type:    "deprecation",
+				Message: msg,
+			}}
 		default:
 			c.Fatalf("unhandled field type %T", field.Interface())
 		}
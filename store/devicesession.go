@@ -0,0 +1,72 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/snapcore/snapd/overlord/auth"
+)
+
+type deviceSessionContextKey struct{}
+
+// suppliedDeviceSession holds the device state given via
+// WithDeviceSession, updated in place when the session is refreshed.
+type suppliedDeviceSession struct {
+	mu     sync.Mutex
+	device *auth.DeviceState
+}
+
+func (sds *suppliedDeviceSession) get() *auth.DeviceState {
+	sds.mu.Lock()
+	defer sds.mu.Unlock()
+	if sds.device == nil {
+		return nil
+	}
+	device := *sds.device
+	return &device
+}
+
+func (sds *suppliedDeviceSession) set(device *auth.DeviceState) {
+	sds.mu.Lock()
+	defer sds.mu.Unlock()
+	sds.device = device
+}
+
+// WithDeviceSession returns a context carrying the given device
+// state, which should have a session already (see
+// EnsureDeviceSession). The store requests done with the context use
+// that session instead of looking up the device every time, e.g. for a
+// burst of requests. If the store asks for the session to be refreshed
+// it is refreshed as usual, and the requests done with the context use
+// the refreshed session from then on.
+func WithDeviceSession(parent context.Context, device *auth.DeviceState) context.Context {
+	dev := *device
+	return context.WithValue(parent, deviceSessionContextKey{}, &suppliedDeviceSession{device: &dev})
+}
+
+func deviceSessionFromContext(ctx context.Context) *suppliedDeviceSession {
+	if ctx == nil {
+		return nil
+	}
+	sds, _ := ctx.Value(deviceSessionContextKey{}).(*suppliedDeviceSession)
+	return sds
+}
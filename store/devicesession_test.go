@@ -0,0 +1,128 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/store"
+)
+
+func (s *storeTestSuite) TestWithDeviceSessionSkipsLookups(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+		n++
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	deviceLookups := 0
+	dauthCtx := &testDauthContext{c: c, device: s.device, deviceGetWitness: func() {
+		deviceLookups++
+	}}
+	sto := store.New(&store.Config{
+		StoreBaseURL: mockServerURL,
+	}, dauthCtx)
+
+	device, err := sto.EnsureDeviceSession()
+	c.Assert(err, IsNil)
+	c.Check(deviceLookups, Equals, 1)
+
+	ctx := store.WithDeviceSession(s.ctx, device)
+	for i := 0; i < 3; i++ {
+		reqOptions := store.NewRequestOptions("GET", mockServerURL)
+		resp, err := sto.DoRequest(ctx, sto.Client(), reqOptions, nil)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+	}
+	c.Check(n, Equals, 3)
+	// no further lookups
+	c.Check(deviceLookups, Equals, 1)
+
+	// without the session in the context the device is looked up
+	reqOptions := store.NewRequestOptions("GET", mockServerURL)
+	resp, err := sto.DoRequest(s.ctx, sto.Client(), reqOptions, nil)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(deviceLookups, Equals, 2)
+}
+
+func (s *storeTestSuite) TestWithDeviceSessionRefreshedOn401(c *C) {
+	expiredAuth := `Macaroon root="expired-session-macaroon"`
+	refreshedAuth := `Macaroon root="refreshed-session-macaroon"`
+	var authorizations []string
+	sessionRequests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			authorization := r.Header.Get("X-Device-Authorization")
+			authorizations = append(authorizations, authorization)
+			if authorization == expiredAuth {
+				w.Header().Set("WWW-Authenticate", "Macaroon refresh_device_session=1")
+				w.WriteHeader(401)
+				return
+			}
+			io.WriteString(w, "response-data")
+		case authNoncesPath:
+			io.WriteString(w, `{"nonce": "1234567890:9876543210"}`)
+		case authSessionPath:
+			c.Check(r.Header.Get("X-Device-Authorization"), Equals, expiredAuth)
+			sessionRequests++
+			io.WriteString(w, `{"macaroon": "refreshed-session-macaroon"}`)
+		default:
+			c.Fatalf("unexpected path %q", r.URL.Path)
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	s.device.SessionMacaroon = "expired-session-macaroon"
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&store.Config{
+		StoreBaseURL: mockServerURL,
+	}, dauthCtx)
+
+	device, err := sto.EnsureDeviceSession()
+	c.Assert(err, IsNil)
+	ctx := store.WithDeviceSession(s.ctx, device)
+
+	for i := 0; i < 2; i++ {
+		reqOptions := store.NewRequestOptions("GET", mockServerURL)
+		resp, err := sto.DoRequest(ctx, sto.Client(), reqOptions, nil)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Check(resp.StatusCode, Equals, 200)
+	}
+
+	c.Check(sessionRequests, Equals, 1)
+	// the refreshed session is used from then on
+	c.Check(authorizations, DeepEquals, []string{expiredAuth, refreshedAuth, refreshedAuth})
+	// and was saved as usual
+	c.Check(s.device.SessionMacaroon, Equals, "refreshed-session-macaroon")
+}
@@ -29,8 +29,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/ratelimit"
@@ -38,6 +41,8 @@ import (
 	"gopkg.in/retry.v1"
 
 	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/httputil"
+	"github.com/snapcore/snapd/logger"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/overlord/auth"
 	"github.com/snapcore/snapd/progress"
@@ -70,6 +75,7 @@ func (s *downloadSuite) TestActualDownload(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c.Check(r.Header.Get("Snap-CDN"), Equals, "")
 		c.Check(r.Header.Get("Snap-Refresh-Reason"), Equals, "")
+		c.Check(r.Header.Get("Snap-Download-Priority"), Equals, "")
 		n++
 		io.WriteString(w, "response-data")
 	}))
@@ -106,6 +112,120 @@ func (s *downloadSuite) TestActualDownloadAutoRefresh(c *C) {
 	c.Check(n, Equals, 1)
 }
 
+func (s *downloadSuite) TestActualDownloadRefreshReason(c *C) {
+	var expected string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Snap-Refresh-Reason"), Equals, expected)
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	theStore := store.New(&store.Config{}, nil)
+
+	for _, t := range []struct {
+		opts     *store.DownloadOptions
+		expected string
+	}{
+		{nil, ""},
+		{&store.DownloadOptions{}, ""},
+		{&store.DownloadOptions{IsAutoRefresh: true}, "scheduled"},
+		{&store.DownloadOptions{RefreshReason: store.RefreshReasonScheduled}, "scheduled"},
+		{&store.DownloadOptions{RefreshReason: store.RefreshReasonManual}, "manual"},
+		{&store.DownloadOptions{RefreshReason: store.RefreshReasonPrereq}, "prereq"},
+		// an explicit reason wins
+		{&store.DownloadOptions{IsAutoRefresh: true, RefreshReason: store.RefreshReasonManual}, "manual"},
+	} {
+		expected = t.expected
+		var buf SillyBuffer
+		err := store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, t.opts)
+		c.Assert(err, IsNil)
+		c.Check(buf.String(), Equals, "response-data")
+	}
+}
+
+func (s *downloadSuite) TestActualDownloadRedirectAllowHosts(c *C) {
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(cdn, NotNil)
+	defer cdn.Close()
+	cdnURL, _ := url.Parse(cdn.URL)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, cdn.URL+"/blob", 302)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+	mockServerURL, _ := url.Parse(mockServer.URL)
+
+	// the redirect target is allowed
+	theStore := store.New(&store.Config{
+		DownloadRedirectAllowHosts: []string{"cdn.example.com", cdnURL.Host},
+	}, nil)
+	var buf SillyBuffer
+	err := store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "response-data")
+
+	// only the original host is allowed, but not the redirect target
+	theStore = store.New(&store.Config{
+		DownloadRedirectAllowHosts: []string{mockServerURL.Host},
+	}, nil)
+	buf = SillyBuffer{}
+	err = store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, nil)
+	c.Assert(err, ErrorMatches, fmt.Sprintf(`.*cannot follow download redirect to %q: host is not allowed`, cdnURL.Host))
+	c.Check(buf.String(), Equals, "")
+
+	// without a list all redirects are followed
+	theStore = store.New(&store.Config{}, nil)
+	buf = SillyBuffer{}
+	err = store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "response-data")
+}
+
+func (s *downloadSuite) TestActualDownloadReportsServedBy(c *C) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(mirror, NotNil)
+	defer mirror.Close()
+	mirrorURL, _ := url.Parse(mirror.URL)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/direct" {
+			io.WriteString(w, "response-data")
+			return
+		}
+		http.Redirect(w, r, mirror.URL+"/blob", 302)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+	mockServerURL, _ := url.Parse(mockServer.URL)
+
+	theStore := store.New(&store.Config{}, nil)
+
+	var servedBy []string
+	opts := &store.DownloadOptions{
+		ServedBy: func(host string) { servedBy = append(servedBy, host) },
+	}
+
+	// the host the download was redirected to is reported
+	var buf SillyBuffer
+	err := store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, opts)
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "response-data")
+	c.Check(servedBy, DeepEquals, []string{mirrorURL.Host})
+
+	// or the original one if not redirected
+	servedBy = nil
+	buf = SillyBuffer{}
+	err = store.Download(context.TODO(), "foo", "", mockServer.URL+"/direct", nil, theStore, &buf, 0, nil, opts)
+	c.Assert(err, IsNil)
+	c.Check(servedBy, DeepEquals, []string{mockServerURL.Host})
+}
+
 func (s *downloadSuite) TestActualDownloadNoCDN(c *C) {
 	os.Setenv("SNAPPY_STORE_NO_CDN", "1")
 	defer os.Unsetenv("SNAPPY_STORE_NO_CDN")
@@ -286,6 +406,201 @@ func (s *downloadSuite) TestActualDownload500Once(c *C) {
 	c.Check(n, Equals, 2)
 }
 
+func (s *downloadSuite) TestActualDownload429RetryAfter(c *C) {
+	store.MockMaxDownloadRetryAfter(&s.BaseTest, 5*time.Second)
+
+	n := 0
+	var firstReq time.Time
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n == 1 {
+			firstReq = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(429)
+		} else {
+			c.Check(time.Since(firstReq) >= time.Second, Equals, true)
+			io.WriteString(w, "response-data")
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	theStore := store.New(&store.Config{}, nil)
+	var buf SillyBuffer
+	err := store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "response-data")
+	c.Check(n, Equals, 2)
+}
+
+func (s *downloadSuite) TestActualDownload429RetryAfterCapped(c *C) {
+	store.MockMaxDownloadRetryAfter(&s.BaseTest, 10*time.Millisecond)
+
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(429)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	theStore := store.New(&store.Config{}, nil)
+	var buf SillyBuffer
+	start := time.Now()
+	err := store.Download(context.TODO(), "foo", "sha3", mockServer.URL, nil, theStore, &buf, 0, nil, nil)
+	c.Assert(err, FitsTypeOf, &store.DownloadError{})
+	c.Check(err.(*store.DownloadError).Code, Equals, 429)
+	// the waits count against the attempts limit
+	c.Check(n, Equals, 5)
+	c.Check(time.Since(start) < time.Minute, Equals, true)
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.now = fc.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- fc.now
+	return ch
+}
+
+func (s *downloadSuite) TestActualDownload429RetryAfterMockedClock(c *C) {
+	startTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fc := &fakeClock{now: startTime}
+	s.AddCleanup(httputil.MockClock(fc))
+
+	var reqTimes []time.Time
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqTimes = append(reqTimes, fc.Now())
+		if len(reqTimes) == 1 {
+			w.Header().Set("Retry-After", "20")
+			w.WriteHeader(429)
+			return
+		}
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	theStore := store.New(&store.Config{}, nil)
+	var buf SillyBuffer
+	start := time.Now()
+	err := store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "response-data")
+	c.Assert(reqTimes, HasLen, 2)
+	// the store asked for a 20s pause, which happened on the mocked
+	// clock only and took the place of the shorter strategy delay
+	c.Check(reqTimes[1].Sub(reqTimes[0]), Equals, 20*time.Second)
+	c.Check(fc.Now().Sub(startTime), Equals, 20*time.Second)
+	c.Check(time.Since(start) < 10*time.Second, Equals, true)
+}
+
+func (s *downloadSuite) TestActualDownload429RetryAfterHTTPDateMockedClock(c *C) {
+	startTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fc := &fakeClock{now: startTime}
+	s.AddCleanup(httputil.MockClock(fc))
+
+	var reqTimes []time.Time
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqTimes = append(reqTimes, fc.Now())
+		if len(reqTimes) == 1 {
+			// the date is relative to the mocked clock
+			w.Header().Set("Retry-After", startTime.Add(20*time.Second).Format(http.TimeFormat))
+			w.WriteHeader(429)
+			return
+		}
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	theStore := store.New(&store.Config{}, nil)
+	var buf SillyBuffer
+	err := store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "response-data")
+	c.Assert(reqTimes, HasLen, 2)
+	c.Check(reqTimes[1].Sub(reqTimes[0]), Equals, 20*time.Second)
+}
+
+func (s *downloadSuite) TestActualDownloadErrorClassification(c *C) {
+	fc := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.AddCleanup(httputil.MockClock(fc))
+	store.MockMaxDownloadRetryAfter(&s.BaseTest, time.Minute)
+
+	for _, t := range []struct {
+		code       int
+		retryAfter string
+
+		retryable   bool
+		clientErr   bool
+		serverErr   bool
+		expectedDur time.Duration
+	}{
+		{code: 401, clientErr: true},
+		{code: 403, clientErr: true},
+		{code: 404, clientErr: true},
+		{code: 429, retryAfter: "20", retryable: true, clientErr: true, expectedDur: 20 * time.Second},
+		{code: 429, retryable: true, clientErr: true},
+		{code: 500, retryable: true, serverErr: true},
+		{code: 501, serverErr: true},
+		{code: 502, retryable: true, serverErr: true},
+		{code: 503, retryAfter: "7", retryable: true, serverErr: true, expectedDur: 7 * time.Second},
+		{code: 504, retryAfter: "7", retryable: true, serverErr: true},
+	} {
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if t.retryAfter != "" {
+				w.Header().Set("Retry-After", t.retryAfter)
+			}
+			w.WriteHeader(t.code)
+		}))
+
+		theStore := store.New(&store.Config{}, nil)
+		var buf SillyBuffer
+		err := store.Download(context.TODO(), "foo", "sha3", mockServer.URL, nil, theStore, &buf, 0, nil, nil)
+		mockServer.Close()
+
+		comment := Commentf("%d", t.code)
+		c.Assert(err, FitsTypeOf, &store.DownloadError{}, comment)
+		dlErr := err.(*store.DownloadError)
+		c.Check(dlErr.Code, Equals, t.code, comment)
+		c.Check(dlErr.IsRetryable(), Equals, t.retryable, comment)
+		c.Check(dlErr.IsClientError(), Equals, t.clientErr, comment)
+		c.Check(dlErr.IsServerError(), Equals, t.serverErr, comment)
+		// only carried for 429 and 503
+		c.Check(dlErr.RetryAfter, Equals, t.expectedDur, comment)
+	}
+}
+
+func (s *downloadSuite) TestActualDownload429RetryAfterCancelled(c *C) {
+	store.MockMaxDownloadRetryAfter(&s.BaseTest, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(429)
+		cancel()
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	theStore := store.New(&store.Config{}, nil)
+	var buf SillyBuffer
+	err := store.Download(ctx, "foo", "sha3", mockServer.URL, nil, theStore, &buf, 0, nil, nil)
+	c.Check(err, ErrorMatches, "The download has been cancelled: context canceled")
+	c.Check(n, Equals, 1)
+}
+
 // SillyBuffer is a ReadWriteSeeker buffer with a limited size for the tests
 // (bytes does not implement an ReadWriteSeeker)
 type SillyBuffer struct {
@@ -448,10 +763,34 @@ func (s *downloadSuite) TestUseDeltas(c *C) {
 			os.Setenv("PATH", altPath)
 		}
 
-		c.Check(store.UseDeltas(), Equals, scenario.wantDelta, Commentf("%#v", scenario))
+		c.Check(store.UseDeltas(""), Equals, scenario.wantDelta, Commentf("%#v", scenario))
 	}
 }
 
+func (s *downloadSuite) TestUseDeltasCustomXdelta3Path(c *C) {
+	origPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", origPath)
+	// no xdelta3 on PATH nor in the system snap
+	os.Setenv("PATH", c.MkDir())
+	origSnapMountDir := dirs.SnapMountDir
+	defer func() { dirs.SnapMountDir = origSnapMountDir }()
+	dirs.SnapMountDir = c.MkDir()
+	origUseDeltas := os.Getenv("SNAPD_USE_DELTAS_EXPERIMENTAL")
+	defer os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", origUseDeltas)
+	os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", "1")
+
+	c.Check(store.UseDeltas(""), Equals, false)
+
+	customPath := filepath.Join(c.MkDir(), "xdelta3")
+	c.Check(store.UseDeltas(customPath), Equals, false)
+
+	c.Assert(ioutil.WriteFile(customPath, nil, 0644), IsNil)
+	c.Check(store.UseDeltas(customPath), Equals, false)
+
+	c.Assert(os.Chmod(customPath, 0755), IsNil)
+	c.Check(store.UseDeltas(customPath), Equals, true)
+}
+
 type downloadBehaviour []struct {
 	url   string
 	error bool
@@ -461,6 +800,7 @@ var deltaTests = []struct {
 	downloads       downloadBehaviour
 	info            snap.DownloadInfo
 	expectedContent string
+	expectedStats   store.DeltaStats
 }{{
 	// The full snap is not downloaded, but rather the delta
 	// is downloaded and applied.
@@ -474,6 +814,7 @@ var deltaTests = []struct {
 		},
 	},
 	expectedContent: "snap-content-via-delta",
+	expectedStats:   store.DeltaStats{Offered: 1, Applied: 1},
 }, {
 	// If there is an error during the delta download, the
 	// full snap is downloaded as per normal.
@@ -488,6 +829,7 @@ var deltaTests = []struct {
 		},
 	},
 	expectedContent: "full-snap-url-content",
+	expectedStats:   store.DeltaStats{Offered: 1, Failed: 1, FullDownloadFallbacks: 1},
 }, {
 	// If more than one matching delta is returned by the store
 	// we ignore deltas and do the full download.
@@ -502,6 +844,16 @@ var deltaTests = []struct {
 		},
 	},
 	expectedContent: "full-snap-url-content",
+	expectedStats:   store.DeltaStats{Offered: 1, FullDownloadFallbacks: 1},
+}, {
+	// No deltas, no stats.
+	downloads: downloadBehaviour{
+		{url: "full-snap-url"},
+	},
+	info: snap.DownloadInfo{
+		AnonDownloadURL: "full-snap-url",
+	},
+	expectedContent: "full-snap-url-content",
 }}
 
 func (s *downloadSuite) TestDownloadWithDelta(c *C) {
@@ -523,7 +875,7 @@ func (s *downloadSuite) TestDownloadWithDelta(c *C) {
 			return nil
 		})
 		defer restore()
-		restore = store.MockApplyDelta(func(name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
+		restore = store.MockApplyDelta(func(ctx context.Context, xdelta3Path string, name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
 			c.Check(deltaInfo, Equals, &testCase.info.Deltas[0])
 			err := ioutil.WriteFile(targetPath, []byte("snap-content-via-delta"), 0644)
 			c.Assert(err, IsNil)
@@ -538,27 +890,839 @@ func (s *downloadSuite) TestDownloadWithDelta(c *C) {
 		c.Assert(err, IsNil)
 		defer os.Remove(path)
 		c.Assert(path, testutil.FileEquals, testCase.expectedContent)
+		c.Check(theStore.DeltaStats(), Equals, testCase.expectedStats)
 	}
 }
 
-func (s *downloadSuite) TestActualDownloadRateLimited(c *C) {
-	var ratelimitReaderUsed bool
-	restore := store.MockRatelimitReader(func(r io.Reader, bucket *ratelimit.Bucket) io.Reader {
-		ratelimitReaderUsed = true
-		return r
+func (s *downloadSuite) TestDownloadWithDeltaStatsAccumulate(c *C) {
+	origUseDeltas := os.Getenv("SNAPD_USE_DELTAS_EXPERIMENTAL")
+	defer os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", origUseDeltas)
+	c.Assert(os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", "1"), IsNil)
+
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		w.Write([]byte(url + "-content"))
+		return nil
+	})
+	defer restore()
+	applyErr := errors.New("cannot apply delta")
+	restore = store.MockApplyDelta(func(ctx context.Context, xdelta3Path string, name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
+		if applyErr != nil {
+			return applyErr
+		}
+		return ioutil.WriteFile(targetPath, []byte("snap-content-via-delta"), 0644)
 	})
 	defer restore()
 
-	canary := "downloaded data"
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprint(w, canary)
-	}))
-	defer ts.Close()
+	info := snap.DownloadInfo{
+		AnonDownloadURL: "full-snap-url",
+		Deltas: []snap.DeltaInfo{
+			{AnonDownloadURL: "delta-url", Format: "xdelta3"},
+		},
+	}
+	theStore := store.New(&store.Config{}, nil)
+
+	// applying the delta fails
+	path := filepath.Join(c.MkDir(), "failed")
+	err := theStore.Download(context.TODO(), "foo", path, &info, nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(path, testutil.FileEquals, "full-snap-url-content")
+	c.Check(theStore.DeltaStats(), Equals, store.DeltaStats{Offered: 1, Failed: 1, FullDownloadFallbacks: 1})
+
+	// applying the delta works
+	applyErr = nil
+	path = filepath.Join(c.MkDir(), "applied")
+	err = theStore.Download(context.TODO(), "foo", path, &info, nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(path, testutil.FileEquals, "snap-content-via-delta")
+	c.Check(theStore.DeltaStats(), Equals, store.DeltaStats{Offered: 2, Applied: 1, Failed: 1, FullDownloadFallbacks: 1})
+}
 
+func (s *downloadSuite) TestDownloadWithDeltaLongTargetName(c *C) {
+	origUseDeltas := os.Getenv("SNAPD_USE_DELTAS_EXPERIMENTAL")
+	defer os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", origUseDeltas)
+	c.Assert(os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", "1"), IsNil)
+
+	dir := c.MkDir()
+	// long, but still a valid file name
+	path := filepath.Join(dir, strings.Repeat("x", 240)+".snap")
+
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		c.Check(url, Equals, "delta-url")
+		w.Write([]byte("the delta"))
+		return nil
+	})
+	defer restore()
+	restore = store.MockApplyDelta(func(ctx context.Context, xdelta3Path string, name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
+		c.Check(filepath.Dir(deltaPath), Equals, dir)
+		c.Check(len(filepath.Base(deltaPath)) < 64, Equals, true, Commentf("%q", deltaPath))
+		// the random part is appended to the hashed prefix
+		c.Check(filepath.Base(deltaPath), Matches, `\.[0-9a-f]{16}\.[0-9]+`)
+		c.Check(deltaPath, testutil.FileEquals, "the delta")
+		return ioutil.WriteFile(targetPath, []byte("snap-content-via-delta"), 0644)
+	})
+	defer restore()
+
+	info := snap.DownloadInfo{
+		AnonDownloadURL: "full-snap-url",
+		Deltas: []snap.DeltaInfo{
+			{AnonDownloadURL: "delta-url", Format: "xdelta3", FromRevision: 24, ToRevision: 26},
+		},
+	}
 	theStore := store.New(&store.Config{}, nil)
-	var buf SillyBuffer
-	err := store.Download(context.TODO(), "example-name", "", ts.URL, nil, theStore, &buf, 0, nil, &store.DownloadOptions{RateLimit: 1})
+	err := theStore.Download(context.TODO(), "foo", path, &info, nil, nil, nil)
 	c.Assert(err, IsNil)
-	c.Check(buf.String(), Equals, canary)
-	c.Check(ratelimitReaderUsed, Equals, true)
+	c.Check(path, testutil.FileEquals, "snap-content-via-delta")
+	c.Check(theStore.DeltaStats(), Equals, store.DeltaStats{Offered: 1, Applied: 1})
+
+	// the delta was cleaned up
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Name(), Equals, filepath.Base(path))
+}
+
+func (s *downloadSuite) TestDownloadWithDeltaConcurrentSameTarget(c *C) {
+	origUseDeltas := os.Getenv("SNAPD_USE_DELTAS_EXPERIMENTAL")
+	defer os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", origUseDeltas)
+	c.Assert(os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", "1"), IsNil)
+
+	const n = 2
+	var started sync.WaitGroup
+	started.Add(n)
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		// write a bit, then wait for the other downloads to be
+		// in the middle of theirs too
+		f := w.(*os.File)
+		f.Write([]byte(filepath.Base(f.Name())))
+		started.Done()
+		started.Wait()
+		return nil
+	})
+	defer restore()
+	var mu sync.Mutex
+	deltaPaths := make(map[string]bool)
+	restore = store.MockApplyDelta(func(ctx context.Context, xdelta3Path string, name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
+		// each delta is intact
+		c.Check(deltaPath, testutil.FileEquals, filepath.Base(deltaPath))
+		mu.Lock()
+		deltaPaths[deltaPath] = true
+		mu.Unlock()
+		return ioutil.WriteFile(targetPath, []byte("snap-content-via-delta"), 0644)
+	})
+	defer restore()
+
+	info := snap.DownloadInfo{
+		AnonDownloadURL: "full-snap-url",
+		Deltas: []snap.DeltaInfo{
+			{AnonDownloadURL: "delta-url", Format: "xdelta3", FromRevision: 24, ToRevision: 26},
+		},
+	}
+	theStore := store.New(&store.Config{}, nil)
+	path := filepath.Join(c.MkDir(), "foo.snap")
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- theStore.Download(context.TODO(), "foo", path, &info, nil, nil, nil)
+		}()
+	}
+	for i := 0; i < n; i++ {
+		c.Check(<-errs, IsNil)
+	}
+	c.Check(deltaPaths, HasLen, n)
+	c.Check(path, testutil.FileEquals, "snap-content-via-delta")
+	c.Check(theStore.DeltaStats(), Equals, store.DeltaStats{Offered: n, Applied: n})
+}
+
+func (s *downloadSuite) TestDownloadWithBrokenXdelta3(c *C) {
+	origUseDeltas := os.Getenv("SNAPD_USE_DELTAS_EXPERIMENTAL")
+	defer os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", origUseDeltas)
+	c.Assert(os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", "1"), IsNil)
+
+	mockXdelta := testutil.MockCommand(c, "xdelta3", "echo broken; exit 1")
+	defer mockXdelta.Restore()
+
+	var urls []string
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		urls = append(urls, url)
+		w.Write([]byte(url + "-content"))
+		return nil
+	})
+	defer restore()
+	restore = store.MockApplyDelta(func(ctx context.Context, xdelta3Path string, name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
+		c.Fatalf("unexpected delta apply")
+		return nil
+	})
+	defer restore()
+
+	info := snap.DownloadInfo{
+		AnonDownloadURL: "full-snap-url",
+		Deltas: []snap.DeltaInfo{
+			{AnonDownloadURL: "delta-url", Format: "xdelta3"},
+		},
+	}
+	theStore := store.New(&store.Config{}, nil)
+
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(c.MkDir(), "downloaded-file")
+		err := theStore.Download(context.TODO(), "foo", path, &info, nil, nil, nil)
+		c.Assert(err, IsNil)
+		c.Check(path, testutil.FileEquals, "full-snap-url-content")
+	}
+	// the delta was never even downloaded
+	c.Check(urls, DeepEquals, []string{"full-snap-url", "full-snap-url"})
+	c.Check(theStore.DeltaStats(), Equals, store.DeltaStats{})
+	// and xdelta3 was only probed once
+	c.Check(mockXdelta.Calls(), DeepEquals, [][]string{{"xdelta3", "-V"}})
+}
+
+func (s *downloadSuite) TestDownloadWithDeltasDisabled(c *C) {
+	origUseDeltas := os.Getenv("SNAPD_USE_DELTAS_EXPERIMENTAL")
+	defer os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", origUseDeltas)
+	c.Assert(os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", "1"), IsNil)
+
+	var urls []string
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		urls = append(urls, url)
+		w.Write([]byte(url + "-content"))
+		return nil
+	})
+	defer restore()
+	restore = store.MockApplyDelta(func(ctx context.Context, xdelta3Path string, name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
+		c.Fatalf("unexpected delta apply")
+		return nil
+	})
+	defer restore()
+
+	info := snap.DownloadInfo{
+		AnonDownloadURL: "full-snap-url",
+		Deltas: []snap.DeltaInfo{
+			{AnonDownloadURL: "delta-url", Format: "xdelta3"},
+		},
+	}
+	theStore := store.New(&store.Config{DisableDeltas: true}, nil)
+
+	path := filepath.Join(c.MkDir(), "downloaded-file")
+	err := theStore.Download(context.TODO(), "foo", path, &info, nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(path, testutil.FileEquals, "full-snap-url-content")
+	c.Check(urls, DeepEquals, []string{"full-snap-url"})
+	c.Check(theStore.DeltaStats(), Equals, store.DeltaStats{})
+}
+
+func (s *downloadSuite) TestActualDownloadRateLimited(c *C) {
+	var ratelimitReaderUsed bool
+	restore := store.MockRatelimitReader(func(r io.Reader, bucket *ratelimit.Bucket) io.Reader {
+		ratelimitReaderUsed = true
+		return r
+	})
+	defer restore()
+
+	canary := "downloaded data"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, canary)
+	}))
+	defer ts.Close()
+
+	theStore := store.New(&store.Config{}, nil)
+	var buf SillyBuffer
+	err := store.Download(context.TODO(), "example-name", "", ts.URL, nil, theStore, &buf, 0, nil, &store.DownloadOptions{RateLimit: 1})
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, canary)
+	c.Check(ratelimitReaderUsed, Equals, true)
+}
+
+// stallClock is a fakeClock whose timers only fire, right away, once
+// it is set to be stalling.
+type stallClock struct {
+	fakeClock
+
+	mu       sync.Mutex
+	stalling bool
+}
+
+type stallTimer struct{}
+
+func (stallTimer) Stop() bool { return true }
+
+func (sc *stallClock) setStalling(stalling bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.stalling = stalling
+}
+
+func (sc *stallClock) AfterFunc(d time.Duration, f func()) httputil.Timer {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.stalling {
+		go f()
+	}
+	return stallTimer{}
+}
+
+// hookedFile calls onWrite with the total written after each write.
+type hookedFile struct {
+	*os.File
+	onWrite func(written int64)
+	written int64
+}
+
+func (f *hookedFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.written += int64(n)
+	f.onWrite(f.written)
+	return n, err
+}
+
+func (s *downloadSuite) TestActualDownloadStalled(c *C) {
+	sc := &stallClock{fakeClock: fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	s.AddCleanup(httputil.MockClock(sc))
+
+	quit := make(chan struct{})
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		switch n {
+		case 1:
+			w.Header().Set("Content-Length", "9")
+			io.WriteString(w, "some ")
+			w.(http.Flusher).Flush()
+			// and then nothing more
+			select {
+			case <-quit:
+			case <-r.Context().Done():
+			}
+		case 2:
+			// the download resumes from what was received
+			c.Check(r.Header.Get("Range"), Equals, "bytes=5-")
+			sc.setStalling(false)
+			w.WriteHeader(206)
+			io.WriteString(w, "data")
+		default:
+			c.Errorf("unexpected request")
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+	defer close(quit)
+
+	theStore := store.New(&store.Config{}, nil)
+	path := filepath.Join(c.MkDir(), "downloaded-file")
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	w := &hookedFile{File: f, onWrite: func(written int64) {
+		if written == 5 {
+			// the next read gets nothing
+			sc.setStalling(true)
+		}
+	}}
+	err = store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, w, 0, nil, &store.DownloadOptions{StallTimeout: time.Minute})
+	c.Assert(err, IsNil)
+	c.Check(path, testutil.FileEquals, "some data")
+	c.Check(n, Equals, 2)
+}
+
+type hookedBody struct {
+	io.Reader
+	onRead func(n int)
+	reads  int
+	closed bool
+}
+
+func (b *hookedBody) Read(p []byte) (int, error) {
+	b.reads++
+	b.onRead(b.reads)
+	return b.Reader.Read(p)
+}
+
+func (b *hookedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (s *downloadSuite) TestStallReaderLateExpire(c *C) {
+	var r interface {
+		io.Reader
+		Expire(gen int)
+	}
+	body := &hookedBody{Reader: strings.NewReader("some data")}
+	body.onRead = func(n int) {
+		if n == 2 {
+			// the timer of the first read fires late, while
+			// the second one is in progress
+			r.Expire(1)
+		}
+	}
+	r = store.NewStallReader(body, time.Hour)
+
+	buf := make([]byte, 5)
+	n, err := r.Read(buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "some ")
+	n, err = r.Read(buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "data")
+	c.Check(body.closed, Equals, false)
+}
+
+func (s *downloadSuite) TestActualDownloadStalledRetriesExhausted(c *C) {
+	store.MockDownloadRetryStrategy(&s.BaseTest, retry.LimitCount(2, retry.Exponential{
+		Initial: time.Millisecond,
+		Factor:  1,
+	}))
+	sc := &stallClock{fakeClock: fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	sc.setStalling(true)
+	s.AddCleanup(httputil.MockClock(sc))
+
+	quit := make(chan struct{})
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.(http.Flusher).Flush()
+		select {
+		case <-quit:
+		case <-r.Context().Done():
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+	defer close(quit)
+
+	theStore := store.New(&store.Config{}, nil)
+	w, err := os.Create(filepath.Join(c.MkDir(), "downloaded-file"))
+	c.Assert(err, IsNil)
+	defer w.Close()
+	err = store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, w, 0, nil, &store.DownloadOptions{StallTimeout: time.Minute})
+	c.Assert(err, ErrorMatches, "download stalled: no data received for 1m0s")
+	c.Check(n, Equals, 2)
+}
+
+func (s *downloadSuite) TestActualDownloadLowPriority(c *C) {
+	var capacity int64
+	restore := store.MockRatelimitReader(func(r io.Reader, bucket *ratelimit.Bucket) io.Reader {
+		capacity = bucket.Capacity()
+		return r
+	})
+	defer restore()
+
+	for _, t := range []struct {
+		opts     *store.DownloadOptions
+		priority string
+		limit    int64
+	}{
+		{nil, "", 0},
+		{&store.DownloadOptions{}, "", 0},
+		{&store.DownloadOptions{RateLimit: 1000}, "", 1000},
+		{&store.DownloadOptions{LowPriority: true}, "low", store.LowPriorityRateLimit},
+		// an explicit rate limit wins
+		{&store.DownloadOptions{LowPriority: true, RateLimit: 1000}, "low", 1000},
+	} {
+		capacity = 0
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.Check(r.Header.Get("Snap-Download-Priority"), Equals, t.priority)
+			io.WriteString(w, "response-data")
+		}))
+
+		theStore := store.New(&store.Config{}, nil)
+		var buf SillyBuffer
+		err := store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, t.opts)
+		mockServer.Close()
+		c.Assert(err, IsNil)
+		c.Check(buf.String(), Equals, "response-data")
+		// the bucket is sized for twice the rate limit
+		c.Check(capacity, Equals, 2*t.limit, Commentf("%+v", t.opts))
+	}
+}
+
+func (s *downloadSuite) TestActualDownloadRateLimitClamped(c *C) {
+	var capacity int64
+	restore := store.MockRatelimitReader(func(r io.Reader, bucket *ratelimit.Bucket) io.Reader {
+		capacity = bucket.Capacity()
+		return r
+	})
+	defer restore()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "response-data")
+	}))
+	defer mockServer.Close()
+
+	cfg := &store.Config{
+		MinDownloadRate: 1000,
+		MaxDownloadRate: 100000,
+	}
+	for _, t := range []struct {
+		opts   *store.DownloadOptions
+		limit  int64
+		logged string
+	}{
+		// too slow
+		{&store.DownloadOptions{RateLimit: 1}, 1000, "Download rate limit of 1 bytes/s is below the minimum, using 1000 bytes/s."},
+		// too fast
+		{&store.DownloadOptions{RateLimit: 1000000}, 100000, "Download rate limit of 1000000 bytes/s is above the maximum, using 100000 bytes/s."},
+		// no limit is capped too
+		{&store.DownloadOptions{}, 100000, ""},
+		// within bounds
+		{&store.DownloadOptions{RateLimit: 1000}, 1000, ""},
+		{&store.DownloadOptions{RateLimit: 50000}, 50000, ""},
+	} {
+		logbuf, restore := logger.MockLogger()
+		capacity = 0
+
+		theStore := store.New(cfg, nil)
+		var buf SillyBuffer
+		err := store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, t.opts)
+		restore()
+		c.Assert(err, IsNil)
+		c.Check(buf.String(), Equals, "response-data")
+		c.Check(capacity, Equals, 2*t.limit, Commentf("%+v", t.opts))
+		if t.logged == "" {
+			c.Check(logbuf.String(), Not(testutil.Contains), "Download rate limit")
+		} else {
+			c.Check(logbuf.String(), testutil.Contains, t.logged)
+		}
+	}
+}
+
+func (s *downloadSuite) TestActualDownloadGlobalRateLimit(c *C) {
+	const rate = 64 * 1024
+	data := strings.Repeat("x", 96*1024)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, data)
+	}))
+	defer mockServer.Close()
+
+	theStore := store.New(&store.Config{GlobalDownloadRate: rate}, nil)
+
+	// the bucket starts out full (twice the rate), so downloading
+	// 2*96KiB concurrently needs to wait for at least another 64KiB
+	// worth of tokens, i.e. ~1s, which it wouldn't need to if each
+	// download had its own bucket
+	dir := c.MkDir()
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	start := time.Now()
+	for i := range errs {
+		w, err := os.Create(filepath.Join(dir, fmt.Sprintf("downloaded-file-%d", i)))
+		c.Assert(err, IsNil)
+		defer w.Close()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, w, 0, nil, nil)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	for i := range errs {
+		c.Assert(errs[i], IsNil)
+		c.Check(filepath.Join(dir, fmt.Sprintf("downloaded-file-%d", i)), testutil.FileEquals, data)
+	}
+	c.Check(elapsed >= 900*time.Millisecond, Equals, true, Commentf("took %v", elapsed))
+}
+
+func (s *downloadSuite) TestActualDownloadGlobalRateLimitShared(c *C) {
+	var buckets []*ratelimit.Bucket
+	restore := store.MockRatelimitReader(func(r io.Reader, bucket *ratelimit.Bucket) io.Reader {
+		buckets = append(buckets, bucket)
+		return r
+	})
+	defer restore()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "response-data")
+	}))
+	defer mockServer.Close()
+
+	theStore := store.New(&store.Config{GlobalDownloadRate: 1000}, nil)
+	for i := 0; i < 2; i++ {
+		var buf SillyBuffer
+		err := store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, &store.DownloadOptions{RateLimit: 5000})
+		c.Assert(err, IsNil)
+		c.Check(buf.String(), Equals, "response-data")
+	}
+	// each download gets its own bucket plus the shared one
+	c.Assert(buckets, HasLen, 4)
+	c.Check(buckets[0].Capacity(), Equals, int64(10000))
+	c.Check(buckets[1].Capacity(), Equals, int64(2000))
+	c.Check(buckets[0], Not(Equals), buckets[2])
+	c.Check(buckets[1], Equals, buckets[3])
+}
+
+func (s *downloadSuite) TestActualDownloadConditional(c *C) {
+	lastModified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if r.Header.Get("If-None-Match") == `"etag-1"` {
+			w.WriteHeader(304)
+			return
+		}
+		if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(ims) {
+			w.WriteHeader(304)
+			return
+		}
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	theStore := store.New(&store.Config{}, nil)
+
+	for _, t := range []struct {
+		opts     *store.DownloadOptions
+		modified bool
+	}{
+		{&store.DownloadOptions{IfNoneMatch: `"etag-1"`}, false},
+		{&store.DownloadOptions{IfModifiedSince: lastModified}, false},
+		{&store.DownloadOptions{IfModifiedSince: lastModified.Add(time.Hour)}, false},
+		{&store.DownloadOptions{IfNoneMatch: `"etag-0"`}, true},
+		{&store.DownloadOptions{IfModifiedSince: lastModified.Add(-time.Hour)}, true},
+	} {
+		n = 0
+		var buf SillyBuffer
+		err := store.Download(context.TODO(), "foo", "", mockServer.URL, nil, theStore, &buf, 0, nil, t.opts)
+		if t.modified {
+			c.Check(err, IsNil)
+			c.Check(buf.String(), Equals, "response-data")
+		} else {
+			c.Check(err, Equals, store.ErrDownloadNotModified)
+			c.Check(buf.String(), Equals, "")
+		}
+		// no retries for 304s
+		c.Check(n, Equals, 1)
+	}
+}
+
+func (s *downloadSuite) TestDownloadNotModifiedLeavesNoFile(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("If-None-Match"), Equals, `"etag-1"`)
+		w.WriteHeader(304)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	theStore := store.New(&store.Config{}, nil)
+	path := filepath.Join(c.MkDir(), "foo.snap")
+	downloadInfo := &snap.DownloadInfo{
+		DownloadURL: mockServer.URL + "/foo.snap",
+		Size:        13,
+	}
+	err := theStore.Download(context.TODO(), "foo", path, downloadInfo, nil, nil, &store.DownloadOptions{IfNoneMatch: `"etag-1"`})
+	c.Check(err, Equals, store.ErrDownloadNotModified)
+	c.Check(path, testutil.FileAbsent)
+	c.Check(path+".partial", testutil.FileAbsent)
+}
+
+func (s *downloadSuite) TestEstimateDownloadSize(c *C) {
+	dirs.SetRootDir(c.MkDir())
+	defer dirs.SetRootDir("")
+
+	info := &snap.DownloadInfo{
+		Size: 1000,
+		Deltas: []snap.DeltaInfo{
+			{FromRevision: 24, ToRevision: 26, Format: "xdelta3", Size: 100},
+		},
+	}
+	theStore := store.New(&store.Config{}, nil)
+
+	// the delta source is not there
+	full, delta, ok := theStore.EstimateDownloadSize("foo", info)
+	c.Check(full, Equals, int64(1000))
+	c.Check(delta, Equals, int64(0))
+	c.Check(ok, Equals, false)
+
+	c.Assert(os.MkdirAll(dirs.SnapBlobDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dirs.SnapBlobDir, "foo_24.snap"), nil, 0644), IsNil)
+
+	full, delta, ok = theStore.EstimateDownloadSize("foo", info)
+	c.Check(full, Equals, int64(1000))
+	c.Check(delta, Equals, int64(100))
+	c.Check(ok, Equals, true)
+}
+
+func (s *downloadSuite) TestEstimateDownloadSizeNoDelta(c *C) {
+	dirs.SetRootDir(c.MkDir())
+	defer dirs.SetRootDir("")
+	c.Assert(os.MkdirAll(dirs.SnapBlobDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dirs.SnapBlobDir, "foo_24.snap"), nil, 0644), IsNil)
+
+	theStore := store.New(&store.Config{}, nil)
+
+	for _, deltas := range [][]snap.DeltaInfo{
+		nil,
+		// unsupported format
+		{{FromRevision: 24, ToRevision: 26, Format: "bsdiff", Size: 100}},
+		// more than one
+		{
+			{FromRevision: 24, ToRevision: 26, Format: "xdelta3", Size: 100},
+			{FromRevision: 25, ToRevision: 26, Format: "xdelta3", Size: 50},
+		},
+	} {
+		info := &snap.DownloadInfo{Size: 1000, Deltas: deltas}
+		full, delta, ok := theStore.EstimateDownloadSize("foo", info)
+		c.Check(full, Equals, int64(1000))
+		c.Check(delta, Equals, int64(0))
+		c.Check(ok, Equals, false)
+	}
+
+	// deltas disabled
+	info := &snap.DownloadInfo{
+		Size: 1000,
+		Deltas: []snap.DeltaInfo{
+			{FromRevision: 24, ToRevision: 26, Format: "xdelta3", Size: 100},
+		},
+	}
+	theStore = store.New(&store.Config{DisableDeltas: true}, nil)
+	full, delta, ok := theStore.EstimateDownloadSize("foo", info)
+	c.Check(full, Equals, int64(1000))
+	c.Check(delta, Equals, int64(0))
+	c.Check(ok, Equals, false)
+}
+
+func (s *downloadSuite) TestDownloadToStream(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n == 1 {
+			// failing before anything was written can be retried
+			w.WriteHeader(500)
+			return
+		}
+		c.Check(r.Header.Get("Range"), Equals, "")
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	h := crypto.SHA3_384.New()
+	io.WriteString(h, "response-data")
+	info := &snap.DownloadInfo{
+		AnonDownloadURL: mockServer.URL,
+		Sha3_384:        fmt.Sprintf("%x", h.Sum(nil)),
+	}
+
+	theStore := store.New(&store.Config{}, nil)
+	var buf bytes.Buffer
+	err := theStore.DownloadTo(context.TODO(), "foo", &buf, info, nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "response-data")
+	c.Check(n, Equals, 2)
+}
+
+func (s *downloadSuite) TestDownloadToStreamNoRetryAfterData(c *C) {
+	n := 0
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Content-Length", "13")
+		io.WriteString(w, "response")
+		w.(http.Flusher).Flush()
+		mockServer.CloseClientConnections()
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	info := &snap.DownloadInfo{
+		AnonDownloadURL: mockServer.URL,
+	}
+
+	theStore := store.New(&store.Config{}, nil)
+	var buf bytes.Buffer
+	err := theStore.DownloadTo(context.TODO(), "foo", &buf, info, nil, nil, nil)
+	c.Assert(err, ErrorMatches, "unexpected EOF")
+	c.Check(buf.String(), Equals, "response")
+	c.Check(n, Equals, 1)
+}
+
+func (s *downloadSuite) TestDownloadToStreamHashMismatch(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	info := &snap.DownloadInfo{
+		AnonDownloadURL: mockServer.URL,
+		Sha3_384:        "1234",
+	}
+
+	theStore := store.New(&store.Config{}, nil)
+	var buf bytes.Buffer
+	err := theStore.DownloadTo(context.TODO(), "foo", &buf, info, nil, nil, nil)
+	c.Assert(err, FitsTypeOf, store.HashError{})
+}
+
+func (s *downloadSuite) TestDownloadToSeekableResumes(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		c.Check(r.Header.Get("Range"), Equals, "bytes=8-")
+		w.WriteHeader(206)
+		io.WriteString(w, "-data")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	h := crypto.SHA3_384.New()
+	io.WriteString(h, "response-data")
+	info := &snap.DownloadInfo{
+		AnonDownloadURL: mockServer.URL,
+		Sha3_384:        fmt.Sprintf("%x", h.Sum(nil)),
+		Size:            13,
+	}
+
+	f, err := os.Create(filepath.Join(c.MkDir(), "target"))
+	c.Assert(err, IsNil)
+	defer f.Close()
+	_, err = f.WriteString("response")
+	c.Assert(err, IsNil)
+
+	theStore := store.New(&store.Config{}, nil)
+	err = theStore.DownloadTo(context.TODO(), "foo", f, info, nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(f.Name(), testutil.FileEquals, "response-data")
+	c.Check(n, Equals, 1)
+}
+
+func (s *downloadSuite) TestDownloadToSeekableHashMismatchRetried(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		switch n {
+		case 1:
+			c.Check(r.Header.Get("Range"), Equals, "bytes=8-")
+			w.WriteHeader(206)
+			io.WriteString(w, "-junk")
+		case 2:
+			c.Check(r.Header.Get("Range"), Equals, "")
+			io.WriteString(w, "response-data")
+		default:
+			c.Fatalf("unexpected request")
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	h := crypto.SHA3_384.New()
+	io.WriteString(h, "response-data")
+	info := &snap.DownloadInfo{
+		AnonDownloadURL: mockServer.URL,
+		Sha3_384:        fmt.Sprintf("%x", h.Sum(nil)),
+		Size:            13,
+	}
+
+	f, err := os.Create(filepath.Join(c.MkDir(), "target"))
+	c.Assert(err, IsNil)
+	defer f.Close()
+	_, err = f.WriteString("response")
+	c.Assert(err, IsNil)
+
+	theStore := store.New(&store.Config{}, nil)
+	err = theStore.DownloadTo(context.TODO(), "foo", f, info, nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(f.Name(), testutil.FileEquals, "response-data")
+	c.Check(n, Equals, 2)
 }
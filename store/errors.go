@@ -25,7 +25,9 @@ import (
 	"net/url"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/snapcore/snapd/snap"
 	"github.com/snapcore/snapd/snap/channel"
 	"github.com/snapcore/snapd/strutil"
 )
@@ -63,11 +65,26 @@ var (
 	// ErrPaymentDeclined is returned when the user's payment method was declined by the upstream payment provider.
 	ErrPaymentDeclined = errors.New("payment declined")
 
+	// ErrOrderNotFound is returned when cancelling an order that the user does not have.
+	ErrOrderNotFound = errors.New("order not found")
+
+	// ErrPermissionDenied is returned when the user is not allowed to manage the snap.
+	ErrPermissionDenied = errors.New("permission denied")
+
 	// ErrLocalSnap is returned when an operation that only applies to snaps that come from a store was attempted on a local snap.
 	ErrLocalSnap = errors.New("cannot perform operation on local snap")
 
 	// ErrNoUpdateAvailable is returned when an update is attempetd for a snap that has no update available.
 	ErrNoUpdateAvailable = errors.New("snap has no updates available")
+
+	// ErrNotModified is returned from SnapInfo when the snap details did not change since they were fetched with the given ETag.
+	ErrNotModified = errors.New("snap details not modified")
+
+	// ErrCatalogTruncated is returned from WriteCatalogs when the commands catalog stream ended before it was complete.
+	ErrCatalogTruncated = errors.New("commands catalog is truncated")
+
+	// ErrDownloadNotModified is returned from conditional downloads when the server says the snap did not change, i.e. the local copy is current.
+	ErrDownloadNotModified = errors.New("download not modified")
 )
 
 // RevisionNotAvailableError is returned when an install is attempted for a snap but the/a revision is not available (given install constraints).
@@ -81,16 +98,92 @@ func (e *RevisionNotAvailableError) Error() string {
 	return "no snap revision available as specified"
 }
 
+// RevisionBlockedError is returned when a refresh is attempted for a snap but the revision offered by the store is blocked.
+type RevisionBlockedError struct {
+	Revision snap.Revision
+}
+
+func (e *RevisionBlockedError) Error() string {
+	return fmt.Sprintf("snap has no updates available: revision %s is blocked", e.Revision)
+}
+
+// StoreServerError is returned when the store answered a request with
+// an unexpected HTTP status code.
+type StoreServerError struct {
+	// Msg describes what was attempted, e.g. "get details for snap"
+	Msg        string
+	StatusCode int
+	Method     string
+	URL        *url.URL
+	// OopsID is the X-Oops-Id the store tagged the response with,
+	// if any, for correlating with its logs
+	OopsID string
+}
+
+func (e *StoreServerError) Error() string {
+	msg := fmt.Sprintf("cannot %s: got unexpected HTTP status code %d via %s to %q", e.Msg, e.StatusCode, e.Method, e.URL)
+	if e.OopsID != "" {
+		msg += fmt.Sprintf(" [%s]", e.OopsID)
+	}
+	return msg
+}
+
+// PublisherMismatchError is returned by Download when the downloaded
+// snap is not published by the expected account.
+type PublisherMismatchError struct {
+	Name        string
+	PublisherID string
+	ExpectedID  string
+}
+
+func (e *PublisherMismatchError) Error() string {
+	return fmt.Sprintf("snap %q is published by %q instead of the expected %q", e.Name, e.PublisherID, e.ExpectedID)
+}
+
+// SnapInfosNotFoundError is returned by SnapInfos, along with the
+// details of the other snaps, when some snaps could not be found.
+type SnapInfosNotFoundError struct {
+	Names []string
+}
+
+func (e *SnapInfosNotFoundError) Error() string {
+	return fmt.Sprintf("cannot get details for snaps: not found: %s", strutil.Quoted(e.Names))
+}
+
 // DownloadError represents a download error
 type DownloadError struct {
 	Code int
 	URL  *url.URL
+	// RetryAfter is the delay asked for by the server via the
+	// Retry-After header of 429 and 503 responses, if any.
+	RetryAfter time.Duration
 }
 
 func (e *DownloadError) Error() string {
 	return fmt.Sprintf("received an unexpected http response code (%v) when trying to download %s", e.Code, e.URL)
 }
 
+// IsRetryable returns whether the download could succeed if tried
+// again later, i.e. the error is a transient one on the server side
+// (or throttling), as opposed to e.g. a missing or forbidden snap.
+func (e *DownloadError) IsRetryable() bool {
+	switch e.Code {
+	case 408, 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// IsClientError returns whether the error is a 4xx one.
+func (e *DownloadError) IsClientError() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// IsServerError returns whether the error is a 5xx one.
+func (e *DownloadError) IsServerError() bool {
+	return e.Code >= 500 && e.Code < 600
+}
+
 // PasswordPolicyError is returned in a few corner cases, most notably
 // when the password has been force-reset.
 type PasswordPolicyError map[string]stringList
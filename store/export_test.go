@@ -25,10 +25,13 @@ import (
 	"context"
 	"net/http"
 	"net/url"
+	"sort"
+	"time"
 
 	"github.com/juju/ratelimit"
 	"gopkg.in/retry.v1"
 
+	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/overlord/auth"
 	"github.com/snapcore/snapd/progress"
 	"github.com/snapcore/snapd/snap"
@@ -60,6 +63,14 @@ var (
 	SnapActionFields = snapActionFields
 )
 
+func MockTrusted(trusted []asserts.Assertion) (restore func()) {
+	old := trustedAssertions
+	trustedAssertions = func() []asserts.Assertion { return trusted }
+	return func() {
+		trustedAssertions = old
+	}
+}
+
 // MockDefaultRetryStrategy mocks the retry strategy used by several store requests
 func MockDefaultRetryStrategy(t *testutil.BaseTest, strategy retry.Strategy) {
 	originalDefaultRetryStrategy := defaultRetryStrategy
@@ -77,6 +88,22 @@ func MockDownloadRetryStrategy(t *testutil.BaseTest, strategy retry.Strategy) {
 	})
 }
 
+func MockMaxDownloadRetryAfter(t *testutil.BaseTest, max time.Duration) {
+	originalMaxDownloadRetryAfter := maxDownloadRetryAfter
+	maxDownloadRetryAfter = max
+	t.AddCleanup(func() {
+		maxDownloadRetryAfter = originalMaxDownloadRetryAfter
+	})
+}
+
+func MockMaxThrottleRetryAfter(t *testutil.BaseTest, max time.Duration) {
+	originalMaxThrottleRetryAfter := maxThrottleRetryAfter
+	maxThrottleRetryAfter = max
+	t.AddCleanup(func() {
+		maxThrottleRetryAfter = originalMaxThrottleRetryAfter
+	})
+}
+
 func MockConnCheckStrategy(t *testutil.BaseTest, strategy retry.Strategy) {
 	originalConnCheckStrategy := connCheckStrategy
 	connCheckStrategy = strategy
@@ -90,7 +117,7 @@ func (cm *CacheManager) CacheDir() string {
 }
 
 func (cm *CacheManager) Cleanup() error {
-	return cm.cleanup()
+	return cm.cleanup(context.Background())
 }
 
 func (cm *CacheManager) Count() int {
@@ -113,7 +140,7 @@ func MockDownload(f func(ctx context.Context, name, sha3_384, downloadURL string
 	}
 }
 
-func MockDoDownloadReq(f func(ctx context.Context, storeURL *url.URL, cdnHeader string, resume int64, s *Store, user *auth.UserState) (*http.Response, error)) (restore func()) {
+func MockDoDownloadReq(f func(ctx context.Context, storeURL *url.URL, cdnHeader string, resume int64, s *Store, user *auth.UserState, dlOpts *DownloadOptions) (*http.Response, error)) (restore func()) {
 	orig := doDownloadReq
 	doDownloadReq = f
 	return func() {
@@ -121,7 +148,7 @@ func MockDoDownloadReq(f func(ctx context.Context, storeURL *url.URL, cdnHeader
 	}
 }
 
-func MockApplyDelta(f func(name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error) (restore func()) {
+func MockApplyDelta(f func(ctx context.Context, xdelta3Path string, name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error) (restore func()) {
 	origApplyDelta := applyDelta
 	applyDelta = f
 	return func() {
@@ -137,12 +164,31 @@ func (sto *Store) MockCacher(obs downloadCache) (restore func()) {
 	}
 }
 
+func NewStallReader(body io.ReadCloser, timeout time.Duration) *stallReader {
+	return newStallReader(body, timeout)
+}
+
+func (r *stallReader) Expire(gen int) {
+	r.expire(gen)
+}
+
+func (sto *Store) CachedCohortKeys() []string {
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	names := make([]string, 0, len(sto.cohortKeys))
+	for name := range sto.cohortKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (sto *Store) SetDeltaFormat(dfmt string) {
 	sto.deltaFormat = dfmt
 }
 
 func (sto *Store) DownloadDelta(deltaName string, downloadInfo *snap.DownloadInfo, w io.ReadWriteSeeker, pbar progress.Meter, user *auth.UserState, dlOpts *DownloadOptions) error {
-	return sto.downloadDelta(deltaName, downloadInfo, w, pbar, user, dlOpts)
+	return sto.downloadDelta(context.TODO(), deltaName, downloadInfo, w, pbar, user, dlOpts)
 }
 
 func (sto *Store) DoRequest(ctx context.Context, client *http.Client, reqOptions *requestOptions, user *auth.UserState) (*http.Response, error) {
@@ -169,10 +215,18 @@ func (sto *Store) SessionUnlock() {
 	sto.sessionMu.Unlock()
 }
 
+func (sto *Store) FindV1(ctx context.Context, search *Search, user *auth.UserState) ([]*snap.Info, error) {
+	return sto.findV1(ctx, search, user)
+}
+
 func (sto *Store) FindFields() []string {
 	return sto.findFields
 }
 
+func (sto *Store) InfoFields() []string {
+	return sto.infoFields
+}
+
 func (cfg *Config) SetBaseURL(u *url.URL) error {
 	return cfg.setBaseURL(u)
 }
@@ -181,6 +235,10 @@ func NewHashError(name, sha3_384, targetSha3_384 string) HashError {
 	return HashError{name, sha3_384, targetSha3_384}
 }
 
+func NewSizeError(name string, size, targetSize int64) SizeError {
+	return SizeError{name, size, targetSize}
+}
+
 func NewRequestOptions(mth string, url *url.URL) *requestOptions {
 	return &requestOptions{
 		Method: mth,
@@ -188,6 +246,16 @@ func NewRequestOptions(mth string, url *url.URL) *requestOptions {
 	}
 }
 
+var LowPriorityRateLimit = lowPriorityRateLimit
+
+func MockMaxTranscriptBodySize(size int) (restore func()) {
+	old := maxTranscriptBodySize
+	maxTranscriptBodySize = size
+	return func() {
+		maxTranscriptBodySize = old
+	}
+}
+
 func MockRatelimitReader(f func(r io.Reader, bucket *ratelimit.Bucket) io.Reader) (restore func()) {
 	oldRatelimitReader := ratelimitReader
 	ratelimitReader = f
@@ -195,3 +263,27 @@ func MockRatelimitReader(f func(r io.Reader, bucket *ratelimit.Bucket) io.Reader
 		ratelimitReader = oldRatelimitReader
 	}
 }
+
+func MockMaxCommonIDsQueryLen(maxLen int) (restore func()) {
+	old := maxCommonIDsQueryLen
+	maxCommonIDsQueryLen = maxLen
+	return func() {
+		maxCommonIDsQueryLen = old
+	}
+}
+
+func MockMaxAssertionChainDepth(depth int) (restore func()) {
+	old := maxAssertionChainDepth
+	maxAssertionChainDepth = depth
+	return func() {
+		maxAssertionChainDepth = old
+	}
+}
+
+func MockMaxSnapInfosPerRequest(n int) (restore func()) {
+	old := maxSnapInfosPerRequest
+	maxSnapInfosPerRequest = n
+	return func() {
+		maxSnapInfosPerRequest = old
+	}
+}
@@ -0,0 +1,105 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+
+	"github.com/snapcore/snapd/logger"
+)
+
+type fieldsResults struct {
+	Fields []string `json:"fields"`
+}
+
+// DiscoverFields asks the store which snap fields it supports, and
+// from then on restricts the fields requested by info and find
+// requests to those. Stores that don't advertise their fields keep
+// being asked for the configured ones. The outcome is cached, i.e.
+// only the first successful call queries the store.
+func (s *Store) DiscoverFields(ctx context.Context) error {
+	s.mu.Lock()
+	discovered := s.fieldsDiscovered
+	s.mu.Unlock()
+	if discovered {
+		return nil
+	}
+
+	reqOptions := &requestOptions{
+		Method:   "GET",
+		URL:      s.endpointURL(fieldsEndpPath, nil),
+		Accept:   jsonContentType,
+		APILevel: apiV2Endps,
+	}
+
+	var fieldsData fieldsResults
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, nil, &fieldsData, nil)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch resp.StatusCode {
+	case 200:
+		if len(fieldsData.Fields) == 0 {
+			// an empty list is as good as no list
+			logger.Debugf("No supported fields listed by %q, using the configured ones.", resp.Request.URL)
+			s.fieldsDiscovered = true
+			return nil
+		}
+	case 404:
+		logger.Debugf("Supported fields are not available from %q, using the configured ones.", resp.Request.URL)
+		s.fieldsDiscovered = true
+		return nil
+	default:
+		return respToError(resp, "discover supported fields")
+	}
+
+	supported := make(map[string]bool, len(fieldsData.Fields))
+	for _, field := range fieldsData.Fields {
+		supported[field] = true
+	}
+	s.infoFields = supportedFields(s.infoFields, supported)
+	s.findFields = supportedFields(s.findFields, supported)
+	s.fieldsDiscovered = true
+
+	return nil
+}
+
+// supportedFields returns the fields that are supported, in order.
+func supportedFields(fields []string, supported map[string]bool) []string {
+	res := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if supported[field] {
+			res = append(res, field)
+		}
+	}
+	return res
+}
+
+// v2Fields returns the snap fields to request in info and find
+// requests respectively.
+func (s *Store) v2Fields() (infoFields, findFields []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.infoFields, s.findFields
+}
@@ -0,0 +1,158 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/store"
+)
+
+const fieldsPath = "/v2/snaps/fields"
+
+func (s *storeTestSuite) TestDiscoverFields(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fieldsPath:
+			assertRequest(c, r, "GET", fieldsPath)
+			n++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			io.WriteString(w, `{"fields": ["summary", "name", "some-new-field", "revision", "snap-id"]}`)
+		case "/v2/snaps/info/hello-world":
+			c.Check(r.URL.Query().Get("fields"), Equals, "name,revision,snap-id,summary")
+			w.WriteHeader(200)
+			io.WriteString(w, mockInfoJSON)
+		default:
+			c.Errorf("unexpected request: %s", r.URL.String())
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+		InfoFields:   []string{"name", "revision", "snap-id", "summary", "media"},
+		FindFields:   []string{"name", "summary", "snap-yaml"},
+	}
+	sto := store.New(&cfg, nil)
+
+	err := sto.DiscoverFields(s.ctx)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+	c.Check(sto.InfoFields(), DeepEquals, []string{"name", "revision", "snap-id", "summary"})
+	c.Check(sto.FindFields(), DeepEquals, []string{"name", "summary"})
+
+	// the discovered fields are used
+	_, err = sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+
+	// and cached
+	err = sto.DiscoverFields(s.ctx)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+}
+
+func (s *storeTestSuite) TestDiscoverFieldsFallback(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", fieldsPath)
+		n++
+		w.WriteHeader(404)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	err := sto.DiscoverFields(s.ctx)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+	c.Check(sto.InfoFields(), DeepEquals, store.DefaultConfig().InfoFields)
+	c.Check(sto.FindFields(), DeepEquals, store.DefaultConfig().FindFields)
+
+	// the store is not asked again
+	err = sto.DiscoverFields(s.ctx)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+}
+
+func (s *storeTestSuite) TestDiscoverFieldsEmpty(c *C) {
+	for _, body := range []string{`{"fields": []}`, `{}`} {
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertRequest(c, r, "GET", fieldsPath)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			io.WriteString(w, body)
+		}))
+		c.Assert(mockServer, NotNil)
+
+		mockServerURL, _ := url.Parse(mockServer.URL)
+		cfg := store.Config{
+			StoreBaseURL: mockServerURL,
+		}
+		sto := store.New(&cfg, nil)
+
+		// no fields listed is handled like no fields advertised
+		err := sto.DiscoverFields(s.ctx)
+		c.Assert(err, IsNil, Commentf(body))
+		c.Check(sto.InfoFields(), DeepEquals, store.DefaultConfig().InfoFields, Commentf(body))
+		c.Check(sto.FindFields(), DeepEquals, store.DefaultConfig().FindFields, Commentf(body))
+
+		mockServer.Close()
+	}
+}
+
+func (s *storeTestSuite) TestDiscoverFieldsError(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", fieldsPath)
+		n++
+		w.WriteHeader(403)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	err := sto.DiscoverFields(s.ctx)
+	c.Assert(err, ErrorMatches, `cannot discover supported fields: got unexpected HTTP status code 403 via GET to "http://.*/v2/snaps/fields"`)
+	c.Check(sto.InfoFields(), DeepEquals, store.DefaultConfig().InfoFields)
+
+	// failures are not cached
+	err = sto.DiscoverFields(s.ctx)
+	c.Assert(err, NotNil)
+	c.Check(n, Equals, 2)
+}
@@ -0,0 +1,230 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/snapcore/snapd/httputil"
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/auth"
+	"github.com/snapcore/snapd/snap"
+)
+
+// errFindStreamStopped is used internally to stop reading the search
+// results once the FindStream callback returned an error.
+var errFindStreamStopped = errors.New("search stopped")
+
+// FindStream works like Find but instead of returning all the snaps
+// found at once it decodes the search results as they arrive, calling
+// f with each snap in turn. If f returns an error the search is
+// stopped and that error is returned.
+//
+// Deduplicating the results by snap ID is not supported.
+func (s *Store) FindStream(ctx context.Context, search *Search, user *auth.UserState, f func(*snap.Info) error) error {
+	if search.DedupeBySnapID {
+		return fmt.Errorf("cannot stream search results deduplicated by snap ID")
+	}
+	reqOptions, err := s.findRequestOptions(search, user)
+	if err != nil {
+		return err
+	}
+	u := reqOptions.URL
+
+	ctx, cancel := s.withDefaultDeadline(ctx)
+	defer cancel()
+
+	orders := &lazyOrders{s: s, user: user}
+	// how many results were passed to f already, a retried request
+	// skips them
+	delivered := 0
+	var stopErr error
+	var errorList []storeError
+
+	doRequest := func() (*http.Response, error) {
+		return s.doRequest(ctx, s.client, reqOptions, user)
+	}
+	readResponse := func(resp *http.Response) error {
+		ct := resp.Header.Get("Content-Type")
+		if resp.StatusCode != 200 {
+			// decode failures only if body is not empty
+			if resp.ContentLength == 0 || ct != jsonContentType {
+				return nil
+			}
+			var searchData searchV2Results
+			if err := json.NewDecoder(resp.Body).Decode(&searchData); err != nil {
+				return err
+			}
+			errorList = searchData.ErrorList
+			return nil
+		}
+		if ct != jsonContentType {
+			return fmt.Errorf("received an unexpected content type (%q) when trying to search via %q", ct, resp.Request.URL)
+		}
+
+		n := 0
+		return decodeSearchResults(resp.Body, func(res *storeSearchResult) error {
+			n++
+			if n <= delivered {
+				return nil
+			}
+			info, err := infoFromStoreSearchResult(res)
+			if err != nil {
+				return err
+			}
+			if err := orders.decorate(info); err != nil {
+				logger.Noticef("cannot get user orders: %v", err)
+			}
+			delivered++
+			if err := f(info); err != nil {
+				stopErr = err
+				return errFindStreamStopped
+			}
+			return nil
+		})
+	}
+	resp, err := httputil.RetryRequestReportExhausted(u.String(), doRequest, readResponse, defaultRetryStrategy)
+	if stopErr != nil {
+		return stopErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		// fallback to search v1; v2 may not be available on some proxies
+		if useFindV1(resp) {
+			snaps, err := s.findV1(ctx, search, user)
+			if err != nil {
+				return err
+			}
+			for _, info := range snaps {
+				if err := f(info); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return findError(resp, errorList)
+	}
+
+	s.extractSuggestedCurrency(resp)
+
+	return nil
+}
+
+// decodeSearchResults decodes the search v2 results read from r one by
+// one, calling f with each of them. Other members of the response are
+// skipped.
+func decodeSearchResults(r io.Reader, f func(*storeSearchResult) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectJSONDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if key, _ := tok.(string); key != "results" {
+			var skipped json.RawMessage
+			if err := dec.Decode(&skipped); err != nil {
+				return err
+			}
+			continue
+		}
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok == nil {
+			// "results": null
+			continue
+		}
+		if tok != json.Delim('[') {
+			return fmt.Errorf("cannot decode search results: unexpected %v", tok)
+		}
+		for dec.More() {
+			var res storeSearchResult
+			if err := dec.Decode(&res); err != nil {
+				return err
+			}
+			if err := f(&res); err != nil {
+				return err
+			}
+		}
+		if err := expectJSONDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectJSONDelim(dec, '}')
+}
+
+func expectJSONDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("cannot decode search results: expected %v but got %v", delim, tok)
+	}
+	return nil
+}
+
+// lazyOrders decorates snaps one at a time like decorateOrders does,
+// fetching the orders of the user only once and only if a snap needs
+// them.
+type lazyOrders struct {
+	s    *Store
+	user *auth.UserState
+
+	fetched bool
+	bought  map[string]bool
+}
+
+// decorate sets MustBuy for info, returning the error if fetching the
+// orders fails, once.
+func (o *lazyOrders) decorate(info *snap.Info) error {
+	if o.s.cfg.SkipOrderDecoration || !info.Paid {
+		return nil
+	}
+	// must buy until we know better
+	info.MustBuy = true
+	if o.user == nil {
+		return nil
+	}
+	if !o.fetched {
+		o.fetched = true
+		bought, err := o.s.boughtSnaps(o.user)
+		if err != nil {
+			return err
+		}
+		o.bought = bought
+	}
+	if o.bought != nil {
+		info.MustBuy = mustBuy(info.Paid, o.bought[info.SnapID])
+	}
+	return nil
+}
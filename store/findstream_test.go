@@ -0,0 +1,157 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/store"
+)
+
+const mockSearchStreamJSON = `{"results": [
+  {"name": "one", "snap-id": "one-id", "revision": {"revision": 1, "channel": "stable"}, "snap": {}},
+  {"name": "two", "snap-id": "two-id", "revision": {"revision": 2, "channel": "stable"}, "snap": {}},
+  {"name": "three", "snap-id": "three-id", "revision": {"revision": 3, "channel": "stable"}, "snap": {}}
+]}`
+
+func (s *storeTestSuite) TestFindStream(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		c.Check(r.URL.Query().Get("q"), Equals, "hello")
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, mockSearchStreamJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	var names []string
+	err := sto.FindStream(s.ctx, &store.Search{Query: "hello"}, nil, func(info *snap.Info) error {
+		names = append(names, info.InstanceName())
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"one", "two", "three"})
+
+	// the same as Find
+	snaps, err := sto.Find(s.ctx, &store.Search{Query: "hello"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(snaps, HasLen, 3)
+	for i, info := range snaps {
+		c.Check(info.InstanceName(), Equals, names[i])
+	}
+}
+
+func (s *storeTestSuite) TestFindStreamStop(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, mockSearchStreamJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	enough := errors.New("enough")
+	var names []string
+	err := sto.FindStream(s.ctx, &store.Search{Query: "hello"}, nil, func(info *snap.Info) error {
+		names = append(names, info.InstanceName())
+		if len(names) == 2 {
+			return enough
+		}
+		return nil
+	})
+	c.Check(err, Equals, enough)
+	c.Check(names, DeepEquals, []string{"one", "two"})
+}
+
+func (s *storeTestSuite) TestFindStreamRetriedSkipsDelivered(c *C) {
+	n := 0
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		n++
+		w.Header().Set("Content-Type", "application/json")
+		if n == 1 {
+			// the connection breaks after the first result
+			io.WriteString(w, mockSearchStreamJSON[:len(`{"results": [`)+110])
+			w.(http.Flusher).Flush()
+			mockServer.CloseClientConnections()
+			return
+		}
+		io.WriteString(w, mockSearchStreamJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	var names []string
+	err := sto.FindStream(s.ctx, &store.Search{Query: "hello"}, nil, func(info *snap.Info) error {
+		names = append(names, info.InstanceName())
+		return nil
+	})
+	c.Assert(err, IsNil)
+	// each only once
+	c.Check(names, DeepEquals, []string{"one", "two", "three"})
+	c.Check(n, Equals, 2)
+}
+
+func (s *storeTestSuite) TestFindStreamErrors(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		io.WriteString(w, `{"error-list": [{"code": "api-error", "message": "bad things"}]}`)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	called := false
+	f := func(*snap.Info) error {
+		called = true
+		return nil
+	}
+	err := sto.FindStream(s.ctx, &store.Search{Query: "hello"}, nil, f)
+	c.Check(err, ErrorMatches, "bad things")
+
+	err = sto.FindStream(s.ctx, &store.Search{Query: "hello", DedupeBySnapID: true}, nil, f)
+	c.Check(err, ErrorMatches, "cannot stream search results deduplicated by snap ID")
+
+	err = sto.FindStream(s.ctx, &store.Search{Query: "hello", Private: true}, nil, f)
+	c.Check(err, Equals, store.ErrUnauthenticated)
+
+	c.Check(called, Equals, false)
+}
@@ -0,0 +1,87 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/auth"
+	"github.com/snapcore/snapd/snap"
+)
+
+// RelatedSnaps returns the snaps the store considers related to the
+// given one (e.g. often installed together with it). If the store does
+// not support the query an empty list is returned.
+func (s *Store) RelatedSnaps(ctx context.Context, snapName string, user *auth.UserState) ([]*snap.Info, error) {
+	if snapName == "" {
+		return nil, fmt.Errorf("internal error: cannot query related snaps without a snap name")
+	}
+
+	_, findFields := s.v2Fields()
+	q := url.Values{}
+	q.Set("fields", strings.Join(findFields, ","))
+	q.Set("architecture", s.architecture)
+
+	reqOptions := &requestOptions{
+		Method:   "GET",
+		URL:      s.endpointURL(path.Join(relatedEndpPath, snapName), q),
+		Accept:   jsonContentType,
+		APILevel: apiV2Endps,
+	}
+	s.setLocale(reqOptions)
+
+	var relatedData searchV2Results
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &relatedData, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		// OK
+	case 404:
+		// not supported by this store
+		logger.Debugf("Related snaps are not available from %q.", resp.Request.URL)
+		return []*snap.Info{}, nil
+	default:
+		return nil, respToError(resp, fmt.Sprintf("get snaps related to %q", snapName))
+	}
+
+	snaps := make([]*snap.Info, len(relatedData.Results))
+	for i, res := range relatedData.Results {
+		info, err := infoFromStoreSearchResult(res)
+		if err != nil {
+			return nil, err
+		}
+		snaps[i] = info
+	}
+
+	err = s.decorateOrders(snaps, user)
+	if err != nil {
+		logger.Noticef("cannot get user orders: %v", err)
+	}
+
+	return snaps, nil
+}
@@ -0,0 +1,105 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/store"
+)
+
+const relatedPathPattern = "/v2/snaps/related/.*"
+
+func (s *storeTestSuite) TestRelatedSnaps(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", relatedPathPattern)
+		c.Check(r.URL.Path, Matches, ".*/related/some-snap")
+		c.Check(r.URL.Query().Get("fields"), Equals, "abc,def")
+		n++
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		io.WriteString(w, MockSearchJSONv2)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+		FindFields:   []string{"abc", "def"},
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	snaps, err := sto.RelatedSnaps(s.ctx, "some-snap", nil)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+	c.Assert(snaps, HasLen, 1)
+	c.Check(snaps[0].InstanceName(), Equals, "hello-world")
+	c.Check(snaps[0].SnapID, Equals, helloWorldSnapID)
+	c.Check(snaps[0].Revision, Equals, snap.R(27))
+	c.Check(snaps[0].Prices, DeepEquals, map[string]float64{"EUR": 2.99, "USD": 3.49})
+}
+
+func (s *storeTestSuite) TestRelatedSnapsNotAvailable(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", relatedPathPattern)
+		w.WriteHeader(404)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	snaps, err := sto.RelatedSnaps(s.ctx, "some-snap", nil)
+	c.Assert(err, IsNil)
+	c.Check(snaps, NotNil)
+	c.Check(snaps, HasLen, 0)
+}
+
+func (s *storeTestSuite) TestRelatedSnapsError(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", relatedPathPattern)
+		w.WriteHeader(418)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, err := sto.RelatedSnaps(s.ctx, "some-snap", nil)
+	c.Check(err, ErrorMatches, `cannot get snaps related to "some-snap": got unexpected HTTP status code 418 via GET to "http://.*/v2/snaps/related/some-snap.*"`)
+}
@@ -0,0 +1,204 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/auth"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/strutil"
+)
+
+// InstallResolution holds the minimal information about a snap that
+// is needed before deciding to proceed with installing it.
+type InstallResolution struct {
+	SnapID       string
+	Base         string
+	Confinement  snap.ConfinementType
+	DownloadSize int64
+}
+
+// the only fields requested from the store when resolving for install
+var installResolutionFields = []string{"snap-id", "base", "confinement", "download"}
+
+// ResolveForInstall queries the store for the snap-id, base,
+// confinement and download size of the snap with the given name as it
+// would be installed from the given channel. It uses a single install
+// action request asking only for the needed fields.
+func (s *Store) ResolveForInstall(ctx context.Context, name, channel string, user *auth.UserState) (*InstallResolution, error) {
+	if name == "" {
+		return nil, fmt.Errorf("internal error: cannot resolve snap without a name")
+	}
+
+	jsonData, err := json.Marshal(snapActionRequest{
+		Context: []*currentSnapV2JSON{},
+		Actions: []*snapActionJSON{{
+			Action:      "install",
+			InstanceKey: "install-1",
+			Name:        name,
+			Channel:     channel,
+			// see comment in snapActionJSON
+			Epoch: (*snap.Epoch)(nil),
+		}},
+		Fields: installResolutionFields,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reqOptions := &requestOptions{
+		Method:      "POST",
+		URL:         s.endpointURL(snapActionEndpPath, nil),
+		Accept:      jsonContentType,
+		ContentType: jsonContentType,
+		Data:        jsonData,
+		APILevel:    apiV2Endps,
+	}
+
+	var results snapActionResultList
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &results, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, respToError(resp, fmt.Sprintf("resolve snap %q for install", name))
+	}
+
+	if len(results.ErrorList) > 0 {
+		if len(results.ErrorList) > 1 {
+			logger.Noticef("unexpected number of errors (%d) when trying to resolve %q for install", len(results.ErrorList), name)
+		}
+		return nil, translateSnapActionError("", "", results.ErrorList[0].Code, results.ErrorList[0].Message, nil)
+	}
+
+	if len(results.Results) != 1 {
+		return nil, fmt.Errorf("unexpected number of results (%d) when trying to resolve %q for install", len(results.Results), name)
+	}
+
+	res := results.Results[0]
+	if res.Result == "error" {
+		return nil, translateSnapActionError("install", channel, res.Error.Code, res.Error.Message, res.Error.Extra.Releases)
+	}
+
+	return &InstallResolution{
+		SnapID:       res.Snap.SnapID,
+		Base:         res.Snap.Base,
+		Confinement:  snap.ConfinementType(res.Snap.Confinement),
+		DownloadSize: res.Snap.Download.Size,
+	}, nil
+}
+
+// ChannelRevision returns the revision of the snap with the given name
+// that is current on the given channel, together with its download
+// info. If the snap exists but nothing is available on the channel a
+// *RevisionNotAvailableError is returned, listing the available
+// releases if known, while ErrSnapNotFound is returned if there is no
+// such snap.
+func (s *Store) ChannelRevision(ctx context.Context, snapName, channel string, user *auth.UserState) (snap.Revision, *snap.DownloadInfo, error) {
+	actions := []*SnapAction{{
+		Action:       "download",
+		InstanceName: snapName,
+		Channel:      channel,
+	}}
+	sars, err := s.SnapAction(ctx, nil, actions, user, nil)
+	if saErr, ok := err.(*SnapActionError); ok {
+		if _, _, singleErr := saErr.SingleOpError(); singleErr != nil {
+			err = singleErr
+		}
+	}
+	if err != nil {
+		return snap.Revision{}, nil, err
+	}
+	if len(sars) != 1 {
+		return snap.Revision{}, nil, fmt.Errorf("unexpected number of results (%d) when trying to resolve channel %q of %q", len(sars), channel, snapName)
+	}
+
+	info := sars[0].Info
+	downloadInfo := info.DownloadInfo
+	return info.Revision, &downloadInfo, nil
+}
+
+// coreBaseRegexp matches the names of the core snaps, core itself and
+// the versioned core18, core20 etc.
+var coreBaseRegexp = regexp.MustCompile(`^core[0-9]*$`)
+
+// ResolveBase returns the store info of the base of the snap with the
+// given info, which is "core" for snaps not declaring one. It returns
+// nil if the snap has no base (base "none", or a snap type that does
+// not use one) or if the base is a core snap among the given installed
+// snap names.
+func (s *Store) ResolveBase(ctx context.Context, info *snap.Info, installed []string, user *auth.UserState) (*snap.Info, error) {
+	switch info.GetType() {
+	case snap.TypeOS, snap.TypeBase, snap.TypeSnapd, snap.TypeKernel:
+		return nil, nil
+	}
+
+	base := info.Base
+	switch base {
+	case "none":
+		return nil, nil
+	case "":
+		base = "core"
+	}
+	if coreBaseRegexp.MatchString(base) && strutil.ListContains(installed, base) {
+		logger.Debugf("Base %q of %q is installed already.", base, info.InstanceName())
+		return nil, nil
+	}
+
+	return s.SnapInfo(ctx, SnapSpec{Name: base}, user)
+}
+
+// SnapInfoByID returns the snap.Info for the store-hosted snap with the
+// given snap ID. The store details are keyed by name, so the name is
+// first looked up in the snap-declaration of the snap.
+func (s *Store) SnapInfoByID(ctx context.Context, snapID string, user *auth.UserState) (*snap.Info, error) {
+	if snapID == "" {
+		return nil, fmt.Errorf("internal error: cannot get snap info without a snap ID")
+	}
+
+	a, err := s.assertion(ctx, asserts.SnapDeclarationType, []string{s.series, snapID}, user, nil)
+	if asserts.IsNotFound(err) {
+		return nil, ErrSnapNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	name := a.(*asserts.SnapDeclaration).SnapName()
+	if name == "" {
+		// the snap was revoked
+		return nil, ErrSnapNotFound
+	}
+
+	info, err := s.SnapInfo(ctx, SnapSpec{Name: name}, user)
+	if err != nil {
+		return nil, err
+	}
+	if info.SnapID != snapID {
+		return nil, fmt.Errorf("cannot get details for snap with ID %q: got snap %q with ID %q instead", snapID, name, info.SnapID)
+	}
+	return info, nil
+}
@@ -0,0 +1,400 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/channel"
+	"github.com/snapcore/snapd/snap/snaptest"
+	"github.com/snapcore/snapd/store"
+)
+
+func (s *storeTestSuite) TestResolveForInstall(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		// check device authorization is set, implicitly checking doRequest was used
+		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+
+		jsonReq, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		var req struct {
+			Context []map[string]interface{} `json:"context"`
+			Actions []map[string]interface{} `json:"actions"`
+			Fields  []string                 `json:"fields"`
+		}
+		err = json.Unmarshal(jsonReq, &req)
+		c.Assert(err, IsNil)
+
+		c.Check(req.Context, HasLen, 0)
+		c.Assert(req.Actions, HasLen, 1)
+		c.Check(req.Actions[0], DeepEquals, map[string]interface{}{
+			"action":       "install",
+			"instance-key": "install-1",
+			"name":         "hello-world",
+			"channel":      "beta",
+			"epoch":        nil,
+		})
+		c.Check(req.Fields, DeepEquals, []string{"snap-id", "base", "confinement", "download"})
+
+		io.WriteString(w, `{
+  "results": [{
+     "result": "install",
+     "instance-key": "install-1",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "base": "core18",
+       "confinement": "strict",
+       "download": {"size": 20480}
+     }
+  }]
+}`)
+		n++
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	res, err := sto.ResolveForInstall(s.ctx, "hello-world", "beta", nil)
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, &store.InstallResolution{
+		SnapID:       helloWorldSnapID,
+		Base:         "core18",
+		Confinement:  snap.StrictConfinement,
+		DownloadSize: 20480,
+	})
+	c.Check(n, Equals, 1)
+}
+
+func (s *storeTestSuite) TestResolveForInstallNotFound(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		io.WriteString(w, `{
+  "results": [{
+     "result": "error",
+     "instance-key": "install-1",
+     "name": "foo",
+     "error": {
+       "code": "name-not-found",
+       "message": "Name not found"
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	res, err := sto.ResolveForInstall(s.ctx, "foo", "stable", nil)
+	c.Check(err, Equals, store.ErrSnapNotFound)
+	c.Check(res, IsNil)
+}
+
+func (s *storeTestSuite) TestChannelRevision(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+
+		jsonReq, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		var req struct {
+			Context []map[string]interface{} `json:"context"`
+			Actions []map[string]interface{} `json:"actions"`
+		}
+		err = json.Unmarshal(jsonReq, &req)
+		c.Assert(err, IsNil)
+
+		c.Check(req.Context, HasLen, 0)
+		c.Assert(req.Actions, HasLen, 1)
+		c.Check(req.Actions[0]["action"], Equals, "download")
+		c.Check(req.Actions[0]["name"], Equals, "hello-world")
+		c.Check(req.Actions[0]["channel"], Equals, "beta")
+
+		io.WriteString(w, `{
+  "results": [{
+     "result": "download",
+     "instance-key": "download-1",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       },
+       "download": {
+          "url": "https://api.snapcraft.io/api/v1/snaps/download/buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ_26.snap",
+          "size": 20480,
+          "sha3-384": "the-sha3-384"
+       }
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	rev, downloadInfo, err := sto.ChannelRevision(s.ctx, "hello-world", "beta", nil)
+	c.Assert(err, IsNil)
+	c.Check(rev, Equals, snap.R(26))
+	c.Check(downloadInfo, DeepEquals, &snap.DownloadInfo{
+		DownloadURL: "https://api.snapcraft.io/api/v1/snaps/download/buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ_26.snap",
+		Size:        20480,
+		Sha3_384:    "the-sha3-384",
+	})
+}
+
+func (s *storeTestSuite) TestChannelRevisionUnknownChannel(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		io.WriteString(w, `{
+  "results": [{
+     "result": "error",
+     "instance-key": "download-1",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "error": {
+       "code": "revision-not-found",
+       "message": "No revision available",
+       "extra": {
+         "releases": [{"architecture": "amd64", "channel": "stable"}]
+       }
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, downloadInfo, err := sto.ChannelRevision(s.ctx, "hello-world", "no-such-track/stable", nil)
+	c.Check(downloadInfo, IsNil)
+	c.Assert(err, FitsTypeOf, &store.RevisionNotAvailableError{})
+	rnaErr := err.(*store.RevisionNotAvailableError)
+	c.Check(rnaErr.Action, Equals, "download")
+	c.Check(rnaErr.Channel, Equals, "no-such-track/stable")
+	c.Check(rnaErr.Releases, DeepEquals, []channel.Channel{
+		snaptest.MustParseChannel("stable", "amd64"),
+	})
+}
+
+func (s *storeTestSuite) TestChannelRevisionUnknownSnap(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		io.WriteString(w, `{
+  "results": [{
+     "result": "error",
+     "instance-key": "download-1",
+     "name": "foo",
+     "error": {
+       "code": "name-not-found",
+       "message": "Name not found"
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, downloadInfo, err := sto.ChannelRevision(s.ctx, "foo", "stable", nil)
+	c.Check(err, Equals, store.ErrSnapNotFound)
+	c.Check(downloadInfo, IsNil)
+}
+
+func (s *storeTestSuite) TestResolveBase(c *C) {
+	var paths []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(200)
+		io.WriteString(w, strings.Replace(mockInfoJSON, `"name": "hello-world"`, `"name": "custom-base"`, -1))
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	info := &snap.Info{
+		SideInfo: snap.SideInfo{RealName: "foo"},
+		Base:     "custom-base",
+		SnapType: snap.TypeApp,
+	}
+	baseInfo, err := sto.ResolveBase(s.ctx, info, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(baseInfo, NotNil)
+	c.Check(baseInfo.InstanceName(), Equals, "custom-base")
+	c.Check(paths, DeepEquals, []string{infoPath("custom-base")})
+
+	// installed bases other than the core ones are resolved still
+	_, err = sto.ResolveBase(s.ctx, info, []string{"custom-base"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(paths, DeepEquals, []string{infoPath("custom-base"), infoPath("custom-base")})
+
+	// snaps without a base are based on core
+	info.Base = ""
+	_, err = sto.ResolveBase(s.ctx, info, []string{"core18"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(paths, DeepEquals, []string{infoPath("custom-base"), infoPath("custom-base"), infoPath("core")})
+}
+
+func (s *storeTestSuite) TestResolveBaseNotNeeded(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Errorf("unexpected request: %s", r.URL.String())
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	installed := []string{"core", "core20", "foo"}
+	for _, info := range []*snap.Info{
+		{SideInfo: snap.SideInfo{RealName: "foo"}, Base: "none", SnapType: snap.TypeApp},
+		{SideInfo: snap.SideInfo{RealName: "foo"}, Base: "core", SnapType: snap.TypeApp},
+		{SideInfo: snap.SideInfo{RealName: "foo"}, Base: "core20", SnapType: snap.TypeApp},
+		{SideInfo: snap.SideInfo{RealName: "foo"}, SnapType: snap.TypeApp},
+		{SideInfo: snap.SideInfo{RealName: "core18"}, SnapType: snap.TypeBase},
+		{SideInfo: snap.SideInfo{RealName: "pc-kernel"}, SnapType: snap.TypeKernel},
+	} {
+		baseInfo, err := sto.ResolveBase(s.ctx, info, installed, nil)
+		c.Assert(err, IsNil)
+		c.Check(baseInfo, IsNil)
+	}
+}
+
+func (s *storeTestSuite) TestSnapInfoByID(c *C) {
+	storeStack := assertstest.NewStoreStack("canonical", nil)
+	snapDecl, err := storeStack.Sign(asserts.SnapDeclarationType, map[string]interface{}{
+		"series":       "16",
+		"snap-id":      helloWorldSnapID,
+		"snap-name":    "hello-world",
+		"publisher-id": "canonical",
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+	}, nil, "")
+	c.Assert(err, IsNil)
+
+	var paths []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/api/v1/snaps/assertions/"):
+			c.Check(r.URL.Path, Equals, "/api/v1/snaps/assertions/snap-declaration/16/"+helloWorldSnapID)
+			w.Header().Set("Content-Type", asserts.MediaType)
+			w.Write(asserts.Encode(snapDecl))
+		default:
+			assertRequest(c, r, "GET", infoPathPattern)
+			c.Check(r.URL.Path, Equals, infoPath("hello-world"))
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, mockInfoJSON)
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, dauthCtx)
+
+	info, err := sto.SnapInfoByID(s.ctx, helloWorldSnapID, nil)
+	c.Assert(err, IsNil)
+	c.Check(info.InstanceName(), Equals, "hello-world")
+	c.Check(info.SnapID, Equals, helloWorldSnapID)
+	c.Check(paths, HasLen, 2)
+}
+
+func (s *storeTestSuite) TestSnapInfoByIDUnknown(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		c.Check(r.URL.Path, Equals, "/api/v1/snaps/assertions/snap-declaration/16/unknown-id")
+		n++
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(404)
+		io.WriteString(w, `{"status": 404,"title": "not found"}`)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, dauthCtx)
+
+	_, err := sto.SnapInfoByID(s.ctx, "unknown-id", nil)
+	c.Check(err, Equals, store.ErrSnapNotFound)
+	// the details were not asked for
+	c.Check(n, Equals, 1)
+
+	_, err = sto.SnapInfoByID(s.ctx, "", nil)
+	c.Check(err, ErrorMatches, "internal error: cannot get snap info without a snap ID")
+	c.Check(n, Equals, 1)
+}
@@ -35,6 +35,8 @@ type storeSearchResult struct {
 	Snap     storeSnap              `json:"snap"`
 	Name     string                 `json:"name"`
 	SnapID   string                 `json:"snap-id"`
+	// Score is the relevance of the result, if the store ranks them
+	Score *float64 `json:"score"`
 }
 
 func infoFromStoreSearchResult(si *storeSearchResult) (*snap.Info, error) {
@@ -0,0 +1,150 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/auth"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/strutil"
+)
+
+// maxSnapInfosPerRequest is how many snaps are asked about at most in
+// a single bulk info request.
+var maxSnapInfosPerRequest = 100
+
+type snapInfosRequest struct {
+	Names []string `json:"names"`
+}
+
+type snapInfosResults struct {
+	Results []*storeInfo `json:"results"`
+}
+
+// SnapInfos returns the snap.Info of the store-hosted snaps matching
+// the given specs, by snap name, using as few bulk requests as
+// possible. Only the names of the specs are used. If some of the snaps
+// are not found the infos of the others are returned together with a
+// *SnapInfosNotFoundError listing them.
+func (s *Store) SnapInfos(ctx context.Context, specs []SnapSpec, user *auth.UserState) (map[string]*snap.Info, error) {
+	names := make([]string, 0, len(specs))
+	seen := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("internal error: cannot get snap details without a snap name")
+		}
+		if seen[spec.Name] {
+			continue
+		}
+		seen[spec.Name] = true
+		names = append(names, spec.Name)
+	}
+
+	infos := make(map[string]*snap.Info, len(names))
+	for len(names) > 0 {
+		chunk := names
+		if len(chunk) > maxSnapInfosPerRequest {
+			chunk = chunk[:maxSnapInfosPerRequest]
+		}
+		names = names[len(chunk):]
+
+		if err := s.snapInfos(ctx, chunk, user, infos); err != nil {
+			return nil, err
+		}
+	}
+
+	var notFound []string
+	for _, spec := range specs {
+		if infos[spec.Name] == nil && !strutil.ListContains(notFound, spec.Name) {
+			notFound = append(notFound, spec.Name)
+		}
+	}
+	if len(notFound) > 0 {
+		return infos, &SnapInfosNotFoundError{Names: notFound}
+	}
+	return infos, nil
+}
+
+// snapInfos gets the details of the given snaps with a single bulk
+// request, adding them to infos.
+func (s *Store) snapInfos(ctx context.Context, names []string, user *auth.UserState, infos map[string]*snap.Info) error {
+	jsonData, err := json.Marshal(snapInfosRequest{Names: names})
+	if err != nil {
+		return err
+	}
+
+	fields, _ := s.v2Fields()
+	query := url.Values{}
+	query.Set("fields", strings.Join(fields, ","))
+	query.Set("architecture", s.architecture)
+
+	reqOptions := &requestOptions{
+		Method:      "POST",
+		URL:         s.endpointURL(snapInfoEndpPath, query),
+		Accept:      jsonContentType,
+		ContentType: jsonContentType,
+		APILevel:    apiV2Endps,
+		Data:        jsonData,
+	}
+	s.setLocale(reqOptions)
+
+	var remote snapInfosResults
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &remote, nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return respToError(resp, fmt.Sprintf("get details for snaps %s", strutil.Quoted(names)))
+	}
+
+	found := make([]*snap.Info, 0, len(remote.Results))
+	for _, res := range remote.Results {
+		info, err := infoFromStoreInfo(res)
+		if err == ErrSnapNotFound {
+			// no released revisions, as with SnapInfo
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		name := info.SnapName()
+		if !strutil.ListContains(names, name) {
+			return fmt.Errorf("cannot get details for snaps: unexpected snap %q in results", name)
+		}
+		infos[name] = info
+		found = append(found, info)
+	}
+
+	err = s.decorateOrders(found, user)
+	if err != nil {
+		logger.Noticef("cannot get user orders: %v", err)
+	}
+
+	s.extractSuggestedCurrency(resp)
+
+	return nil
+}
@@ -0,0 +1,187 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/store"
+)
+
+const snapInfosPath = "/v2/snaps/info"
+
+func mockSnapInfoJSON(name string, revision int) string {
+	return fmt.Sprintf(`{
+  "name": %[1]q,
+  "snap-id": "%[1]s-id",
+  "channel-map": [
+    {
+      "channel": {"architecture": "amd64", "name": "stable", "risk": "stable", "track": "latest", "released-at": "2020-01-01T00:00:00.000000+00:00"},
+      "revision": %[2]d,
+      "version": "1.0",
+      "type": "app",
+      "confinement": "strict",
+      "download": {"url": "https://example.com/%[1]s_%[2]d.snap", "size": 4096, "sha3-384": "abcd"}
+    }
+  ],
+  "snap": {
+    "name": %[1]q,
+    "snap-id": "%[1]s-id",
+    "summary": "the %[1]s snap",
+    "publisher": {"id": "canonical", "username": "canonical", "display-name": "Canonical"}
+  }
+}`, name, revision)
+}
+
+// mockSnapInfosServer answers bulk info requests with the details of
+// the known snaps asked about, recording the names of each request.
+func (s *storeTestSuite) mockSnapInfosServer(c *C, known map[string]int, requested *[][]string) *httptest.Server {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapInfosPath)
+		c.Check(r.Header.Get("Content-Type"), Equals, store.JsonContentType)
+		c.Check(r.URL.Query().Get("architecture"), Not(Equals), "")
+
+		var req struct {
+			Names []string `json:"names"`
+		}
+		c.Assert(json.NewDecoder(r.Body).Decode(&req), IsNil)
+		*requested = append(*requested, req.Names)
+
+		var results []string
+		for _, name := range req.Names {
+			switch rev, ok := known[name]; {
+			case !ok:
+				// not found snaps are left out
+			case rev == 0:
+				// no released revisions
+				results = append(results, fmt.Sprintf(`{"name": %q, "snap-id": "%s-id", "channel-map": [], "snap": {"name": %q}}`, name, name, name))
+			default:
+				results = append(results, mockSnapInfoJSON(name, rev))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"results": [%s]}`, strings.Join(results, ","))
+	}))
+	c.Assert(mockServer, NotNil)
+	return mockServer
+}
+
+func (s *storeTestSuite) TestSnapInfos(c *C) {
+	var requested [][]string
+	mockServer := s.mockSnapInfosServer(c, map[string]int{"foo": 1, "bar": 2}, &requested)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	infos, err := sto.SnapInfos(s.ctx, []store.SnapSpec{{Name: "foo"}, {Name: "bar"}}, nil)
+	c.Assert(err, IsNil)
+	c.Check(requested, DeepEquals, [][]string{{"foo", "bar"}})
+	c.Assert(infos, HasLen, 2)
+	c.Check(infos["foo"].SnapName(), Equals, "foo")
+	c.Check(infos["foo"].SnapID, Equals, "foo-id")
+	c.Check(infos["foo"].Revision, Equals, snap.R(1))
+	c.Check(infos["foo"].Summary(), Equals, "the foo snap")
+	c.Check(infos["foo"].DownloadURL, Equals, "https://example.com/foo_1.snap")
+	c.Check(infos["bar"].Revision, Equals, snap.R(2))
+	c.Check(infos["bar"].Channels["latest/stable"].Revision, Equals, snap.R(2))
+}
+
+func (s *storeTestSuite) TestSnapInfosSomeNotFound(c *C) {
+	var requested [][]string
+	mockServer := s.mockSnapInfosServer(c, map[string]int{"foo": 1, "unreleased": 0}, &requested)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	specs := []store.SnapSpec{{Name: "missing"}, {Name: "foo"}, {Name: "unreleased"}, {Name: "foo"}}
+	infos, err := sto.SnapInfos(s.ctx, specs, nil)
+	c.Check(err, ErrorMatches, `cannot get details for snaps: not found: "missing", "unreleased"`)
+	c.Assert(err, FitsTypeOf, &store.SnapInfosNotFoundError{})
+	c.Check(err.(*store.SnapInfosNotFoundError).Names, DeepEquals, []string{"missing", "unreleased"})
+	// the found ones are returned nevertheless
+	c.Assert(infos, HasLen, 1)
+	c.Check(infos["foo"].Revision, Equals, snap.R(1))
+	// names are asked about once
+	c.Check(requested, DeepEquals, [][]string{{"missing", "foo", "unreleased"}})
+}
+
+func (s *storeTestSuite) TestSnapInfosChunked(c *C) {
+	restore := store.MockMaxSnapInfosPerRequest(2)
+	defer restore()
+
+	var requested [][]string
+	mockServer := s.mockSnapInfosServer(c, map[string]int{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5}, &requested)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	infos, err := sto.SnapInfos(s.ctx, []store.SnapSpec{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}, {Name: "e"}}, nil)
+	c.Assert(err, IsNil)
+	c.Check(requested, DeepEquals, [][]string{{"a", "b"}, {"c", "d"}, {"e"}})
+	c.Assert(infos, HasLen, 5)
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		c.Check(infos[name].Revision, Equals, snap.R(i+1))
+	}
+}
+
+func (s *storeTestSuite) TestSnapInfosErrors(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapInfosPath)
+		w.WriteHeader(418)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	_, err := sto.SnapInfos(s.ctx, []store.SnapSpec{{Name: "foo"}}, nil)
+	c.Check(err, ErrorMatches, `cannot get details for snaps "foo": got unexpected HTTP status code 418 via POST to "http://.*/v2/snaps/info\?.*"`)
+
+	_, err = sto.SnapInfos(s.ctx, []store.SnapSpec{{Name: ""}}, nil)
+	c.Check(err, ErrorMatches, `internal error: cannot get snap details without a snap name`)
+}
@@ -21,30 +21,40 @@
 package store
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/juju/ratelimit"
 	"gopkg.in/retry.v1"
 
 	"github.com/snapcore/snapd/arch"
 	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/sysdb"
 	"github.com/snapcore/snapd/client"
 	"github.com/snapcore/snapd/cmd/cmdutil"
 	"github.com/snapcore/snapd/dirs"
@@ -57,6 +67,7 @@ import (
 	"github.com/snapcore/snapd/progress"
 	"github.com/snapcore/snapd/release"
 	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/channel"
 	"github.com/snapcore/snapd/snapdenv"
 	"github.com/snapcore/snapd/strutil"
 )
@@ -74,13 +85,64 @@ const (
 	UbuntuCoreWireProtocol = "1"
 )
 
+// RefreshReason tells the store why a refresh (or the download for
+// it) is happening, via the Snap-Refresh-Reason header.
+type RefreshReason int
+
+const (
+	// RefreshReasonUnset leaves it to IsAutoRefresh: auto-refreshes
+	// are sent as scheduled, anything else sends no reason.
+	RefreshReasonUnset RefreshReason = iota
+	// RefreshReasonScheduled is for auto-refreshes.
+	RefreshReasonScheduled
+	// RefreshReasonManual is for refreshes asked for by the user.
+	RefreshReasonManual
+	// RefreshReasonPrereq is for refreshes of prerequisites (e.g. base
+	// or content providers) of another snap being installed or
+	// refreshed.
+	RefreshReasonPrereq
+)
+
+// refreshReasonHeader returns the value of the Snap-Refresh-Reason
+// header for the given reason, or "" if none should be sent.
+func refreshReasonHeader(reason RefreshReason, isAutoRefresh bool) string {
+	switch reason {
+	case RefreshReasonScheduled:
+		return "scheduled"
+	case RefreshReasonManual:
+		return "manual"
+	case RefreshReasonPrereq:
+		return "prereq"
+	}
+	if isAutoRefresh {
+		return "scheduled"
+	}
+	return ""
+}
+
 type RefreshOptions struct {
 	// RefreshManaged indicates to the store that the refresh is
 	// managed via snapd-control.
 	RefreshManaged bool
 	IsAutoRefresh  bool
+	// RefreshReason, if set, takes precedence over IsAutoRefresh
+	// for the Snap-Refresh-Reason header.
+	RefreshReason RefreshReason
 
 	PrivacyKey string
+	// InstanceKeyFunc, if set, replaces the default derivation
+	// (hashing with PrivacyKey) of the opaque keys sent to the store
+	// for parallel instances of snaps. It must return a non-empty
+	// value, always the same one for the same arguments, as the
+	// results are matched back to the snaps by these keys.
+	InstanceKeyFunc func(snapID, instanceKey string) (string, error)
+
+	// AnonDownloadURLs has the request made without the user
+	// authorization, so that the store hands out anonymous download
+	// URLs only, which are then also set as AnonDownloadURL of the
+	// results, e.g. to build mirror manifests. Snaps only accessible
+	// to the user are not found this way.
+	AnonDownloadURLs bool
 }
 
 // the LimitTime should be slightly more than 3 times of our http.Client
@@ -99,6 +161,14 @@ var downloadRetryStrategy = retry.LimitCount(7, retry.LimitTime(90*time.Second,
 	},
 ))
 
+// maxDownloadRetryAfter caps how long a download waits when
+// throttled by the store with a 429 and a Retry-After
+var maxDownloadRetryAfter = 30 * time.Second
+
+// maxThrottleRetryAfter caps how long all the requests of a store are
+// held back after the store answered one with a 429 and a Retry-After
+var maxThrottleRetryAfter = 60 * time.Second
+
 var connCheckStrategy = retry.LimitCount(3, retry.LimitTime(38*time.Second,
 	retry.Exponential{
 		Initial: 900 * time.Millisecond,
@@ -112,6 +182,11 @@ type Config struct {
 	// be overridden by its own env var.
 	StoreBaseURL      *url.URL
 	AssertionsBaseURL *url.URL
+	// AssertionsPath, if set, overrides the path prefix (relative to
+	// the assertions base URL) under which the assertions are
+	// served, e.g. for proxies mounting them elsewhere. It must not
+	// contain a query string.
+	AssertionsPath string
 
 	// StoreID is the store id used if we can't get one through the DeviceAndAuthContext.
 	StoreID string
@@ -124,12 +199,104 @@ type Config struct {
 	// search v2 fields
 	FindFields  []string
 	DeltaFormat string
+	// DisableDeltas turns off delta downloads for this store,
+	// regardless of SNAPD_USE_DELTAS_EXPERIMENTAL
+	DisableDeltas bool
+	// Xdelta3Path, if set, is the xdelta3 binary to apply deltas
+	// with, instead of the one found on PATH or in the system snap
+	Xdelta3Path string
 
 	// CacheDownloads is the number of downloads that should be cached
 	CacheDownloads int
+	// CacheDownloadsMaxBytes is the maximum total size of the cached
+	// downloads; if both are set the cache is kept within both limits
+	CacheDownloadsMaxBytes int64
+	// DownloadRedirectAllowHosts, if set, restricts the hosts that
+	// downloads may be redirected to (e.g. CDN hosts). Entries are
+	// either host names or host:port pairs.
+	DownloadRedirectAllowHosts []string
+
+	// CacheNamespace, if set, keeps the cached downloads in a
+	// namespace of their own under the download cache dir, separate
+	// from those of stores using other (or no) namespaces. It must be
+	// a single path component.
+	CacheNamespace string
+
+	// Locale, if set, is sent as Accept-Language with info and
+	// search requests to get localized snap metadata
+	Locale string
+
+	// DefaultRequestTimeout, if set, bounds the total time (including
+	// retries) of metadata requests whose context has no deadline of
+	// its own. It does not apply to downloads.
+	DefaultRequestTimeout time.Duration
 
 	// Proxy returns the HTTP proxy to use when talking to the store
 	Proxy func(*http.Request) (*url.URL, error)
+
+	// TLSConfig, if set, is used as the base TLS configuration when
+	// talking to the store and the CDNs, e.g. to pin a minimum TLS
+	// version or restrict the cipher suites. It is not modified: the
+	// extra certificates from dirs.SnapdStoreSSLCertsDir are added
+	// to a copy of its RootCAs, or of the system ones if it sets
+	// none, as usual.
+	TLSConfig *tls.Config
+
+	// UnixSocketProxy, if set, is the path of a unix socket of a local
+	// agent fronting the store; all requests are sent through it
+	// as-is, with the host taken from the request URL. This is
+	// distinct from the HTTP Proxy.
+	UnixSocketProxy string
+
+	// CaptureTranscript, if set, is called with the request and
+	// response bodies (capped to maxTranscriptBodySize each) of the
+	// snap action requests, and their URL, e.g. to attach them to bug
+	// reports. No headers (and so no credentials) are passed on.
+	CaptureTranscript func(reqBody, respBody []byte, url string)
+
+	// MaxConcurrentRequests, if set, bounds the number of requests to
+	// the store (not counting downloads) in flight at the same time;
+	// requests over the limit wait for a slot to free up.
+	MaxConcurrentRequests int
+
+	// SkipOrderDecoration disables querying the user's orders to set
+	// the MustBuy property of the paid snaps returned by info and
+	// search requests (MustBuy is then left unset).
+	SkipOrderDecoration bool
+
+	// RequestSigner, if set, is called with every request to the
+	// store (API and downloads alike) once all the standard headers
+	// are in place, e.g. to add a signature required by an
+	// enterprise proxy.
+	RequestSigner func(*http.Request) error
+
+	// DeviceCapabilities are the client capabilities advertised to
+	// the store with every request; defaults to "default-tracks".
+	// Invalid (empty or containing whitespace) ones are ignored.
+	DeviceCapabilities []string
+
+	// MinDownloadRate and MaxDownloadRate, if set, bound (in
+	// bytes/sec) the rate limit of downloads, guarding against
+	// misconfigured limits; MaxDownloadRate also applies to
+	// downloads without a limit.
+	MinDownloadRate int64
+	MaxDownloadRate int64
+	// GlobalDownloadRate, if set, limits (in bytes/sec) the
+	// combined rate of all the downloads from the store, on top of
+	// the rate limits of the single downloads.
+	GlobalDownloadRate int64
+
+	// TraceRequest, if set, is called after every attempt of a
+	// request to the store (retries included) with its timing
+	// breakdown (DNS, connect, TLS and first byte), to help
+	// diagnosing slow store interactions.
+	TraceRequest func(*RequestTrace)
+
+	// Context, if set, is the parent of the contexts of the requests
+	// the store makes on its own or for methods not taking a context
+	// (e.g. order decoration, delta downloads, connectivity checks),
+	// so that cancelling it aborts all of them.
+	Context context.Context
 }
 
 // setBaseURL updates the store API's base URL in the Config. Must not be used
@@ -166,6 +333,12 @@ type Store struct {
 	infoFields   []string
 	findFields   []string
 	deltaFormat  string
+	locale       string
+
+	requestTimeout time.Duration
+	// parent context of the requests not done on behalf of a caller
+	// supplied context
+	baseCtx context.Context
 	// reused http client
 	client *http.Client
 
@@ -174,13 +347,36 @@ type Store struct {
 
 	mu                sync.Mutex
 	suggestedCurrency string
+	refreshHints      map[string]string
+	experiments       map[string]string
+	deltaStats        DeltaStats
+	// whether infoFields and findFields were restricted to the
+	// fields the store supports (or it turned out it cannot tell)
+	fieldsDiscovered bool
+	// requests are held back until then, as asked by the store
+	throttledUntil time.Time
+	// cohort keys handed out by EnsureCohorts, by snap name
+	cohortKeys map[string]cachedCohortKey
+
+	snapInfoRequests requestGroup
 
 	cacher downloadCache
 
+	// semaphore for MaxConcurrentRequests, nil if unlimited
+	requestSlots chan struct{}
+	// bucket shared by all downloads for GlobalDownloadRate, nil if
+	// unlimited
+	globalDownloadBucket *ratelimit.Bucket
+
+	xdelta3Probe sync.Once
+	xdelta3Works bool
+
 	proxy              func(*http.Request) (*url.URL, error)
 	proxyConnectHeader http.Header
 
 	userAgent string
+	// the Snap-Device-Capabilities header
+	deviceCapabilities string
 }
 
 var ErrTooManyRequests = errors.New("too many requests")
@@ -190,26 +386,53 @@ func respToError(resp *http.Response, msg string) error {
 		return ErrTooManyRequests
 	}
 
-	tpl := "cannot %s: got unexpected HTTP status code %d via %s to %q"
-	if oops := resp.Header.Get("X-Oops-Id"); oops != "" {
-		tpl += " [%s]"
-		return fmt.Errorf(tpl, msg, resp.StatusCode, resp.Request.Method, resp.Request.URL, oops)
+	return &StoreServerError{
+		Msg:        msg,
+		StatusCode: resp.StatusCode,
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL,
+		OopsID:     resp.Header.Get("X-Oops-Id"),
 	}
-
-	return fmt.Errorf(tpl, msg, resp.StatusCode, resp.Request.Method, resp.Request.URL)
 }
 
 // Deltas enabled by default on classic, but allow opting in or out on both classic and core.
-func useDeltas() bool {
+func useDeltas(xdelta3Path string) bool {
 	// only xdelta3 is supported for now, so check the binary exists here
 	// TODO: have a per-format checker instead
-	if _, err := getXdelta3Cmd(); err != nil {
+	if _, err := getXdelta3Cmd(xdelta3Path); err != nil {
 		return false
 	}
 
 	return osutil.GetenvBool("SNAPD_USE_DELTAS_EXPERIMENTAL", true)
 }
 
+// useDeltas is like the global useDeltas but also honours the store
+// configuration and checks (once per store) that the xdelta3 binary
+// actually works, so that a broken one disables deltas instead of
+// failing every delta download.
+func (s *Store) useDeltas() bool {
+	if s.cfg.DisableDeltas || !useDeltas(s.cfg.Xdelta3Path) {
+		return false
+	}
+	s.xdelta3Probe.Do(func() {
+		s.xdelta3Works = probeXdelta3(s.cfg.Xdelta3Path)
+	})
+	return s.xdelta3Works
+}
+
+func probeXdelta3(xdelta3Path string) bool {
+	cmd, err := getXdelta3Cmd(xdelta3Path, "-V")
+	if err != nil {
+		logger.Noticef("Cannot use xdelta3, disabling deltas: %v", err)
+		return false
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		logger.Noticef("Cannot use xdelta3, disabling deltas: %v", osutil.OutputErr(output, err))
+		return false
+	}
+	return true
+}
+
 // endpointURL clones a base URL and updates it with optional path and query.
 func endpointURL(base *url.URL, path string, query url.Values) *url.URL {
 	u := *base
@@ -318,16 +541,14 @@ func init() {
 	defaultConfig.DetailFields = jsonutil.StructFields((*snapDetails)(nil), "snap_yaml_raw")
 	defaultConfig.InfoFields = jsonutil.StructFields((*storeSnap)(nil), "snap-yaml")
 	defaultConfig.FindFields = append(jsonutil.StructFields((*storeSnap)(nil),
-		"architectures", "created-at", "epoch", "name", "snap-id", "snap-yaml"),
+		"architectures", "created-at", "epoch", "name", "release-notes", "snap-id", "snap-yaml"),
 		"channel")
+	defaultConfig.DeviceCapabilities = []string{"default-tracks"}
 }
 
 type searchV2Results struct {
 	Results   []*storeSearchResult `json:"results"`
-	ErrorList []struct {
-		Code    string `json:"code"`
-		Message string `json:"message"`
-	} `json:"error-list"`
+	ErrorList []storeError         `json:"error-list"`
 }
 
 type searchResults struct {
@@ -381,6 +602,16 @@ func New(cfg *Config, dauthCtx DeviceAndAuthContext) *Store {
 		deltaFormat = defaultSupportedDeltaFormat
 	}
 
+	baseCtx := cfg.Context
+	if baseCtx == nil {
+		baseCtx = context.Background()
+	}
+
+	deviceCapabilities := cfg.DeviceCapabilities
+	if deviceCapabilities == nil {
+		deviceCapabilities = defaultConfig.DeviceCapabilities
+	}
+
 	userAgent := snapdenv.UserAgent()
 	proxyConnectHeader := http.Header{"User-Agent": []string{userAgent}}
 
@@ -395,9 +626,19 @@ func New(cfg *Config, dauthCtx DeviceAndAuthContext) *Store {
 		findFields:         findFields,
 		dauthCtx:           dauthCtx,
 		deltaFormat:        deltaFormat,
+		locale:             cfg.Locale,
+		requestTimeout:     cfg.DefaultRequestTimeout,
+		baseCtx:            baseCtx,
 		proxy:              cfg.Proxy,
 		proxyConnectHeader: proxyConnectHeader,
 		userAgent:          userAgent,
+		deviceCapabilities: joinDeviceCapabilities(deviceCapabilities),
+	}
+	if cfg.MaxConcurrentRequests > 0 {
+		store.requestSlots = make(chan struct{}, cfg.MaxConcurrentRequests)
+	}
+	if cfg.GlobalDownloadRate > 0 {
+		store.globalDownloadBucket = ratelimit.NewBucketWithRate(float64(cfg.GlobalDownloadRate), 2*cfg.GlobalDownloadRate)
 	}
 	store.client = store.newHTTPClient(&httputil.ClientOptions{
 		Timeout:    10 * time.Second,
@@ -408,6 +649,20 @@ func New(cfg *Config, dauthCtx DeviceAndAuthContext) *Store {
 	return store
 }
 
+// joinDeviceCapabilities returns the Snap-Device-Capabilities header
+// value advertising the given capabilities, leaving out invalid ones.
+func joinDeviceCapabilities(capabilities []string) string {
+	valid := make([]string, 0, len(capabilities))
+	for _, capability := range capabilities {
+		if capability == "" || strings.IndexFunc(capability, unicode.IsSpace) >= 0 {
+			logger.Noticef("cannot advertise invalid device capability %q, ignoring", capability)
+			continue
+		}
+		valid = append(valid, capability)
+	}
+	return strings.Join(valid, " ")
+}
+
 // API endpoint paths
 const (
 	// see https://dashboard.snapcraft.io/docs/
@@ -420,6 +675,7 @@ const (
 	ordersEndpPath      = "api/v1/snaps/purchases/orders"
 	buyEndpPath         = "api/v1/snaps/purchases/buy"
 	customersMeEndpPath = "api/v1/snaps/purchases/customers/me"
+	reportEndpPath      = "api/v1/snaps/report"
 	sectionsEndpPath    = "api/v1/snaps/sections"
 	commandsEndpPath    = "api/v1/snaps/names"
 	// v2
@@ -427,6 +683,9 @@ const (
 	snapInfoEndpPath   = "v2/snaps/info"
 	cohortsEndpPath    = "v2/cohorts"
 	findEndpPath       = "v2/snaps/find"
+	relatedEndpPath    = "v2/snaps/related"
+	categoriesEndpPath = "v2/snaps/categories"
+	fieldsEndpPath     = "v2/snaps/fields"
 
 	deviceNonceEndpPath   = "api/v1/snaps/auth/nonces"
 	deviceSessionEndpPath = "api/v1/snaps/auth/sessions"
@@ -440,12 +699,36 @@ func (s *Store) newHTTPClient(opts *httputil.ClientOptions) *http.Client {
 	}
 	opts.Proxy = s.cfg.Proxy
 	opts.ProxyConnectHeader = s.proxyConnectHeader
+	opts.UnixSocket = s.cfg.UnixSocketProxy
 	opts.ExtraSSLCerts = &httputil.ExtraSSLCertsFromDir{
 		Dir: dirs.SnapdStoreSSLCertsDir,
 	}
+	opts.TLSConfig = s.cfg.TLSConfig
 	return httputil.NewHTTPClient(opts)
 }
 
+// Close releases the resources the store holds on to, i.e. closes
+// the idle connections of its HTTP client. Calling it is optional, but
+// advised in long-running processes that create many stores. The store
+// can still be used afterwards, opening new connections as needed.
+func (s *Store) Close() error {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if ci, ok := s.client.Transport.(closeIdler); ok {
+		ci.CloseIdleConnections()
+	}
+	return nil
+}
+
+// setLocale asks for snap metadata localized to the configured
+// locale, if any.
+func (s *Store) setLocale(reqOptions *requestOptions) {
+	if s.locale != "" {
+		reqOptions.addHeader("Accept-Language", s.locale)
+	}
+}
+
 func (s *Store) defaultSnapQuery() url.Values {
 	q := url.Values{}
 	if len(s.detailFields) != 0 {
@@ -473,13 +756,20 @@ func (s *Store) endpointURL(p string, query url.Values) *url.URL {
 	return endpointURL(s.baseURL(s.cfg.StoreBaseURL), p, query)
 }
 
-func (s *Store) assertionsEndpointURL(p string, query url.Values) *url.URL {
+func (s *Store) assertionsEndpointURL(p string, query url.Values) (*url.URL, error) {
 	defBaseURL := s.cfg.StoreBaseURL
 	// can be overridden separately!
 	if s.cfg.AssertionsBaseURL != nil {
 		defBaseURL = s.cfg.AssertionsBaseURL
 	}
-	return endpointURL(s.baseURL(defBaseURL), path.Join(assertionsPath, p), query)
+	assertsPath := assertionsPath
+	if s.cfg.AssertionsPath != "" {
+		if strings.ContainsAny(s.cfg.AssertionsPath, "?#") {
+			return nil, fmt.Errorf("invalid assertions path %q: must not contain a query string", s.cfg.AssertionsPath)
+		}
+		assertsPath = s.cfg.AssertionsPath
+	}
+	return endpointURL(s.baseURL(defBaseURL), path.Join(assertsPath, p), query), nil
 }
 
 // LoginUser logs user in the store and returns the authentication macaroons.
@@ -507,6 +797,70 @@ func (s *Store) LoginUser(username, password, otp string) (string, string, error
 	return macaroon, discharge, nil
 }
 
+// CaveatInfo describes a third party caveat of a store macaroon.
+type CaveatInfo struct {
+	ID       string
+	Location string
+}
+
+// RequestStoreMacaroon requests a store macaroon for a new login, and
+// returns it serialized together with its third party caveats. This is
+// the first half of LoginUser, for callers that want to get the login
+// caveat (the one with location UbuntuoneLocation) discharged
+// themselves, and then complete the login using CompleteLogin.
+func (s *Store) RequestStoreMacaroon() (string, []CaveatInfo, error) {
+	macaroon, err := requestStoreMacaroon(s.client)
+	if err != nil {
+		return "", nil, err
+	}
+	deserializedMacaroon, err := auth.MacaroonDeserialize(macaroon)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the login caveat is needed to complete the login
+	if _, err := loginCaveatID(deserializedMacaroon); err != nil {
+		return "", nil, err
+	}
+
+	var caveats []CaveatInfo
+	for _, caveat := range deserializedMacaroon.Caveats() {
+		if caveat.Location == "" {
+			// first party caveat
+			continue
+		}
+		caveats = append(caveats, CaveatInfo{ID: caveat.Id, Location: caveat.Location})
+	}
+
+	return macaroon, caveats, nil
+}
+
+// CompleteLogin checks that the given discharge is for the login
+// caveat of the given store macaroon, as obtained with
+// RequestStoreMacaroon, and returns the resulting store credentials.
+func (s *Store) CompleteLogin(macaroon, discharge string) (*auth.UserState, error) {
+	deserializedMacaroon, err := auth.MacaroonDeserialize(macaroon)
+	if err != nil {
+		return nil, fmt.Errorf("cannot complete login: %v", err)
+	}
+	loginCaveat, err := loginCaveatID(deserializedMacaroon)
+	if err != nil {
+		return nil, fmt.Errorf("cannot complete login: %v", err)
+	}
+	deserializedDischarge, err := auth.MacaroonDeserialize(discharge)
+	if err != nil {
+		return nil, fmt.Errorf("cannot complete login: %v", err)
+	}
+	if deserializedDischarge.Id() != loginCaveat {
+		return nil, fmt.Errorf("cannot complete login: discharge is not for the login caveat")
+	}
+
+	return &auth.UserState{
+		StoreMacaroon:   macaroon,
+		StoreDischarges: []string{discharge},
+	}, nil
+}
+
 // authAvailable returns true if there is a user and/or device session setup
 func (s *Store) authAvailable(user *auth.UserState) (bool, error) {
 	if user.HasStoreAuth() {
@@ -673,6 +1027,29 @@ func (s *Store) EnsureDeviceSession() (*auth.DeviceState, error) {
 	return device, err
 }
 
+// RefreshDeviceSession forces getting a new device session from the
+// store, even if the device has one already.
+// Expects the store to have an AuthContext.
+func (s *Store) RefreshDeviceSession() (*auth.DeviceState, error) {
+	if s.dauthCtx == nil {
+		return nil, fmt.Errorf("internal error: no authContext")
+	}
+
+	device, err := s.dauthCtx.Device()
+	if err != nil {
+		return nil, err
+	}
+
+	if device.Serial == "" {
+		return nil, ErrNoSerial
+	}
+	err = s.refreshDeviceSession(device)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
 // authenticateDevice will add the store expected Macaroon X-Device-Authorization header for device
 func authenticateDevice(r *http.Request, device *auth.DeviceState, apiLevel apiLevel) {
 	if device != nil && device.SessionMacaroon != "" {
@@ -680,7 +1057,11 @@ func authenticateDevice(r *http.Request, device *auth.DeviceState, apiLevel apiL
 	}
 }
 
-func (s *Store) setStoreID(r *http.Request, apiLevel apiLevel) (customStore bool) {
+func (s *Store) setStoreID(r *http.Request, apiLevel apiLevel, storeIDOverride string) (customStore bool) {
+	if storeIDOverride != "" {
+		r.Header.Set(hdrSnapDeviceStore[apiLevel], storeIDOverride)
+		return true
+	}
 	storeID := s.fallbackStoreID
 	if s.dauthCtx != nil {
 		cand, err := s.dauthCtx.StoreID(storeID)
@@ -735,6 +1116,20 @@ type requestOptions struct {
 	//  - deviceAuthCustomStoreOnly: should be provided only in case
 	//    of a custom store
 	DeviceAuthNeed deviceAuthNeed
+
+	// IsDownload marks (long lived) download requests, which are not
+	// subject to MaxConcurrentRequests.
+	IsDownload bool
+
+	// CaptureTranscript marks requests whose bodies are passed to
+	// Config.CaptureTranscript, if set.
+	CaptureTranscript bool
+
+	// StoreIDOverride, if set, is used as the store ID instead of
+	// the one from the device and auth context or the
+	// configuration. If unset the one given with WithStoreID to the
+	// request context, if any, is used.
+	StoreIDOverride string
 }
 
 func (r *requestOptions) addHeader(k, v string) {
@@ -753,13 +1148,10 @@ func cancelled(ctx context.Context) bool {
 	}
 }
 
-var expectedCatalogPreamble = []interface{}{
-	json.Delim('{'),
-	"_embedded",
-	json.Delim('{'),
-	"clickindex:package",
-	json.Delim('['),
-}
+// catalogPackagesPath is the path of keys leading to the array of
+// packages in the catalog; other keys along the way are skipped so that
+// additive changes to the store's schema don't break the decoding
+var catalogPackagesPath = []string{"_embedded", "clickindex:package"}
 
 type alias struct {
 	Name string `json:"name"`
@@ -782,21 +1174,15 @@ func decodeCatalog(resp *http.Response, names io.Writer, db SnapAdder) error {
 	if resp.StatusCode != 200 {
 		return respToError(resp, what)
 	}
-	dec := json.NewDecoder(resp.Body)
-	for _, expectedToken := range expectedCatalogPreamble {
-		token, err := dec.Token()
-		if err != nil {
-			return err
-		}
-		if token != expectedToken {
-			return fmt.Errorf(what+": bad catalog preamble: expected %#v, got %#v", expectedToken, token)
-		}
+	dec := json.NewDecoder(&catalogReader{r: resp.Body})
+	if err := seekCatalogPackages(dec); err != nil {
+		return catalogDecodeError(what, err)
 	}
 
 	for dec.More() {
 		var v catalogItem
 		if err := dec.Decode(&v); err != nil {
-			return fmt.Errorf(what+": %v", err)
+			return catalogDecodeError(what, err)
 		}
 		if v.Name == "" {
 			continue
@@ -820,6 +1206,170 @@ func decodeCatalog(resp *http.Response, names io.Writer, db SnapAdder) error {
 		}
 	}
 
+	// dec.More() also stops at the end of the stream, make sure the
+	// catalog was actually complete
+	if err := finishCatalog(dec); err != nil {
+		return catalogDecodeError(what, err)
+	}
+
+	return nil
+}
+
+// catalogSpool spools the snaps of the catalog to a file until it was
+// received in full, so that they are not held in memory.
+type catalogSpool struct {
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+type spooledSnap struct {
+	Name     string   `json:"name"`
+	Version  string   `json:"version"`
+	Summary  string   `json:"summary"`
+	Commands []string `json:"commands"`
+}
+
+func newCatalogSpool(f *os.File) *catalogSpool {
+	w := bufio.NewWriter(f)
+	return &catalogSpool{f: f, w: w, enc: json.NewEncoder(w)}
+}
+
+func (sp *catalogSpool) AddSnap(snapName, version, summary string, commands []string) error {
+	return sp.enc.Encode(spooledSnap{Name: snapName, Version: version, Summary: summary, Commands: commands})
+}
+
+// reset drops whatever was spooled so far.
+func (sp *catalogSpool) reset() error {
+	sp.w.Reset(sp.f)
+	return truncateSpool(sp.f)
+}
+
+// replay passes the spooled snaps to adder.
+func (sp *catalogSpool) replay(adder SnapAdder) error {
+	if err := sp.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := sp.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bufio.NewReader(sp.f))
+	for {
+		var sn spooledSnap
+		if err := dec.Decode(&sn); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := adder.AddSnap(sn.Name, sn.Version, sn.Summary, sn.Commands); err != nil {
+			return err
+		}
+	}
+}
+
+func truncateSpool(f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return f.Truncate(0)
+}
+
+// catalogReader reports the end of the catalog stream as
+// io.ErrUnexpectedEOF: the decoding stops at the closing brace of the
+// catalog without reading any further, so whenever the decoder runs
+// into the end of the stream the catalog was cut short.
+type catalogReader struct {
+	r io.Reader
+}
+
+func (r *catalogReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// catalogDecodeError returns err as is if it is due to the catalog
+// stream ending prematurely, so that the request can be retried, and
+// a decoding error otherwise.
+func catalogDecodeError(what string, err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return err
+	}
+	return fmt.Errorf(what+": %v", err)
+}
+
+// seekCatalogPackages advances the decoder to just inside the array of
+// packages found by following catalogPackagesPath, skipping over any
+// sibling keys (and their values) found along the way.
+func seekCatalogPackages(dec *json.Decoder) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for i, key := range catalogPackagesPath {
+		for {
+			token, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			if token == json.Delim('}') {
+				return fmt.Errorf("bad catalog preamble: cannot find %q", key)
+			}
+			if token == key {
+				break
+			}
+			// skip the value of an unknown key
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+		delim := json.Delim('{')
+		if i == len(catalogPackagesPath)-1 {
+			delim = '['
+		}
+		if err := expectDelim(dec, delim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishCatalog consumes the end of the array of packages and of the
+// objects enclosing it, skipping over any sibling keys found after it.
+func finishCatalog(dec *json.Decoder) error {
+	if err := expectDelim(dec, ']'); err != nil {
+		return err
+	}
+	for range catalogPackagesPath {
+		for {
+			token, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			if token == json.Delim('}') {
+				break
+			}
+			// skip the value of the remaining keys
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, expected json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != expected {
+		return fmt.Errorf("bad catalog preamble: expected %#v, got %#v", expected, token)
+	}
 	return nil
 }
 
@@ -839,17 +1389,196 @@ func decodeJSONBody(resp *http.Response, success interface{}, failure interface{
 	return nil
 }
 
+// withDefaultDeadline returns ctx with the default request deadline
+// applied, unless ctx has a deadline already.
+func (s *Store) withDefaultDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if s.requestTimeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		// never override the deadline of the caller
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.requestTimeout)
+}
+
 // retryRequestDecodeJSON calls retryRequest and decodes the response into either success or failure.
 func (s *Store) retryRequestDecodeJSON(ctx context.Context, reqOptions *requestOptions, user *auth.UserState, success interface{}, failure interface{}) (resp *http.Response, err error) {
-	return httputil.RetryRequest(reqOptions.URL.String(), func() (*http.Response, error) {
+	ctx, cancel := s.withDefaultDeadline(ctx)
+	defer cancel()
+	return httputil.RetryRequestReportExhausted(reqOptions.URL.String(), func() (*http.Response, error) {
 		return s.doRequest(ctx, s.client, reqOptions, user)
 	}, func(resp *http.Response) error {
+		if reqOptions.CaptureTranscript && s.cfg.CaptureTranscript != nil {
+			return s.decodeJSONBodyWithTranscript(reqOptions, resp, success, failure)
+		}
 		return decodeJSONBody(resp, success, failure)
 	}, defaultRetryStrategy)
 }
 
+// the maximum size of each of the bodies passed to Config.CaptureTranscript
+var maxTranscriptBodySize = 64 * 1024
+
+// cappedBuffer keeps the first max bytes written to it, and discards
+// the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// decodeJSONBodyWithTranscript works like decodeJSONBody but also passes
+// the request and response bodies to Config.CaptureTranscript.
+func (s *Store) decodeJSONBodyWithTranscript(reqOptions *requestOptions, resp *http.Response, success interface{}, failure interface{}) error {
+	respBody := &cappedBuffer{max: maxTranscriptBodySize}
+	body := resp.Body
+	tee := io.TeeReader(body, respBody)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{tee, body}
+
+	err := decodeJSONBody(resp, success, failure)
+	// get hold of whatever the decoder did not need
+	io.Copy(ioutil.Discard, io.LimitReader(tee, int64(maxTranscriptBodySize)))
+
+	reqBody := reqOptions.Data
+	if len(reqBody) > maxTranscriptBodySize {
+		reqBody = reqBody[:maxTranscriptBodySize]
+	}
+	s.cfg.CaptureTranscript(reqBody, respBody.Bytes(), reqOptions.URL.String())
+
+	return err
+}
+
 // doRequest does an authenticated request to the store handling a potential macaroon refresh required if needed
+//
+// Unless it is a download the request takes up one of the
+// MaxConcurrentRequests slots until the body of the response is
+// closed, so callers must always close it.
 func (s *Store) doRequest(ctx context.Context, client *http.Client, reqOptions *requestOptions, user *auth.UserState) (*http.Response, error) {
+	if reqOptions.IsDownload {
+		// downloads are served by the CDN, and handle throttling
+		// on their own
+		return s.doRequestRefreshingAuth(ctx, client, reqOptions, user)
+	}
+
+	if err := s.waitThrottle(ctx); err != nil {
+		return nil, err
+	}
+	release, err := s.acquireRequestSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the slot is handed over to the body of the response, anything
+	// else gives it back
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			release()
+		}
+	}()
+	resp, err := s.doRequestRefreshingAuth(ctx, client, reqOptions, user)
+	if err != nil {
+		return nil, err
+	}
+	s.noteThrottling(resp)
+	s.extractExperiments(resp)
+	// the request is in flight until its body is closed
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	handedOver = true
+	return resp, nil
+}
+
+// acquireRequestSlot waits until a request can be sent within the
+// MaxConcurrentRequests limit, or the context is done. It returns the
+// function to call once the request is done.
+func (s *Store) acquireRequestSlot(ctx context.Context) (release func(), err error) {
+	if s.requestSlots == nil {
+		return func() {}, nil
+	}
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	select {
+	case s.requestSlots <- struct{}{}:
+	case <-done:
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-s.requestSlots })
+	}, nil
+}
+
+// waitThrottle waits until the store is not throttling our requests
+// anymore, as asked by a previous 429 response, or the context is
+// done.
+func (s *Store) waitThrottle(ctx context.Context) error {
+	s.mu.Lock()
+	wait := s.throttledUntil.Sub(httputil.Clock().Now())
+	s.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	logger.Debugf("Store requests throttled, waiting %v.", wait)
+	select {
+	case <-httputil.Clock().After(wait):
+		return nil
+	case <-done:
+		return ctx.Err()
+	}
+}
+
+// noteThrottling holds back all further requests for the delay asked
+// by resp if it is a 429 with a Retry-After header.
+func (s *Store) noteThrottling(resp *http.Response) {
+	if resp.StatusCode != 429 {
+		return
+	}
+	wait := retryAfter(resp, maxThrottleRetryAfter)
+	if wait <= 0 {
+		return
+	}
+	until := httputil.Clock().Now().Add(wait)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until.After(s.throttledUntil) {
+		s.throttledUntil = until
+	}
+}
+
+// releasingBody calls release once the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+func (s *Store) doRequestRefreshingAuth(ctx context.Context, client *http.Client, reqOptions *requestOptions, user *auth.UserState) (*http.Response, error) {
 	authRefreshes := 0
 	for {
 		req, err := s.newRequest(ctx, reqOptions, user)
@@ -859,8 +1588,16 @@ func (s *Store) doRequest(ctx context.Context, client *http.Client, reqOptions *
 		if ctx != nil {
 			req = req.WithContext(ctx)
 		}
+		var tracer *requestTracer
+		if s.cfg.TraceRequest != nil {
+			tracer = newRequestTracer(req)
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), tracer.clientTrace()))
+		}
 
 		resp, err := client.Do(req)
+		if tracer != nil {
+			s.cfg.TraceRequest(tracer.done(err))
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -879,7 +1616,7 @@ func (s *Store) doRequest(ctx context.Context, client *http.Client, reqOptions *
 				refreshNeed.device = true
 			}
 			if refreshNeed.needed() {
-				err := s.refreshAuth(user, refreshNeed)
+				err := s.refreshAuth(ctx, user, refreshNeed)
 				if err != nil {
 					return nil, err
 				}
@@ -903,7 +1640,7 @@ func (rn *authRefreshNeed) needed() bool {
 	return rn.device || rn.user
 }
 
-func (s *Store) refreshAuth(user *auth.UserState, need authRefreshNeed) error {
+func (s *Store) refreshAuth(ctx context.Context, user *auth.UserState, need authRefreshNeed) error {
 	if need.user {
 		// refresh user
 		err := s.refreshUser(user)
@@ -916,15 +1653,26 @@ func (s *Store) refreshAuth(user *auth.UserState, need authRefreshNeed) error {
 		if s.dauthCtx == nil {
 			return fmt.Errorf("internal error: no device and auth context")
 		}
-		device, err := s.dauthCtx.Device()
-		if err != nil {
-			return err
+		supplied := deviceSessionFromContext(ctx)
+		var device *auth.DeviceState
+		if supplied != nil {
+			device = supplied.get()
 		}
-
-		err = s.refreshDeviceSession(device)
+		if device == nil {
+			var err error
+			device, err = s.dauthCtx.Device()
+			if err != nil {
+				return err
+			}
+		}
+
+		err := s.refreshDeviceSession(device)
 		if err != nil {
 			return err
 		}
+		if supplied != nil {
+			supplied.set(device)
+		}
 	}
 	return nil
 }
@@ -941,18 +1689,30 @@ func (s *Store) newRequest(ctx context.Context, reqOptions *requestOptions, user
 		return nil, err
 	}
 
-	customStore := s.setStoreID(req, reqOptions.APILevel)
+	storeIDOverride := reqOptions.StoreIDOverride
+	if storeIDOverride == "" {
+		storeIDOverride = storeIDFromContext(ctx)
+	}
+	customStore := s.setStoreID(req, reqOptions.APILevel, storeIDOverride)
 
 	if s.dauthCtx != nil && (customStore || reqOptions.DeviceAuthNeed != deviceAuthCustomStoreOnly) {
-		device, err := s.EnsureDeviceSession()
-		if err != nil && err != ErrNoSerial {
-			return nil, err
+		var device *auth.DeviceState
+		if supplied := deviceSessionFromContext(ctx); supplied != nil {
+			device = supplied.get()
 		}
-		if err == ErrNoSerial {
-			// missing serial assertion, log and continue without device authentication
-			logger.Debugf("cannot set device session: %v", err)
-		} else {
+		if device != nil && device.SessionMacaroon != "" {
 			authenticateDevice(req, device, reqOptions.APILevel)
+		} else {
+			device, err := s.EnsureDeviceSession()
+			if err != nil && err != ErrNoSerial {
+				return nil, err
+			}
+			if err == ErrNoSerial {
+				// missing serial assertion, log and continue without device authentication
+				logger.Debugf("cannot set device session: %v", err)
+			} else {
+				authenticateDevice(req, device, reqOptions.APILevel)
+			}
 		}
 	}
 
@@ -966,7 +1726,9 @@ func (s *Store) newRequest(ctx context.Context, reqOptions *requestOptions, user
 	req.Header.Set(hdrSnapDeviceArchitecture[reqOptions.APILevel], s.architecture)
 	req.Header.Set(hdrSnapDeviceSeries[reqOptions.APILevel], s.series)
 	req.Header.Set(hdrSnapClassic[reqOptions.APILevel], strconv.FormatBool(release.OnClassic))
-	req.Header.Set("Snap-Device-Capabilities", "default-tracks")
+	if s.deviceCapabilities != "" {
+		req.Header.Set("Snap-Device-Capabilities", s.deviceCapabilities)
+	}
 	if cua := ClientUserAgent(ctx); cua != "" {
 		req.Header.Set("Snap-Client-User-Agent", cua)
 	}
@@ -982,6 +1744,12 @@ func (s *Store) newRequest(ctx context.Context, reqOptions *requestOptions, user
 		req.Header.Set(header, value)
 	}
 
+	if s.cfg.RequestSigner != nil {
+		if err := s.cfg.RequestSigner(req); err != nil {
+			return nil, fmt.Errorf("cannot sign request: %v", err)
+		}
+	}
+
 	return req, nil
 }
 
@@ -1069,6 +1837,10 @@ type order struct {
 
 // decorateOrders sets the MustBuy property of each snap in the given list according to the user's known orders.
 func (s *Store) decorateOrders(snaps []*snap.Info, user *auth.UserState) error {
+	if s.cfg.SkipOrderDecoration {
+		return nil
+	}
+
 	// Mark every non-free snap as must buy until we know better.
 	hasPriced := false
 	for _, info := range snaps {
@@ -1086,38 +1858,45 @@ func (s *Store) decorateOrders(snaps []*snap.Info, user *auth.UserState) error {
 		return nil
 	}
 
-	var err error
+	bought, err := s.boughtSnaps(user)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range snaps {
+		info.MustBuy = mustBuy(info.Paid, bought[info.SnapID])
+	}
+
+	return nil
+}
 
+// boughtSnaps returns the set of the IDs of the snaps the user has
+// orders for.
+func (s *Store) boughtSnaps(user *auth.UserState) (map[string]bool, error) {
 	reqOptions := &requestOptions{
 		Method: "GET",
 		URL:    s.endpointURL(ordersEndpPath, nil),
 		Accept: jsonContentType,
 	}
 	var result ordersResult
-	resp, err := s.retryRequestDecodeJSON(context.TODO(), reqOptions, user, &result, nil)
+	resp, err := s.retryRequestDecodeJSON(s.baseCtx, reqOptions, user, &result, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if resp.StatusCode == 401 {
 		// TODO handle token expiry and refresh
-		return ErrInvalidCredentials
+		return nil, ErrInvalidCredentials
 	}
 	if resp.StatusCode != 200 {
-		return respToError(resp, "obtain known orders from store")
+		return nil, respToError(resp, "obtain known orders from store")
 	}
 
-	// Make a map of the IDs of bought snaps
 	bought := make(map[string]bool)
 	for _, order := range result.Orders {
 		bought[order.SnapID] = true
 	}
-
-	for _, info := range snaps {
-		info.MustBuy = mustBuy(info.Paid, bought[info.SnapID])
-	}
-
-	return nil
+	return bought, nil
 }
 
 // mustBuy determines if a snap requires a payment, based on if it is non-free and if the user has already bought it
@@ -1133,12 +1912,57 @@ func mustBuy(paid bool, bought bool) bool {
 // A SnapSpec describes a single snap wanted from SnapInfo
 type SnapSpec struct {
 	Name string
+	// ETag, if set, is the StoreETag of previously fetched details
+	// of the snap; SnapInfo then returns ErrNotModified if they
+	// did not change since.
+	ETag string
+	// Fields, if set, are the only snap fields requested from the
+	// store instead of the full default set, e.g. for UIs needing
+	// just the summary and icon; the other fields of the returned
+	// snap.Info are left unset.
+	Fields []string
+	// Components, if set, additionally requests the components
+	// (resources) of the snap, returned in snap.Info.Components;
+	// ignored if Fields is set.
+	Components bool
+	// AnonDownloadURLs is like RefreshOptions.AnonDownloadURLs.
+	AnonDownloadURLs bool
+}
+
+// storeCredentialsKey identifies the store credentials sent on behalf
+// of user; the local ID does not do, users that were not added locally
+// have none.
+func storeCredentialsKey(user *auth.UserState) string {
+	if user == nil {
+		return "-"
+	}
+	h := sha256.New()
+	io.WriteString(h, user.StoreMacaroon)
+	for _, d := range user.StoreDischarges {
+		h.Write([]byte{0})
+		io.WriteString(h, d)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// snapInfoResponse is the outcome of an info request, shared by the
+// identical concurrent SnapInfo calls.
+type snapInfoResponse struct {
+	resp   *http.Response
+	remote storeInfo
 }
 
 // SnapInfo returns the snap.Info for the store-hosted snap matching the given spec, or an error.
 func (s *Store) SnapInfo(ctx context.Context, snapSpec SnapSpec, user *auth.UserState) (*snap.Info, error) {
+	fields, _ := s.v2Fields()
+	if len(snapSpec.Fields) > 0 {
+		fields = snapSpec.Fields
+	} else if snapSpec.Components {
+		fields = append(fields[:len(fields):len(fields)], "resources")
+	}
+
 	query := url.Values{}
-	query.Set("fields", strings.Join(s.infoFields, ","))
+	query.Set("fields", strings.Join(fields, ","))
 	query.Set("architecture", s.architecture)
 
 	u := s.endpointURL(path.Join(snapInfoEndpPath, snapSpec.Name), query)
@@ -1147,17 +1971,44 @@ func (s *Store) SnapInfo(ctx context.Context, snapSpec SnapSpec, user *auth.User
 		URL:      u,
 		APILevel: apiV2Endps,
 	}
+	s.setLocale(reqOptions)
+	if snapSpec.ETag != "" {
+		reqOptions.addHeader("If-None-Match", snapSpec.ETag)
+	}
+
+	if snapSpec.AnonDownloadURLs {
+		user = nil
+	}
 
-	var remote storeInfo
-	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &remote, nil)
+	// identical concurrent requests share a single round trip; the
+	// shared request is done with the context values of the first
+	// caller, so those that make it into the request are part of the
+	// key as well
+	userKey := storeCredentialsKey(user)
+	sessionKey := fmt.Sprintf("%p", deviceSessionFromContext(ctx))
+	key := strings.Join([]string{snapSpec.Name, query.Get("fields"), s.architecture, s.series, snapSpec.ETag, storeIDFromContext(ctx), sessionKey, ClientUserAgent(ctx), userKey}, "\x00")
+	res, err := s.snapInfoRequests.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		var remote storeInfo
+		resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &remote, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &snapInfoResponse{resp: resp, remote: remote}, nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	resp := res.(*snapInfoResponse).resp
+	// the shared response is only read from, and each caller gets
+	// its own snap.Info out of it
+	remote := res.(*snapInfoResponse).remote
 
 	// check statusCode
 	switch resp.StatusCode {
 	case 200:
 		// OK
+	case 304:
+		return nil, ErrNotModified
 	case 404:
 		return nil, ErrSnapNotFound
 	default:
@@ -1169,6 +2020,10 @@ func (s *Store) SnapInfo(ctx context.Context, snapSpec SnapSpec, user *auth.User
 	if err != nil {
 		return nil, err
 	}
+	info.StoreETag = resp.Header.Get("ETag")
+	if snapSpec.AnonDownloadURLs {
+		setAnonDownloadURLs(info)
+	}
 
 	err = s.decorateOrders([]*snap.Info{info}, user)
 	if err != nil {
@@ -1180,6 +2035,15 @@ func (s *Store) SnapInfo(ctx context.Context, snapSpec SnapSpec, user *auth.User
 	return info, nil
 }
 
+// setAnonDownloadURLs records the download URLs of info, fetched
+// without user authorization, as its anonymous ones as well.
+func setAnonDownloadURLs(info *snap.Info) {
+	info.AnonDownloadURL = info.DownloadURL
+	for i := range info.Deltas {
+		info.Deltas[i].AnonDownloadURL = info.Deltas[i].DownloadURL
+	}
+}
+
 // A Search is what you do in order to Find something
 type Search struct {
 	// Query is a term to search by or a prefix (if Prefix is true)
@@ -1192,11 +2056,193 @@ type Search struct {
 	Category string
 	Private  bool
 	Scope    string
+
+	// MaxContentRating, if set, has the store exclude snaps rated
+	// above it from the results; unrated snaps are still included.
+	MaxContentRating string
+
+	// ExtraParams are sent as additional query parameters with search
+	// v2 requests, e.g. to opt into store experiments. They cannot
+	// override the parameters set by Find itself.
+	ExtraParams map[string]string
+
+	// DedupeBySnapID has Find return only one result per snap ID,
+	// preferring the one from the stable channel when the snap
+	// was found in several channels.
+	DedupeBySnapID bool
+}
+
+// findReservedParams are the query parameters of search v2 requests
+// that are set by Find and cannot be given via Search.ExtraParams.
+var findReservedParams = []string{
+	"architecture",
+	"category",
+	"channel",
+	"common-id",
+	"confinement",
+	"fields",
+	"max-age-rating",
+	"name",
+	"private",
+	"q",
+	"scope",
+}
+
+// findBadQueryChars are the characters rejected in search queries,
+// see Find.
+const findBadQueryChars = `+=&|><!(){}[]^"~*?:\/`
+
+func checkFindExtraParams(params map[string]string) error {
+	for k, v := range params {
+		if k == "" || strutil.ListContains(findReservedParams, k) {
+			return fmt.Errorf("cannot override reserved search parameter %q", k)
+		}
+		if strings.ContainsAny(v, findBadQueryChars) {
+			return ErrBadQuery
+		}
+	}
+	return nil
 }
 
 // Find finds  (installable) snaps from the store, matching the
 // given Search.
 func (s *Store) Find(ctx context.Context, search *Search, user *auth.UserState) ([]*snap.Info, error) {
+	results, err := s.FindRanked(ctx, search, user)
+	if err != nil || results == nil {
+		return nil, err
+	}
+	snaps := make([]*snap.Info, len(results))
+	for i, res := range results {
+		snaps[i] = res.Info
+	}
+	return snaps, nil
+}
+
+// FindResult is a snap found by FindRanked.
+type FindResult struct {
+	Info *snap.Info
+	// Score is the relevance of the snap to the search as given by
+	// the store, if Scored; higher is more relevant.
+	Score  float64
+	Scored bool
+}
+
+// FindRanked works like Find but also returns the relevance scores
+// the store gave to the snaps found, if any. The results are in the
+// order the store returned them in.
+func (s *Store) FindRanked(ctx context.Context, search *Search, user *auth.UserState) ([]FindResult, error) {
+	reqOptions, err := s.findRequestOptions(search, user)
+	if err != nil {
+		return nil, err
+	}
+	u := reqOptions.URL
+
+	var searchData searchV2Results
+
+	ctx, cancel := s.withDefaultDeadline(ctx)
+	defer cancel()
+
+	// TODO: use retryRequestDecodeJSON (may require content-type check there,
+	// requires checking other handlers, their tests and store).
+	doRequest := func() (*http.Response, error) {
+		return s.doRequest(ctx, s.client, reqOptions, user)
+	}
+	readResponse := func(resp *http.Response) error {
+		ok := (resp.StatusCode == 200 || resp.StatusCode == 201)
+		ct := resp.Header.Get("Content-Type")
+		// always decode on success; decode failures only if body is not empty
+		if !ok && (resp.ContentLength == 0 || ct != jsonContentType) {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(&searchData)
+	}
+	resp, err := httputil.RetryRequestReportExhausted(u.String(), doRequest, readResponse, defaultRetryStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		// fallback to search v1; v2 may not be available on some proxies
+		if useFindV1(resp) {
+			snaps, err := s.findV1(ctx, search, user)
+			if err != nil || snaps == nil {
+				return nil, err
+			}
+			// search v1 does not score results
+			results := make([]FindResult, 0, len(snaps))
+			seen := newFindSeen(search)
+			for _, info := range snaps {
+				results = appendFindResult(results, seen, FindResult{Info: info})
+			}
+			return results, nil
+		}
+		return nil, findError(resp, searchData.ErrorList)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != jsonContentType {
+		return nil, fmt.Errorf("received an unexpected content type (%q) when trying to search via %q", ct, resp.Request.URL)
+	}
+
+	results := make([]FindResult, 0, len(searchData.Results))
+	seen := newFindSeen(search)
+	for _, res := range searchData.Results {
+		info, err := infoFromStoreSearchResult(res)
+		if err != nil {
+			return nil, err
+		}
+		result := FindResult{Info: info}
+		if res.Score != nil {
+			result.Score = *res.Score
+			result.Scored = true
+		}
+		results = appendFindResult(results, seen, result)
+	}
+	snaps := make([]*snap.Info, len(results))
+	for i, res := range results {
+		snaps[i] = res.Info
+	}
+
+	err = s.decorateOrders(snaps, user)
+	if err != nil {
+		logger.Noticef("cannot get user orders: %v", err)
+	}
+
+	s.extractSuggestedCurrency(resp)
+
+	return results, nil
+}
+
+// useFindV1 returns whether the given failed search v2 response asks
+// for falling back to search v1, i.e. v2 is not available from the
+// store (or a proxy of it).
+func useFindV1(resp *http.Response) bool {
+	if resp.StatusCode != 404 {
+		return false
+	}
+	verstr := resp.Header.Get("Snap-Store-Version")
+	ver, err := strconv.Atoi(verstr)
+	if err != nil {
+		logger.Debugf("Bogus Snap-Store-Version header %q.", verstr)
+		return false
+	}
+	return ver < 20
+}
+
+// findError returns the error for the given failed search v2
+// response, with the given errors from its body.
+func findError(resp *http.Response, errorList []storeError) error {
+	if len(errorList) > 0 {
+		if len(errorList) > 1 {
+			logger.Noticef("unexpected number of errors (%d) when trying to search via %q", len(errorList), resp.Request.URL)
+		}
+		return translateSnapActionError("", "", errorList[0].Code, errorList[0].Message, nil)
+	}
+	return respToError(resp, "search")
+}
+
+// findRequestOptions returns the options of the search v2 request for
+// the given Search.
+func (s *Store) findRequestOptions(search *Search, user *auth.UserState) (*requestOptions, error) {
 	if search.Private && user == nil {
 		return nil, ErrUnauthenticated
 	}
@@ -1209,12 +2255,21 @@ func (s *Store) Find(ctx context.Context, search *Search, user *auth.UserState)
 	//
 	// "-" might also be special on the server, but it's also a
 	// valid part of a package name, so we let it pass
-	if strings.ContainsAny(searchTerm, `+=&|><!(){}[]^"~*?:\/`) {
+	if strings.ContainsAny(searchTerm, findBadQueryChars) {
 		return nil, ErrBadQuery
 	}
 
+	if err := validateScope(search.Scope); err != nil {
+		return nil, err
+	}
+
+	if err := checkFindExtraParams(search.ExtraParams); err != nil {
+		return nil, err
+	}
+
+	_, findFields := s.v2Fields()
 	q := url.Values{}
-	q.Set("fields", strings.Join(s.findFields, ","))
+	q.Set("fields", strings.Join(findFields, ","))
 	q.Set("architecture", s.architecture)
 
 	if search.Private {
@@ -1240,8 +2295,14 @@ func (s *Store) Find(ctx context.Context, search *Search, user *auth.UserState)
 	// with v1) so we need to restrict channel if scope is not passed.
 	if search.Scope == "" {
 		q.Set("channel", "stable")
-	} else if search.Scope != "wide" {
-		return nil, ErrInvalidScope
+	}
+
+	if search.MaxContentRating != "" {
+		q.Set("max-age-rating", search.MaxContentRating)
+	}
+
+	for k, v := range search.ExtraParams {
+		q.Set(k, v)
 	}
 
 	if release.OnClassic {
@@ -1257,73 +2318,64 @@ func (s *Store) Find(ctx context.Context, search *Search, user *auth.UserState)
 		Accept:   jsonContentType,
 		APILevel: apiV2Endps,
 	}
+	s.setLocale(reqOptions)
+	return reqOptions, nil
+}
 
-	var searchData searchV2Results
-
-	// TODO: use retryRequestDecodeJSON (may require content-type check there,
-	// requires checking other handlers, their tests and store).
-	doRequest := func() (*http.Response, error) {
-		return s.doRequest(ctx, s.client, reqOptions, user)
-	}
-	readResponse := func(resp *http.Response) error {
-		ok := (resp.StatusCode == 200 || resp.StatusCode == 201)
-		ct := resp.Header.Get("Content-Type")
-		// always decode on success; decode failures only if body is not empty
-		if !ok && (resp.ContentLength == 0 || ct != jsonContentType) {
-			return nil
-		}
-		return json.NewDecoder(resp.Body).Decode(&searchData)
-	}
-	resp, err := httputil.RetryRequest(u.String(), doRequest, readResponse, defaultRetryStrategy)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != 200 {
-		// fallback to search v1; v2 may not be available on some proxies
-		if resp.StatusCode == 404 {
-			verstr := resp.Header.Get("Snap-Store-Version")
-			ver, err := strconv.Atoi(verstr)
-			if err != nil {
-				logger.Debugf("Bogus Snap-Store-Version header %q.", verstr)
-			} else if ver < 20 {
-				return s.findV1(ctx, search, user)
-			}
-		}
-		if len(searchData.ErrorList) > 0 {
-			if len(searchData.ErrorList) > 1 {
-				logger.Noticef("unexpected number of errors (%d) when trying to search via %q", len(searchData.ErrorList), resp.Request.URL)
-			}
-			return nil, translateSnapActionError("", "", searchData.ErrorList[0].Code, searchData.ErrorList[0].Message, nil)
-		}
-		return nil, respToError(resp, "search")
-	}
-
-	if ct := resp.Header.Get("Content-Type"); ct != jsonContentType {
-		return nil, fmt.Errorf("received an unexpected content type (%q) when trying to search via %q", ct, resp.Request.URL)
+// newFindSeen returns the map appendFindResult tracks the snap IDs
+// found so far in, if search asks for deduplicating the results, or
+// nil otherwise.
+func newFindSeen(search *Search) map[string]int {
+	if !search.DedupeBySnapID {
+		return nil
 	}
+	return make(map[string]int)
+}
 
-	snaps := make([]*snap.Info, len(searchData.Results))
-	for i, res := range searchData.Results {
-		info, err := infoFromStoreSearchResult(res)
-		if err != nil {
-			return nil, err
+// appendFindResult appends result to results. If seen is not nil and
+// a result for the same snap ID was appended already, the earlier
+// result is kept in place instead, unless result comes from the
+// stable channel and the earlier one does not, in which case result
+// replaces it.
+func appendFindResult(results []FindResult, seen map[string]int, result FindResult) []FindResult {
+	snapID := result.Info.SnapID
+	if seen == nil || snapID == "" {
+		return append(results, result)
+	}
+	if i, ok := seen[snapID]; ok {
+		if !isStableChannel(results[i].Info.Channel) && isStableChannel(result.Info.Channel) {
+			results[i] = result
 		}
-		snaps[i] = info
+		return results
 	}
+	seen[snapID] = len(results)
+	return append(results, result)
+}
 
-	err = s.decorateOrders(snaps, user)
+// isStableChannel returns whether ch is the stable risk of any track.
+func isStableChannel(ch string) bool {
+	c, err := channel.Parse(ch, "")
 	if err != nil {
-		logger.Noticef("cannot get user orders: %v", err)
+		return false
 	}
+	return c.Risk == "stable" && c.Branch == ""
+}
 
-	s.extractSuggestedCurrency(resp)
-
-	return snaps, nil
+// validateScope checks that scope is one of the supported search
+// scopes: "" (stable channel only) or "wide" (all channels).
+func validateScope(scope string) error {
+	switch scope {
+	case "", "wide":
+		return nil
+	}
+	return ErrInvalidScope
 }
 
 func (s *Store) findV1(ctx context.Context, search *Search, user *auth.UserState) ([]*snap.Info, error) {
 	// search.Query is already verified for illegal characters by Find()
+	if err := validateScope(search.Scope); err != nil {
+		return nil, err
+	}
 	searchTerm := strings.TrimSpace(search.Query)
 	q := s.defaultSnapQuery()
 
@@ -1346,8 +2398,9 @@ func (s *Store) findV1(ctx context.Context, search *Search, user *auth.UserState
 	if search.Category != "" {
 		q.Set("section", search.Category)
 	}
-	if search.Scope != "" {
-		q.Set("scope", search.Scope)
+	// v1 searches only the stable channel by default
+	if search.Scope == "wide" {
+		q.Set("scope", "wide")
 	}
 
 	if release.OnClassic {
@@ -1362,6 +2415,7 @@ func (s *Store) findV1(ctx context.Context, search *Search, user *auth.UserState
 		URL:    u,
 		Accept: halJsonContentType,
 	}
+	s.setLocale(reqOptions)
 
 	var searchData searchResults
 	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &searchData, nil)
@@ -1394,6 +2448,22 @@ func (s *Store) findV1(ctx context.Context, search *Search, user *auth.UserState
 
 // Sections retrieves the list of available store sections.
 func (s *Store) Sections(ctx context.Context, user *auth.UserState) ([]string, error) {
+	sections, err := s.sectionsV1(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	var sectionNames []string
+	for _, section := range sections {
+		sectionNames = append(sectionNames, section.Name)
+	}
+
+	return sectionNames, nil
+}
+
+// sectionsV1 retrieves the store sections via the v1 API, which only
+// knows about their names.
+func (s *Store) sectionsV1(ctx context.Context, user *auth.UserState) ([]Category, error) {
 	reqOptions := &requestOptions{
 		Method:         "GET",
 		URL:            s.endpointURL(sectionsEndpPath, nil),
@@ -1402,7 +2472,7 @@ func (s *Store) Sections(ctx context.Context, user *auth.UserState) ([]string, e
 	}
 
 	var sectionData sectionResults
-	resp, err := s.retryRequestDecodeJSON(context.TODO(), reqOptions, user, &sectionData, nil)
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &sectionData, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -1415,16 +2485,21 @@ func (s *Store) Sections(ctx context.Context, user *auth.UserState) ([]string, e
 		return nil, fmt.Errorf("received an unexpected content type (%q) when trying to retrieve the sections via %q", ct, resp.Request.URL)
 	}
 
-	var sectionNames []string
+	var sections []Category
 	for _, s := range sectionData.Payload.Sections {
-		sectionNames = append(sectionNames, s.Name)
+		sections = append(sections, Category{Name: s.Name})
 	}
 
-	return sectionNames, nil
+	return sections, nil
 }
 
 // WriteCatalogs queries the "commands" endpoint and writes the
-// command names into the given io.Writer.
+// command names into the given io.Writer. The names are only written
+// and the snaps passed to the SnapAdder once the whole catalog was
+// received and decoded, they are spooled to dirs.SnapCacheDir
+// meanwhile; a catalog stream that is cut short is retried, and if
+// that keeps happening ErrCatalogTruncated is returned and nothing is
+// written.
 func (s *Store) WriteCatalogs(ctx context.Context, names io.Writer, adder SnapAdder) error {
 	u := *s.endpointURL(commandsEndpPath, nil)
 
@@ -1448,14 +2523,44 @@ func (s *Store) WriteCatalogs(ctx context.Context, names io.Writer, adder SnapAd
 		MayLogBody: false,
 		Timeout:    10 * time.Second,
 	})
+	// spool the names and snaps so that a partial catalog is never
+	// written
+	if err := os.MkdirAll(dirs.SnapCacheDir, 0755); err != nil {
+		return err
+	}
+	tmpNames, err := ioutil.TempFile(dirs.SnapCacheDir, "snap-names-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpNames.Name())
+	defer tmpNames.Close()
+	tmpSnaps, err := ioutil.TempFile(dirs.SnapCacheDir, "snap-catalog-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpSnaps.Name())
+	defer tmpSnaps.Close()
+	snaps := newCatalogSpool(tmpSnaps)
+
 	doRequest := func() (*http.Response, error) {
 		return s.doRequest(ctx, client, reqOptions, nil)
 	}
 	readResponse := func(resp *http.Response) error {
-		return decodeCatalog(resp, names, adder)
+		// start afresh on each attempt
+		if err := truncateSpool(tmpNames); err != nil {
+			return err
+		}
+		if err := snaps.reset(); err != nil {
+			return err
+		}
+		return decodeCatalog(resp, tmpNames, snaps)
 	}
 
 	resp, err := httputil.RetryRequest(u.String(), doRequest, readResponse, defaultRetryStrategy)
+	if err == io.ErrUnexpectedEOF {
+		// still cut short on the last attempt
+		return ErrCatalogTruncated
+	}
 	if err != nil {
 		return err
 	}
@@ -1463,7 +2568,14 @@ func (s *Store) WriteCatalogs(ctx context.Context, names io.Writer, adder SnapAd
 		return respToError(resp, "refresh commands catalog")
 	}
 
-	return nil
+	if err := snaps.replay(adder); err != nil {
+		return err
+	}
+	if _, err := tmpNames.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(names, tmpNames)
+	return err
 }
 
 func findRev(needle snap.Revision, haystack []snap.Revision) bool {
@@ -1485,36 +2597,312 @@ func (e HashError) Error() string {
 	return fmt.Sprintf("sha3-384 mismatch for %q: got %s but expected %s", e.name, e.sha3_384, e.targetSha3_384)
 }
 
-type DownloadOptions struct {
-	RateLimit           int64
-	IsAutoRefresh       bool
-	LeavePartialOnError bool
+type SizeError struct {
+	name       string
+	size       int64
+	targetSize int64
 }
 
-// Download downloads the snap addressed by download info and returns its
-// filename.
-// The file is saved in temporary storage, and should be removed
-// after use to prevent the disk from running out of space.
-func (s *Store) Download(ctx context.Context, name string, targetPath string, downloadInfo *snap.DownloadInfo, pbar progress.Meter, user *auth.UserState, dlOpts *DownloadOptions) error {
-	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+func (e SizeError) Error() string {
+	return fmt.Sprintf("size mismatch for %q: got %d but expected %d", e.name, e.size, e.targetSize)
+}
+
+// checkDigest reads all of r from the start and returns a HashError if
+// its sha3-384 doesn't match the expected one.
+func checkDigest(name string, r io.ReadSeeker, sha3_384 string) error {
+	if _, err := r.Seek(0, os.SEEK_SET); err != nil {
 		return err
 	}
-
-	if err := s.cacher.Get(downloadInfo.Sha3_384, targetPath); err == nil {
-		logger.Debugf("Cache hit for SHA3_384 …%.5s.", downloadInfo.Sha3_384)
-		return nil
+	h := crypto.SHA3_384.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	actualSha3 := fmt.Sprintf("%x", h.Sum(nil))
+	if sha3_384 != actualSha3 {
+		return HashError{name, actualSha3, sha3_384}
+	}
+	return nil
+}
+
+// VerifyLocalSnap checks that the snap file at path matches the size
+// and sha3-384 advertised by the store in downloadInfo, returning a
+// SizeError or a HashError otherwise. Both must be known.
+func VerifyLocalSnap(path string, downloadInfo *snap.DownloadInfo) error {
+	if downloadInfo.Size == 0 {
+		return fmt.Errorf("cannot verify %q: no expected size", path)
+	}
+	if downloadInfo.Sha3_384 == "" {
+		return fmt.Errorf("cannot verify %q: no expected sha3-384", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != downloadInfo.Size {
+		return SizeError{path, fi.Size(), downloadInfo.Size}
+	}
+
+	return checkDigest(path, f, downloadInfo.Sha3_384)
+}
+
+type DownloadOptions struct {
+	RateLimit           int64
+	IsAutoRefresh       bool
+	LeavePartialOnError bool
+	// RefreshReason, if set, takes precedence over IsAutoRefresh
+	// for the Snap-Refresh-Reason header.
+	RefreshReason RefreshReason
+	// LowPriority marks background downloads that should yield to
+	// interactive ones; unless RateLimit is set they are capped at
+	// lowPriorityRateLimit.
+	LowPriority bool
+	// VerifyCacheHit makes Download re-check the digest of a file
+	// provided by the download cache, evicting it and downloading
+	// afresh if it does not match.
+	VerifyCacheHit bool
+	// ServedBy, if set, is called with the host that actually
+	// serves the download, i.e. the one reached after following
+	// any redirects to mirrors or caching proxies. It is not called
+	// for downloads provided by the download cache.
+	ServedBy func(host string)
+	// StallTimeout is how long a download may wait for data from
+	// the server before it is aborted and retried. If 0,
+	// defaultDownloadStallTimeout is used; if negative, stalls are
+	// not detected.
+	StallTimeout time.Duration
+	// ExpectPublisherID, if set, makes Download check that the
+	// downloaded snap is published by the account with this ID, as
+	// per its snap-declaration assertion (found via the snap-revision
+	// one, whatever account uploaded the revision). The assertions
+	// are fetched with their chain and verified against the trusted
+	// assertions of the system (see sysdb.Trusted). The downloaded
+	// snap is removed and an error (a PublisherMismatchError if the
+	// assertions check out but name another account) is returned
+	// otherwise.
+	ExpectPublisherID string
+	// IfModifiedSince and IfNoneMatch (an ETag), if set, make the
+	// download conditional: ErrDownloadNotModified is returned if
+	// the server says the snap did not change since that time or
+	// still has that ETag, e.g. to skip unchanged snaps when syncing
+	// a mirror. Deltas are not used for conditional downloads.
+	IfModifiedSince time.Time
+	IfNoneMatch     string
+}
+
+func (opts *DownloadOptions) conditional() bool {
+	return opts != nil && (!opts.IfModifiedSince.IsZero() || opts.IfNoneMatch != "")
+}
+
+// defaultDownloadStallTimeout is the StallTimeout of downloads without
+// an explicit one.
+var defaultDownloadStallTimeout = 60 * time.Second
+
+func (opts *DownloadOptions) stallTimeout() time.Duration {
+	if opts.StallTimeout == 0 {
+		return defaultDownloadStallTimeout
+	}
+	return opts.StallTimeout
+}
+
+// lowPriorityRateLimit is the rate limit (in bytes/sec) applied to low
+// priority downloads without an explicit one.
+var lowPriorityRateLimit int64 = 512 * 1024
+
+func (opts *DownloadOptions) rateLimit() int64 {
+	if opts.RateLimit == 0 && opts.LowPriority {
+		return lowPriorityRateLimit
+	}
+	return opts.RateLimit
+}
+
+// downloadRateLimit returns the rate limit (in bytes/sec, 0 meaning
+// unlimited) of a download with the given options, clamped to the
+// configured MinDownloadRate and MaxDownloadRate.
+func (s *Store) downloadRateLimit(opts *DownloadOptions) int64 {
+	limit := opts.rateLimit()
+	if min := s.cfg.MinDownloadRate; limit > 0 && limit < min {
+		logger.Noticef("Download rate limit of %d bytes/s is below the minimum, using %d bytes/s.", limit, min)
+		return min
+	}
+	if max := s.cfg.MaxDownloadRate; max > 0 && (limit == 0 || limit > max) {
+		if limit > 0 {
+			logger.Noticef("Download rate limit of %d bytes/s is above the maximum, using %d bytes/s.", limit, max)
+		}
+		return max
+	}
+	return limit
+}
+
+// Download downloads the snap addressed by download info and returns its
+// filename.
+// The file is saved in temporary storage, and should be removed
+// after use to prevent the disk from running out of space.
+func (s *Store) Download(ctx context.Context, name string, targetPath string, downloadInfo *snap.DownloadInfo, pbar progress.Meter, user *auth.UserState, dlOpts *DownloadOptions) error {
+	if err := s.downloadSnap(ctx, name, targetPath, downloadInfo, pbar, user, dlOpts); err != nil {
+		return err
+	}
+	if dlOpts == nil || dlOpts.ExpectPublisherID == "" {
+		return nil
+	}
+	if err := s.checkPublisher(ctx, name, targetPath, downloadInfo, user, dlOpts.ExpectPublisherID); err != nil {
+		if rerr := os.Remove(targetPath); rerr != nil {
+			logger.Noticef("Cannot remove %q: %v", targetPath, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkPublisher checks that the snap downloaded to targetPath is
+// published by the account with the given ID, going by its
+// snap-revision and snap-declaration assertions once verified against
+// the trusted assertions.
+func (s *Store) checkPublisher(ctx context.Context, name, targetPath string, downloadInfo *snap.DownloadInfo, user *auth.UserState, publisherID string) error {
+	var snapSHA3_384 string
+	if downloadInfo.Sha3_384 != "" {
+		// the download was checked against it
+		digest, err := hex.DecodeString(downloadInfo.Sha3_384)
+		if err != nil {
+			return fmt.Errorf("cannot check publisher of snap %q: %v", name, err)
+		}
+		snapSHA3_384, err = asserts.EncodeDigest(crypto.SHA3_384, digest)
+		if err != nil {
+			return fmt.Errorf("cannot check publisher of snap %q: %v", name, err)
+		}
+	} else {
+		var err error
+		snapSHA3_384, _, err = asserts.SnapFileSHA3_384(targetPath)
+		if err != nil {
+			return fmt.Errorf("cannot check publisher of snap %q: %v", name, err)
+		}
+	}
+
+	chain, err := s.FetchAssertionChain(ctx, asserts.SnapRevisionType, []string{snapSHA3_384}, user)
+	if err != nil {
+		return fmt.Errorf("cannot check publisher of snap %q: %v", name, err)
+	}
+	db, err := verifiedAssertionsDB(chain)
+	if err != nil {
+		return fmt.Errorf("cannot check publisher of snap %q: %v", name, err)
+	}
+
+	a, err := db.Find(asserts.SnapRevisionType, map[string]string{
+		"snap-sha3-384": snapSHA3_384,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot check publisher of snap %q: %v", name, err)
+	}
+	snapRev := a.(*asserts.SnapRevision)
+	if s.series != release.Series {
+		// the chain has the snap-declaration for the series of
+		// the system as prerequisite, fetch the one for the
+		// series of the store as well
+		declChain, err := s.FetchAssertionChain(ctx, asserts.SnapDeclarationType, []string{s.series, snapRev.SnapID()}, user)
+		if err != nil {
+			return fmt.Errorf("cannot check publisher of snap %q: %v", name, err)
+		}
+		if err := addVerifiedAssertions(db, declChain); err != nil {
+			return fmt.Errorf("cannot check publisher of snap %q: %v", name, err)
+		}
+	}
+	a, err = db.Find(asserts.SnapDeclarationType, map[string]string{
+		"series":  s.series,
+		"snap-id": snapRev.SnapID(),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot check publisher of snap %q: %v", name, err)
+	}
+	snapDecl := a.(*asserts.SnapDeclaration)
+
+	// the revision may have been uploaded by a collaborator, only
+	// the publisher matters
+	if snapDecl.PublisherID() != publisherID {
+		return &PublisherMismatchError{
+			Name:        name,
+			PublisherID: snapDecl.PublisherID(),
+			ExpectedID:  publisherID,
+		}
+	}
+	return nil
+}
+
+// trustedAssertions returns the roots of trust the assertions of
+// downloaded snaps are verified against.
+var trustedAssertions = sysdb.Trusted
+
+// verifiedAssertionsDB returns an in-memory assertions database with
+// the given chain, as returned by FetchAssertionChain, added to it
+// after checking it against the trusted assertions of the system.
+func verifiedAssertionsDB(chain []asserts.Assertion) (*asserts.Database, error) {
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: asserts.NewMemoryBackstore(),
+		Trusted:   trustedAssertions(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := addVerifiedAssertions(db, chain); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// addVerifiedAssertions adds the assertions of chain, as returned by
+// FetchAssertionChain, to db, skipping those it already has.
+func addVerifiedAssertions(db *asserts.Database, chain []asserts.Assertion) error {
+	for _, a := range chain {
+		if _, err := a.Ref().Resolve(db.Find); err == nil {
+			// the roots of trust the chain ends with, or the
+			// assertions shared with a previous chain, are
+			// already there
+			continue
+		}
+		if err := db.Add(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadSnap does the actual downloading for Download.
+func (s *Store) downloadSnap(ctx context.Context, name string, targetPath string, downloadInfo *snap.DownloadInfo, pbar progress.Meter, user *auth.UserState, dlOpts *DownloadOptions) error {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+
+	if err := s.cacher.Get(downloadInfo.Sha3_384, targetPath); err == nil {
+		logger.Debugf("Cache hit for SHA3_384 …%.5s.", downloadInfo.Sha3_384)
+		if dlOpts == nil || !dlOpts.VerifyCacheHit {
+			return nil
+		}
+		if err := s.verifyCacheHit(name, targetPath, downloadInfo.Sha3_384); err == nil {
+			return nil
+		}
 	}
 
-	if useDeltas() {
+	if s.useDeltas() && !dlOpts.conditional() {
 		logger.Debugf("Available deltas returned by store: %v", downloadInfo.Deltas)
 
-		if len(downloadInfo.Deltas) == 1 {
-			err := s.downloadAndApplyDelta(name, targetPath, downloadInfo, pbar, user, dlOpts)
+		switch len(downloadInfo.Deltas) {
+		case 0:
+			// nothing to do
+		case 1:
+			err := s.downloadAndApplyDelta(ctx, name, targetPath, downloadInfo, pbar, user, dlOpts)
+			s.recordDeltaAttempt(err)
 			if err == nil {
 				return nil
 			}
 			// We revert to normal downloads if there is any error.
 			logger.Noticef("Cannot download or apply deltas for %s: %v", name, err)
+		default:
+			s.recordDeltaSkipped()
 		}
 	}
 
@@ -1562,17 +2950,7 @@ func (s *Store) Download(ctx context.Context, name string, targetPath string, do
 		}
 	} else {
 		// we're done! check the hash though
-		h := crypto.SHA3_384.New()
-		if _, err := w.Seek(0, os.SEEK_SET); err != nil {
-			return err
-		}
-		if _, err := io.Copy(h, w); err != nil {
-			return err
-		}
-		actualSha3 := fmt.Sprintf("%x", h.Sum(nil))
-		if downloadInfo.Sha3_384 != actualSha3 {
-			err = HashError{name, actualSha3, downloadInfo.Sha3_384}
-		}
+		err = checkDigest(name, w, downloadInfo.Sha3_384)
 	}
 	// If hashsum is incorrect retry once
 	if _, ok := err.(HashError); ok {
@@ -1604,7 +2982,150 @@ func (s *Store) Download(ctx context.Context, name string, targetPath string, do
 		return err
 	}
 
-	return s.cacher.Put(downloadInfo.Sha3_384, targetPath)
+	return s.cacheDownload(ctx, downloadInfo.Sha3_384, targetPath)
+}
+
+var errUnseekableDownload = errors.New("cannot seek in download written to a stream")
+
+// streamWriter adapts a plain io.Writer for download, which can then
+// only (re)start from the beginning as long as nothing was written.
+type streamWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *streamWriter) Read(p []byte) (int, error) {
+	return 0, errUnseekableDownload
+}
+
+func (w *streamWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && w.n == 0 && whence != os.SEEK_CUR {
+		return 0, nil
+	}
+	return 0, errUnseekableDownload
+}
+
+// DownloadTo downloads the snap addressed by the given download info
+// to w, checking its hash and retrying as Download does. If w is an
+// io.ReadWriteSeeker what it already holds is taken as the start of
+// the snap and the download is resumed after it; if it also has a
+// Truncate method the download is retried from scratch on a hash
+// mismatch. Downloads to other writers cannot be resumed or retried
+// once data was written.
+func (s *Store) DownloadTo(ctx context.Context, name string, w io.Writer, downloadInfo *snap.DownloadInfo, pbar progress.Meter, user *auth.UserState, dlOpts *DownloadOptions) error {
+	authAvail, err := s.authAvailable(user)
+	if err != nil {
+		return err
+	}
+
+	url := downloadInfo.AnonDownloadURL
+	if url == "" || authAvail {
+		url = downloadInfo.DownloadURL
+	}
+
+	rws, ok := w.(io.ReadWriteSeeker)
+	if !ok {
+		return download(ctx, name, downloadInfo.Sha3_384, url, user, s, &streamWriter{Writer: w}, 0, pbar, dlOpts)
+	}
+
+	resume, err := rws.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if downloadInfo.Size == 0 || resume < downloadInfo.Size {
+		err = download(ctx, name, downloadInfo.Sha3_384, url, user, s, rws, resume, pbar, dlOpts)
+	} else {
+		err = checkDigest(name, rws, downloadInfo.Sha3_384)
+	}
+	truncater, ok := w.(interface{ Truncate(int64) error })
+	if _, isHashErr := err.(HashError); isHashErr && ok {
+		logger.Debugf("Hashsum error on download: %v", err.Error())
+		logger.Debugf("Truncating and trying again from scratch.")
+		if err := truncater.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := rws.Seek(0, os.SEEK_SET); err != nil {
+			return err
+		}
+		err = download(ctx, name, downloadInfo.Sha3_384, url, user, s, rws, 0, pbar, nil)
+	}
+	return err
+}
+
+// DownloadWithAssertions downloads the snap like Download and also
+// fetches the given assertions (e.g. its snap-declaration and
+// snap-revision), writing them to a sidecar .assert file next to the
+// snap (targetPath with its .snap extension, if any, replaced), so
+// that the two together can be installed offline. The assertions are
+// fetched first, so that a failure to get them does not waste a
+// download.
+func (s *Store) DownloadWithAssertions(ctx context.Context, name string, targetPath string, downloadInfo *snap.DownloadInfo, assertRefs []*asserts.Ref, user *auth.UserState, dlOpts *DownloadOptions) error {
+	var buf bytes.Buffer
+	enc := asserts.NewEncoder(&buf)
+	for _, ref := range assertRefs {
+		a, err := s.AssertionWithOptions(ctx, ref.Type, ref.PrimaryKey, user, nil)
+		if err != nil {
+			return fmt.Errorf("cannot fetch assertion %s: %v", ref, err)
+		}
+		if err := enc.Encode(a); err != nil {
+			return err
+		}
+	}
+
+	if err := s.Download(ctx, name, targetPath, downloadInfo, nil, user, dlOpts); err != nil {
+		return err
+	}
+
+	assertPath := strings.TrimSuffix(targetPath, ".snap") + ".assert"
+	return osutil.AtomicWriteFile(assertPath, buf.Bytes(), 0644, 0)
+}
+
+// verifyCacheHit checks the digest of the file at targetPath that was
+// provided by the cache; if it does not match the file is removed and
+// also evicted from the cache.
+func (s *Store) verifyCacheHit(name, targetPath, sha3_384 string) error {
+	f, err := os.Open(targetPath)
+	if err != nil {
+		return err
+	}
+	err = checkDigest(name, f, sha3_384)
+	f.Close()
+	if err == nil {
+		return nil
+	}
+
+	logger.Noticef("Cannot use cached download of %s, evicting it: %v", name, err)
+	if rerr := os.Remove(targetPath); rerr != nil && !os.IsNotExist(rerr) {
+		logger.Noticef("Cannot remove %q: %v", targetPath, rerr)
+	}
+	if rerr := s.cacher.Remove(sha3_384); rerr != nil {
+		logger.Noticef("Cannot evict %s from the download cache: %v", name, rerr)
+	}
+	return err
+}
+
+// cacheDownload puts the downloaded file at targetPath into the
+// download cache unless ctx is done. Caching is best-effort: if ctx is
+// cancelled before or while caching, the caching is skipped or aborted
+// and the download is still considered successful.
+func (s *Store) cacheDownload(ctx context.Context, cacheKey, targetPath string) error {
+	if cancelled(ctx) {
+		logger.Debugf("Not caching %q: %v.", targetPath, ctx.Err())
+		return nil
+	}
+
+	err := s.cacher.Put(ctx, cacheKey, targetPath)
+	if err != nil && cancelled(ctx) {
+		logger.Debugf("Caching of %q aborted: %v.", targetPath, err)
+		return nil
+	}
+	return err
 }
 
 func downloadReqOpts(storeURL *url.URL, cdnHeader string, opts *DownloadOptions) *requestOptions {
@@ -1612,14 +3133,26 @@ func downloadReqOpts(storeURL *url.URL, cdnHeader string, opts *DownloadOptions)
 		Method:       "GET",
 		URL:          storeURL,
 		ExtraHeaders: map[string]string{},
+		IsDownload:   true,
 		// FIXME: use the new headers? with
 		// APILevel: apiV2Endps,
 	}
 	if cdnHeader != "" {
 		reqOptions.ExtraHeaders["Snap-CDN"] = cdnHeader
 	}
-	if opts != nil && opts.IsAutoRefresh {
-		reqOptions.ExtraHeaders["Snap-Refresh-Reason"] = "scheduled"
+	if opts != nil {
+		if reason := refreshReasonHeader(opts.RefreshReason, opts.IsAutoRefresh); reason != "" {
+			reqOptions.ExtraHeaders["Snap-Refresh-Reason"] = reason
+		}
+	}
+	if opts != nil && opts.LowPriority {
+		reqOptions.ExtraHeaders["Snap-Download-Priority"] = "low"
+	}
+	if opts != nil && !opts.IfModifiedSince.IsZero() {
+		reqOptions.ExtraHeaders["If-Modified-Since"] = opts.IfModifiedSince.UTC().Format(http.TimeFormat)
+	}
+	if opts != nil && opts.IfNoneMatch != "" {
+		reqOptions.ExtraHeaders["If-None-Match"] = opts.IfNoneMatch
 	}
 
 	return &reqOptions
@@ -1627,6 +3160,75 @@ func downloadReqOpts(storeURL *url.URL, cdnHeader string, opts *DownloadOptions)
 
 var ratelimitReader = ratelimit.Reader
 
+// downloadStalledError is returned by a stallReader whose reads got
+// no data for its timeout. It is a net.Error timeout, so that the
+// download is retried.
+type downloadStalledError struct {
+	timeout time.Duration
+}
+
+func (e *downloadStalledError) Error() string {
+	return fmt.Sprintf("download stalled: no data received for %v", e.timeout)
+}
+
+func (e *downloadStalledError) Timeout() bool   { return true }
+func (e *downloadStalledError) Temporary() bool { return true }
+
+// stallReader reads from the body of a download response, closing it
+// to abort the download if a single read blocks for longer than
+// timeout. Only the time spent in reads counts, so that e.g. waiting
+// for the rate limiter does not look like a stall.
+type stallReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+
+	mu sync.Mutex
+	// gen identifies the current read, so that the timer of an
+	// earlier read firing late does not abort a later one
+	gen     int
+	reading bool
+	stalled bool
+}
+
+func newStallReader(body io.ReadCloser, timeout time.Duration) *stallReader {
+	return &stallReader{body: body, timeout: timeout}
+}
+
+func (r *stallReader) expire(gen int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if gen != r.gen || !r.reading {
+		// that read is over
+		return
+	}
+	r.stalled = true
+	r.body.Close()
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	if r.timeout <= 0 {
+		return r.body.Read(p)
+	}
+	r.mu.Lock()
+	r.gen++
+	gen := r.gen
+	r.reading = true
+	r.mu.Unlock()
+
+	timer := httputil.AfterFunc(r.timeout, func() { r.expire(gen) })
+	n, err := r.body.Read(p)
+	timer.Stop()
+
+	r.mu.Lock()
+	r.reading = false
+	stalled := r.stalled
+	r.mu.Unlock()
+	if stalled {
+		return n, &downloadStalledError{r.timeout}
+	}
+	return n, err
+}
+
 var download = downloadImpl
 
 // download writes an http.Request showing a progress.Meter
@@ -1634,6 +3236,7 @@ func downloadImpl(ctx context.Context, name, sha3_384, downloadURL string, user
 	if dlOpts == nil {
 		dlOpts = &DownloadOptions{}
 	}
+	rateLimit := s.downloadRateLimit(dlOpts)
 
 	storeURL, err := url.Parse(downloadURL)
 	if err != nil {
@@ -1647,8 +3250,9 @@ func downloadImpl(ctx context.Context, name, sha3_384, downloadURL string, user
 
 	var finalErr error
 	var dlSize float64
-	startTime := time.Now()
-	for attempt := retry.Start(downloadRetryStrategy, nil); attempt.Next(); {
+	clock := httputil.Clock()
+	startTime := clock.Now()
+	for attempt := retry.Start(downloadRetryStrategy, clock); attempt.Next(); {
 		reqOptions := downloadReqOpts(storeURL, cdnHeader, dlOpts)
 
 		httputil.MaybeLogRetryAttempt(reqOptions.URL.String(), attempt, startTime)
@@ -1674,7 +3278,7 @@ func downloadImpl(ctx context.Context, name, sha3_384, downloadURL string, user
 			return fmt.Errorf("The download has been cancelled: %s", ctx.Err())
 		}
 		var resp *http.Response
-		cli := s.newHTTPClient(nil)
+		cli := s.newDownloadHTTPClient()
 		resp, finalErr = s.doRequest(ctx, cli, reqOptions, user)
 
 		if cancelled(ctx) {
@@ -1698,16 +3302,43 @@ func downloadImpl(ctx context.Context, name, sha3_384, downloadURL string, user
 			resp.Body.Close()
 			continue
 		}
+		if resp.StatusCode == 429 && attempt.More() {
+			resp.Body.Close()
+			// attempt.Next sleeps only until the strategy's next
+			// deadline, so the time spent waiting here counts
+			// towards the strategy delay instead of adding to it
+			wait := retryAfter(resp, maxDownloadRetryAfter)
+			logger.Debugf("Download of %q throttled, retrying in %v.", name, wait)
+			select {
+			case <-clock.After(wait):
+			case <-ctx.Done():
+				return fmt.Errorf("The download has been cancelled: %s", ctx.Err())
+			}
+			continue
+		}
 
 		defer resp.Body.Close()
 
 		switch resp.StatusCode {
 		case 200, 206: // OK, Partial Content
+		case 304: // Not Modified, for conditional downloads
+			return ErrDownloadNotModified
 		case 402: // Payment Required
 
 			return fmt.Errorf("please buy %s before installing it.", name)
 		default:
-			return &DownloadError{Code: resp.StatusCode, URL: resp.Request.URL}
+			dlErr := &DownloadError{Code: resp.StatusCode, URL: resp.Request.URL}
+			if resp.StatusCode == 429 || resp.StatusCode == 503 {
+				dlErr.RetryAfter = retryAfter(resp, maxDownloadRetryAfter)
+			}
+			return dlErr
+		}
+
+		// the request is the last one of any redirects followed
+		servedBy := resp.Request.URL.Host
+		logger.Debugf("Download of %q served by %s.", name, servedBy)
+		if dlOpts.ServedBy != nil {
+			dlOpts.ServedBy(servedBy)
 		}
 
 		if pbar == nil {
@@ -1717,10 +3348,14 @@ func downloadImpl(ctx context.Context, name, sha3_384, downloadURL string, user
 		pbar.Start(name, dlSize)
 		mw := io.MultiWriter(w, h, pbar)
 		var limiter io.Reader
-		limiter = resp.Body
-		if limit := dlOpts.RateLimit; limit > 0 {
-			bucket := ratelimit.NewBucketWithRate(float64(limit), 2*limit)
-			limiter = ratelimitReader(resp.Body, bucket)
+		body := newStallReader(resp.Body, dlOpts.stallTimeout())
+		limiter = body
+		if rateLimit > 0 {
+			bucket := ratelimit.NewBucketWithRate(float64(rateLimit), 2*rateLimit)
+			limiter = ratelimitReader(body, bucket)
+		}
+		if s.globalDownloadBucket != nil {
+			limiter = ratelimitReader(limiter, s.globalDownloadBucket)
 		}
 		_, finalErr = io.Copy(mw, limiter)
 		pbar.Finished()
@@ -1749,7 +3384,7 @@ func downloadImpl(ctx context.Context, name, sha3_384, downloadURL string, user
 	}
 	if finalErr == nil {
 		// not using quantity.FormatFoo as this is just for debug
-		dt := time.Since(startTime)
+		dt := clock.Now().Sub(startTime)
 		r := dlSize / dt.Seconds()
 		var p rune
 		for _, p = range " kMGTPEZY" {
@@ -1764,25 +3399,77 @@ func downloadImpl(ctx context.Context, name, sha3_384, downloadURL string, user
 	return finalErr
 }
 
+// retryAfter returns the delay requested by the Retry-After header of
+// the response, either as seconds or as an HTTP date, capped at max.
+func retryAfter(resp *http.Response, max time.Duration) time.Duration {
+	var d time.Duration
+	v := resp.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(httputil.Clock().Now())
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
 // DownloadStream will copy the snap from the request to the io.Reader
 func (s *Store) DownloadStream(ctx context.Context, name string, downloadInfo *snap.DownloadInfo, resume int64, user *auth.UserState) (io.ReadCloser, int, error) {
+	return s.DownloadStreamWithOptions(ctx, name, downloadInfo, resume, user, nil)
+}
+
+// DownloadStreamWithOptions is like DownloadStream but takes download
+// options; the full snap is streamed with only the conditional ones
+// (IfModifiedSince and IfNoneMatch), the refresh reason and the
+// priority, while a delta is downloaded with all of them.
+func (s *Store) DownloadStreamWithOptions(ctx context.Context, name string, downloadInfo *snap.DownloadInfo, resume int64, user *auth.UserState, dlOpts *DownloadOptions) (io.ReadCloser, int, error) {
 	// XXX: coverage of this is rather poor
-	if path := s.cacher.GetPath(downloadInfo.Sha3_384); path != "" {
+	// the file is opened straight away, and kept from being evicted
+	// while it is read
+	file, err := s.cacher.Open(downloadInfo.Sha3_384)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	if err == nil {
 		logger.Debugf("Cache hit for SHA3_384 …%.5s.", downloadInfo.Sha3_384)
-		file, err := os.OpenFile(path, os.O_RDONLY, 0600)
+		if resume == 0 {
+			return file, 200, nil
+		}
+		fi, err := file.Stat()
 		if err != nil {
+			file.Close()
 			return nil, 0, err
 		}
-		if resume == 0 {
-			return file, 200, nil
+		// seeking past the end would silently give a truncated result
+		if resume > fi.Size() {
+			file.Close()
+			return nil, 0, fmt.Errorf("cannot resume download of %q from offset %d: cached file has only %d bytes", name, resume, fi.Size())
 		}
 		_, err = file.Seek(resume, os.SEEK_SET)
 		if err != nil {
+			file.Close()
 			return nil, 0, err
 		}
 		return file, 206, nil
 	}
 
+	if resume == 0 && s.useDeltas() && len(downloadInfo.Deltas) == 1 && !dlOpts.conditional() {
+		logger.Debugf("Available deltas returned by store: %v", downloadInfo.Deltas)
+
+		r, err := s.downloadAndApplyDeltaStream(ctx, name, downloadInfo, user, dlOpts)
+		s.recordDeltaAttempt(err)
+		if err == nil {
+			return r, 200, nil
+		}
+		// We revert to streaming the full snap if there is any error.
+		logger.Noticef("Cannot download or apply deltas for %s: %v", name, err)
+	}
+
 	authAvail, err := s.authAvailable(user)
 	if err != nil {
 		return nil, 0, err
@@ -1803,26 +3490,51 @@ func (s *Store) DownloadStream(ctx context.Context, name string, downloadInfo *s
 		return nil, 0, err
 	}
 
-	resp, err := doDownloadReq(ctx, storeURL, cdnHeader, resume, s, user)
+	resp, err := doDownloadReq(ctx, storeURL, cdnHeader, resume, s, user, dlOpts)
 	if err != nil {
 		return nil, 0, err
 	}
+	if resp.StatusCode == 304 {
+		resp.Body.Close()
+		return nil, resp.StatusCode, ErrDownloadNotModified
+	}
 	return resp.Body, resp.StatusCode, nil
 }
 
 var doDownloadReq = doDownloadReqImpl
 
-func doDownloadReqImpl(ctx context.Context, storeURL *url.URL, cdnHeader string, resume int64, s *Store, user *auth.UserState) (*http.Response, error) {
-	reqOptions := downloadReqOpts(storeURL, cdnHeader, nil)
+func doDownloadReqImpl(ctx context.Context, storeURL *url.URL, cdnHeader string, resume int64, s *Store, user *auth.UserState, dlOpts *DownloadOptions) (*http.Response, error) {
+	reqOptions := downloadReqOpts(storeURL, cdnHeader, dlOpts)
 	if resume > 0 {
 		reqOptions.ExtraHeaders["Range"] = fmt.Sprintf("bytes=%d-", resume)
 	}
-	cli := s.newHTTPClient(nil)
+	cli := s.newDownloadHTTPClient()
 	return s.doRequest(ctx, cli, reqOptions, user)
 }
 
+// newDownloadHTTPClient returns a client for downloads, which only
+// follows redirects to the allowed hosts if any are configured.
+func (s *Store) newDownloadHTTPClient() *http.Client {
+	cli := s.newHTTPClient(nil)
+	allowed := s.cfg.DownloadRedirectAllowHosts
+	if len(allowed) == 0 {
+		return cli
+	}
+	checkRedirect := cli.CheckRedirect
+	cli.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !strutil.ListContains(allowed, req.URL.Host) && !strutil.ListContains(allowed, req.URL.Hostname()) {
+			return fmt.Errorf("cannot follow download redirect to %q: host is not allowed", req.URL.Host)
+		}
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		return nil
+	}
+	return cli
+}
+
 // downloadDelta downloads the delta for the preferred format, returning the path.
-func (s *Store) downloadDelta(deltaName string, downloadInfo *snap.DownloadInfo, w io.ReadWriteSeeker, pbar progress.Meter, user *auth.UserState, dlOpts *DownloadOptions) error {
+func (s *Store) downloadDelta(ctx context.Context, deltaName string, downloadInfo *snap.DownloadInfo, w io.ReadWriteSeeker, pbar progress.Meter, user *auth.UserState, dlOpts *DownloadOptions) error {
 
 	if len(downloadInfo.Deltas) != 1 {
 		return errors.New("store returned more than one download delta")
@@ -1844,25 +3556,74 @@ func (s *Store) downloadDelta(deltaName string, downloadInfo *snap.DownloadInfo,
 		url = deltaInfo.DownloadURL
 	}
 
-	return download(context.TODO(), deltaName, deltaInfo.Sha3_384, url, user, s, w, 0, pbar, dlOpts)
+	return download(ctx, deltaName, deltaInfo.Sha3_384, url, user, s, w, 0, pbar, dlOpts)
 }
 
-func getXdelta3Cmd(args ...string) (*exec.Cmd, error) {
+// getXdelta3Cmd returns the command running xdelta3 with the given
+// arguments, using the binary at xdelta3Path if set.
+func getXdelta3Cmd(xdelta3Path string, args ...string) (*exec.Cmd, error) {
+	if xdelta3Path != "" {
+		st, err := os.Stat(xdelta3Path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot use xdelta3 at %q: %v", xdelta3Path, err)
+		}
+		if !st.Mode().IsRegular() || st.Mode().Perm()&0111 == 0 {
+			return nil, fmt.Errorf("cannot use xdelta3 at %q: not an executable file", xdelta3Path)
+		}
+		return exec.Command(xdelta3Path, args...), nil
+	}
 	if osutil.ExecutableExists("xdelta3") {
 		return exec.Command("xdelta3", args...), nil
 	}
 	return cmdutil.CommandFromSystemSnap("/usr/bin/xdelta3", args...)
 }
 
-// applyDelta generates a target snap from a previously downloaded snap and a downloaded delta.
-var applyDelta = func(name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
+// deltaSourcePath returns the path of the previously downloaded snap
+// the given delta applies to.
+func deltaSourcePath(name string, deltaInfo *snap.DeltaInfo) string {
 	snapBase := fmt.Sprintf("%s_%d.snap", name, deltaInfo.FromRevision)
-	snapPath := filepath.Join(dirs.SnapBlobDir, snapBase)
+	return filepath.Join(dirs.SnapBlobDir, snapBase)
+}
+
+// EstimateDownloadSize reports how much Download would fetch for the
+// given snap: the size of the full snap and, if the store offered a
+// delta that Download would use because its source revision is
+// available locally, the size of that delta. It does not touch the
+// network.
+func (s *Store) EstimateDownloadSize(name string, downloadInfo *snap.DownloadInfo) (full int64, delta int64, deltaApplicable bool) {
+	full = downloadInfo.Size
+	if !s.useDeltas() || len(downloadInfo.Deltas) != 1 {
+		return full, 0, false
+	}
+	deltaInfo := &downloadInfo.Deltas[0]
+	if deltaInfo.Format != s.deltaFormat || !osutil.FileExists(deltaSourcePath(name, deltaInfo)) {
+		return full, 0, false
+	}
+	return full, deltaInfo.Size, true
+}
+
+// applyDelta generates a target snap from a previously downloaded snap and a downloaded delta,
+// using the xdelta3 binary at xdelta3Path if set. xdelta3 is killed if
+// ctx is done before it finished.
+var applyDelta = func(ctx context.Context, xdelta3Path string, name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
+	snapPath := deltaSourcePath(name, deltaInfo)
 
 	if !osutil.FileExists(snapPath) {
 		return fmt.Errorf("snap %q revision %d not found at %s", name, deltaInfo.FromRevision, snapPath)
 	}
 
+	// the baseline is found by its name only, make sure it is
+	// actually the expected revision before building on it
+	if deltaInfo.FromSha3_384 != "" {
+		bsha3_384, _, err := osutil.FileDigest(snapPath, crypto.SHA3_384)
+		if err != nil {
+			return err
+		}
+		if sha3_384 := fmt.Sprintf("%x", bsha3_384); sha3_384 != deltaInfo.FromSha3_384 {
+			return fmt.Errorf("cannot apply delta: snap %q revision %d is corrupted: %v", name, deltaInfo.FromRevision, HashError{name, sha3_384, deltaInfo.FromSha3_384})
+		}
+	}
+
 	if deltaInfo.Format != "xdelta3" {
 		return fmt.Errorf("cannot apply unsupported delta format %q (only xdelta3 currently)", deltaInfo.Format)
 	}
@@ -1870,12 +3631,12 @@ var applyDelta = func(name string, deltaPath string, deltaInfo *snap.DeltaInfo,
 	partialTargetPath := targetPath + ".partial"
 
 	xdelta3Args := []string{"-d", "-s", snapPath, deltaPath, partialTargetPath}
-	cmd, err := getXdelta3Cmd(xdelta3Args...)
+	cmd, err := getXdelta3Cmd(xdelta3Path, xdelta3Args...)
 	if err != nil {
 		return err
 	}
 
-	if err := cmd.Run(); err != nil {
+	if err := runCmdContext(ctx, cmd); err != nil {
 		if err := os.Remove(partialTargetPath); err != nil {
 			logger.Noticef("failed to remove partial delta target %q: %s", partialTargetPath, err)
 		}
@@ -1905,17 +3666,49 @@ var applyDelta = func(name string, deltaPath string, deltaInfo *snap.DeltaInfo,
 	return nil
 }
 
+// runCmdContext runs cmd, killing it if ctx is done before it finished.
+func runCmdContext(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// deltaTempPrefix returns the prefix of the name of the temporary
+// file the given delta for targetPath is downloaded to. The target
+// name and the delta details are hashed so that the name stays short
+// however long the target name is, and the file is created with
+// ioutil.TempFile, which appends a random suffix to the prefix, so
+// that concurrent downloads of the same delta for the same target
+// don't clobber each other.
+func deltaTempPrefix(targetPath string, deltaInfo *snap.DeltaInfo) string {
+	key := fmt.Sprintf("%s\x00%s-%d-to-%d", filepath.Base(targetPath), deltaInfo.Format, deltaInfo.FromRevision, deltaInfo.ToRevision)
+	h := sha256.Sum256([]byte(key))
+	return fmt.Sprintf(".%x.", h[:8])
+}
+
 // downloadAndApplyDelta downloads and then applies the delta to the current snap.
-func (s *Store) downloadAndApplyDelta(name, targetPath string, downloadInfo *snap.DownloadInfo, pbar progress.Meter, user *auth.UserState, dlOpts *DownloadOptions) error {
+func (s *Store) downloadAndApplyDelta(ctx context.Context, name, targetPath string, downloadInfo *snap.DownloadInfo, pbar progress.Meter, user *auth.UserState, dlOpts *DownloadOptions) error {
 	deltaInfo := &downloadInfo.Deltas[0]
 
-	deltaPath := fmt.Sprintf("%s.%s-%d-to-%d.partial", targetPath, deltaInfo.Format, deltaInfo.FromRevision, deltaInfo.ToRevision)
 	deltaName := fmt.Sprintf(i18n.G("%s (delta)"), name)
 
-	w, err := os.OpenFile(deltaPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	w, err := ioutil.TempFile(filepath.Dir(targetPath), deltaTempPrefix(targetPath, deltaInfo))
 	if err != nil {
 		return err
 	}
+	deltaPath := w.Name()
 	defer func() {
 		if cerr := w.Close(); cerr != nil && err == nil {
 			err = cerr
@@ -1923,13 +3716,13 @@ func (s *Store) downloadAndApplyDelta(name, targetPath string, downloadInfo *sna
 		os.Remove(deltaPath)
 	}()
 
-	err = s.downloadDelta(deltaName, downloadInfo, w, pbar, user, dlOpts)
+	err = s.downloadDelta(ctx, deltaName, downloadInfo, w, pbar, user, dlOpts)
 	if err != nil {
 		return err
 	}
 
 	logger.Debugf("Successfully downloaded delta for %q at %s", name, deltaPath)
-	if err := applyDelta(name, deltaPath, deltaInfo, targetPath, downloadInfo.Sha3_384); err != nil {
+	if err := applyDelta(ctx, s.cfg.Xdelta3Path, name, deltaPath, deltaInfo, targetPath, downloadInfo.Sha3_384); err != nil {
 		return err
 	}
 
@@ -1937,6 +3730,74 @@ func (s *Store) downloadAndApplyDelta(name, targetPath string, downloadInfo *sna
 	return nil
 }
 
+// DeltaStats holds counters about the use of deltas by downloads.
+type DeltaStats struct {
+	// Offered counts the downloads for which the store offered deltas.
+	Offered int
+	// Applied counts the deltas that were downloaded and applied.
+	Applied int
+	// Failed counts the deltas that could not be downloaded or applied.
+	Failed int
+	// FullDownloadFallbacks counts the downloads for which deltas were
+	// offered but the full snap was downloaded instead.
+	FullDownloadFallbacks int
+}
+
+// DeltaStats returns a snapshot of the delta counters of the store.
+func (s *Store) DeltaStats() DeltaStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deltaStats
+}
+
+// recordDeltaAttempt counts the outcome of trying to download and apply
+// an offered delta, a failure meaning a fallback to the full snap.
+func (s *Store) recordDeltaAttempt(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deltaStats.Offered++
+	if err == nil {
+		s.deltaStats.Applied++
+	} else {
+		s.deltaStats.Failed++
+		s.deltaStats.FullDownloadFallbacks++
+	}
+}
+
+// recordDeltaSkipped counts offered deltas that were not even tried.
+func (s *Store) recordDeltaSkipped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deltaStats.Offered++
+	s.deltaStats.FullDownloadFallbacks++
+}
+
+// downloadAndApplyDeltaStream downloads and applies the delta to the
+// current snap in a temporary location next to it, as the resulting
+// snap can be large, and returns a reader over the resulting snap.
+func (s *Store) downloadAndApplyDeltaStream(ctx context.Context, name string, downloadInfo *snap.DownloadInfo, user *auth.UserState, dlOpts *DownloadOptions) (io.ReadCloser, error) {
+	deltaInfo := &downloadInfo.Deltas[0]
+	// don't bother downloading the delta if it cannot be applied
+	snapPath := deltaSourcePath(name, deltaInfo)
+	if !osutil.FileExists(snapPath) {
+		return nil, fmt.Errorf("snap %q revision %d not found at %s", name, deltaInfo.FromRevision, snapPath)
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Dir(snapPath), ".delta-stream-")
+	if err != nil {
+		return nil, err
+	}
+	// the opened file stays readable after being removed
+	defer os.RemoveAll(tmpDir)
+
+	targetPath := filepath.Join(tmpDir, name+".snap")
+	if err := s.downloadAndApplyDelta(ctx, name, targetPath, downloadInfo, nil, user, dlOpts); err != nil {
+		return nil, err
+	}
+
+	return os.Open(targetPath)
+}
+
 type assertionSvcError struct {
 	Status int    `json:"status"`
 	Type   string `json:"type"`
@@ -1944,11 +3805,125 @@ type assertionSvcError struct {
 	Detail string `json:"detail"`
 }
 
+// AssertionOptions tweak how assertions are fetched.
+type AssertionOptions struct {
+	// MaxFormat, if set, is the max-format asked for instead of the
+	// maximum format supported for the assertion type, e.g. to test
+	// how older clients are served. It cannot be above the latter.
+	MaxFormat *int
+}
+
+// maxFormat returns the max-format to ask for assertions of the given
+// type with opts.
+func (opts *AssertionOptions) maxFormat(assertType *asserts.AssertionType) (int, error) {
+	maxFormat := assertType.MaxSupportedFormat()
+	if opts == nil || opts.MaxFormat == nil {
+		return maxFormat, nil
+	}
+	if *opts.MaxFormat < 0 || *opts.MaxFormat > maxFormat {
+		return 0, fmt.Errorf("cannot fetch %s assertion with max-format %d: supported max-format is %d", assertType.Name, *opts.MaxFormat, maxFormat)
+	}
+	return *opts.MaxFormat, nil
+}
+
 // Assertion retrivies the assertion for the given type and primary key.
 func (s *Store) Assertion(assertType *asserts.AssertionType, primaryKey []string, user *auth.UserState) (asserts.Assertion, error) {
+	return s.assertion(s.baseCtx, assertType, primaryKey, user, nil)
+}
+
+// AssertionWithOptions is like Assertion but takes a context and
+// options, e.g. to ask for a lower max-format.
+func (s *Store) AssertionWithOptions(ctx context.Context, assertType *asserts.AssertionType, primaryKey []string, user *auth.UserState, opts *AssertionOptions) (asserts.Assertion, error) {
+	return s.assertion(ctx, assertType, primaryKey, user, opts)
+}
+
+func (s *Store) assertion(ctx context.Context, assertType *asserts.AssertionType, primaryKey []string, user *auth.UserState, opts *AssertionOptions) (asserts.Assertion, error) {
+	maxFormat, err := opts.maxFormat(assertType)
+	if err != nil {
+		return nil, err
+	}
 	v := url.Values{}
-	v.Set("max-format", strconv.Itoa(assertType.MaxSupportedFormat()))
-	u := s.assertionsEndpointURL(path.Join(assertType.Name, path.Join(primaryKey...)), v)
+	v.Set("max-format", strconv.Itoa(maxFormat))
+	u, err := s.assertionsEndpointURL(path.Join(assertType.Name, path.Join(primaryKey...)), v)
+	if err != nil {
+		return nil, err
+	}
+
+	reqOptions := &requestOptions{
+		Method: "GET",
+		URL:    u,
+		Accept: asserts.MediaType,
+	}
+
+	var asrt asserts.Assertion
+
+	ctx, cancel := s.withDefaultDeadline(ctx)
+	defer cancel()
+
+	resp, err := httputil.RetryRequestReportExhausted(reqOptions.URL.String(), func() (*http.Response, error) {
+		return s.doRequest(ctx, s.client, reqOptions, user)
+	}, func(resp *http.Response) error {
+		var e error
+		if resp.StatusCode == 200 {
+			// decode assertion
+			dec := asserts.NewDecoder(resp.Body)
+			asrt, e = dec.Decode()
+		} else {
+			e = assertionSvcErrorFromResponse(resp, assertType, primaryKey)
+		}
+		return e
+	}, defaultRetryStrategy)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, respToError(resp, "fetch assertion")
+	}
+
+	return asrt, err
+}
+
+// assertionSvcErrorFromResponse decodes the error, if any, returned by
+// the assertion service in the given non-200 response.
+func assertionSvcErrorFromResponse(resp *http.Response, assertType *asserts.AssertionType, primaryKey []string) error {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != jsonContentType && contentType != "application/problem+json" {
+		return nil
+	}
+	var svcErr assertionSvcError
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&svcErr); err != nil {
+		return fmt.Errorf("cannot decode assertion service error with HTTP status code %d: %v", resp.StatusCode, err)
+	}
+	if svcErr.Status == 404 {
+		// best-effort
+		headers, _ := asserts.HeadersFromPrimaryKey(assertType, primaryKey)
+		return &asserts.NotFoundError{
+			Type:    assertType,
+			Headers: headers,
+		}
+	}
+	return fmt.Errorf("assertion service error: [%s] %q", svcErr.Title, svcErr.Detail)
+}
+
+// AssertionRevisions retrieves all the known revisions of the assertion
+// with the given type and primary key, ordered by revision. Stores that
+// do not keep the history return only the latest revision. opts can
+// be nil.
+func (s *Store) AssertionRevisions(ctx context.Context, assertType *asserts.AssertionType, primaryKey []string, user *auth.UserState, opts *AssertionOptions) ([]asserts.Assertion, error) {
+	maxFormat, err := opts.maxFormat(assertType)
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	v.Set("max-format", strconv.Itoa(maxFormat))
+	v.Set("history", "all")
+	u, err := s.assertionsEndpointURL(path.Join(assertType.Name, path.Join(primaryKey...)), v)
+	if err != nil {
+		return nil, err
+	}
 
 	reqOptions := &requestOptions{
 		Method: "GET",
@@ -1956,47 +3931,143 @@ func (s *Store) Assertion(assertType *asserts.AssertionType, primaryKey []string
 		Accept: asserts.MediaType,
 	}
 
-	var asrt asserts.Assertion
+	var revisions []asserts.Assertion
+
+	ctx, cancel := s.withDefaultDeadline(ctx)
+	defer cancel()
+
+	resp, err := httputil.RetryRequestReportExhausted(reqOptions.URL.String(), func() (*http.Response, error) {
+		return s.doRequest(ctx, s.client, reqOptions, user)
+	}, func(resp *http.Response) error {
+		if resp.StatusCode != 200 {
+			return assertionSvcErrorFromResponse(resp, assertType, primaryKey)
+		}
+		revisions = nil
+		dec := asserts.NewDecoder(resp.Body)
+		for {
+			a, err := dec.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			revisions = append(revisions, a)
+		}
+		return nil
+	}, defaultRetryStrategy)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, respToError(resp, "fetch assertion revisions")
+	}
+
+	if len(revisions) == 0 {
+		return nil, fmt.Errorf("cannot fetch assertion revisions: no assertions returned")
+	}
+
+	ref := &asserts.Ref{Type: assertType, PrimaryKey: primaryKey}
+	for _, a := range revisions {
+		if a.Ref().Unique() != ref.Unique() {
+			return nil, fmt.Errorf("cannot fetch assertion revisions: got %v instead of %v", a.Ref(), ref)
+		}
+	}
+	sort.SliceStable(revisions, func(i, j int) bool {
+		return revisions[i].Revision() < revisions[j].Revision()
+	})
+
+	return revisions, nil
+}
+
+const refreshHintHeaderPrefix = "Snap-Refresh-"
+
+// extractRefreshHints remembers the Snap-Refresh-* advisory headers of
+// the given snap action response, replacing any previous ones.
+func (s *Store) extractRefreshHints(resp *http.Response) {
+	var hints map[string]string
+	for k := range resp.Header {
+		if !strings.HasPrefix(k, refreshHintHeaderPrefix) || len(k) == len(refreshHintHeaderPrefix) {
+			continue
+		}
+		if hints == nil {
+			hints = make(map[string]string)
+		}
+		hints[strings.ToLower(k[len(refreshHintHeaderPrefix):])] = resp.Header.Get(k)
+	}
+
+	s.mu.Lock()
+	s.refreshHints = hints
+	s.mu.Unlock()
+}
+
+// RefreshHints returns the refresh timing hints sent by the store with
+// the last snap action response, keyed by the lowercased suffix of
+// their Snap-Refresh-* header (e.g. "retry-after" for
+// Snap-Refresh-Retry-After), or nil if there were none.
+func (s *Store) RefreshHints() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refreshHints == nil {
+		return nil
+	}
+	hints := make(map[string]string, len(s.refreshHints))
+	for k, v := range s.refreshHints {
+		hints[k] = v
+	}
+	return hints
+}
+
+const experimentHeader = "Snap-Store-Experiment"
+
+// extractExperiments remembers the store-side experiments the given
+// response was part of, as listed by its Snap-Store-Experiment headers
+// with comma-separated <experiment>=<variant> entries. Responses
+// without such headers leave the previous ones in place.
+func (s *Store) extractExperiments(resp *http.Response) {
+	values := resp.Header[experimentHeader]
+	if len(values) == 0 {
+		return
+	}
+	experiments := make(map[string]string)
+	for _, v := range values {
+		for _, entry := range strings.Split(v, ",") {
+			name, variant := entry, ""
+			if i := strings.IndexRune(entry, '='); i >= 0 {
+				name, variant = entry[:i], entry[i+1:]
+			}
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			experiments[name] = strings.TrimSpace(variant)
+		}
+	}
+
+	s.mu.Lock()
+	s.experiments = experiments
+	s.mu.Unlock()
+}
 
-	resp, err := httputil.RetryRequest(reqOptions.URL.String(), func() (*http.Response, error) {
-		return s.doRequest(context.TODO(), s.client, reqOptions, user)
-	}, func(resp *http.Response) error {
-		var e error
-		if resp.StatusCode == 200 {
-			// decode assertion
-			dec := asserts.NewDecoder(resp.Body)
-			asrt, e = dec.Decode()
-		} else {
-			contentType := resp.Header.Get("Content-Type")
-			if contentType == jsonContentType || contentType == "application/problem+json" {
-				var svcErr assertionSvcError
-				dec := json.NewDecoder(resp.Body)
-				if e = dec.Decode(&svcErr); e != nil {
-					return fmt.Errorf("cannot decode assertion service error with HTTP status code %d: %v", resp.StatusCode, e)
-				}
-				if svcErr.Status == 404 {
-					// best-effort
-					headers, _ := asserts.HeadersFromPrimaryKey(assertType, primaryKey)
-					return &asserts.NotFoundError{
-						Type:    assertType,
-						Headers: headers,
-					}
-				}
-				return fmt.Errorf("assertion service error: [%s] %q", svcErr.Title, svcErr.Detail)
-			}
-		}
-		return e
-	}, defaultRetryStrategy)
+// Experiments returns the store-side experiments, mapped to their
+// variant, the most recent store response that listed any was part
+// of, or nil if there were none. This is useful to correlate client
+// behavior with them, e.g. in telemetry.
+func (s *Store) Experiments() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if err != nil {
-		return nil, err
+	if s.experiments == nil {
+		return nil
 	}
-
-	if resp.StatusCode != 200 {
-		return nil, respToError(resp, "fetch assertion")
+	experiments := make(map[string]string, len(s.experiments))
+	for k, v := range s.experiments {
+		experiments[k] = v
 	}
-
-	return asrt, err
+	return experiments
 }
 
 // SuggestedCurrency retrieves the cached value for the store's suggested currency
@@ -2015,6 +4086,7 @@ type orderInstruction struct {
 	SnapID   string `json:"snap_id"`
 	Amount   string `json:"amount,omitempty"`
 	Currency string `json:"currency,omitempty"`
+	Action   string `json:"action,omitempty"`
 }
 
 type storeError struct {
@@ -2050,7 +4122,7 @@ func buyOptionError(message string) (*client.BuyResult, error) {
 
 // Buy sends a buy request for the specified snap.
 // Returns the state of the order: Complete, Cancelled.
-func (s *Store) Buy(options *client.BuyOptions, user *auth.UserState) (*client.BuyResult, error) {
+func (s *Store) Buy(ctx context.Context, options *client.BuyOptions, user *auth.UserState) (*client.BuyResult, error) {
 	if options.SnapID == "" {
 		return buyOptionError("snap ID missing")
 	}
@@ -2085,7 +4157,7 @@ func (s *Store) Buy(options *client.BuyOptions, user *auth.UserState) (*client.B
 
 	var orderDetails order
 	var errorInfo storeErrors
-	resp, err := s.retryRequestDecodeJSON(context.TODO(), reqOptions, user, &orderDetails, &errorInfo)
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &orderDetails, &errorInfo)
 	if err != nil {
 		return nil, err
 	}
@@ -2126,19 +4198,189 @@ func (s *Store) Buy(options *client.BuyOptions, user *auth.UserState) (*client.B
 	}
 }
 
+// CancelOrder cancels the pending order of the user for the
+// specified snap, e.g. one waiting on a payment confirmation the user
+// abandoned.
+func (s *Store) CancelOrder(ctx context.Context, snapID string, user *auth.UserState) error {
+	if snapID == "" {
+		return fmt.Errorf("cannot cancel order: snap ID missing")
+	}
+	if user == nil {
+		return ErrUnauthenticated
+	}
+
+	jsonData, err := json.Marshal(orderInstruction{
+		SnapID: snapID,
+		Action: "cancel",
+	})
+	if err != nil {
+		return err
+	}
+
+	reqOptions := &requestOptions{
+		Method:      "POST",
+		URL:         s.endpointURL(ordersEndpPath, nil),
+		Accept:      jsonContentType,
+		ContentType: jsonContentType,
+		Data:        jsonData,
+	}
+
+	var errorInfo storeErrors
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, nil, &errorInfo)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		return nil
+	case 400:
+		// e.g. the order is complete already
+		return fmt.Errorf("cannot cancel order: bad request: %v", errorInfo.Error())
+	case 404:
+		return ErrOrderNotFound
+	case 401:
+		return ErrInvalidCredentials
+	default:
+		return respToError(resp, "cancel order")
+	}
+}
+
+type closeChannelsRequest struct {
+	Channels []string `json:"channels"`
+}
+
+type closeChannelsResult struct {
+	ClosedChannels []string `json:"closed_channels"`
+}
+
+// CloseChannels closes the given channels of the snap with the given
+// ID via the developer dashboard, returning the channels that were
+// actually closed.
+func (s *Store) CloseChannels(ctx context.Context, snapID string, channels []string, user *auth.UserState) (closed []string, err error) {
+	if snapID == "" {
+		return nil, fmt.Errorf("cannot close channels: snap ID missing")
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("cannot close channels: no channels given")
+	}
+	if user == nil {
+		return nil, ErrUnauthenticated
+	}
+
+	jsonData, err := json.Marshal(closeChannelsRequest{Channels: channels})
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(DeveloperSnapsAPI + url.PathEscape(snapID) + "/close")
+	if err != nil {
+		return nil, err
+	}
+
+	reqOptions := &requestOptions{
+		Method:         "POST",
+		URL:            u,
+		Accept:         jsonContentType,
+		ContentType:    jsonContentType,
+		Data:           jsonData,
+		DeviceAuthNeed: deviceAuthCustomStoreOnly,
+	}
+
+	var result closeChannelsResult
+	var errorInfo storeErrors
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &result, &errorInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		return result.ClosedChannels, nil
+	case 400:
+		// e.g. an unknown channel
+		return nil, fmt.Errorf("cannot close channels: bad request: %v", errorInfo.Error())
+	case 401:
+		return nil, ErrInvalidCredentials
+	case 403:
+		return nil, ErrPermissionDenied
+	case 404:
+		return nil, ErrSnapNotFound
+	default:
+		return nil, respToError(resp, "close channels")
+	}
+}
+
+type reportSnapRequest struct {
+	SnapID  string `json:"snap_id"`
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+}
+
+// ReportSnap reports the snap with the given ID to the store as
+// broken or malicious, for the given reason (e.g. "malware") and with
+// an optional message from the user.
+func (s *Store) ReportSnap(ctx context.Context, snapID, reason, message string, user *auth.UserState) error {
+	if snapID == "" {
+		return fmt.Errorf("cannot report snap: snap ID missing")
+	}
+	if reason == "" {
+		return fmt.Errorf("cannot report snap: reason missing")
+	}
+	if user == nil {
+		return ErrUnauthenticated
+	}
+
+	jsonData, err := json.Marshal(reportSnapRequest{
+		SnapID:  snapID,
+		Reason:  reason,
+		Message: message,
+	})
+	if err != nil {
+		return err
+	}
+
+	reqOptions := &requestOptions{
+		Method:      "POST",
+		URL:         s.endpointURL(reportEndpPath, nil),
+		Accept:      jsonContentType,
+		ContentType: jsonContentType,
+		Data:        jsonData,
+	}
+
+	var errorInfo storeErrors
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, nil, &errorInfo)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case 200, 201, 202:
+		return nil
+	case 400:
+		// e.g. an unknown reason
+		return fmt.Errorf("cannot report snap: bad request: %v", errorInfo.Error())
+	case 401:
+		return ErrInvalidCredentials
+	case 404:
+		return ErrSnapNotFound
+	default:
+		// this includes ErrTooManyRequests for 429
+		return respToError(resp, "report snap")
+	}
+}
+
 type storeCustomer struct {
 	LatestTOSDate     string `json:"latest_tos_date"`
 	AcceptedTOSDate   string `json:"accepted_tos_date"`
 	LatestTOSAccepted bool   `json:"latest_tos_accepted"`
+	LatestTOSURL      string `json:"latest_tos_url"`
 	HasPaymentMethod  bool   `json:"has_payment_method"`
 }
 
-// ReadyToBuy returns nil if the user's account has accepted T&Cs and has a payment method registered, and an error otherwise
-func (s *Store) ReadyToBuy(user *auth.UserState) error {
-	if user == nil {
-		return ErrUnauthenticated
-	}
-
+// customer retrieves the pay server details of the user's account;
+// what names the details asked for in the errors.
+func (s *Store) customer(ctx context.Context, user *auth.UserState, what string) (*storeCustomer, error) {
 	reqOptions := &requestOptions{
 		Method: "GET",
 		URL:    s.endpointURL(customersMeEndpPath, nil),
@@ -2147,31 +4389,89 @@ func (s *Store) ReadyToBuy(user *auth.UserState) error {
 
 	var customer storeCustomer
 	var errors storeErrors
-	resp, err := s.retryRequestDecodeJSON(context.TODO(), reqOptions, user, &customer, &errors)
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &customer, &errors)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	switch resp.StatusCode {
 	case 200:
-		if !customer.HasPaymentMethod {
-			return ErrNoPaymentMethods
-		}
-		if !customer.LatestTOSAccepted {
-			return ErrTOSNotAccepted
-		}
-		return nil
+		return &customer, nil
 	case 404:
 		// Likely because user has no account registered on the pay server
-		return fmt.Errorf("cannot get customer details: server says no account exists")
+		return nil, fmt.Errorf("cannot get %s: server says no account exists", what)
 	case 401:
-		return ErrInvalidCredentials
+		return nil, ErrInvalidCredentials
 	default:
 		if len(errors.Errors) == 0 {
-			return fmt.Errorf("cannot get customer details: unexpected HTTP code %d", resp.StatusCode)
+			return nil, fmt.Errorf("cannot get %s: unexpected HTTP code %d", what, resp.StatusCode)
+		}
+		return nil, &errors
+	}
+}
+
+// ReadyToBuy returns nil if the user's account has accepted T&Cs and has a payment method registered, and an error otherwise
+func (s *Store) ReadyToBuy(user *auth.UserState) error {
+	if user == nil {
+		return ErrUnauthenticated
+	}
+
+	customer, err := s.customer(s.baseCtx, user, "customer details")
+	if err != nil {
+		return err
+	}
+	if !customer.HasPaymentMethod {
+		return ErrNoPaymentMethods
+	}
+	if !customer.LatestTOSAccepted {
+		return ErrTOSNotAccepted
+	}
+	return nil
+}
+
+// TOSInfo describes the store's terms of service as seen by a user.
+type TOSInfo struct {
+	// LatestDate is the date of the latest terms of service
+	LatestDate time.Time
+	// AcceptedDate is the date the user last accepted the terms
+	// of service, if ever
+	AcceptedDate time.Time
+	// Accepted is whether the user accepted the latest terms of service
+	Accepted bool
+	// URL points to the text of the latest terms of service, if
+	// the store gave one
+	URL string
+}
+
+// TermsOfService returns the date of the latest terms of service of
+// the store, whether the user accepted them, and where to read them.
+func (s *Store) TermsOfService(ctx context.Context, user *auth.UserState) (*TOSInfo, error) {
+	if user == nil {
+		return nil, ErrUnauthenticated
+	}
+
+	customer, err := s.customer(ctx, user, "terms of service")
+	if err != nil {
+		return nil, err
+	}
+
+	tos := &TOSInfo{
+		Accepted: customer.LatestTOSAccepted,
+		URL:      customer.LatestTOSURL,
+	}
+	tos.LatestDate, err = time.Parse(time.RFC3339, customer.LatestTOSDate)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get terms of service: invalid latest date: %v", err)
+	}
+	// users that never accepted the terms have no accepted date
+	if customer.AcceptedTOSDate != "" {
+		tos.AcceptedDate, err = time.Parse(time.RFC3339, customer.AcceptedTOSDate)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get terms of service: invalid accepted date: %v", err)
 		}
-		return &errors
 	}
+
+	return tos, nil
 }
 
 func (s *Store) CacheDownloads() int {
@@ -2180,8 +4480,38 @@ func (s *Store) CacheDownloads() int {
 
 func (s *Store) SetCacheDownloads(fileCount int) {
 	s.cfg.CacheDownloads = fileCount
-	if fileCount > 0 {
-		s.cacher = NewCacheManager(dirs.SnapDownloadCacheDir, fileCount)
+	s.setCacher()
+}
+
+// SetCacheDownloadsMaxBytes sets the maximum total size of the cached
+// downloads, in addition to the number of downloads limit.
+func (s *Store) SetCacheDownloadsMaxBytes(maxBytes int64) {
+	s.cfg.CacheDownloadsMaxBytes = maxBytes
+	s.setCacher()
+}
+
+// validCacheNamespace returns whether ns can be used as a cache
+// namespace, i.e. it is a single path component.
+func validCacheNamespace(ns string) bool {
+	return ns != "." && ns != ".." && !strings.ContainsRune(ns, '/')
+}
+
+func (s *Store) setCacher() {
+	cacheDir := dirs.SnapDownloadCacheDir
+	if ns := s.cfg.CacheNamespace; ns != "" {
+		if !validCacheNamespace(ns) {
+			// better not to cache than to share the cache
+			logger.Noticef("cannot use invalid cache namespace %q, not caching downloads", ns)
+			s.cacher = &nullCache{}
+			return
+		}
+		cacheDir = filepath.Join(cacheDir, ns)
+	}
+	if s.cfg.CacheDownloads > 0 || s.cfg.CacheDownloadsMaxBytes > 0 {
+		s.cacher = NewCacheManagerWithOptions(cacheDir, &CacheManagerOptions{
+			MaxItems: s.cfg.CacheDownloads,
+			MaxBytes: s.cfg.CacheDownloadsMaxBytes,
+		})
 	} else {
 		s.cacher = &nullCache{}
 	}
@@ -2199,6 +4529,14 @@ type CurrentSnap struct {
 	Block            []snap.Revision
 	Epoch            snap.Epoch
 	CohortKey        string
+	// ValidationSets are the enforced validation sets constraining
+	// the snap, as <account-id>/<name> keys.
+	ValidationSets []string
+	// Held marks snaps that are held from refreshing locally, until
+	// HeldUntil if set or else indefinitely. This is only reported to
+	// the store.
+	Held      bool
+	HeldUntil time.Time
 }
 
 type currentSnapV2JSON struct {
@@ -2210,6 +4548,9 @@ type currentSnapV2JSON struct {
 	RefreshedDate    *time.Time `json:"refreshed-date,omitempty"`
 	IgnoreValidation bool       `json:"ignore-validation,omitempty"`
 	CohortKey        string     `json:"cohort-key,omitempty"`
+	ValidationSets   []string   `json:"validation-sets,omitempty"`
+	Held             bool       `json:"held,omitempty"`
+	HeldUntil        *time.Time `json:"held-until,omitempty"`
 }
 
 type SnapActionFlags int
@@ -2217,6 +4558,10 @@ type SnapActionFlags int
 const (
 	SnapActionIgnoreValidation SnapActionFlags = 1 << iota
 	SnapActionEnforceValidation
+	// SnapActionRefreshAmend makes a "refresh" action send its Epoch
+	// to the store, which otherwise goes by the epoch of the snap in
+	// the context; it is the amend-on-refresh case.
+	SnapActionRefreshAmend
 )
 
 type SnapAction struct {
@@ -2228,6 +4573,10 @@ type SnapAction struct {
 	CohortKey    string
 	Flags        SnapActionFlags
 	Epoch        snap.Epoch
+	// CorrelationID is an opaque caller-supplied identifier that is
+	// not sent to the store but echoed back on the SnapActionResult
+	// for this action.
+	CorrelationID string
 }
 
 func isValidAction(action string) bool {
@@ -2255,6 +4604,8 @@ type snapActionJSON struct {
 	// already.  We achieve this by making Epoch be an `interface{}` with omitempty,
 	// and then setting it to a (possibly nil) epoch for install and download. As a
 	// nil epoch is not an empty interface{}, you'll get the null in the json.
+	// The exception is a "refresh" with SnapActionRefreshAmend, which sends
+	// its epoch.
 	Epoch interface{} `json:"epoch,omitempty"`
 }
 
@@ -2271,7 +4622,9 @@ type snapActionResult struct {
 	Snap             storeSnap `json:"snap"`
 	EffectiveChannel string    `json:"effective-channel,omitempty"`
 	RedirectChannel  string    `json:"redirect-channel,omitempty"`
-	Error            struct {
+	// set on refreshes to a revision with a different confinement
+	ConfinementChange *confinementChangeJSON `json:"confinement-change,omitempty"`
+	Error             struct {
 		Code    string `json:"code"`
 		Message string `json:"message"`
 		Extra   struct {
@@ -2280,6 +4633,11 @@ type snapActionResult struct {
 	} `json:"error"`
 }
 
+type confinementChangeJSON struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
 type snapActionRequest struct {
 	Context []*currentSnapV2JSON `json:"context"`
 	Actions []*snapActionJSON    `json:"actions"`
@@ -2327,7 +4685,7 @@ func (s *Store) SnapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 				}
 			}
 			if refreshNeed.needed() {
-				err := s.refreshAuth(user, refreshNeed)
+				err := s.refreshAuth(ctx, user, refreshNeed)
 				if err != nil {
 					// best effort
 					logger.Noticef("cannot refresh soft-expired authorisation: %v", err)
@@ -2345,13 +4703,24 @@ func (s *Store) SnapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 	}
 }
 
-func genInstanceKey(curSnap *CurrentSnap, salt string) (string, error) {
+func genInstanceKey(curSnap *CurrentSnap, salt string, keyFunc func(snapID, instanceKey string) (string, error)) (string, error) {
 	_, snapInstanceKey := snap.SplitInstanceName(curSnap.InstanceName)
 
 	if snapInstanceKey == "" {
 		return curSnap.SnapID, nil
 	}
 
+	if keyFunc != nil {
+		key, err := keyFunc(curSnap.SnapID, snapInstanceKey)
+		if err != nil {
+			return "", fmt.Errorf("cannot derive instance key for %q: %v", curSnap.InstanceName, err)
+		}
+		if key == "" {
+			return "", fmt.Errorf("cannot derive instance key for %q: empty key", curSnap.InstanceName)
+		}
+		return fmt.Sprintf("%s:%s", curSnap.SnapID, key), nil
+	}
+
 	if salt == "" {
 		return "", fmt.Errorf("internal error: request salt not provided")
 	}
@@ -2371,6 +4740,24 @@ func genInstanceKey(curSnap *CurrentSnap, salt string) (string, error) {
 type SnapActionResult struct {
 	*snap.Info
 	RedirectChannel string
+	// CorrelationID is the one of the SnapAction this result is for.
+	CorrelationID string
+	// ConfinementChange is set when the store flagged that the
+	// confinement of the snap changes with the refresh, e.g. for
+	// asking the user to acknowledge classic confinement.
+	ConfinementChange *ConfinementChange
+}
+
+// ConfinementChange describes a change of confinement of a snap
+// between revisions.
+type ConfinementChange struct {
+	From snap.ConfinementType
+	To   snap.ConfinementType
+}
+
+// ToClassic returns whether the snap becomes classic confined.
+func (cc *ConfinementChange) ToClassic() bool {
+	return cc.To == snap.ClassicConfinement && cc.From != snap.ClassicConfinement
 }
 
 func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, actions []*SnapAction, user *auth.UserState, opts *RefreshOptions) ([]SnapActionResult, error) {
@@ -2380,8 +4767,10 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 	// same snap-id, for now we keep instance-key handling internal
 
 	requestSalt := ""
+	var instanceKeyFunc func(snapID, instanceKey string) (string, error)
 	if opts != nil {
 		requestSalt = opts.PrivacyKey
+		instanceKeyFunc = opts.InstanceKeyFunc
 	}
 	curSnaps := make(map[string]*CurrentSnap, len(currentSnaps))
 	curSnapJSONs := make([]*currentSnapV2JSON, len(currentSnaps))
@@ -2390,7 +4779,7 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 		if curSnap.SnapID == "" || curSnap.InstanceName == "" || curSnap.Revision.Unset() {
 			return nil, fmt.Errorf("internal error: invalid current snap information")
 		}
-		instanceKey, err := genInstanceKey(curSnap, requestSalt)
+		instanceKey, err := genInstanceKey(curSnap, requestSalt, instanceKeyFunc)
 		if err != nil {
 			return nil, err
 		}
@@ -2405,6 +4794,10 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 		if !curSnap.RefreshedDate.IsZero() {
 			refreshedDate = &curSnap.RefreshedDate
 		}
+		var heldUntil *time.Time
+		if curSnap.Held && !curSnap.HeldUntil.IsZero() {
+			heldUntil = &curSnap.HeldUntil
+		}
 		curSnapJSONs[i] = &currentSnapV2JSON{
 			SnapID:           curSnap.SnapID,
 			InstanceKey:      instanceKey,
@@ -2414,6 +4807,9 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 			RefreshedDate:    refreshedDate,
 			Epoch:            curSnap.Epoch,
 			CohortKey:        curSnap.CohortKey,
+			ValidationSets:   curSnap.ValidationSets,
+			Held:             curSnap.Held,
+			HeldUntil:        heldUntil,
 		}
 	}
 
@@ -2430,6 +4826,15 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 		if a.InstanceName == "" {
 			return nil, fmt.Errorf("internal error: action without instance name")
 		}
+		refreshAmend := a.Flags&SnapActionRefreshAmend != 0
+		if refreshAmend {
+			if a.Action != "refresh" {
+				return nil, fmt.Errorf("internal error: refresh amend flag on %q action for %q", a.Action, a.InstanceName)
+			}
+			if a.Epoch.IsZero() {
+				return nil, fmt.Errorf("internal error: refresh amend of %q without an epoch", a.InstanceName)
+			}
+		}
 		var ignoreValidation *bool
 		if a.Flags&SnapActionIgnoreValidation != 0 {
 			var t = true
@@ -2479,6 +4884,10 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 				// this is the amend case
 				aJSON.Epoch = &a.Epoch
 			}
+		} else if refreshAmend {
+			// an explicit amend on refresh, otherwise any Epoch
+			// is ignored for refreshes
+			aJSON.Epoch = &a.Epoch
 		}
 
 		aJSON.InstanceKey = instanceKey
@@ -2497,20 +4906,21 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 	}
 
 	reqOptions := &requestOptions{
-		Method:      "POST",
-		URL:         s.endpointURL(snapActionEndpPath, nil),
-		Accept:      jsonContentType,
-		ContentType: jsonContentType,
-		Data:        jsonData,
-		APILevel:    apiV2Endps,
+		Method:            "POST",
+		URL:               s.endpointURL(snapActionEndpPath, nil),
+		Accept:            jsonContentType,
+		ContentType:       jsonContentType,
+		Data:              jsonData,
+		APILevel:          apiV2Endps,
+		CaptureTranscript: true,
 	}
 
-	if opts.IsAutoRefresh {
-		logger.Debugf("Auto-refresh; adding header Snap-Refresh-Reason: scheduled")
-		reqOptions.addHeader("Snap-Refresh-Reason", "scheduled")
+	if reason := refreshReasonHeader(opts.RefreshReason, opts.IsAutoRefresh); reason != "" {
+		logger.Debugf("Adding header Snap-Refresh-Reason: %s", reason)
+		reqOptions.addHeader("Snap-Refresh-Reason", reason)
 	}
 
-	if useDeltas() {
+	if s.useDeltas() {
 		logger.Debugf("Deltas enabled. Adding header Snap-Accept-Delta-Format: %v", s.deltaFormat)
 		reqOptions.addHeader("Snap-Accept-Delta-Format", s.deltaFormat)
 	}
@@ -2518,6 +4928,10 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 		reqOptions.addHeader("Snap-Refresh-Managed", "true")
 	}
 
+	if opts.AnonDownloadURLs {
+		user = nil
+	}
+
 	var results snapActionResultList
 	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &results, nil)
 	if err != nil {
@@ -2529,6 +4943,7 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 	}
 
 	s.extractSuggestedCurrency(resp)
+	s.extractRefreshHints(resp)
 
 	refreshErrors := make(map[string]error)
 	installErrors := make(map[string]error)
@@ -2574,22 +4989,38 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 		}
 
 		snapInfo.Channel = res.EffectiveChannel
+		if opts.AnonDownloadURLs {
+			setAnonDownloadURLs(snapInfo)
+		}
 
 		var instanceName string
+		var correlationID string
 		if res.Result == "refresh" {
 			cur := curSnaps[res.InstanceKey]
 			if cur == nil {
 				return nil, fmt.Errorf("unexpected invalid install/refresh API result: unexpected refresh")
 			}
 			rrev := snap.R(res.Snap.Revision)
-			if rrev == cur.Revision || findRev(rrev, cur.Block) {
+			if rrev == cur.Revision {
 				refreshErrors[cur.InstanceName] = ErrNoUpdateAvailable
 				continue
 			}
+			if findRev(rrev, cur.Block) {
+				refreshErrors[cur.InstanceName] = &RevisionBlockedError{Revision: rrev}
+				continue
+			}
 			instanceName = cur.InstanceName
+			if action := refreshes[res.InstanceKey]; action != nil {
+				correlationID = action.CorrelationID
+			}
 		} else if res.Result == "install" {
 			if action := installs[res.InstanceKey]; action != nil {
 				instanceName = action.InstanceName
+				correlationID = action.CorrelationID
+			}
+		} else if res.Result == "download" {
+			if action := downloads[res.InstanceKey]; action != nil {
+				correlationID = action.CorrelationID
 			}
 		}
 
@@ -2600,7 +5031,15 @@ func (s *Store) snapAction(ctx context.Context, currentSnaps []*CurrentSnap, act
 		_, instanceKey := snap.SplitInstanceName(instanceName)
 		snapInfo.InstanceKey = instanceKey
 
-		sars = append(sars, SnapActionResult{Info: snapInfo, RedirectChannel: res.RedirectChannel})
+		var confinementChange *ConfinementChange
+		if cc := res.ConfinementChange; cc != nil && cc.From != cc.To {
+			confinementChange = &ConfinementChange{
+				From: snap.ConfinementType(cc.From),
+				To:   snap.ConfinementType(cc.To),
+			}
+		}
+
+		sars = append(sars, SnapActionResult{Info: snapInfo, RedirectChannel: res.RedirectChannel, CorrelationID: correlationID, ConfinementChange: confinementChange})
 	}
 
 	for _, errObj := range results.ErrorList {
@@ -2640,9 +5079,27 @@ type storeInfoAbbrev struct {
 	ChannelMap [1]storeInfoChannelAbbrev `json:"channel-map"`
 }
 
-var errUnexpectedConnCheckResponse = errors.New("unexpected response during connection check")
+var (
+	errUnexpectedConnCheckResponse = errors.New("unexpected response during connection check")
+	errCaptivePortalConnCheck      = errors.New("captive portal detected during connection check")
+)
+
+// isCaptivePortalResponse returns whether resp looks like a page
+// served by a captive portal (e.g. an HTML login page) rather than a
+// response from the store or its CDN, neither of which serve HTML
+// on the endpoints used by the connectivity check.
+func isCaptivePortalResponse(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
 
 func (s *Store) snapConnCheck() ([]string, error) {
+	ctx, cancel := s.withDefaultDeadline(s.baseCtx)
+	defer cancel()
+
 	var hosts []string
 	// NOTE: "core" is possibly the only snap that's sure to be in all stores
 	//       when we drop "core" in the move to snapd/core18/etc, change this
@@ -2656,12 +5113,15 @@ func (s *Store) snapConnCheck() ([]string, error) {
 
 	var result storeInfoAbbrev
 	resp, err := httputil.RetryRequest(infoURL.String(), func() (*http.Response, error) {
-		return s.doRequest(context.TODO(), s.client, &requestOptions{
+		return s.doRequest(ctx, s.client, &requestOptions{
 			Method:   "GET",
 			URL:      infoURL,
 			APILevel: apiV2Endps,
 		}, nil)
 	}, func(resp *http.Response) error {
+		if isCaptivePortalResponse(resp) {
+			return errCaptivePortalConnCheck
+		}
 		return decodeJSONBody(resp, &result, nil)
 	}, connCheckStrategy)
 
@@ -2671,6 +5131,9 @@ func (s *Store) snapConnCheck() ([]string, error) {
 	resp.Body.Close()
 
 	dlURLraw := result.ChannelMap[0].Download.URL
+	if dlURLraw == "" {
+		return hosts, errUnexpectedConnCheckResponse
+	}
 	dlURL, err := url.ParseRequestURI(dlURLraw)
 	if err != nil {
 		return hosts, err
@@ -2690,7 +5153,7 @@ func (s *Store) snapConnCheck() ([]string, error) {
 	//       after the redirect here. Suggested in
 	// https://github.com/snapcore/snapd/pull/5176#discussion_r193437230
 	resp, err = httputil.RetryRequest(dlURLraw, func() (*http.Response, error) {
-		return s.doRequest(context.TODO(), s.client, reqOptions, nil)
+		return s.doRequest(ctx, s.client, reqOptions, nil)
 	}, func(resp *http.Response) error {
 		// account for redirect
 		hosts[len(hosts)-1] = resp.Request.URL.Host
@@ -2704,6 +5167,9 @@ func (s *Store) snapConnCheck() ([]string, error) {
 	if resp.StatusCode != 200 {
 		return hosts, errUnexpectedConnCheckResponse
 	}
+	if isCaptivePortalResponse(resp) {
+		return hosts, errCaptivePortalConnCheck
+	}
 
 	return hosts, nil
 }
@@ -2757,3 +5223,60 @@ func (s *Store) CreateCohorts(ctx context.Context, snaps []string) (map[string]s
 
 	return remote.CohortKeys, nil
 }
+
+type cachedCohortKey struct {
+	key     string
+	created time.Time
+}
+
+// EnsureCohorts is like CreateCohorts but reuses the cohort keys it
+// created for the given snaps less than ttl ago, only asking the store
+// for the missing or expired ones. The ttl is checked against the
+// creation time on every call, so a shorter ttl takes effect at once.
+// A non-positive ttl disables the caching.
+func (s *Store) EnsureCohorts(ctx context.Context, snaps []string, ttl time.Duration) (map[string]string, error) {
+	if ttl <= 0 {
+		return s.CreateCohorts(ctx, snaps)
+	}
+
+	now := httputil.Clock().Now()
+	cohorts := make(map[string]string, len(snaps))
+	var missing []string
+	s.mu.Lock()
+	// drop the keys that expired, for these snaps or any other ones
+	for name, cached := range s.cohortKeys {
+		if now.Sub(cached.created) >= ttl {
+			delete(s.cohortKeys, name)
+		}
+	}
+	for _, name := range snaps {
+		if cached, ok := s.cohortKeys[name]; ok {
+			cohorts[name] = cached.key
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(missing) == 0 {
+		return cohorts, nil
+	}
+
+	created, err := s.CreateCohorts(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	now = httputil.Clock().Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cohortKeys == nil {
+		s.cohortKeys = make(map[string]cachedCohortKey, len(created))
+	}
+	for name, key := range created {
+		s.cohortKeys[name] = cachedCohortKey{key: key, created: now}
+		cohorts[name] = key
+	}
+
+	return cohorts, nil
+}
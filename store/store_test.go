@@ -23,10 +23,15 @@ import (
 	"bytes"
 	"context"
 	"crypto"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -41,6 +46,7 @@ import (
 	"time"
 
 	"golang.org/x/crypto/sha3"
+	"golang.org/x/xerrors"
 	. "gopkg.in/check.v1"
 	"gopkg.in/macaroon.v1"
 	"gopkg.in/retry.v1"
@@ -50,6 +56,7 @@ import (
 	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/client"
 	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/httputil"
 	"github.com/snapcore/snapd/logger"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/overlord/auth"
@@ -147,6 +154,7 @@ const (
 	customersMePath    = "/api/v1/snaps/purchases/customers/me"
 	detailsPathPattern = "/api/v1/snaps/details/.*"
 	ordersPath         = "/api/v1/snaps/purchases/orders"
+	reportPath         = "/api/v1/snaps/report"
 	searchPath         = "/api/v1/snaps/search"
 	sectionsPath       = "/api/v1/snaps/sections"
 	// v2
@@ -463,7 +471,7 @@ func (s *storeTestSuite) expectedAuthorization(c *C, user *auth.UserState) strin
 
 func (s *storeTestSuite) TestDownloadStreamOK(c *C) {
 	expectedContent := []byte("I was downloaded")
-	restore := store.MockDoDownloadReq(func(ctx context.Context, url *url.URL, cdnHeader string, resume int64, s *store.Store, user *auth.UserState) (*http.Response, error) {
+	restore := store.MockDoDownloadReq(func(ctx context.Context, url *url.URL, cdnHeader string, resume int64, s *store.Store, user *auth.UserState, dlOpts *store.DownloadOptions) (*http.Response, error) {
 		c.Check(url.String(), Equals, "http://anon-url")
 		r := &http.Response{
 			Body: ioutil.NopCloser(bytes.NewReader(expectedContent[resume:])),
@@ -500,9 +508,174 @@ func (s *storeTestSuite) TestDownloadStreamOK(c *C) {
 	c.Check(buf.String(), Equals, string(expectedContent[2:]))
 }
 
+func (s *storeTestSuite) TestDownloadStreamConditional(c *C) {
+	lastModified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	expectedContent := []byte("I was downloaded")
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"etag-1"` || r.Header.Get("If-Modified-Since") == "Thu, 02 Jan 2020 03:04:05 GMT" {
+			w.WriteHeader(304)
+			return
+		}
+		w.Header().Set("ETag", `"etag-2"`)
+		w.Write(expectedContent)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	downloadInfo := &snap.DownloadInfo{
+		AnonDownloadURL: mockServer.URL + "/foo.snap",
+		Size:            int64(len(expectedContent)),
+	}
+
+	for _, opts := range []*store.DownloadOptions{
+		{IfNoneMatch: `"etag-1"`},
+		{IfModifiedSince: lastModified},
+	} {
+		stream, status, err := s.store.DownloadStreamWithOptions(s.ctx, "foo", downloadInfo, 0, nil, opts)
+		c.Check(err, Equals, store.ErrDownloadNotModified)
+		c.Check(status, Equals, 304)
+		c.Check(stream, IsNil)
+	}
+
+	// modified
+	for _, opts := range []*store.DownloadOptions{
+		nil,
+		{IfNoneMatch: `"etag-0"`},
+		{IfModifiedSince: lastModified.Add(-time.Hour)},
+	} {
+		stream, status, err := s.store.DownloadStreamWithOptions(s.ctx, "foo", downloadInfo, 0, nil, opts)
+		c.Assert(err, IsNil)
+		c.Check(status, Equals, 200)
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(stream)
+		stream.Close()
+		c.Check(buf.String(), Equals, string(expectedContent))
+	}
+}
+
+type deltaStreamCtxKey struct{}
+
+func (s *storeTestSuite) TestDownloadStreamDeltaOK(c *C) {
+	expectedContent := []byte("I was assembled from a delta")
+	// the delta is downloaded and applied with the context of the
+	// caller
+	ctx := context.WithValue(s.ctx, deltaStreamCtxKey{}, "stream-ctx")
+	defer store.MockDoDownloadReq(func(context.Context, *url.URL, string, int64, *store.Store, *auth.UserState, *store.DownloadOptions) (*http.Response, error) {
+		c.Fatalf("the full snap should not be downloaded")
+		return nil, nil
+	})()
+	defer store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		c.Check(name, Equals, "foo (delta)")
+		c.Check(url, Equals, "delta-url")
+		c.Check(ctx.Value(deltaStreamCtxKey{}), Equals, "stream-ctx")
+		// with the options of the caller
+		c.Check(dlOpts, DeepEquals, &store.DownloadOptions{RateLimit: 1024})
+		w.Write([]byte("the delta"))
+		return nil
+	})()
+	applied := false
+	defer store.MockApplyDelta(func(ctx context.Context, xdelta3Path string, name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
+		c.Check(ctx.Value(deltaStreamCtxKey{}), Equals, "stream-ctx")
+		c.Check(name, Equals, "foo")
+		c.Check(deltaPath, testutil.FileEquals, "the delta")
+		c.Check(targetSha3_384, Equals, "sha3_384-of-foo")
+		// the snap is assembled next to the current one, not in
+		// the system temporary dir
+		c.Check(filepath.Dir(filepath.Dir(targetPath)), Equals, dirs.SnapBlobDir)
+		applied = true
+		return ioutil.WriteFile(targetPath, expectedContent, 0600)
+	})()
+
+	c.Assert(os.MkdirAll(dirs.SnapBlobDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dirs.SnapBlobDir, "foo_24.snap"), []byte("baseline"), 0600), IsNil)
+
+	downloadInfo := &snap.DownloadInfo{
+		AnonDownloadURL: "http://anon-url",
+		Sha3_384:        "sha3_384-of-foo",
+		Deltas: []snap.DeltaInfo{
+			{AnonDownloadURL: "delta-url", Format: "xdelta3", FromRevision: 24, ToRevision: 26},
+		},
+	}
+
+	stream, status, err := s.store.DownloadStreamWithOptions(ctx, "foo", downloadInfo, 0, nil, &store.DownloadOptions{RateLimit: 1024})
+	c.Assert(err, IsNil)
+	c.Check(status, Equals, 200)
+	c.Check(applied, Equals, true)
+	c.Check(s.store.DeltaStats(), Equals, store.DeltaStats{Offered: 1, Applied: 1})
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(stream)
+	c.Check(stream.Close(), IsNil)
+	c.Check(buf.String(), Equals, string(expectedContent))
+	// the temporary files are gone
+	entries, err := ioutil.ReadDir(dirs.SnapBlobDir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Name(), Equals, "foo_24.snap")
+}
+
+func (s *storeTestSuite) testDownloadStreamDeltaFallback(c *C, withBaseline bool, applyErr error) {
+	expectedContent := []byte("I was downloaded in full")
+	fullDownloads := 0
+	defer store.MockDoDownloadReq(func(ctx context.Context, url *url.URL, cdnHeader string, resume int64, s *store.Store, user *auth.UserState, dlOpts *store.DownloadOptions) (*http.Response, error) {
+		c.Check(url.String(), Equals, "http://anon-url")
+		fullDownloads++
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(expectedContent)),
+		}, nil
+	})()
+	deltaDownloads := 0
+	defer store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		deltaDownloads++
+		w.Write([]byte("the delta"))
+		return nil
+	})()
+	defer store.MockApplyDelta(func(ctx context.Context, xdelta3Path string, name string, deltaPath string, deltaInfo *snap.DeltaInfo, targetPath string, targetSha3_384 string) error {
+		return applyErr
+	})()
+
+	if withBaseline {
+		c.Assert(os.MkdirAll(dirs.SnapBlobDir, 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dirs.SnapBlobDir, "foo_24.snap"), []byte("baseline"), 0600), IsNil)
+	}
+
+	downloadInfo := &snap.DownloadInfo{
+		AnonDownloadURL: "http://anon-url",
+		Sha3_384:        "sha3_384-of-foo",
+		Deltas: []snap.DeltaInfo{
+			{AnonDownloadURL: "delta-url", Format: "xdelta3", FromRevision: 24, ToRevision: 26},
+		},
+	}
+
+	stream, status, err := s.store.DownloadStream(s.ctx, "foo", downloadInfo, 0, nil)
+	c.Assert(err, IsNil)
+	c.Check(status, Equals, 200)
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(stream)
+	c.Check(buf.String(), Equals, string(expectedContent))
+	c.Check(fullDownloads, Equals, 1)
+	if withBaseline {
+		c.Check(deltaDownloads, Equals, 1)
+	} else {
+		// the delta is not even downloaded without a baseline
+		c.Check(deltaDownloads, Equals, 0)
+	}
+	c.Check(s.store.DeltaStats(), Equals, store.DeltaStats{Offered: 1, Failed: 1, FullDownloadFallbacks: 1})
+}
+
+func (s *storeTestSuite) TestDownloadStreamDeltaFallbackNoBaseline(c *C) {
+	s.testDownloadStreamDeltaFallback(c, false, nil)
+}
+
+func (s *storeTestSuite) TestDownloadStreamDeltaFallbackApplyError(c *C) {
+	s.testDownloadStreamDeltaFallback(c, true, errors.New("cannot apply delta"))
+}
+
 func (s *storeTestSuite) TestDownloadStreamCachedOK(c *C) {
 	expectedContent := []byte("I was NOT downloaded")
-	defer store.MockDoDownloadReq(func(context.Context, *url.URL, string, int64, *store.Store, *auth.UserState) (*http.Response, error) {
+	defer store.MockDoDownloadReq(func(context.Context, *url.URL, string, int64, *store.Store, *auth.UserState, *store.DownloadOptions) (*http.Response, error) {
 		c.Fatalf("should not be here")
 		return nil, nil
 	})()
@@ -537,6 +710,94 @@ func (s *storeTestSuite) TestDownloadStreamCachedOK(c *C) {
 	c.Check(buf.String(), Equals, string(expectedContent[2:]))
 }
 
+func (s *storeTestSuite) testDownloadStreamCachedResume(c *C, resume int64) (io.ReadCloser, int, error) {
+	expectedContent := []byte("I was NOT downloaded")
+	defer store.MockDoDownloadReq(func(context.Context, *url.URL, string, int64, *store.Store, *auth.UserState, *store.DownloadOptions) (*http.Response, error) {
+		c.Fatalf("should not be here")
+		return nil, nil
+	})()
+
+	c.Assert(os.MkdirAll(dirs.SnapDownloadCacheDir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dirs.SnapDownloadCacheDir, "sha3_384-of-foo"), expectedContent, 0600), IsNil)
+
+	cache := store.NewCacheManager(dirs.SnapDownloadCacheDir, 1)
+	defer s.store.MockCacher(cache)()
+
+	downloadInfo := &snap.DownloadInfo{
+		AnonDownloadURL: "http://anon-url",
+		Size:            int64(len(expectedContent)),
+		Sha3_384:        "sha3_384-of-foo",
+	}
+	return s.store.DownloadStream(context.TODO(), "foo", downloadInfo, resume, nil)
+}
+
+func (s *storeTestSuite) TestDownloadStreamCachedResumeValid(c *C) {
+	stream, status, err := s.testDownloadStreamCachedResume(c, 6)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	c.Check(status, Equals, 206)
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(stream)
+	c.Check(buf.String(), Equals, "NOT downloaded")
+}
+
+func (s *storeTestSuite) TestDownloadStreamCachedResumeAtEOF(c *C) {
+	stream, status, err := s.testDownloadStreamCachedResume(c, int64(len("I was NOT downloaded")))
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	c.Check(status, Equals, 206)
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(stream)
+	c.Check(buf.String(), Equals, "")
+}
+
+func (s *storeTestSuite) TestDownloadStreamCachedResumeBeyondEOF(c *C) {
+	stream, _, err := s.testDownloadStreamCachedResume(c, 100)
+	c.Assert(err, ErrorMatches, `cannot resume download of "foo" from offset 100: cached file has only 20 bytes`)
+	c.Check(stream, IsNil)
+}
+
+func (s *storeTestSuite) TestDownloadStreamCachedEvictedWhileReading(c *C) {
+	expectedContent := []byte("I was NOT downloaded")
+	defer store.MockDoDownloadReq(func(context.Context, *url.URL, string, int64, *store.Store, *auth.UserState, *store.DownloadOptions) (*http.Response, error) {
+		c.Fatalf("should not be here")
+		return nil, nil
+	})()
+
+	c.Assert(os.MkdirAll(dirs.SnapDownloadCacheDir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dirs.SnapDownloadCacheDir, "sha3_384-of-foo"), expectedContent, 0600), IsNil)
+
+	cache := store.NewCacheManager(dirs.SnapDownloadCacheDir, 1)
+	defer s.store.MockCacher(cache)()
+
+	downloadInfo := &snap.DownloadInfo{
+		AnonDownloadURL: "http://anon-url",
+		Size:            int64(len(expectedContent)),
+		Sha3_384:        "sha3_384-of-foo",
+	}
+	stream, status, err := s.store.DownloadStream(s.ctx, "foo", downloadInfo, 0, nil)
+	c.Assert(err, IsNil)
+	c.Check(status, Equals, 200)
+
+	start := make([]byte, 6)
+	_, err = io.ReadFull(stream, start)
+	c.Assert(err, IsNil)
+
+	// another snap gets cached meanwhile, which would evict foo
+	other := filepath.Join(c.MkDir(), "bar.snap")
+	c.Assert(ioutil.WriteFile(other, []byte("bar"), 0600), IsNil)
+	c.Assert(cache.Put(context.TODO(), "sha3_384-of-bar", other), IsNil)
+	c.Assert(os.Remove(other), IsNil)
+
+	rest, err := ioutil.ReadAll(stream)
+	c.Assert(err, IsNil)
+	c.Check(string(start)+string(rest), Equals, string(expectedContent))
+	c.Check(stream.Close(), IsNil)
+	c.Check(cache.GetPath("sha3_384-of-foo"), Not(Equals), "")
+}
+
 func (s *storeTestSuite) TestDownloadOK(c *C) {
 	expectedContent := []byte("I was downloaded")
 
@@ -1208,10 +1469,24 @@ var applyDeltaTests = []struct {
 	deltaInfo:       snap.DeltaInfo{Format: "nodelta", FromRevision: 24, ToRevision: 26},
 	currentRevision: 24,
 	error:           "cannot apply unsupported delta format \"nodelta\" (only xdelta3 currently)",
+}, {
+	// A delta can be applied to a baseline matching the expected hash.
+	deltaInfo:       snap.DeltaInfo{Format: "xdelta3", FromRevision: 24, ToRevision: 26, FromSha3_384: emptySha3_384},
+	currentRevision: 24,
+	error:           "",
+}, {
+	// An error is returned if the baseline does not match the expected hash.
+	deltaInfo:       snap.DeltaInfo{Format: "xdelta3", FromRevision: 24, ToRevision: 26, FromSha3_384: "1234"},
+	currentRevision: 24,
+	error:           "cannot apply delta: snap \"foo\" revision 24 is corrupted: sha3-384 mismatch for \"foo\": got " + emptySha3_384 + " but expected 1234",
 }}
 
+// the sha3-384 of the empty baseline snaps of applyDeltaTests
+const emptySha3_384 = "0c63a75b845e4f7d01107d852e4c2485c51a50aaaa94fc61995e71bbee983a2ac3713831264adb47fb6bd1e058d5f004"
+
 func (s *storeTestSuite) TestApplyDelta(c *C) {
 	for _, testCase := range applyDeltaTests {
+		s.mockXDelta.ForgetCalls()
 		name := "foo"
 		currentSnapName := fmt.Sprintf("%s_%d.snap", name, testCase.currentRevision)
 		currentSnapPath := filepath.Join(dirs.SnapBlobDir, currentSnapName)
@@ -1232,7 +1507,7 @@ func (s *storeTestSuite) TestApplyDelta(c *C) {
 			c.Assert(err, IsNil)
 		}
 
-		err = store.ApplyDelta(name, deltaPath, &testCase.deltaInfo, targetSnapPath, "")
+		err = store.ApplyDelta(context.TODO(), "", name, deltaPath, &testCase.deltaInfo, targetSnapPath, "")
 
 		if testCase.error == "" {
 			c.Assert(err, IsNil)
@@ -1247,6 +1522,7 @@ func (s *storeTestSuite) TestApplyDelta(c *C) {
 		} else {
 			c.Assert(err, NotNil)
 			c.Assert(err.Error()[0:len(testCase.error)], Equals, testCase.error)
+			c.Assert(s.mockXDelta.Calls(), HasLen, 0)
 			c.Assert(osutil.FileExists(targetSnapPath+".partial"), Equals, false)
 			c.Assert(osutil.FileExists(targetSnapPath), Equals, false)
 		}
@@ -1255,6 +1531,71 @@ func (s *storeTestSuite) TestApplyDelta(c *C) {
 	}
 }
 
+func (s *storeTestSuite) TestApplyDeltaCustomXdelta3Path(c *C) {
+	customXDelta := testutil.MockCommand(c, filepath.Join(c.MkDir(), "opt/bin/my-xdelta3"), "")
+
+	deltaInfo := &snap.DeltaInfo{Format: "xdelta3", FromRevision: 24, ToRevision: 26}
+	currentSnapPath := filepath.Join(dirs.SnapBlobDir, "foo_24.snap")
+	targetSnapPath := filepath.Join(dirs.SnapBlobDir, "foo_26.snap")
+	deltaPath := filepath.Join(dirs.SnapBlobDir, "the.delta")
+	c.Assert(os.MkdirAll(dirs.SnapBlobDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(currentSnapPath, nil, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(deltaPath, nil, 0644), IsNil)
+	// simulate the resulting .partial
+	c.Assert(ioutil.WriteFile(targetSnapPath+".partial", nil, 0644), IsNil)
+
+	err := store.ApplyDelta(context.TODO(), customXDelta.Exe(), "foo", deltaPath, deltaInfo, targetSnapPath, "")
+	c.Assert(err, IsNil)
+	c.Check(customXDelta.Calls(), DeepEquals, [][]string{
+		{"my-xdelta3", "-d", "-s", currentSnapPath, deltaPath, targetSnapPath + ".partial"},
+	})
+	// the one on PATH was not used
+	c.Check(s.mockXDelta.Calls(), HasLen, 0)
+	c.Check(targetSnapPath, testutil.FilePresent)
+}
+
+func (s *storeTestSuite) TestApplyDeltaCancelled(c *C) {
+	slowXDelta := testutil.MockCommand(c, filepath.Join(c.MkDir(), "xdelta3"), "sleep 10")
+
+	deltaInfo := &snap.DeltaInfo{Format: "xdelta3", FromRevision: 24, ToRevision: 26}
+	currentSnapPath := filepath.Join(dirs.SnapBlobDir, "foo_24.snap")
+	targetSnapPath := filepath.Join(dirs.SnapBlobDir, "foo_26.snap")
+	deltaPath := filepath.Join(dirs.SnapBlobDir, "the.delta")
+	c.Assert(os.MkdirAll(dirs.SnapBlobDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(currentSnapPath, nil, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(deltaPath, nil, 0644), IsNil)
+
+	ctx, cancel := context.WithTimeout(s.ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := store.ApplyDelta(ctx, slowXDelta.Exe(), "foo", deltaPath, deltaInfo, targetSnapPath, "")
+	c.Check(err, Equals, context.DeadlineExceeded)
+	// xdelta3 was killed rather than waited for
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+	c.Check(targetSnapPath, testutil.FileAbsent)
+	c.Check(targetSnapPath+".partial", testutil.FileAbsent)
+}
+
+func (s *storeTestSuite) TestApplyDeltaCustomXdelta3PathNotExecutable(c *C) {
+	notExe := filepath.Join(c.MkDir(), "xdelta3")
+	c.Assert(ioutil.WriteFile(notExe, nil, 0644), IsNil)
+
+	deltaInfo := &snap.DeltaInfo{Format: "xdelta3", FromRevision: 24, ToRevision: 26}
+	currentSnapPath := filepath.Join(dirs.SnapBlobDir, "foo_24.snap")
+	targetSnapPath := filepath.Join(dirs.SnapBlobDir, "foo_26.snap")
+	c.Assert(os.MkdirAll(dirs.SnapBlobDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(currentSnapPath, nil, 0644), IsNil)
+
+	err := store.ApplyDelta(context.TODO(), notExe, "foo", "the.delta", deltaInfo, targetSnapPath, "")
+	c.Check(err, ErrorMatches, `cannot use xdelta3 at ".*/xdelta3": not an executable file`)
+
+	err = store.ApplyDelta(context.TODO(), notExe+"-missing", "foo", "the.delta", deltaInfo, targetSnapPath, "")
+	c.Check(err, ErrorMatches, `cannot use xdelta3 at ".*/xdelta3-missing": .* no such file or directory`)
+
+	c.Check(s.mockXDelta.Calls(), HasLen, 0)
+	c.Check(targetSnapPath, testutil.FileAbsent)
+}
+
 var (
 	userAgent = snapdenv.UserAgent()
 )
@@ -1555,6 +1896,115 @@ func (s *storeTestSuite) TestEnsureDeviceSessionSerialisation(c *C) {
 	c.Check(int(deviceSessionRequested), Equals, 1)
 }
 
+func (s *storeTestSuite) TestRefreshDeviceSession(c *C) {
+	deviceSessionRequested := 0
+	// mock store response
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case authNoncesPath:
+			io.WriteString(w, `{"nonce": "1234567890:9876543210"}`)
+		case authSessionPath:
+			// the current session is presented for the refresh
+			authorization := r.Header.Get("X-Device-Authorization")
+			c.Check(authorization, Equals, `Macaroon root="current-session-macaroon"`)
+			deviceSessionRequested++
+			io.WriteString(w, `{"macaroon": "fresh-session-macaroon"}`)
+		default:
+			c.Fatalf("unexpected path %q", r.URL.Path)
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+
+	// the device has a session already
+	s.device.SessionMacaroon = "current-session-macaroon"
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&store.Config{
+		StoreBaseURL: mockServerURL,
+	}, dauthCtx)
+
+	// EnsureDeviceSession is happy with it
+	device, err := sto.EnsureDeviceSession()
+	c.Assert(err, IsNil)
+	c.Check(device.SessionMacaroon, Equals, "current-session-macaroon")
+	c.Check(deviceSessionRequested, Equals, 0)
+
+	device, err = sto.RefreshDeviceSession()
+	c.Assert(err, IsNil)
+	c.Check(device.SessionMacaroon, Equals, "fresh-session-macaroon")
+	c.Check(s.device.SessionMacaroon, Equals, "fresh-session-macaroon")
+	c.Check(deviceSessionRequested, Equals, 1)
+}
+
+func (s *storeTestSuite) TestRefreshDeviceSessionNoSerial(c *C) {
+	s.device.Serial = ""
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&store.Config{}, dauthCtx)
+
+	_, err := sto.RefreshDeviceSession()
+	c.Check(err, Equals, store.ErrNoSerial)
+}
+
+func (s *storeTestSuite) TestRefreshDeviceSessionSerialisation(c *C) {
+	var deviceSessionRequested int32
+	// mock store response
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case authNoncesPath:
+			io.WriteString(w, `{"nonce": "1234567890:9876543210"}`)
+		case authSessionPath:
+			atomic.AddInt32(&deviceSessionRequested, 1)
+			io.WriteString(w, `{"macaroon": "fresh-session-macaroon"}`)
+		default:
+			c.Fatalf("unexpected path %q", r.URL.Path)
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+
+	wgGetDevice := new(sync.WaitGroup)
+
+	s.device.SessionMacaroon = "current-session-macaroon"
+	dauthCtx := &testDauthContext{
+		c:                c,
+		device:           s.device,
+		deviceGetWitness: wgGetDevice.Done,
+	}
+	sto := store.New(&store.Config{
+		StoreBaseURL: mockServerURL,
+	}, dauthCtx)
+
+	wg := new(sync.WaitGroup)
+
+	sto.SessionLock()
+
+	// refresh the session 10 times in parallel, all starting
+	// from the same original session
+	for i := 0; i < 10; i++ {
+		wgGetDevice.Add(1)
+		wg.Add(1)
+		go func(n int) {
+			device, err := sto.RefreshDeviceSession()
+			c.Assert(err, IsNil)
+			c.Check(device.SessionMacaroon, Equals, "fresh-session-macaroon")
+			wg.Done()
+		}(i)
+	}
+
+	wgGetDevice.Wait()
+	dauthCtx.deviceGetWitness = nil
+	sto.SessionUnlock()
+	wg.Wait()
+
+	c.Check(s.device.SessionMacaroon, Equals, "fresh-session-macaroon")
+	// the session was refreshed from the store only once
+	c.Check(int(deviceSessionRequested), Equals, 1)
+}
+
 func (s *storeTestSuite) TestDoRequestSetsAndRefreshesDeviceAuth(c *C) {
 	deviceSessionRequested := false
 	refreshSessionRequested := false
@@ -1750,21 +2200,237 @@ func (s *storeTestSuite) TestDoRequestSetsExtraHeaders(c *C) {
 	c.Check(string(responseData), Equals, "response-data")
 }
 
-func (s *storeTestSuite) TestLoginUser(c *C) {
-	macaroon, err := makeTestMacaroon()
-	c.Assert(err, IsNil)
-	serializedMacaroon, err := auth.MacaroonSerialize(macaroon)
-	c.Assert(err, IsNil)
+func (s *storeTestSuite) TestDoRequestDeviceCapabilities(c *C) {
+	for _, t := range []struct {
+		capabilities []string
+		header       string
+		logged       string
+	}{
+		{nil, "default-tracks", ""},
+		{[]string{"default-tracks", "foo", "bar-baz"}, "default-tracks foo bar-baz", ""},
+		{[]string{"default-tracks", "", "foo bar", "baz"}, "default-tracks baz", `cannot advertise invalid device capability "foo bar", ignoring`},
+		{[]string{}, "", ""},
+	} {
+		logbuf, restore := logger.MockLogger()
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.Check(r.Header.Get("Snap-Device-Capabilities"), Equals, t.header)
+			_, ok := r.Header["Snap-Device-Capabilities"]
+			c.Check(ok, Equals, t.header != "")
+			io.WriteString(w, "response-data")
+		}))
+		c.Assert(mockServer, NotNil)
+
+		sto := store.New(&store.Config{DeviceCapabilities: t.capabilities}, nil)
+		endpoint, _ := url.Parse(mockServer.URL)
+		reqOptions := store.NewRequestOptions("GET", endpoint)
+		response, err := sto.DoRequest(s.ctx, sto.Client(), reqOptions, nil)
+		mockServer.Close()
+		restore()
+		c.Assert(err, IsNil)
+		response.Body.Close()
+		if t.logged != "" {
+			c.Check(logbuf.String(), testutil.Contains, t.logged)
+		}
+	}
+}
+
+func (s *storeTestSuite) TestRequestSigner(c *C) {
+	sign := func(r *http.Request) string {
+		return fmt.Sprintf("%s %s", r.Method, r.URL.Path)
+	}
+
+	var paths []string
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		io.WriteString(w, fmt.Sprintf(`{"macaroon": "%s"}`, serializedMacaroon))
+		c.Check(r.Header.Get("X-Test-Signature"), Equals, sign(r))
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/download/foo.snap":
+			io.WriteString(w, "snap-data")
+		default:
+			io.WriteString(w, mockInfoJSON)
+		}
 	}))
 	c.Assert(mockServer, NotNil)
 	defer mockServer.Close()
-	store.MacaroonACLAPI = mockServer.URL + "/acl/"
 
-	discharge, err := makeTestDischarge()
-	c.Assert(err, IsNil)
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+		RequestSigner: func(r *http.Request) error {
+			// all the standard headers are set already
+			c.Check(r.Header.Get("User-Agent"), Not(Equals), "")
+			r.Header.Set("X-Test-Signature", sign(r))
+			return nil
+		},
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	// API request
+	result, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(result.InstanceName(), Equals, "hello-world")
+
+	// download request
+	dlURL := mockServer.URL + "/download/foo.snap"
+	stream, status, err := sto.DownloadStream(s.ctx, "foo", &snap.DownloadInfo{AnonDownloadURL: dlURL, DownloadURL: dlURL}, 0, nil)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	c.Check(status, Equals, 200)
+	data, err := ioutil.ReadAll(stream)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "snap-data")
+
+	c.Check(paths, HasLen, 2)
+}
+
+func (s *storeTestSuite) TestRequestSignerError(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("request should not have been sent")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	sto := store.New(&store.Config{
+		RequestSigner: func(*http.Request) error {
+			return errors.New("no key")
+		},
+	}, nil)
+	endpoint, _ := url.Parse(mockServer.URL)
+	reqOptions := store.NewRequestOptions("GET", endpoint)
+
+	_, err := sto.DoRequest(s.ctx, sto.Client(), reqOptions, s.user)
+	c.Assert(err, ErrorMatches, "cannot sign request: no key")
+}
+
+func (s *storeTestSuite) TestMaxConcurrentRequests(c *C) {
+	var mu sync.Mutex
+	inFlight, maxInFlight, n := 0, 0, 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		mu.Lock()
+		inFlight++
+		n++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		io.WriteString(w, mockInfoJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL:          mockServerURL,
+		MaxConcurrentRequests: 2,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		// different snaps, as identical requests are coalesced
+		name := fmt.Sprintf("hello-world-%d", i)
+		go func() {
+			defer wg.Done()
+			_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: name}, nil)
+			c.Check(err, IsNil)
+		}()
+	}
+	wg.Wait()
+
+	c.Check(n, Equals, 8)
+	c.Check(maxInFlight <= 2, Equals, true, Commentf("%d requests in flight", maxInFlight))
+}
+
+func (s *storeTestSuite) TestMaxConcurrentRequestsWaitHonorsContext(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	sto := store.New(&store.Config{MaxConcurrentRequests: 1}, nil)
+	endpoint, _ := url.Parse(mockServer.URL)
+	reqOptions := store.NewRequestOptions("GET", endpoint)
+
+	// the only slot is taken until the body is closed
+	resp, err := sto.DoRequest(s.ctx, sto.Client(), reqOptions, nil)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(s.ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = sto.DoRequest(ctx, sto.Client(), reqOptions, nil)
+	c.Check(err, Equals, context.DeadlineExceeded)
+	c.Check(n, Equals, 1)
+
+	c.Check(resp.Body.Close(), IsNil)
+	resp, err = sto.DoRequest(s.ctx, sto.Client(), reqOptions, nil)
+	c.Assert(err, IsNil)
+	c.Check(resp.Body.Close(), IsNil)
+	c.Check(n, Equals, 2)
+}
+
+func (s *storeTestSuite) TestMaxConcurrentRequestsErrorsReleaseSlot(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n <= 3 {
+			// drop the connection without a response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if c.Check(err, IsNil) {
+				conn.Close()
+			}
+			return
+		}
+		io.WriteString(w, "response-data")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	sto := store.New(&store.Config{MaxConcurrentRequests: 1}, nil)
+	endpoint, _ := url.Parse(mockServer.URL)
+	reqOptions := store.NewRequestOptions("GET", endpoint)
+
+	// failed requests do not hold on to the only slot
+	for i := 0; i < 3; i++ {
+		_, err := sto.DoRequest(s.ctx, sto.Client(), reqOptions, nil)
+		c.Assert(err, NotNil)
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+	defer cancel()
+	resp, err := sto.DoRequest(ctx, sto.Client(), reqOptions, nil)
+	c.Assert(err, IsNil)
+	c.Check(resp.Body.Close(), IsNil)
+	c.Check(n, Equals, 4)
+}
+
+func (s *storeTestSuite) TestLoginUser(c *C) {
+	macaroon, err := makeTestMacaroon()
+	c.Assert(err, IsNil)
+	serializedMacaroon, err := auth.MacaroonSerialize(macaroon)
+	c.Assert(err, IsNil)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		io.WriteString(w, fmt.Sprintf(`{"macaroon": "%s"}`, serializedMacaroon))
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+	store.MacaroonACLAPI = mockServer.URL + "/acl/"
+
+	discharge, err := makeTestDischarge()
+	c.Assert(err, IsNil)
 	serializedDischarge, err := auth.MacaroonSerialize(discharge)
 	c.Assert(err, IsNil)
 	mockSSOServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -1827,6 +2493,76 @@ func (s *storeTestSuite) TestLoginUserSSOError(c *C) {
 	c.Check(userDischarge, Equals, "")
 }
 
+func (s *storeTestSuite) TestLoginUserSplitFlow(c *C) {
+	macaroon, err := makeTestMacaroon()
+	c.Assert(err, IsNil)
+	err = macaroon.AddFirstPartyCaveat("first-party-caveat")
+	c.Assert(err, IsNil)
+	serializedMacaroon, err := auth.MacaroonSerialize(macaroon)
+	c.Assert(err, IsNil)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		io.WriteString(w, fmt.Sprintf(`{"macaroon": "%s"}`, serializedMacaroon))
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+	store.MacaroonACLAPI = mockServer.URL + "/acl/"
+
+	userMacaroon, caveats, err := s.store.RequestStoreMacaroon()
+	c.Assert(err, IsNil)
+	c.Check(userMacaroon, Equals, serializedMacaroon)
+	c.Check(caveats, DeepEquals, []store.CaveatInfo{
+		{ID: "third-party-caveat", Location: store.UbuntuoneLocation},
+	})
+
+	// the caveat is discharged externally
+	discharge, err := makeTestDischarge()
+	c.Assert(err, IsNil)
+	serializedDischarge, err := auth.MacaroonSerialize(discharge)
+	c.Assert(err, IsNil)
+
+	user, err := s.store.CompleteLogin(userMacaroon, serializedDischarge)
+	c.Assert(err, IsNil)
+	c.Check(user.HasStoreAuth(), Equals, true)
+	c.Check(user.StoreMacaroon, Equals, serializedMacaroon)
+	c.Check(user.StoreDischarges, DeepEquals, []string{serializedDischarge})
+}
+
+func (s *storeTestSuite) TestRequestStoreMacaroonMissingLoginCaveat(c *C) {
+	m, err := macaroon.New([]byte("secret"), "some-id", "location")
+	c.Assert(err, IsNil)
+	serializedMacaroon, err := auth.MacaroonSerialize(m)
+	c.Assert(err, IsNil)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		io.WriteString(w, fmt.Sprintf(`{"macaroon": "%s"}`, serializedMacaroon))
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+	store.MacaroonACLAPI = mockServer.URL + "/acl/"
+
+	_, _, err = s.store.RequestStoreMacaroon()
+	c.Assert(err, ErrorMatches, "missing login caveat")
+}
+
+func (s *storeTestSuite) TestCompleteLoginWrongDischarge(c *C) {
+	m, err := makeTestMacaroon()
+	c.Assert(err, IsNil)
+	serializedMacaroon, err := auth.MacaroonSerialize(m)
+	c.Assert(err, IsNil)
+	discharge, err := macaroon.New([]byte("shared-key"), "other-caveat", store.UbuntuoneLocation)
+	c.Assert(err, IsNil)
+	serializedDischarge, err := auth.MacaroonSerialize(discharge)
+	c.Assert(err, IsNil)
+
+	user, err := s.store.CompleteLogin(serializedMacaroon, serializedDischarge)
+	c.Assert(err, ErrorMatches, "cannot complete login: discharge is not for the login caveat")
+	c.Check(user, IsNil)
+
+	_, err = s.store.CompleteLogin(serializedMacaroon, "garbage")
+	c.Assert(err, ErrorMatches, "cannot complete login: .*")
+}
+
 const (
 	funkyAppSnapID = "1e21e12ex4iim2xj1g2ul6f12f1"
 
@@ -2177,6 +2913,38 @@ func (s *storeTestSuite) TestInfo(c *C) {
 	c.Check(slot.Apps["content-plug"].Command, Equals, "bin/content-plug")
 }
 
+func (s *storeTestSuite) TestInfoAnonDownloadURLs(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		// no user authorization, but device authorization is set
+		c.Check(r.Header.Get("Authorization"), Equals, "")
+		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	sto := store.New(&cfg, dauthCtx)
+
+	spec := store.SnapSpec{
+		Name:             "hello-world",
+		AnonDownloadURLs: true,
+	}
+	result, err := sto.SnapInfo(s.ctx, spec, s.user)
+	c.Assert(err, IsNil)
+	c.Check(result.InstanceName(), Equals, "hello-world")
+	c.Check(result.AnonDownloadURL, Equals, "https://api.snapcraft.io/api/v1/snaps/download/buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ_27.snap")
+	c.Check(result.DownloadURL, Equals, result.AnonDownloadURL)
+}
+
 func (s *storeTestSuite) TestInfoBadResponses(c *C) {
 	restore := release.MockOnClassic(false)
 	defer restore()
@@ -2408,46 +3176,295 @@ func (s *storeTestSuite) TestInfoAndChannels(c *C) {
 	c.Check(snap.Validate(result), IsNil)
 }
 
-func (s *storeTestSuite) TestInfoMoreChannels(c *C) {
-	// NB this tests more channels, but still only one architecture
+const mockInfoWithComponentsJSON = `{
+    "channel-map": [
+        {
+            "architectures": ["all"],
+            "channel": {
+                "architecture": "amd64",
+                "name": "stable",
+                "released-at": "2019-01-01T10:11:12.123456789+00:00",
+                "risk": "stable",
+                "track": "latest"
+            },
+            "confinement": "strict",
+            "download": {
+                "sha3-384": "eed62063c04a8c3819eb71ce7d929cc8d743b43be9e7d86b397b6d61b66b0c3a684f3148a9dbe5821360ae32105c1bd9",
+                "size": 20480,
+                "url": "https://api.snapcraft.io/api/v1/snaps/download/buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ_27.snap"
+            },
+            "epoch": {"read": [0], "write": [0]},
+            "resources": [
+                {
+                    "name": "kernel-modules",
+                    "type": "component/kernel-modules",
+                    "revision": 3,
+                    "version": "1.0",
+                    "description": "some kernel modules",
+                    "download": {
+                        "sha3-384": "aaaa",
+                        "size": 1024,
+                        "url": "https://api.snapcraft.io/api/v1/snaps/download/hello-world+kernel-modules_3.comp"
+                    }
+                },
+                {
+                    "name": "test-data",
+                    "type": "component/test",
+                    "revision": 7,
+                    "download": {
+                        "sha3-384": "bbbb",
+                        "size": 2048,
+                        "url": "https://api.snapcraft.io/api/v1/snaps/download/hello-world+test-data_7.comp"
+                    }
+                }
+            ],
+            "revision": 27,
+            "snap-yaml": "name: hello-world\nversion: 6.3\n",
+            "type": "app",
+            "version": "6.3"
+        }
+    ],
+    "name": "hello-world",
+    "snap": {
+        "name": "hello-world",
+        "publisher": {
+            "display-name": "Canonical",
+            "id": "canonical",
+            "username": "canonical",
+            "validation": "verified"
+        },
+        "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+        "summary": "The 'hello-world' of snaps"
+    },
+    "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ"
+}`
+
+func (s *storeTestSuite) TestInfoComponents(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "GET", infoPathPattern)
-		// following is just an aligned version of:
-		// http https://api.snapcraft.io/v2/snaps/info/go architecture==amd64 fields==channel Snap-Device-Series:16 | jq -c '.["channel-map"] | .[]'
-		io.WriteString(w, `{"channel-map": [
-{"channel":{"architecture":"amd64","name":"stable",        "released-at":"2018-12-17T09:17:16.288554+00:00","risk":"stable",   "track":"latest"}},
-{"channel":{"architecture":"amd64","name":"edge",          "released-at":"2018-11-06T00:46:03.348730+00:00","risk":"edge",     "track":"latest"}},
-{"channel":{"architecture":"amd64","name":"1.11/stable",   "released-at":"2018-12-17T09:17:48.847205+00:00","risk":"stable",   "track":"1.11"}},
-{"channel":{"architecture":"amd64","name":"1.11/candidate","released-at":"2018-12-17T00:10:05.864910+00:00","risk":"candidate","track":"1.11"}},
-{"channel":{"architecture":"amd64","name":"1.10/stable",   "released-at":"2018-12-17T06:53:57.915517+00:00","risk":"stable",   "track":"1.10"}},
-{"channel":{"architecture":"amd64","name":"1.10/candidate","released-at":"2018-12-17T00:04:13.413244+00:00","risk":"candidate","track":"1.10"}},
-{"channel":{"architecture":"amd64","name":"1.9/stable",    "released-at":"2018-06-13T02:23:06.338145+00:00","risk":"stable",   "track":"1.9"}},
-{"channel":{"architecture":"amd64","name":"1.8/stable",    "released-at":"2018-02-07T23:08:59.152984+00:00","risk":"stable",   "track":"1.8"}},
-{"channel":{"architecture":"amd64","name":"1.7/stable",    "released-at":"2017-06-02T01:16:52.640258+00:00","risk":"stable",   "track":"1.7"}},
-{"channel":{"architecture":"amd64","name":"1.6/stable",    "released-at":"2017-05-17T21:18:42.224979+00:00","risk":"stable",   "track":"1.6"}}
-]}`)
+		c.Check(r.URL.Path, Matches, ".*/hello-world")
+
+		// the resources were asked for
+		c.Check(r.URL.Query().Get("fields"), Matches, "(.*,)?resources(,.*)?")
+
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoWithComponentsJSON)
 	}))
 
 	c.Assert(mockServer, NotNil)
 	defer mockServer.Close()
 
 	mockServerURL, _ := url.Parse(mockServer.URL)
-	cfg := store.Config{
-		StoreBaseURL: mockServerURL,
-	}
+	cfg := store.DefaultConfig()
+	cfg.StoreBaseURL = mockServerURL
 	dauthCtx := &testDauthContext{c: c, device: s.device}
-	sto := store.New(&cfg, dauthCtx)
+	sto := store.New(cfg, dauthCtx)
 
-	// the actual test
-	result, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "eh"}, nil)
+	spec := store.SnapSpec{
+		Name:       "hello-world",
+		Components: true,
+	}
+	result, err := sto.SnapInfo(s.ctx, spec, nil)
 	c.Assert(err, IsNil)
-	expected := map[string]*snap.ChannelSnapInfo{
-		"latest/stable":  {Channel: "latest/stable", ReleasedAt: time.Date(2018, 12, 17, 9, 17, 16, 288554000, time.UTC)},
-		"latest/edge":    {Channel: "latest/edge", ReleasedAt: time.Date(2018, 11, 6, 0, 46, 3, 348730000, time.UTC)},
-		"1.6/stable":     {Channel: "1.6/stable", ReleasedAt: time.Date(2017, 5, 17, 21, 18, 42, 224979000, time.UTC)},
-		"1.7/stable":     {Channel: "1.7/stable", ReleasedAt: time.Date(2017, 6, 2, 1, 16, 52, 640258000, time.UTC)},
-		"1.8/stable":     {Channel: "1.8/stable", ReleasedAt: time.Date(2018, 2, 7, 23, 8, 59, 152984000, time.UTC)},
-		"1.9/stable":     {Channel: "1.9/stable", ReleasedAt: time.Date(2018, 6, 13, 2, 23, 6, 338145000, time.UTC)},
+	c.Check(result.InstanceName(), Equals, "hello-world")
+	c.Check(result.Components, DeepEquals, []snap.StoreComponent{
+		{
+			Name:        "kernel-modules",
+			Type:        "component/kernel-modules",
+			Revision:    snap.R(3),
+			Version:     "1.0",
+			Description: "some kernel modules",
+			DownloadInfo: snap.DownloadInfo{
+				DownloadURL: "https://api.snapcraft.io/api/v1/snaps/download/hello-world+kernel-modules_3.comp",
+				Size:        1024,
+				Sha3_384:    "aaaa",
+			},
+		},
+		{
+			Name:     "test-data",
+			Type:     "component/test",
+			Revision: snap.R(7),
+			DownloadInfo: snap.DownloadInfo{
+				DownloadURL: "https://api.snapcraft.io/api/v1/snaps/download/hello-world+test-data_7.comp",
+				Size:        2048,
+				Sha3_384:    "bbbb",
+			},
+		},
+	})
+}
+
+func (s *storeTestSuite) TestInfoNoComponentsByDefault(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		// the resources are only requested when asked for
+		c.Check(strings.Split(r.URL.Query().Get("fields"), ","), Not(testutil.Contains), "resources")
+
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.DefaultConfig()
+	cfg.StoreBaseURL = mockServerURL
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(cfg, dauthCtx)
+
+	result, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(result.Components, HasLen, 0)
+	c.Check(store.DefaultConfig().InfoFields, Not(testutil.Contains), "resources")
+}
+
+func (s *storeTestSuite) TestInfoLocalized(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		c.Check(r.Header.Get("Accept-Language"), Equals, "de-DE")
+
+		w.WriteHeader(200)
+		io.WriteString(w, strings.Replace(mockInfoJSON, "The 'hello-world' of snaps", "Das 'Hallo Welt' der Snaps", -1))
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+		Locale:       "de-DE",
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	result, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(result.Summary(), Equals, "Das 'Hallo Welt' der Snaps")
+}
+
+func (s *storeTestSuite) TestInfoNoLocale(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		c.Check(r.Header.Get("Accept-Language"), Equals, "")
+
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *storeTestSuite) TestInfoDefaultRequestTimeout(c *C) {
+	var n int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		atomic.AddInt32(&n, 1)
+		// the request gets cancelled before this returns
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			c.Errorf("request was not cancelled")
+		}
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL:          mockServerURL,
+		DefaultRequestTimeout: 50 * time.Millisecond,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	start := time.Now()
+	_, err := sto.SnapInfo(context.Background(), store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, ErrorMatches, ".*context deadline exceeded.*")
+	// the deadline bounds the whole request, it is not retried
+	c.Check(atomic.LoadInt32(&n), Equals, int32(1))
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+}
+
+func (s *storeTestSuite) TestInfoDefaultRequestTimeoutExplicitDeadline(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		// slower than the default timeout
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, mockInfoJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL:          mockServerURL,
+		DefaultRequestTimeout: 10 * time.Millisecond,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	// the explicit deadline of the caller wins
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := sto.SnapInfo(ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(result.InstanceName(), Equals, "hello-world")
+}
+
+func (s *storeTestSuite) TestInfoMoreChannels(c *C) {
+	// NB this tests more channels, but still only one architecture
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		// following is just an aligned version of:
+		// http https://api.snapcraft.io/v2/snaps/info/go architecture==amd64 fields==channel Snap-Device-Series:16 | jq -c '.["channel-map"] | .[]'
+		io.WriteString(w, `{"channel-map": [
+{"channel":{"architecture":"amd64","name":"stable",        "released-at":"2018-12-17T09:17:16.288554+00:00","risk":"stable",   "track":"latest"}},
+{"channel":{"architecture":"amd64","name":"edge",          "released-at":"2018-11-06T00:46:03.348730+00:00","risk":"edge",     "track":"latest"}},
+{"channel":{"architecture":"amd64","name":"1.11/stable",   "released-at":"2018-12-17T09:17:48.847205+00:00","risk":"stable",   "track":"1.11"}},
+{"channel":{"architecture":"amd64","name":"1.11/candidate","released-at":"2018-12-17T00:10:05.864910+00:00","risk":"candidate","track":"1.11"}},
+{"channel":{"architecture":"amd64","name":"1.10/stable",   "released-at":"2018-12-17T06:53:57.915517+00:00","risk":"stable",   "track":"1.10"}},
+{"channel":{"architecture":"amd64","name":"1.10/candidate","released-at":"2018-12-17T00:04:13.413244+00:00","risk":"candidate","track":"1.10"}},
+{"channel":{"architecture":"amd64","name":"1.9/stable",    "released-at":"2018-06-13T02:23:06.338145+00:00","risk":"stable",   "track":"1.9"}},
+{"channel":{"architecture":"amd64","name":"1.8/stable",    "released-at":"2018-02-07T23:08:59.152984+00:00","risk":"stable",   "track":"1.8"}},
+{"channel":{"architecture":"amd64","name":"1.7/stable",    "released-at":"2017-06-02T01:16:52.640258+00:00","risk":"stable",   "track":"1.7"}},
+{"channel":{"architecture":"amd64","name":"1.6/stable",    "released-at":"2017-05-17T21:18:42.224979+00:00","risk":"stable",   "track":"1.6"}}
+]}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	// the actual test
+	result, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "eh"}, nil)
+	c.Assert(err, IsNil)
+	expected := map[string]*snap.ChannelSnapInfo{
+		"latest/stable":  {Channel: "latest/stable", ReleasedAt: time.Date(2018, 12, 17, 9, 17, 16, 288554000, time.UTC)},
+		"latest/edge":    {Channel: "latest/edge", ReleasedAt: time.Date(2018, 11, 6, 0, 46, 3, 348730000, time.UTC)},
+		"1.6/stable":     {Channel: "1.6/stable", ReleasedAt: time.Date(2017, 5, 17, 21, 18, 42, 224979000, time.UTC)},
+		"1.7/stable":     {Channel: "1.7/stable", ReleasedAt: time.Date(2017, 6, 2, 1, 16, 52, 640258000, time.UTC)},
+		"1.8/stable":     {Channel: "1.8/stable", ReleasedAt: time.Date(2018, 2, 7, 23, 8, 59, 152984000, time.UTC)},
+		"1.9/stable":     {Channel: "1.9/stable", ReleasedAt: time.Date(2018, 6, 13, 2, 23, 6, 338145000, time.UTC)},
 		"1.10/stable":    {Channel: "1.10/stable", ReleasedAt: time.Date(2018, 12, 17, 6, 53, 57, 915517000, time.UTC)},
 		"1.10/candidate": {Channel: "1.10/candidate", ReleasedAt: time.Date(2018, 12, 17, 0, 4, 13, 413244000, time.UTC)},
 		"1.11/stable":    {Channel: "1.11/stable", ReleasedAt: time.Date(2018, 12, 17, 9, 17, 48, 847205000, time.UTC)},
@@ -2526,6 +3543,90 @@ func (s *storeTestSuite) TestStoreIDFromAuthContext(c *C) {
 	c.Check(result.InstanceName(), Equals, "hello-world")
 }
 
+func (s *storeTestSuite) TestStoreIDOverrideFromContext(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		storeID := r.Header.Get("Snap-Device-Store")
+		c.Check(storeID, Equals, "other-store-id")
+
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.DefaultConfig()
+	cfg.StoreBaseURL = mockServerURL
+	cfg.StoreID = "fallback"
+	sto := store.New(cfg, &testDauthContext{c: c, device: s.device, storeID: "my-brand-store-id"})
+
+	// the actual test
+	spec := store.SnapSpec{
+		Name: "hello-world",
+	}
+	ctx := store.WithStoreID(s.ctx, "other-store-id")
+	result, err := sto.SnapInfo(ctx, spec, nil)
+	c.Assert(err, IsNil)
+	c.Check(result.InstanceName(), Equals, "hello-world")
+}
+
+func (s *storeTestSuite) TestSectionsQueryStoreIDOverride(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", sectionsPath)
+		c.Check(r.Header.Get("X-Ubuntu-Store"), Equals, "my-brand-store")
+		// the override makes it a custom store, so device
+		// authorization is provided
+		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.WriteHeader(200)
+		io.WriteString(w, MockSectionsJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	serverURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: serverURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	sections, err := sto.Sections(store.WithStoreID(s.ctx, "my-brand-store"), s.user)
+	c.Check(err, IsNil)
+	c.Check(sections, DeepEquals, []string{"featured", "database"})
+}
+
+func (s *storeTestSuite) TestDoRequestStoreIDOverride(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("X-Ubuntu-Store"), Equals, "options-store-id")
+
+		io.WriteString(w, "response-data")
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	dauthCtx := &testDauthContext{c: c, device: s.device, storeID: "my-brand-store-id"}
+	sto := store.New(&store.Config{}, dauthCtx)
+
+	endpoint, _ := url.Parse(mockServer.URL)
+	reqOptions := store.NewRequestOptions("GET", endpoint)
+	reqOptions.StoreIDOverride = "options-store-id"
+
+	// the request options take precedence over the context
+	ctx := store.WithStoreID(s.ctx, "context-store-id")
+	response, err := sto.DoRequest(ctx, sto.Client(), reqOptions, nil)
+	c.Assert(err, IsNil)
+	defer response.Body.Close()
+
+	responseData, err := ioutil.ReadAll(response.Body)
+	c.Assert(err, IsNil)
+	c.Check(string(responseData), Equals, "response-data")
+}
+
 func (s *storeTestSuite) TestProxyStoreFromAuthContext(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "GET", infoPathPattern)
@@ -2615,32 +3716,54 @@ func (s *storeTestSuite) TestInfoOopses(c *C) {
 	}
 	_, err := sto.SnapInfo(s.ctx, spec, nil)
 	c.Assert(err, ErrorMatches, `cannot get details for snap "hello-world": got unexpected HTTP status code 5.. via GET to "http://\S+" \[OOPS-[[:xdigit:]]*\]`)
-}
 
-/*
-acquired via
+	// the details are also available programmatically, even when
+	// the error is wrapped
+	var serverErr *store.StoreServerError
+	c.Assert(xerrors.As(xerrors.Errorf("some context: %w", err), &serverErr), Equals, true)
+	c.Check(serverErr.OopsID, Equals, "OOPS-d4f46f75a5bcc10edcacc87e1fc0119f")
+	c.Check(serverErr.StatusCode, Equals, 500)
+	c.Check(serverErr.Method, Equals, "GET")
+	c.Check(serverErr.URL.Path, Matches, ".*/hello-world")
+}
 
-http --pretty=format --print b https://api.snapcraft.io/v2/snaps/info/no:such:package architecture==amd64 fields==architectures,base,confinement,contact,created-at,description,download,epoch,license,name,prices,private,publisher,revision,snap-id,snap-yaml,summary,title,type,version,media,common-ids Snap-Device-Series:16 | xsel -b
+func (s *storeTestSuite) TestInfoUnexpectedStatusNoOops(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		w.WriteHeader(418)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
 
-on 2018-06-14
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
 
-*/
-const MockNoDetailsJSON = `{
-    "error-list": [
-        {
-            "code": "resource-not-found",
-            "message": "No snap named 'no:such:package' found in series '16'."
-        }
-    ]
-}`
+	_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, ErrorMatches, `cannot get details for snap "hello-world": got unexpected HTTP status code 418 via GET to "http://\S+"`)
+	var serverErr *store.StoreServerError
+	c.Assert(xerrors.As(err, &serverErr), Equals, true)
+	c.Check(serverErr.OopsID, Equals, "")
+	c.Check(serverErr.StatusCode, Equals, 418)
+}
 
-func (s *storeTestSuite) TestNoInfo(c *C) {
+func (s *storeTestSuite) TestInfoETagNotModified(c *C) {
+	n := 0
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "GET", infoPathPattern)
-		c.Check(r.URL.Path, Matches, ".*/no-such-pkg")
-
-		w.WriteHeader(404)
-		io.WriteString(w, MockNoDetailsJSON)
+		n++
+		switch n {
+		case 1:
+			c.Check(r.Header.Get("If-None-Match"), Equals, "")
+		case 2:
+			c.Check(r.Header.Get("If-None-Match"), Equals, `"etag-1"`)
+			w.WriteHeader(304)
+			return
+		default:
+			c.Fatalf("unexpected request")
+		}
+		w.Header().Set("ETag", `"etag-1"`)
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoJSON)
 	}))
 
 	c.Assert(mockServer, NotNil)
@@ -2652,14 +3775,499 @@ func (s *storeTestSuite) TestNoInfo(c *C) {
 	}
 	sto := store.New(&cfg, nil)
 
-	// the actual test
-	spec := store.SnapSpec{
-		Name: "no-such-pkg",
-	}
-	result, err := sto.SnapInfo(s.ctx, spec, nil)
-	c.Assert(err, NotNil)
-	c.Assert(result, IsNil)
-}
+	result, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(result.StoreETag, Equals, `"etag-1"`)
+
+	result, err = sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world", ETag: result.StoreETag}, nil)
+	c.Assert(err, Equals, store.ErrNotModified)
+	c.Check(result, IsNil)
+	c.Check(n, Equals, 2)
+}
+
+func (s *storeTestSuite) TestInfoETagModified(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		c.Check(r.Header.Get("If-None-Match"), Equals, `"etag-1"`)
+		w.Header().Set("ETag", `"etag-2"`)
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	result, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world", ETag: `"etag-1"`}, nil)
+	c.Assert(err, IsNil)
+	c.Check(result.InstanceName(), Equals, "hello-world")
+	c.Check(result.StoreETag, Equals, `"etag-2"`)
+}
+
+func (s *storeTestSuite) TestInfoMinimalFields(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		c.Check(r.URL.Query().Get("fields"), Equals, "summary,media")
+		w.WriteHeader(200)
+		io.WriteString(w, `{
+  "channel-map": [
+    {
+      "channel": {
+        "architecture": "amd64",
+        "name": "stable",
+        "released-at": "2019-04-17T16:47:59.117114+00:00",
+        "risk": "stable",
+        "track": "latest"
+      },
+      "summary": "The 'hello-world' of snaps",
+      "media": [
+        {"type": "icon", "url": "https://dashboard.snapcraft.io/site_media/appmedia/2015/03/hello.svg_NZLfWbh.png"}
+      ]
+    }
+  ],
+  "name": "hello-world",
+  "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ"
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	spec := store.SnapSpec{
+		Name:   "hello-world",
+		Fields: []string{"summary", "media"},
+	}
+	result, err := sto.SnapInfo(s.ctx, spec, nil)
+	c.Assert(err, IsNil)
+	c.Check(result.Summary(), Equals, "The 'hello-world' of snaps")
+	c.Check(result.Media, DeepEquals, snap.MediaInfos{
+		{Type: "icon", URL: "https://dashboard.snapcraft.io/site_media/appmedia/2015/03/hello.svg_NZLfWbh.png"},
+	})
+	c.Check(result.Channel, Equals, "stable")
+	c.Check(result.Channels, HasLen, 1)
+	// the fields that were not requested are left unset
+	c.Check(result.Revision.Unset(), Equals, true)
+	c.Check(result.DownloadURL, Equals, "")
+	c.Check(result.Version, Equals, "")
+	c.Check(result.Paid, Equals, false)
+}
+
+func (s *storeTestSuite) TestInfoCoalescesConcurrentRequests(c *C) {
+	const n = 10
+	var mu sync.Mutex
+	requests := 0
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		// hold the response until all the calls were made
+		<-release
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	infos := make(chan *snap.Info, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			info, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+			infos <- info
+			errs <- err
+		}()
+	}
+	// give all the calls the chance to join the first one
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	seen := make(map[*snap.Info]bool, n)
+	for i := 0; i < n; i++ {
+		c.Check(<-errs, IsNil)
+		info := <-infos
+		c.Assert(info, NotNil)
+		c.Check(info.InstanceName(), Equals, "hello-world")
+		seen[info] = true
+	}
+	// each caller got its own info
+	c.Check(seen, HasLen, n)
+	mu.Lock()
+	c.Check(requests, Equals, 1)
+	mu.Unlock()
+
+	// later calls do a request of their own
+	_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+	mu.Lock()
+	c.Check(requests, Equals, 2)
+	mu.Unlock()
+}
+
+func (s *storeTestSuite) TestInfoCoalescedErrorsAndCancellation(c *C) {
+	var mu sync.Mutex
+	requests := 0
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		arrived <- struct{}{}
+		<-release
+		w.WriteHeader(404)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	cancelledErr := make(chan error, 1)
+	go func() {
+		_, err := sto.SnapInfo(ctx, store.SnapSpec{Name: "hello-world"}, nil)
+		cancelledErr <- err
+	}()
+	<-arrived
+	otherErr := make(chan error, 1)
+	go func() {
+		_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+		otherErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the first caller giving up does not abort the request of the other
+	cancel()
+	c.Check(<-cancelledErr, Equals, context.Canceled)
+	close(release)
+	c.Check(<-otherErr, Equals, store.ErrSnapNotFound)
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Check(requests, Equals, 1)
+}
+
+func (s *storeTestSuite) TestInfoNotCoalescedAcrossContextValues(c *C) {
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	arrived := make(chan struct{}, 4)
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		mu.Lock()
+		seen[r.Header.Get("Snap-Client-User-Agent")+"|"+r.Header.Get("Snap-Device-Authorization")]++
+		mu.Unlock()
+		arrived <- struct{}{}
+		<-release
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, dauthCtx)
+
+	withUA := func(ctx context.Context, ua string) context.Context {
+		return store.WithClientUserAgent(ctx, &http.Request{Header: http.Header{"User-Agent": {ua}}})
+	}
+	ctxs := []context.Context{
+		withUA(s.ctx, "ua1"),
+		withUA(s.ctx, "ua2"),
+		store.WithDeviceSession(s.ctx, &auth.DeviceState{Serial: "9999", SessionMacaroon: "session-1"}),
+		store.WithDeviceSession(s.ctx, &auth.DeviceState{Serial: "9999", SessionMacaroon: "session-2"}),
+	}
+	errs := make(chan error, len(ctxs))
+	for _, ctx := range ctxs {
+		go func(ctx context.Context) {
+			_, err := sto.SnapInfo(ctx, store.SnapSpec{Name: "hello-world"}, nil)
+			errs <- err
+		}(ctx)
+	}
+	// all the requests reach the server while the others are in flight
+	timeout := time.After(5 * time.Second)
+waitArrived:
+	for range ctxs {
+		select {
+		case <-arrived:
+		case <-timeout:
+			c.Errorf("not all the requests reached the server")
+			break waitArrived
+		}
+	}
+	close(release)
+	for range ctxs {
+		c.Check(<-errs, IsNil)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Check(seen, HasLen, 4)
+	c.Check(seen[`|Macaroon root="session-1"`], Equals, 1)
+	c.Check(seen[`|Macaroon root="session-2"`], Equals, 1)
+}
+
+func (s *storeTestSuite) TestInfoNotCoalescedAcrossStoreCredentials(c *C) {
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	arrived := make(chan struct{}, 2)
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		mu.Lock()
+		seen[r.Header.Get("Authorization")]++
+		mu.Unlock()
+		arrived <- struct{}{}
+		<-release
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	// two store accounts, neither of them added locally
+	discharge, err := makeTestDischarge()
+	c.Assert(err, IsNil)
+	var users []*auth.UserState
+	for _, id := range []string{"some-id", "other-id"} {
+		root, err := macaroon.New([]byte("secret"), id, "location")
+		c.Assert(err, IsNil)
+		user, err := createTestUser(0, root, discharge)
+		c.Assert(err, IsNil)
+		users = append(users, user)
+	}
+
+	errs := make(chan error, len(users))
+	for _, user := range users {
+		go func(user *auth.UserState) {
+			_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, user)
+			errs <- err
+		}(user)
+	}
+	// both requests reach the server while the other is in flight
+	timeout := time.After(5 * time.Second)
+waitArrived:
+	for range users {
+		select {
+		case <-arrived:
+		case <-timeout:
+			c.Errorf("not all the requests reached the server")
+			break waitArrived
+		}
+	}
+	close(release)
+	for range users {
+		c.Check(<-errs, IsNil)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Check(seen, HasLen, 2)
+	for authz, n := range seen {
+		c.Check(authz, Matches, `Macaroon root=".*", discharge=".*"`)
+		c.Check(n, Equals, 1)
+	}
+}
+
+func (s *storeTestSuite) TestInfoRetriesExhausted(c *C) {
+	var n int32
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		atomic.AddInt32(&n, 1)
+		io.WriteString(w, "{")
+		mockServer.CloseClientConnections()
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, ErrorMatches, `.*EOF \(gave up after 5 attempts in .*\)`)
+	var exhaustedErr *httputil.RetriesExhaustedError
+	c.Assert(xerrors.As(err, &exhaustedErr), Equals, true)
+	c.Check(exhaustedErr.Attempts, Equals, 5)
+	c.Check(atomic.LoadInt32(&n), Equals, int32(5))
+}
+
+func (s *storeTestSuite) TestFindRetriesExhausted(c *C) {
+	var n int32
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		atomic.AddInt32(&n, 1)
+		io.WriteString(w, "{")
+		mockServer.CloseClientConnections()
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, err := sto.Find(s.ctx, &store.Search{Query: "hello"}, nil)
+	var exhaustedErr *httputil.RetriesExhaustedError
+	c.Assert(xerrors.As(err, &exhaustedErr), Equals, true)
+	c.Check(exhaustedErr.Attempts, Equals, 5)
+	c.Check(atomic.LoadInt32(&n), Equals, int32(5))
+}
+
+func (s *storeTestSuite) TestFindRetriedNotExhausted(c *C) {
+	var n int32
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		if atomic.AddInt32(&n, 1) < 5 {
+			io.WriteString(w, "{")
+			mockServer.CloseClientConnections()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, MockSearchJSONv2)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	// the last attempt succeeds
+	snaps, err := sto.Find(s.ctx, &store.Search{Query: "hello"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(snaps, HasLen, 1)
+	c.Check(atomic.LoadInt32(&n), Equals, int32(5))
+}
+
+func (s *storeTestSuite) TestAssertionRetriesExhausted(c *C) {
+	var n int32
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		atomic.AddInt32(&n, 1)
+		io.WriteString(w, "type: ")
+		mockServer.CloseClientConnections()
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, err := sto.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
+	var exhaustedErr *httputil.RetriesExhaustedError
+	c.Assert(xerrors.As(err, &exhaustedErr), Equals, true)
+	c.Check(exhaustedErr.Attempts, Equals, 5)
+	c.Check(atomic.LoadInt32(&n), Equals, int32(5))
+}
+
+func (s *storeTestSuite) TestAssertionRevisionsRetriesExhausted(c *C) {
+	var n int32
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		atomic.AddInt32(&n, 1)
+		io.WriteString(w, "type: ")
+		mockServer.CloseClientConnections()
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, err := sto.AssertionRevisions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, nil)
+	var exhaustedErr *httputil.RetriesExhaustedError
+	c.Assert(xerrors.As(err, &exhaustedErr), Equals, true)
+	c.Check(exhaustedErr.Attempts, Equals, 5)
+	c.Check(atomic.LoadInt32(&n), Equals, int32(5))
+}
+
+/*
+acquired via
+
+http --pretty=format --print b https://api.snapcraft.io/v2/snaps/info/no:such:package architecture==amd64 fields==architectures,base,confinement,contact,created-at,description,download,epoch,license,name,prices,private,publisher,revision,snap-id,snap-yaml,summary,title,type,version,media,common-ids Snap-Device-Series:16 | xsel -b
+
+on 2018-06-14
+
+*/
+const MockNoDetailsJSON = `{
+    "error-list": [
+        {
+            "code": "resource-not-found",
+            "message": "No snap named 'no:such:package' found in series '16'."
+        }
+    ]
+}`
+
+func (s *storeTestSuite) TestNoInfo(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		c.Check(r.URL.Path, Matches, ".*/no-such-pkg")
+
+		w.WriteHeader(404)
+		io.WriteString(w, MockNoDetailsJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	// the actual test
+	spec := store.SnapSpec{
+		Name: "no-such-pkg",
+	}
+	result, err := sto.SnapInfo(s.ctx, spec, nil)
+	c.Assert(err, NotNil)
+	c.Assert(result, IsNil)
+}
 
 /* acquired via looking at the query snapd does for "snap find 'hello-world of snaps' --narrow" (on core) and adding size=1:
 curl -s -H "accept: application/hal+json" -H "X-Ubuntu-Release: 16" -H "X-Ubuntu-Wire-Protocol: 1" -H "X-Ubuntu-Architecture: amd64" 'https://api.snapcraft.io/api/v1/snaps/search?confinement=strict&fields=anon_download_url%2Carchitecture%2Cchannel%2Cdownload_sha3_384%2Csummary%2Cdescription%2Cbinary_filesize%2Cdownload_url%2Clast_updated%2Cpackage_name%2Cprices%2Cpublisher%2Cratings_average%2Crevision%2Csnap_id%2Clicense%2Cbase%2Cmedia%2Csupport_url%2Ccontact%2Ctitle%2Ccontent%2Cversion%2Corigin%2Cdeveloper_id%2Cdeveloper_name%2Cdeveloper_validation%2Cprivate%2Cconfinement%2Ccommon_ids&q=hello-world+of+snaps&size=1' | python -m json.tool | xsel -b
@@ -2931,23 +4539,120 @@ func (s *storeTestSuite) TestSectionsQueryTooMany(c *C) {
 	c.Check(n, Equals, 1)
 }
 
-func (s *storeTestSuite) TestSectionsQueryCustomStore(c *C) {
-	n := 0
-	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "GET", sectionsPath)
-		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+func (s *storeTestSuite) TestTooManyRequestsThrottlesOtherRequests(c *C) {
+	fc := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.AddCleanup(httputil.MockClock(fc))
 
-		switch n {
-		case 0:
-			// All good.
-		default:
-			c.Fatalf("what? %d", n)
+	var throttledAt time.Time
+	var arrivals []time.Time
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == infoPath("throttled") {
+			throttledAt = fc.Now()
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(429)
+			return
 		}
-
-		w.Header().Set("Content-Type", "application/hal+json")
+		arrivals = append(arrivals, fc.Now())
 		w.WriteHeader(200)
-		io.WriteString(w, MockSectionsJSON)
-		n++
+		io.WriteString(w, mockInfoJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "throttled"}, nil)
+	c.Assert(err, Equals, store.ErrTooManyRequests)
+
+	// the next requests wait for the store to be ready, only the
+	// first one has to wait though
+	for i := 0; i < 2; i++ {
+		// different snaps, as identical requests are coalesced
+		_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: fmt.Sprintf("hello-world-%d", i)}, nil)
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(arrivals, HasLen, 2)
+	for _, t := range arrivals {
+		c.Check(t.Sub(throttledAt), Equals, 10*time.Second)
+	}
+}
+
+func (s *storeTestSuite) TestTooManyRequestsThrottleCapped(c *C) {
+	fc := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.AddCleanup(httputil.MockClock(fc))
+	store.MockMaxThrottleRetryAfter(&s.BaseTest, 2*time.Second)
+
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(429)
+			return
+		}
+		w.WriteHeader(200)
+		io.WriteString(w, mockInfoJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	start := fc.Now()
+	_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, Equals, store.ErrTooManyRequests)
+	_, err = sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 2)
+	// the wait is capped
+	c.Check(fc.Now().Sub(start), Equals, 2*time.Second)
+}
+
+func (s *storeTestSuite) TestTooManyRequestsThrottleCancelled(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(429)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, Equals, store.ErrTooManyRequests)
+	c.Check(n, Equals, 1)
+
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = sto.SnapInfo(ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Check(err, ErrorMatches, ".*context deadline exceeded")
+	// the store was not bothered again
+	c.Check(n, Equals, 1)
+}
+
+func (s *storeTestSuite) TestSectionsQueryCustomStore(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", sectionsPath)
+		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+
+		switch n {
+		case 0:
+			// All good.
+		default:
+			c.Fatalf("what? %d", n)
+		}
+
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.WriteHeader(200)
+		io.WriteString(w, MockSectionsJSON)
+		n++
 	}))
 	c.Assert(mockServer, NotNil)
 	defer mockServer.Close()
@@ -3099,6 +4804,280 @@ func (s *storeTestSuite) TestSnapCommandsTooMany(c *C) {
 	c.Check(n, Equals, 1)
 }
 
+type recordingSnapAdder struct {
+	added map[string][]string
+}
+
+func (a *recordingSnapAdder) AddSnap(snapName, version, summary string, commands []string) error {
+	if a.added == nil {
+		a.added = make(map[string][]string)
+	}
+	a.added[snapName] = commands
+	return nil
+}
+
+func (s *storeTestSuite) testSnapCommandsSchemaChange(c *C, namesJSON string) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/api/v1/snaps/names")
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.WriteHeader(200)
+		io.WriteString(w, namesJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	serverURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: serverURL}, nil)
+
+	var db recordingSnapAdder
+	var bufNames bytes.Buffer
+	err := sto.WriteCatalogs(s.ctx, &bufNames, &db)
+	c.Assert(err, IsNil)
+	c.Check(bufNames.String(), Equals, "bar\nfoo\n")
+	c.Check(db.added, DeepEquals, map[string][]string{
+		"bar": {"potato", "meh", "bar.baz"},
+		"foo": {"meh", "foo"},
+	})
+}
+
+func (s *storeTestSuite) TestSnapCommandsExtraFieldBefore(c *C) {
+	s.testSnapCommandsSchemaChange(c, `{
+  "_links": {"self": {"href": "https://api.snapcraft.io/api/v1/snaps/names"}},
+  "_embedded": {
+    "total": {"count": 2, "extra": [1, 2, {"x": "]"}]},
+    "clickindex:package": [
+      {
+        "aliases": [{"name": "potato", "target": "baz"}, {"name": "meh", "target": "baz"}],
+        "apps": ["baz"],
+        "package_name": "bar",
+        "version": "2.0"
+      },
+      {
+        "aliases": [{"name": "meh", "target": "foo"}],
+        "apps": ["foo"],
+        "package_name": "foo",
+        "version": "1.0"
+      }
+    ]
+  }
+}`)
+}
+
+func (s *storeTestSuite) TestSnapCommandsExtraFieldAfter(c *C) {
+	s.testSnapCommandsSchemaChange(c, `{
+  "_embedded": {
+    "clickindex:package": [
+      {
+        "aliases": [{"name": "potato", "target": "baz"}, {"name": "meh", "target": "baz"}],
+        "apps": ["baz"],
+        "package_name": "bar",
+        "version": "2.0"
+      },
+      {
+        "aliases": [{"name": "meh", "target": "foo"}],
+        "apps": ["foo"],
+        "package_name": "foo",
+        "version": "1.0"
+      }
+    ],
+    "total": 2
+  },
+  "_links": {"self": {"href": "https://api.snapcraft.io/api/v1/snaps/names"}}
+}`)
+}
+
+func (s *storeTestSuite) TestSnapCommandsNoPackages(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		io.WriteString(w, `{"_links": {}, "_embedded": {"total": 0}}`)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	serverURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: serverURL}, nil)
+
+	var db recordingSnapAdder
+	var bufNames bytes.Buffer
+	err := sto.WriteCatalogs(s.ctx, &bufNames, &db)
+	c.Assert(err, ErrorMatches, `decode new commands catalog: bad catalog preamble: cannot find "clickindex:package"`)
+}
+
+const truncatedNamesJSON = `{
+  "_embedded": {
+    "clickindex:package": [
+      {
+        "aliases": [{"name": "potato", "target": "baz"}, {"name": "meh", "target": "baz"}],
+        "apps": ["baz"],
+        "package_name": "bar",
+        "version": "2.0"
+      },
+      {
+        "aliases": [{"name": "meh", "target": "foo"}],
+        "apps": ["foo"],
+        "package_name": "foo",
+        "version": "1.0"
+      }`
+
+func (s *storeTestSuite) TestSnapCommandsTruncated(c *C) {
+	var n int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/api/v1/snaps/names")
+		atomic.AddInt32(&n, 1)
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.WriteHeader(200)
+		io.WriteString(w, truncatedNamesJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	serverURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: serverURL}, nil)
+
+	var db recordingSnapAdder
+	var bufNames bytes.Buffer
+	err := sto.WriteCatalogs(s.ctx, &bufNames, &db)
+	c.Assert(err, Equals, store.ErrCatalogTruncated)
+	// the partial catalog is not written out
+	c.Check(bufNames.String(), Equals, "")
+	c.Check(db.added, IsNil)
+	// and it was retried
+	c.Check(atomic.LoadInt32(&n), Equals, int32(5))
+}
+
+func (s *storeTestSuite) TestSnapCommandsTruncatedThenComplete(c *C) {
+	c.Assert(os.MkdirAll(dirs.SnapCacheDir, 0755), IsNil)
+
+	var n int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/api/v1/snaps/names")
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.WriteHeader(200)
+		// the catalog is spooled to the cache dir
+		spooled, err := filepath.Glob(filepath.Join(dirs.SnapCacheDir, "snap-*"))
+		c.Check(err, IsNil)
+		c.Check(spooled, HasLen, 2)
+		if atomic.AddInt32(&n, 1) == 1 {
+			io.WriteString(w, truncatedNamesJSON)
+			return
+		}
+		io.WriteString(w, mockNamesJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	serverURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: serverURL}, nil)
+
+	db, err := advisor.Create()
+	c.Assert(err, IsNil)
+	defer db.Rollback()
+
+	var bufNames bytes.Buffer
+	err = sto.WriteCatalogs(s.ctx, &bufNames, db)
+	c.Assert(err, IsNil)
+	db.Commit()
+	c.Check(bufNames.String(), Equals, "bar\nfoo\n")
+
+	// the snaps of the cut short attempt were not added
+	dump, err := advisor.DumpCommands()
+	c.Assert(err, IsNil)
+	c.Check(dump, DeepEquals, map[string]string{
+		"foo":     `[{"snap":"foo","version":"1.0"}]`,
+		"bar.baz": `[{"snap":"bar","version":"2.0"}]`,
+		"potato":  `[{"snap":"bar","version":"2.0"}]`,
+		"meh":     `[{"snap":"bar","version":"2.0"},{"snap":"foo","version":"1.0"}]`,
+	})
+	c.Check(atomic.LoadInt32(&n), Equals, int32(2))
+
+	// and the spool files are gone
+	spooled, err := filepath.Glob(filepath.Join(dirs.SnapCacheDir, "snap-*"))
+	c.Assert(err, IsNil)
+	c.Check(spooled, HasLen, 0)
+}
+
+func (s *storeTestSuite) TestSnapCommandsCutOff(c *C) {
+	var body string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/api/v1/snaps/names")
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.WriteHeader(200)
+		io.WriteString(w, body)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	serverURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: serverURL}, nil)
+
+	// only the detection of the truncation matters here, not retrying
+	store.MockDefaultRetryStrategy(&s.BaseTest, retry.LimitCount(1, retry.Exponential{
+		Initial: 1 * time.Millisecond,
+		Factor:  1,
+	}))
+
+	// wherever the catalog is cut off, between or inside tokens,
+	// it is found to be truncated
+	complete := strings.TrimSpace(mockNamesJSON)
+	for i := 0; i < len(complete); i++ {
+		body = complete[:i]
+		var db recordingSnapAdder
+		var bufNames bytes.Buffer
+		err := sto.WriteCatalogs(s.ctx, &bufNames, &db)
+		c.Assert(err, Equals, store.ErrCatalogTruncated, Commentf("cut off at %d: %q", i, body))
+		c.Check(bufNames.String(), Equals, "")
+		c.Check(db.added, IsNil)
+	}
+}
+
+func (s *storeTestSuite) TestSnapCommandsMalformedNotTruncated(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/api/v1/snaps/names")
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.WriteHeader(200)
+		io.WriteString(w, strings.Replace(mockNamesJSON, `"version": "2.0"`, `"version": x`, 1))
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	serverURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: serverURL}, nil)
+
+	var db recordingSnapAdder
+	var bufNames bytes.Buffer
+	err := sto.WriteCatalogs(s.ctx, &bufNames, &db)
+	c.Assert(err, ErrorMatches, `decode new commands catalog: invalid character 'x' .*`)
+	c.Check(bufNames.String(), Equals, "")
+}
+
+func (s *storeTestSuite) TestSnapCommandsConnectionDropped(c *C) {
+	var n int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/api/v1/snaps/names")
+		atomic.AddInt32(&n, 1)
+		w.Header().Set("Content-Type", "application/hal+json")
+		// promise the whole catalog, but drop the connection
+		// halfway through the second package
+		w.Header().Set("Content-Length", fmt.Sprint(len(mockNamesJSON)))
+		w.WriteHeader(200)
+		io.WriteString(w, truncatedNamesJSON[:len(truncatedNamesJSON)-40])
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	serverURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: serverURL}, nil)
+
+	var db recordingSnapAdder
+	var bufNames bytes.Buffer
+	err := sto.WriteCatalogs(s.ctx, &bufNames, &db)
+	c.Assert(err, Equals, store.ErrCatalogTruncated)
+	c.Check(bufNames.String(), Equals, "")
+	c.Check(db.added, IsNil)
+	// a dropped connection is retried
+	c.Check(atomic.LoadInt32(&n), Equals, int32(5))
+}
+
 func (s *storeTestSuite) testFind(c *C, apiV1 bool) {
 	restore := release.MockOnClassic(false)
 	defer restore()
@@ -3246,24 +5225,359 @@ func (s *storeTestSuite) TestFindV2(c *C) {
 	s.testFind(c, false)
 }
 
-func (s *storeTestSuite) TestFindV2FindFields(c *C) {
-	dauthCtx := &testDauthContext{c: c, device: s.device}
-	sto := store.New(nil, dauthCtx)
+func (s *storeTestSuite) TestFindV2Localized(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		c.Check(r.Header.Get("Accept-Language"), Equals, "es")
 
-	findFields := sto.FindFields()
-	sort.Strings(findFields)
-	c.Assert(findFields, DeepEquals, []string{
-		"base", "channel", "common-ids", "confinement", "contact",
-		"description", "download", "license", "media", "prices", "private",
-		"publisher", "revision", "store-url", "summary", "title", "type",
-		"version", "website"})
-}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		io.WriteString(w, strings.Replace(MockSearchJSONv2, "This is a simple hello world example.", "Este es un ejemplo sencillo de hola mundo.", -1))
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
 
-func (s *storeTestSuite) testFindPrivate(c *C, apiV1 bool) {
-	n := 0
-	var v1Fallback, v2Hit bool
-	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if apiV1 {
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+		Locale:       "es",
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	snaps, err := sto.Find(s.ctx, &store.Search{Query: "hello"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(snaps, HasLen, 1)
+	c.Check(snaps[0].Description(), Equals, "Este es un ejemplo sencillo de hola mundo.")
+}
+
+func (s *storeTestSuite) TestFindV1Localized(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, findPath) {
+			forceSearchV1(w)
+			return
+		}
+		assertRequest(c, r, "GET", searchPath)
+		c.Check(r.Header.Get("Accept-Language"), Equals, "es")
+
+		w.Header().Set("Content-Type", "application/hal+json")
+		w.WriteHeader(200)
+		io.WriteString(w, MockSearchJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+		Locale:       "es",
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	snaps, err := sto.Find(s.ctx, &store.Search{Query: "hello"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(snaps, HasLen, 1)
+}
+
+func (s *storeTestSuite) TestFindV2ConfinementAndType(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		fields := r.URL.Query().Get("fields")
+		c.Check(fields, Matches, "(.*,)?confinement(,.*)?")
+		c.Check(fields, Matches, "(.*,)?type(,.*)?")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		io.WriteString(w, `{
+  "results": [
+    {
+      "name": "classic-app",
+      "snap-id": "classic-app-id",
+      "revision": {"revision": 1, "version": "1.0", "type": "app", "confinement": "classic", "channel": "stable"},
+      "snap": {"summary": "a classic app", "publisher": {"id": "foo-id", "username": "foo"}}
+    },
+    {
+      "name": "strict-app",
+      "snap-id": "strict-app-id",
+      "revision": {"revision": 2, "version": "2.0", "type": "app", "confinement": "strict", "channel": "stable"},
+      "snap": {"summary": "a strict app", "publisher": {"id": "foo-id", "username": "foo"}}
+    },
+    {
+      "name": "core20",
+      "snap-id": "core20-id",
+      "revision": {"revision": 3, "version": "20", "type": "base", "confinement": "strict", "channel": "stable"},
+      "snap": {"summary": "a base", "publisher": {"id": "canonical", "username": "canonical"}}
+    }
+  ]
+}`)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.DefaultConfig()
+	cfg.StoreBaseURL = mockServerURL
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(cfg, dauthCtx)
+
+	snaps, err := sto.Find(s.ctx, &store.Search{Query: "app"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(snaps, HasLen, 3)
+
+	c.Check(snaps[0].InstanceName(), Equals, "classic-app")
+	c.Check(snaps[0].Confinement, Equals, snap.ClassicConfinement)
+	c.Check(snaps[0].GetType(), Equals, snap.TypeApp)
+
+	c.Check(snaps[1].InstanceName(), Equals, "strict-app")
+	c.Check(snaps[1].Confinement, Equals, snap.StrictConfinement)
+	c.Check(snaps[1].GetType(), Equals, snap.TypeApp)
+
+	c.Check(snaps[2].InstanceName(), Equals, "core20")
+	c.Check(snaps[2].Confinement, Equals, snap.StrictConfinement)
+	c.Check(snaps[2].GetType(), Equals, snap.TypeBase)
+}
+
+func (s *storeTestSuite) TestFindMaxContentRating(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		query := r.URL.Query()
+		c.Check(query.Get("q"), Equals, "hello")
+		switch n {
+		case 0:
+			c.Check(query.Get("max-age-rating"), Equals, "12")
+		case 1:
+			_, ok := query["max-age-rating"]
+			c.Check(ok, Equals, false)
+		default:
+			c.Fatalf("unexpected request")
+		}
+		n++
+
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, strings.Replace(MockSearchJSONv2, `"snap" : {`, `"snap" : {"age-rating": "7",`, 1))
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	snaps, err := sto.Find(s.ctx, &store.Search{Query: "hello", MaxContentRating: "12"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(snaps, HasLen, 1)
+	c.Check(snaps[0].AgeRating, Equals, "7")
+
+	_, err = sto.Find(s.ctx, &store.Search{Query: "hello"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 2)
+}
+
+func (s *storeTestSuite) TestFindRankedScores(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		w.Header().Set("Content-Type", "application/json")
+		switch n {
+		case 0:
+			io.WriteString(w, `{"results": [
+  {"name": "hello", "snap-id": "hello-id", "score": 0.25, "revision": {"revision": 1, "channel": "stable"}, "snap": {}},
+  {"name": "hello-world", "snap-id": "hello-world-id", "score": 0.75, "revision": {"revision": 2, "channel": "stable"}, "snap": {}}
+]}`)
+		case 1:
+			io.WriteString(w, MockSearchJSONv2)
+		default:
+			c.Fatalf("unexpected request")
+		}
+		n++
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	results, err := sto.FindRanked(s.ctx, &store.Search{Query: "hello"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 2)
+	// in the order of the store, not by score
+	c.Check(results[0].Info.InstanceName(), Equals, "hello")
+	c.Check(results[0].Scored, Equals, true)
+	c.Check(results[0].Score, Equals, 0.25)
+	c.Check(results[1].Info.InstanceName(), Equals, "hello-world")
+	c.Check(results[1].Scored, Equals, true)
+	c.Check(results[1].Score, Equals, 0.75)
+
+	// stores may not score results
+	results, err = sto.FindRanked(s.ctx, &store.Search{Query: "hello"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Check(results[0].Info.InstanceName(), Equals, "hello-world")
+	c.Check(results[0].Scored, Equals, false)
+	c.Check(results[0].Score, Equals, 0.0)
+	c.Check(n, Equals, 2)
+}
+
+func (s *storeTestSuite) TestFindDedupeBySnapID(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"results": [
+  {"name": "hello", "snap-id": "hello-id", "revision": {"revision": 3, "channel": "edge"}, "snap": {}},
+  {"name": "other", "snap-id": "other-id", "revision": {"revision": 5, "channel": "beta"}, "snap": {}},
+  {"name": "hello", "snap-id": "hello-id", "revision": {"revision": 1, "channel": "stable"}, "snap": {}},
+  {"name": "hello", "snap-id": "hello-id", "revision": {"revision": 2, "channel": "2.0/stable"}, "snap": {}},
+  {"name": "other", "snap-id": "other-id", "revision": {"revision": 4, "channel": "edge"}, "snap": {}}
+]}`)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	snaps, err := sto.Find(s.ctx, &store.Search{Query: "hello", Scope: "wide"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(snaps, HasLen, 5)
+
+	snaps, err = sto.Find(s.ctx, &store.Search{Query: "hello", Scope: "wide", DedupeBySnapID: true}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(snaps, HasLen, 2)
+	// in the order the snaps were first found in, with the stable
+	// entry preferred, or else the first one
+	c.Check(snaps[0].SnapID, Equals, "hello-id")
+	c.Check(snaps[0].Channel, Equals, "stable")
+	c.Check(snaps[0].Revision, Equals, snap.R(1))
+	c.Check(snaps[1].SnapID, Equals, "other-id")
+	c.Check(snaps[1].Channel, Equals, "beta")
+	c.Check(snaps[1].Revision, Equals, snap.R(5))
+}
+
+func (s *storeTestSuite) TestFindV1DedupeBySnapID(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, findPath) {
+			forceSearchV1(w)
+			return
+		}
+		assertRequest(c, r, "GET", searchPath)
+		w.Header().Set("Content-Type", "application/hal+json")
+		io.WriteString(w, `{"_embedded": {"clickindex:package": [
+  {"package_name": "hello", "snap_id": "hello-id", "revision": 3, "channel": "edge"},
+  {"package_name": "hello", "snap_id": "hello-id", "revision": 1, "channel": "latest/stable"}
+]}}`)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	snaps, err := sto.Find(s.ctx, &store.Search{Query: "hello", Scope: "wide", DedupeBySnapID: true}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(snaps, HasLen, 1)
+	c.Check(snaps[0].SnapID, Equals, "hello-id")
+	c.Check(snaps[0].Channel, Equals, "latest/stable")
+	c.Check(snaps[0].Revision, Equals, snap.R(1))
+}
+
+func (s *storeTestSuite) TestFindExtraParams(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		query := r.URL.Query()
+		c.Check(query.Get("q"), Equals, "hello")
+		c.Check(query.Get("channel"), Equals, "stable")
+		c.Check(query.Get("ranking"), Equals, "experiment-b")
+		c.Check(query.Get("boost"), Equals, "1.5")
+		n++
+
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, MockSearchJSONv2)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	snaps, err := sto.Find(s.ctx, &store.Search{
+		Query: "hello",
+		ExtraParams: map[string]string{
+			"ranking": "experiment-b",
+			"boost":   "1.5",
+		},
+	}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(snaps, HasLen, 1)
+	c.Check(n, Equals, 1)
+}
+
+func (s *storeTestSuite) TestFindExtraParamsInvalid(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Fatalf("no request expected")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	for _, param := range []string{"fields", "architecture", "q", "name", "channel", "confinement", "common-id", "category", "private", ""} {
+		_, err := sto.Find(s.ctx, &store.Search{
+			Query:       "hello",
+			ExtraParams: map[string]string{param: "foo"},
+		}, nil)
+		c.Check(err, ErrorMatches, fmt.Sprintf("cannot override reserved search parameter %q", param))
+	}
+
+	for _, value := range []string{"foo:bar", "a&b", "x=y", "(z)"} {
+		_, err := sto.Find(s.ctx, &store.Search{
+			Query:       "hello",
+			ExtraParams: map[string]string{"ranking": value},
+		}, nil)
+		c.Check(err, Equals, store.ErrBadQuery, Commentf("%q", value))
+	}
+}
+
+func (s *storeTestSuite) TestFindV2FindFields(c *C) {
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(nil, dauthCtx)
+
+	findFields := sto.FindFields()
+	sort.Strings(findFields)
+	c.Assert(findFields, DeepEquals, []string{
+		"age-rating", "base", "channel", "common-ids", "confinement", "contact",
+		"description", "download", "license", "media", "notes", "prices",
+		"private", "publisher", "revision", "store-url", "summary", "title",
+		"type", "version", "website"})
+}
+
+func (s *storeTestSuite) testFindPrivate(c *C, apiV1 bool) {
+	n := 0
+	var v1Fallback, v2Hit bool
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiV1 {
 			if strings.Contains(r.URL.Path, findPath) {
 				forceSearchV1(w)
 				return
@@ -3399,6 +5713,33 @@ func (s *storeTestSuite) TestFindInvalidScope(c *C) {
 	c.Check(err, Equals, store.ErrInvalidScope)
 }
 
+func (s *storeTestSuite) TestFindInvalidScopeNoRequest(c *C) {
+	for _, v1 := range []bool{false, true} {
+		n := 0
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n++
+			if v1 {
+				forceSearchV1(w)
+				return
+			}
+			w.WriteHeader(500)
+		}))
+		c.Assert(mockServer, NotNil)
+
+		mockServerURL, _ := url.Parse(mockServer.URL)
+		sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+		for _, scope := range []string{"foo", "WIDE", " wide", "stable"} {
+			search := &store.Search{Query: "hello", Scope: scope}
+			_, err := sto.Find(s.ctx, search, nil)
+			c.Check(err, Equals, store.ErrInvalidScope, Commentf("v1: %v, scope: %q", v1, scope))
+			_, err = sto.FindV1(s.ctx, search, nil)
+			c.Check(err, Equals, store.ErrInvalidScope, Commentf("v1: %v, scope: %q", v1, scope))
+		}
+		c.Check(n, Equals, 0)
+		mockServer.Close()
+	}
+}
+
 func (s *storeTestSuite) testFindFails(c *C, apiV1 bool) {
 	var v1Fallback, v2Hit bool
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -4026,29 +6367,171 @@ func (s *storeTestSuite) TestNew(c *C) {
 	c.Check(aStore.DetailFields(), DeepEquals, store.DefaultConfig().DetailFields)
 }
 
-var testAssertion = `type: snap-declaration
-authority-id: super
-series: 16
-snap-id: snapidfoo
-publisher-id: devidbaz
-snap-name: mysnap
-timestamp: 2016-03-30T12:22:16Z
-sign-key-sha3-384: Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij
+func (s *storeTestSuite) TestNewTLSConfig(c *C) {
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}
+	aStore := store.New(&store.Config{TLSConfig: tlsConfig}, nil)
+	c.Assert(aStore, NotNil)
 
-openpgp wsBcBAABCAAQBQJW+8VBCRDWhXkqAWcrfgAAQ9gIABZFgMPByJZeUE835FkX3/y2hORn
-AzE3R1ktDkQEVe/nfVDMACAuaw1fKmUS4zQ7LIrx/AZYw5i0vKVmJszL42LBWVsqR0+p9Cxebzv9
-U2VUSIajEsUUKkBwzD8wxFzagepFlScif1NvCGZx0vcGUOu0Ent0v+gqgAv21of4efKqEW7crlI1
-T/A8LqZYmIzKRHGwCVucCyAUD8xnwt9nyWLgLB+LLPOVFNK8SR6YyNsX05Yz1BUSndBfaTN8j/k8
-8isKGZE6P0O9ozBbNIAE8v8NMWQegJ4uWuil7D3psLkzQIrxSypk9TrQ2GlIG2hJdUovc5zBuroe
-xS4u9rVT6UY=`
+	transport := aStore.Client().Transport.(*httputil.LoggedTransport).Transport.(*http.Transport)
+	c.Assert(transport.TLSClientConfig, NotNil)
+	c.Check(transport.TLSClientConfig.MinVersion, Equals, uint16(tls.VersionTLS12))
+	c.Check(transport.TLSClientConfig.CipherSuites, DeepEquals, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256})
+	// the config of the caller is not shared
+	c.Check(transport.TLSClientConfig, Not(Equals), tlsConfig)
+}
 
-func (s *storeTestSuite) TestAssertion(c *C) {
-	restore := asserts.MockMaxSupportedFormat(asserts.SnapDeclarationType, 88)
-	defer restore()
-	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
-		// check device authorization is set, implicitly checking doRequest was used
-		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+func (s *storeTestSuite) TestUnixSocketProxy(c *C) {
+	sock := filepath.Join(c.MkDir(), "store-agent.sock")
+	l, err := net.Listen("unix", sock)
+	c.Assert(err, IsNil)
+
+	n := 0
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		c.Check(r.Host, Equals, "store.example.com")
+		c.Check(r.URL.Path, Matches, ".*/hello-world")
+		io.WriteString(w, mockInfoJSON)
+		n++
+	}))
+	mockServer.Listener.Close()
+	mockServer.Listener = l
+	mockServer.Start()
+	defer mockServer.Close()
+
+	storeURL, _ := url.Parse("http://store.example.com/")
+	cfg := store.Config{
+		StoreBaseURL:    storeURL,
+		UnixSocketProxy: sock,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	result, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(result.InstanceName(), Equals, "hello-world")
+	c.Check(n, Equals, 1)
+}
+
+func (s *storeTestSuite) TestClose(c *C) {
+	closed := make(chan struct{})
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		io.WriteString(w, mockInfoJSON)
+	}))
+	mockServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			close(closed)
+		}
+	}
+	mockServer.Start()
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+
+	// the connection is kept around idle
+	select {
+	case <-closed:
+		c.Fatalf("connection closed too early")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.Assert(sto.Close(), IsNil)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("idle connection was not closed")
+	}
+}
+
+func (s *storeTestSuite) TestTLSConfigWithExtraCerts(c *C) {
+	mockServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	// the server cert is only known via the extra certs dir
+	c.Assert(os.MkdirAll(dirs.SnapdStoreSSLCertsDir, 0755), IsNil)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mockServer.Certificate().Raw})
+	err := ioutil.WriteFile(filepath.Join(dirs.SnapdStoreSSLCertsDir, "test.pem"), certPEM, 0644)
+	c.Assert(err, IsNil)
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	aStore := store.New(&store.Config{TLSConfig: tlsConfig}, nil)
+
+	resp, err := aStore.Client().Get(mockServer.URL)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, 200)
+	// the config of the caller is left alone
+	c.Check(tlsConfig.RootCAs, IsNil)
+}
+
+func (s *storeTestSuite) TestTLSConfigRootCAsNotModified(c *C) {
+	mockServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	c.Assert(os.MkdirAll(dirs.SnapdStoreSSLCertsDir, 0755), IsNil)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mockServer.Certificate().Raw})
+	err := ioutil.WriteFile(filepath.Join(dirs.SnapdStoreSSLCertsDir, "test.pem"), certPEM, 0644)
+	c.Assert(err, IsNil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(mockServer.Certificate())
+	tlsConfig := &tls.Config{
+		RootCAs: roots,
+	}
+	aStore := store.New(&store.Config{TLSConfig: tlsConfig}, nil)
+
+	resp, err := aStore.Client().Get(mockServer.URL)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, 200)
+	// the config of the caller is left alone
+	c.Check(tlsConfig.MinVersion, Equals, uint16(0))
+	c.Check(tlsConfig.RootCAs, Equals, roots)
+	c.Check(roots.Subjects(), HasLen, 1)
+}
+
+var testAssertion = `type: snap-declaration
+authority-id: super
+series: 16
+snap-id: snapidfoo
+publisher-id: devidbaz
+snap-name: mysnap
+timestamp: 2016-03-30T12:22:16Z
+sign-key-sha3-384: Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij
+
+openpgp wsBcBAABCAAQBQJW+8VBCRDWhXkqAWcrfgAAQ9gIABZFgMPByJZeUE835FkX3/y2hORn
+AzE3R1ktDkQEVe/nfVDMACAuaw1fKmUS4zQ7LIrx/AZYw5i0vKVmJszL42LBWVsqR0+p9Cxebzv9
+U2VUSIajEsUUKkBwzD8wxFzagepFlScif1NvCGZx0vcGUOu0Ent0v+gqgAv21of4efKqEW7crlI1
+T/A8LqZYmIzKRHGwCVucCyAUD8xnwt9nyWLgLB+LLPOVFNK8SR6YyNsX05Yz1BUSndBfaTN8j/k8
+8isKGZE6P0O9ozBbNIAE8v8NMWQegJ4uWuil7D3psLkzQIrxSypk9TrQ2GlIG2hJdUovc5zBuroe
+xS4u9rVT6UY=`
+
+func (s *storeTestSuite) TestAssertion(c *C) {
+	restore := asserts.MockMaxSupportedFormat(asserts.SnapDeclarationType, 88)
+	defer restore()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		// check device authorization is set, implicitly checking doRequest was used
+		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
 
 		c.Check(r.Header.Get("Accept"), Equals, "application/x.ubuntu.assertion")
 		c.Check(r.URL.Path, Matches, ".*/snap-declaration/16/snapidfoo")
@@ -4072,6 +6555,109 @@ func (s *storeTestSuite) TestAssertion(c *C) {
 	c.Check(a.Type(), Equals, asserts.SnapDeclarationType)
 }
 
+func (s *storeTestSuite) TestAssertionDefaultRequestTimeout(c *C) {
+	var n int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		atomic.AddInt32(&n, 1)
+		// the request gets cancelled before this returns
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			c.Errorf("request was not cancelled")
+		}
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL:          mockServerURL,
+		DefaultRequestTimeout: 50 * time.Millisecond,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	_, err := sto.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
+	c.Assert(err, ErrorMatches, ".*context deadline exceeded.*")
+	c.Check(atomic.LoadInt32(&n), Equals, int32(1))
+
+	atomic.StoreInt32(&n, 0)
+	_, err = sto.AssertionRevisions(context.Background(), asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, nil)
+	c.Assert(err, ErrorMatches, ".*context deadline exceeded.*")
+	c.Check(atomic.LoadInt32(&n), Equals, int32(1))
+}
+
+func maxFormatOpt(n int) *int {
+	return &n
+}
+
+func (s *storeTestSuite) TestAssertionWithOptionsMaxFormat(c *C) {
+	restore := asserts.MockMaxSupportedFormat(asserts.SnapDeclarationType, 88)
+	defer restore()
+
+	var maxFormat string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		c.Check(r.URL.Path, Matches, ".*/snap-declaration/16/snapidfoo")
+		maxFormat = r.URL.Query().Get("max-format")
+		io.WriteString(w, testAssertion)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	for _, t := range []struct {
+		opts      *store.AssertionOptions
+		maxFormat string
+	}{
+		{nil, "88"},
+		{&store.AssertionOptions{}, "88"},
+		{&store.AssertionOptions{MaxFormat: maxFormatOpt(88)}, "88"},
+		{&store.AssertionOptions{MaxFormat: maxFormatOpt(3)}, "3"},
+		// the lowest format can be asked for too
+		{&store.AssertionOptions{MaxFormat: maxFormatOpt(0)}, "0"},
+	} {
+		maxFormat = ""
+		a, err := sto.AssertionWithOptions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, t.opts)
+		c.Assert(err, IsNil)
+		c.Check(a.Type(), Equals, asserts.SnapDeclarationType)
+		c.Check(maxFormat, Equals, t.maxFormat, Commentf("%+v", t.opts))
+	}
+}
+
+func (s *storeTestSuite) TestAssertionWithOptionsMaxFormatTooHigh(c *C) {
+	restore := asserts.MockMaxSupportedFormat(asserts.SnapDeclarationType, 88)
+	defer restore()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Errorf("unexpected request: %s", r.URL.String())
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, err := sto.AssertionWithOptions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, &store.AssertionOptions{MaxFormat: maxFormatOpt(89)})
+	c.Check(err, ErrorMatches, `cannot fetch snap-declaration assertion with max-format 89: supported max-format is 88`)
+	_, err = sto.AssertionWithOptions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, &store.AssertionOptions{MaxFormat: maxFormatOpt(-1)})
+	c.Check(err, ErrorMatches, `cannot fetch snap-declaration assertion with max-format -1: supported max-format is 88`)
+	_, err = sto.AssertionRevisions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, &store.AssertionOptions{MaxFormat: maxFormatOpt(89)})
+	c.Check(err, ErrorMatches, `cannot fetch snap-declaration assertion with max-format 89: supported max-format is 88`)
+}
+
 func (s *storeTestSuite) TestAssertionProxyStoreFromAuthContext(c *C) {
 	restore := asserts.MockMaxSupportedFormat(asserts.SnapDeclarationType, 88)
 	defer restore()
@@ -4109,14 +6695,14 @@ func (s *storeTestSuite) TestAssertionProxyStoreFromAuthContext(c *C) {
 	c.Check(a.Type(), Equals, asserts.SnapDeclarationType)
 }
 
-func (s *storeTestSuite) TestAssertionNotFound(c *C) {
+func (s *storeTestSuite) TestAssertionCustomPath(c *C) {
+	restore := asserts.MockMaxSupportedFormat(asserts.SnapDeclarationType, 88)
+	defer restore()
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
-		c.Check(r.Header.Get("Accept"), Equals, "application/x.ubuntu.assertion")
-		c.Check(r.URL.Path, Matches, ".*/snap-declaration/16/snapidfoo")
-		w.Header().Set("Content-Type", "application/problem+json")
-		w.WriteHeader(404)
-		io.WriteString(w, `{"status": 404,"title": "not found"}`)
+		assertRequest(c, r, "GET", "/proxy/assertions/.*")
+		c.Check(r.URL.Path, Equals, "/proxy/assertions/snap-declaration/16/snapidfoo")
+		c.Check(r.URL.RawQuery, Equals, "max-format=88")
+		io.WriteString(w, testAssertion)
 	}))
 
 	c.Assert(mockServer, NotNil)
@@ -4125,310 +6711,527 @@ func (s *storeTestSuite) TestAssertionNotFound(c *C) {
 	mockServerURL, _ := url.Parse(mockServer.URL)
 	cfg := store.Config{
 		AssertionsBaseURL: mockServerURL,
+		AssertionsPath:    "proxy/assertions",
 	}
 	sto := store.New(&cfg, nil)
 
-	_, err := sto.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
-	c.Check(asserts.IsNotFound(err), Equals, true)
-	c.Check(err, DeepEquals, &asserts.NotFoundError{
-		Type: asserts.SnapDeclarationType,
-		Headers: map[string]string{
-			"series":  "16",
-			"snap-id": "snapidfoo",
-		},
-	})
+	a, err := sto.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(a.Type(), Equals, asserts.SnapDeclarationType)
 }
 
-func (s *storeTestSuite) TestAssertion500(c *C) {
-	var n = 0
+func (s *storeTestSuite) TestAssertionInvalidCustomPath(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
-		n++
-		w.WriteHeader(500)
+		c.Fatalf("no request expected")
 	}))
 
 	c.Assert(mockServer, NotNil)
 	defer mockServer.Close()
 
 	mockServerURL, _ := url.Parse(mockServer.URL)
-	cfg := store.Config{
-		AssertionsBaseURL: mockServerURL,
-	}
-	sto := store.New(&cfg, nil)
+	for _, p := range []string{"proxy/assertions?foo=bar", "proxy/assertions#frag"} {
+		cfg := store.Config{
+			AssertionsBaseURL: mockServerURL,
+			AssertionsPath:    p,
+		}
+		sto := store.New(&cfg, nil)
 
-	_, err := sto.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
-	c.Assert(err, ErrorMatches, `cannot fetch assertion: got unexpected HTTP status code 500 via .+`)
-	c.Assert(n, Equals, 5)
-}
+		_, err := sto.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
+		c.Check(err, ErrorMatches, `invalid assertions path ".*": must not contain a query string`)
 
-func (s *storeTestSuite) TestSuggestedCurrency(c *C) {
-	suggestedCurrency := "GBP"
+		_, err = sto.AssertionRevisions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, nil)
+		c.Check(err, ErrorMatches, `invalid assertions path ".*": must not contain a query string`)
+	}
+}
 
+func (s *storeTestSuite) TestDownloadWithAssertions(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "GET", infoPathPattern)
-		w.Header().Set("X-Suggested-Currency", suggestedCurrency)
-		w.WriteHeader(200)
-
-		io.WriteString(w, mockInfoJSON)
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		c.Check(r.URL.Path, Matches, ".*/snap-declaration/16/snapidfoo")
+		// the assertions are fetched with the context of the caller
+		c.Check(r.Header.Get("Snap-Client-User-Agent"), Equals, "some-agent")
+		io.WriteString(w, testAssertion)
 	}))
 
 	c.Assert(mockServer, NotNil)
 	defer mockServer.Close()
 
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		c.Check(url, Equals, "anon-url")
+		w.Write([]byte("snap-data"))
+		return nil
+	})
+	defer restore()
+
 	mockServerURL, _ := url.Parse(mockServer.URL)
 	cfg := store.Config{
-		StoreBaseURL: mockServerURL,
+		AssertionsBaseURL: mockServerURL,
 	}
 	sto := store.New(&cfg, nil)
 
-	// the store doesn't know the currency until after the first search, so fall back to dollars
-	c.Check(sto.SuggestedCurrency(), Equals, "USD")
-
-	// we should soon have a suggested currency
-	spec := store.SnapSpec{
-		Name: "hello-world",
+	dlInfo := &snap.DownloadInfo{AnonDownloadURL: "anon-url"}
+	refs := []*asserts.Ref{
+		{Type: asserts.SnapDeclarationType, PrimaryKey: []string{"16", "snapidfoo"}},
 	}
-	result, err := sto.SnapInfo(s.ctx, spec, nil)
+	path := filepath.Join(c.MkDir(), "mysnap_1.snap")
+	ctx := store.WithClientUserAgent(s.ctx, &http.Request{Header: http.Header{"User-Agent": {"some-agent"}}})
+	err := sto.DownloadWithAssertions(ctx, "mysnap", path, dlInfo, refs, nil, nil)
 	c.Assert(err, IsNil)
-	c.Assert(result, NotNil)
-	c.Check(sto.SuggestedCurrency(), Equals, "GBP")
 
-	suggestedCurrency = "EUR"
-
-	// checking the currency updates
-	result, err = sto.SnapInfo(s.ctx, spec, nil)
+	c.Check(path, testutil.FileEquals, "snap-data")
+	f, err := os.Open(strings.TrimSuffix(path, ".snap") + ".assert")
 	c.Assert(err, IsNil)
-	c.Assert(result, NotNil)
-	c.Check(sto.SuggestedCurrency(), Equals, "EUR")
+	defer f.Close()
+	dec := asserts.NewDecoder(f)
+	a, err := dec.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a.Type(), Equals, asserts.SnapDeclarationType)
+	c.Check(a.HeaderString("snap-id"), Equals, "snapidfoo")
+	_, err = dec.Decode()
+	c.Check(err, Equals, io.EOF)
 }
 
-func (s *storeTestSuite) TestDecorateOrders(c *C) {
-	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "GET", ordersPath)
-		// check device authorization is set, implicitly checking doRequest was used
-		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
-		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
-		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
-		c.Check(r.URL.Path, Equals, ordersPath)
-		io.WriteString(w, mockOrdersJSON)
+func (s *storeTestSuite) TestDownloadWithAssertionsFetchError(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(404)
+		io.WriteString(w, `{"status": 404,"title": "not found"}`)
 	}))
 
-	c.Assert(mockPurchasesServer, NotNil)
-	defer mockPurchasesServer.Close()
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
 
-	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
-	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		c.Fatalf("unexpected download")
+		return nil
+	})
+	defer restore()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
 	cfg := store.Config{
-		StoreBaseURL: mockServerURL,
+		AssertionsBaseURL: mockServerURL,
 	}
-	sto := store.New(&cfg, dauthCtx)
+	sto := store.New(&cfg, nil)
 
-	helloWorld := &snap.Info{}
-	helloWorld.SnapID = helloWorldSnapID
-	helloWorld.Prices = map[string]float64{"USD": 1.23}
-	helloWorld.Paid = true
-
-	funkyApp := &snap.Info{}
-	funkyApp.SnapID = funkyAppSnapID
-	funkyApp.Prices = map[string]float64{"USD": 2.34}
-	funkyApp.Paid = true
-
-	otherApp := &snap.Info{}
-	otherApp.SnapID = "other"
-	otherApp.Prices = map[string]float64{"USD": 3.45}
-	otherApp.Paid = true
-
-	otherApp2 := &snap.Info{}
-	otherApp2.SnapID = "other2"
-
-	snaps := []*snap.Info{helloWorld, funkyApp, otherApp, otherApp2}
-
-	err := sto.DecorateOrders(snaps, s.user)
-	c.Assert(err, IsNil)
+	dlInfo := &snap.DownloadInfo{AnonDownloadURL: "anon-url"}
+	refs := []*asserts.Ref{
+		{Type: asserts.SnapDeclarationType, PrimaryKey: []string{"16", "snapidfoo"}},
+	}
+	dir := c.MkDir()
+	path := filepath.Join(dir, "mysnap_1.snap")
+	err := sto.DownloadWithAssertions(s.ctx, "mysnap", path, dlInfo, refs, nil, nil)
+	c.Check(err, ErrorMatches, `cannot fetch assertion snap-declaration \(snapidfoo; series:16\): snap-declaration \(snapidfoo; series:16\) not found`)
 
-	c.Check(helloWorld.MustBuy, Equals, false)
-	c.Check(funkyApp.MustBuy, Equals, false)
-	c.Check(otherApp.MustBuy, Equals, true)
-	c.Check(otherApp2.MustBuy, Equals, false)
+	// nothing was written
+	c.Check(path, testutil.FileAbsent)
+	c.Check(filepath.Join(dir, "mysnap_1.assert"), testutil.FileAbsent)
 }
 
-func (s *storeTestSuite) TestDecorateOrdersFailedAccess(c *C) {
-	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "GET", ordersPath)
-		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
-		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
-		c.Check(r.URL.Path, Equals, ordersPath)
-		w.WriteHeader(401)
-		io.WriteString(w, "{}")
+func (s *storeTestSuite) TestDownloadWithAssertionsCancelled(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Fatalf("unexpected request")
 	}))
 
-	c.Assert(mockPurchasesServer, NotNil)
-	defer mockPurchasesServer.Close()
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
 
-	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		c.Fatalf("unexpected download")
+		return nil
+	})
+	defer restore()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
 	cfg := store.Config{
-		StoreBaseURL: mockServerURL,
+		AssertionsBaseURL: mockServerURL,
 	}
 	sto := store.New(&cfg, nil)
 
-	helloWorld := &snap.Info{}
-	helloWorld.SnapID = helloWorldSnapID
-	helloWorld.Prices = map[string]float64{"USD": 1.23}
-	helloWorld.Paid = true
-
-	funkyApp := &snap.Info{}
-	funkyApp.SnapID = funkyAppSnapID
-	funkyApp.Prices = map[string]float64{"USD": 2.34}
-	funkyApp.Paid = true
-
-	otherApp := &snap.Info{}
-	otherApp.SnapID = "other"
-	otherApp.Prices = map[string]float64{"USD": 3.45}
-	otherApp.Paid = true
+	dlInfo := &snap.DownloadInfo{AnonDownloadURL: "anon-url"}
+	refs := []*asserts.Ref{
+		{Type: asserts.SnapDeclarationType, PrimaryKey: []string{"16", "snapidfoo"}},
+	}
+	path := filepath.Join(c.MkDir(), "mysnap_1.snap")
+	ctx, cancel := context.WithCancel(s.ctx)
+	cancel()
+	err := sto.DownloadWithAssertions(ctx, "mysnap", path, dlInfo, refs, nil, nil)
+	c.Check(err, ErrorMatches, `cannot fetch assertion snap-declaration \(snapidfoo; series:16\): .*context canceled`)
+	c.Check(path, testutil.FileAbsent)
+}
+
+type expectPublisherIDTest struct {
+	expectedPublisherID string
+	// withDigest makes the download info carry the digest of the snap
+	withDigest bool
+	// otherUploader makes the revision be uploaded by another account
+	otherUploader bool
+	// untrusted makes the store assertions not be trusted
+	untrusted bool
+	// series sets the series of the store, with the snap published
+	// there by seriesPublisherID
+	series            string
+	seriesPublisherID string
+}
+
+func (s *storeTestSuite) testDownloadExpectPublisherID(c *C, t expectPublisherIDTest) error {
+	h := crypto.SHA3_384.New()
+	h.Write([]byte("snap-data"))
+	digest := h.Sum(nil)
+	snapDigest, err := asserts.EncodeDigest(crypto.SHA3_384, digest)
+	c.Assert(err, IsNil)
 
-	otherApp2 := &snap.Info{}
-	otherApp2.SnapID = "other2"
+	f := newSnapAssertionsFixture(c, snapDigest, t.otherUploader)
+	if t.series != "" {
+		f.addSeriesSnapDecl(c, t.series, t.seriesPublisherID)
+	}
+	if !t.untrusted {
+		defer store.MockTrusted(f.storeStack.Trusted)()
+	}
+	mockServer := f.serve(c, make(map[string]int))
+	defer mockServer.Close()
 
-	snaps := []*snap.Info{helloWorld, funkyApp, otherApp, otherApp2}
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		w.Write([]byte("snap-data"))
+		return nil
+	})
+	defer restore()
 
-	err := sto.DecorateOrders(snaps, s.user)
-	c.Assert(err, NotNil)
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL, Series: t.series}, nil)
 
-	c.Check(helloWorld.MustBuy, Equals, true)
-	c.Check(funkyApp.MustBuy, Equals, true)
-	c.Check(otherApp.MustBuy, Equals, true)
-	c.Check(otherApp2.MustBuy, Equals, false)
+	dlInfo := &snap.DownloadInfo{AnonDownloadURL: "anon-url"}
+	if t.withDigest {
+		dlInfo.Sha3_384 = fmt.Sprintf("%x", digest)
+	}
+	path := filepath.Join(c.MkDir(), "foo_1.snap")
+	err = sto.Download(s.ctx, "foo", path, dlInfo, nil, nil, &store.DownloadOptions{ExpectPublisherID: t.expectedPublisherID})
+	if err == nil {
+		c.Check(path, testutil.FileEquals, "snap-data")
+	} else {
+		c.Check(path, testutil.FileAbsent)
+	}
+	return err
 }
 
-func (s *storeTestSuite) TestDecorateOrdersNoAuth(c *C) {
-	cfg := store.Config{}
-	sto := store.New(&cfg, nil)
-
-	helloWorld := &snap.Info{}
-	helloWorld.SnapID = helloWorldSnapID
-	helloWorld.Prices = map[string]float64{"USD": 1.23}
-	helloWorld.Paid = true
+func (s *storeTestSuite) TestDownloadExpectPublisherID(c *C) {
+	err := s.testDownloadExpectPublisherID(c, expectPublisherIDTest{
+		expectedPublisherID: "developer1",
+		withDigest:          true,
+	})
+	c.Check(err, IsNil)
 
-	funkyApp := &snap.Info{}
-	funkyApp.SnapID = funkyAppSnapID
-	funkyApp.Prices = map[string]float64{"USD": 2.34}
-	funkyApp.Paid = true
+	// without a digest from the store the snap itself is hashed
+	err = s.testDownloadExpectPublisherID(c, expectPublisherIDTest{
+		expectedPublisherID: "developer1",
+	})
+	c.Check(err, IsNil)
+}
 
-	otherApp := &snap.Info{}
-	otherApp.SnapID = "other"
-	otherApp.Prices = map[string]float64{"USD": 3.45}
-	otherApp.Paid = true
+func (s *storeTestSuite) TestDownloadExpectPublisherIDMismatch(c *C) {
+	err := s.testDownloadExpectPublisherID(c, expectPublisherIDTest{
+		expectedPublisherID: "someone-else",
+		withDigest:          true,
+	})
+	c.Assert(err, FitsTypeOf, &store.PublisherMismatchError{})
+	c.Check(err, DeepEquals, &store.PublisherMismatchError{
+		Name:        "foo",
+		PublisherID: "developer1",
+		ExpectedID:  "someone-else",
+	})
+	c.Check(err, ErrorMatches, `snap "foo" is published by "developer1" instead of the expected "someone-else"`)
+}
 
-	otherApp2 := &snap.Info{}
-	otherApp2.SnapID = "other2"
+func (s *storeTestSuite) TestDownloadExpectPublisherIDOtherUploader(c *C) {
+	// a revision uploaded by a collaborator of the publisher is fine
+	err := s.testDownloadExpectPublisherID(c, expectPublisherIDTest{
+		expectedPublisherID: "developer1",
+		withDigest:          true,
+		otherUploader:       true,
+	})
+	c.Check(err, IsNil)
 
-	snaps := []*snap.Info{helloWorld, funkyApp, otherApp, otherApp2}
+	// but the publisher is still checked
+	err = s.testDownloadExpectPublisherID(c, expectPublisherIDTest{
+		expectedPublisherID: "developer2",
+		withDigest:          true,
+		otherUploader:       true,
+	})
+	c.Check(err, DeepEquals, &store.PublisherMismatchError{
+		Name:        "foo",
+		PublisherID: "developer1",
+		ExpectedID:  "developer2",
+	})
+}
 
-	err := sto.DecorateOrders(snaps, nil)
-	c.Assert(err, IsNil)
+func (s *storeTestSuite) TestDownloadExpectPublisherIDStoreSeries(c *C) {
+	// the snap-declaration for the series of the store is the one
+	// checked
+	err := s.testDownloadExpectPublisherID(c, expectPublisherIDTest{
+		expectedPublisherID: "developer1",
+		withDigest:          true,
+		series:              "18",
+		seriesPublisherID:   "developer3",
+	})
+	c.Assert(err, FitsTypeOf, &store.PublisherMismatchError{})
+	c.Check(err, DeepEquals, &store.PublisherMismatchError{
+		Name:        "foo",
+		PublisherID: "developer3",
+		ExpectedID:  "developer1",
+	})
 
-	c.Check(helloWorld.MustBuy, Equals, true)
-	c.Check(funkyApp.MustBuy, Equals, true)
-	c.Check(otherApp.MustBuy, Equals, true)
-	c.Check(otherApp2.MustBuy, Equals, false)
+	err = s.testDownloadExpectPublisherID(c, expectPublisherIDTest{
+		expectedPublisherID: "developer1",
+		withDigest:          true,
+		series:              "18",
+		seriesPublisherID:   "developer1",
+	})
+	c.Check(err, IsNil)
 }
 
-func (s *storeTestSuite) TestDecorateOrdersAllFree(c *C) {
-	requestRecieved := false
+func (s *storeTestSuite) TestDownloadExpectPublisherIDUntrusted(c *C) {
+	// assertions not signed by a trusted authority prove nothing
+	err := s.testDownloadExpectPublisherID(c, expectPublisherIDTest{
+		expectedPublisherID: "developer1",
+		withDigest:          true,
+		untrusted:           true,
+	})
+	c.Check(err, ErrorMatches, `cannot check publisher of snap "foo": .*no matching public key.*`)
+	c.Check(err, Not(FitsTypeOf), &store.PublisherMismatchError{})
+}
 
-	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c.Error(r.URL.Path)
-		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
-		requestRecieved = true
-		io.WriteString(w, `{"orders": []}`)
+func (s *storeTestSuite) TestAssertionNotFound(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		c.Check(r.Header.Get("Accept"), Equals, "application/x.ubuntu.assertion")
+		c.Check(r.URL.Path, Matches, ".*/snap-declaration/16/snapidfoo")
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(404)
+		io.WriteString(w, `{"status": 404,"title": "not found"}`)
 	}))
 
-	c.Assert(mockPurchasesServer, NotNil)
-	defer mockPurchasesServer.Close()
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
 
-	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+	mockServerURL, _ := url.Parse(mockServer.URL)
 	cfg := store.Config{
-		StoreBaseURL: mockServerURL,
+		AssertionsBaseURL: mockServerURL,
 	}
-
 	sto := store.New(&cfg, nil)
 
-	// This snap is free
-	helloWorld := &snap.Info{}
-	helloWorld.SnapID = helloWorldSnapID
-
-	// This snap is also free
-	funkyApp := &snap.Info{}
-	funkyApp.SnapID = funkyAppSnapID
-
-	snaps := []*snap.Info{helloWorld, funkyApp}
-
-	// There should be no request to the purchase server.
-	err := sto.DecorateOrders(snaps, s.user)
-	c.Assert(err, IsNil)
-	c.Check(requestRecieved, Equals, false)
+	_, err := sto.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
+	c.Check(asserts.IsNotFound(err), Equals, true)
+	c.Check(err, DeepEquals, &asserts.NotFoundError{
+		Type: asserts.SnapDeclarationType,
+		Headers: map[string]string{
+			"series":  "16",
+			"snap-id": "snapidfoo",
+		},
+	})
 }
 
-func (s *storeTestSuite) TestDecorateOrdersSingle(c *C) {
-	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
-		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
-		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
-		c.Check(r.URL.Path, Equals, ordersPath)
-		io.WriteString(w, mockSingleOrderJSON)
+func (s *storeTestSuite) TestAssertion500(c *C) {
+	var n = 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		n++
+		w.WriteHeader(500)
 	}))
 
-	c.Assert(mockPurchasesServer, NotNil)
-	defer mockPurchasesServer.Close()
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
 
-	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
-	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	mockServerURL, _ := url.Parse(mockServer.URL)
 	cfg := store.Config{
-		StoreBaseURL: mockServerURL,
+		AssertionsBaseURL: mockServerURL,
 	}
-	sto := store.New(&cfg, dauthCtx)
+	sto := store.New(&cfg, nil)
 
-	helloWorld := &snap.Info{}
-	helloWorld.SnapID = helloWorldSnapID
-	helloWorld.Prices = map[string]float64{"USD": 1.23}
-	helloWorld.Paid = true
+	_, err := sto.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
+	c.Assert(err, ErrorMatches, `cannot fetch assertion: got unexpected HTTP status code 500 via .+`)
+	c.Assert(n, Equals, 5)
+}
 
-	snaps := []*snap.Info{helloWorld}
+func (s *storeTestSuite) TestAssertionRevisions(c *C) {
+	restore := asserts.MockMaxSupportedFormat(asserts.SnapDeclarationType, 88)
+	defer restore()
 
-	err := sto.DecorateOrders(snaps, s.user)
-	c.Assert(err, IsNil)
-	c.Check(helloWorld.MustBuy, Equals, false)
-}
+	rev := func(n int) string {
+		return strings.Replace(testAssertion, "snap-name: mysnap\n", fmt.Sprintf("snap-name: mysnap\nrevision: %d\n", n), 1)
+	}
 
-func (s *storeTestSuite) TestDecorateOrdersSingleFreeSnap(c *C) {
-	cfg := store.Config{}
-	sto := store.New(&cfg, nil)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		c.Check(r.Header.Get("Accept"), Equals, "application/x.ubuntu.assertion")
+		c.Check(r.URL.Path, Matches, ".*/snap-declaration/16/snapidfoo")
+		c.Check(r.URL.Query().Get("max-format"), Equals, "88")
+		c.Check(r.URL.Query().Get("history"), Equals, "all")
+		// not necessarily in order
+		io.WriteString(w, strings.Join([]string{rev(2), testAssertion, rev(1)}, "\n\n"))
+	}))
 
-	helloWorld := &snap.Info{}
-	helloWorld.SnapID = helloWorldSnapID
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
 
-	snaps := []*snap.Info{helloWorld}
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		AssertionsBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
 
-	err := sto.DecorateOrders(snaps, s.user)
+	as, err := sto.AssertionRevisions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, nil)
 	c.Assert(err, IsNil)
-	c.Check(helloWorld.MustBuy, Equals, false)
+	c.Assert(as, HasLen, 3)
+	for i, a := range as {
+		c.Check(a.Type(), Equals, asserts.SnapDeclarationType)
+		c.Check(a.Revision(), Equals, i)
+	}
 }
 
-func (s *storeTestSuite) TestDecorateOrdersSingleNotFound(c *C) {
-	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "GET", ordersPath)
-		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
-		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
-		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
-		c.Check(r.URL.Path, Equals, ordersPath)
-		w.WriteHeader(404)
-		io.WriteString(w, "{}")
+func (s *storeTestSuite) TestAssertionRevisionsMaxFormat(c *C) {
+	restore := asserts.MockMaxSupportedFormat(asserts.SnapDeclarationType, 88)
+	defer restore()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		c.Check(r.URL.Query().Get("max-format"), Equals, "2")
+		c.Check(r.URL.Query().Get("history"), Equals, "all")
+		io.WriteString(w, testAssertion)
 	}))
 
-	c.Assert(mockPurchasesServer, NotNil)
-	defer mockPurchasesServer.Close()
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
 
-	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		AssertionsBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	as, err := sto.AssertionRevisions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, &store.AssertionOptions{MaxFormat: maxFormatOpt(2)})
+	c.Assert(err, IsNil)
+	c.Check(as, HasLen, 1)
+}
+
+func (s *storeTestSuite) TestAssertionRevisionsOnlyLatest(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		// the history is not supported, just the latest is returned
+		io.WriteString(w, testAssertion)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		AssertionsBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	as, err := sto.AssertionRevisions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(as, HasLen, 1)
+	c.Check(as[0].Type(), Equals, asserts.SnapDeclarationType)
+	c.Check(as[0].Revision(), Equals, 0)
+}
+
+func (s *storeTestSuite) TestAssertionRevisionsWrongAssertion(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		io.WriteString(w, testAssertion)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		AssertionsBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, err := sto.AssertionRevisions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidbar"}, nil, nil)
+	c.Check(err, ErrorMatches, `cannot fetch assertion revisions: got snap-declaration \(snapidfoo; series:16\) instead of snap-declaration \(snapidbar; series:16\)`)
+}
+
+func (s *storeTestSuite) TestAssertionRevisionsNotFound(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", "/api/v1/snaps/assertions/.*")
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(404)
+		io.WriteString(w, `{"status": 404,"title": "not found"}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		AssertionsBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	_, err := sto.AssertionRevisions(s.ctx, asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil, nil)
+	c.Check(asserts.IsNotFound(err), Equals, true)
+}
+
+func (s *storeTestSuite) TestSuggestedCurrency(c *C) {
+	suggestedCurrency := "GBP"
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		w.Header().Set("X-Suggested-Currency", suggestedCurrency)
+		w.WriteHeader(200)
+
+		io.WriteString(w, mockInfoJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	// the store doesn't know the currency until after the first search, so fall back to dollars
+	c.Check(sto.SuggestedCurrency(), Equals, "USD")
+
+	// we should soon have a suggested currency
+	spec := store.SnapSpec{
+		Name: "hello-world",
+	}
+	result, err := sto.SnapInfo(s.ctx, spec, nil)
+	c.Assert(err, IsNil)
+	c.Assert(result, NotNil)
+	c.Check(sto.SuggestedCurrency(), Equals, "GBP")
+
+	suggestedCurrency = "EUR"
+
+	// checking the currency updates
+	result, err = sto.SnapInfo(s.ctx, spec, nil)
+	c.Assert(err, IsNil)
+	c.Assert(result, NotNil)
+	c.Check(sto.SuggestedCurrency(), Equals, "EUR")
+}
+
+func (s *storeTestSuite) TestDecorateOrders(c *C) {
+	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", ordersPath)
+		// check device authorization is set, implicitly checking doRequest was used
+		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
+		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
+		c.Check(r.URL.Path, Equals, ordersPath)
+		io.WriteString(w, mockOrdersJSON)
+	}))
+
+	c.Assert(mockPurchasesServer, NotNil)
+	defer mockPurchasesServer.Close()
+
+	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
 	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
 	cfg := store.Config{
 		StoreBaseURL: mockServerURL,
@@ -4440,108 +7243,373 @@ func (s *storeTestSuite) TestDecorateOrdersSingleNotFound(c *C) {
 	helloWorld.Prices = map[string]float64{"USD": 1.23}
 	helloWorld.Paid = true
 
-	snaps := []*snap.Info{helloWorld}
+	funkyApp := &snap.Info{}
+	funkyApp.SnapID = funkyAppSnapID
+	funkyApp.Prices = map[string]float64{"USD": 2.34}
+	funkyApp.Paid = true
+
+	otherApp := &snap.Info{}
+	otherApp.SnapID = "other"
+	otherApp.Prices = map[string]float64{"USD": 3.45}
+	otherApp.Paid = true
+
+	otherApp2 := &snap.Info{}
+	otherApp2.SnapID = "other2"
+
+	snaps := []*snap.Info{helloWorld, funkyApp, otherApp, otherApp2}
 
 	err := sto.DecorateOrders(snaps, s.user)
-	c.Assert(err, NotNil)
-	c.Check(helloWorld.MustBuy, Equals, true)
+	c.Assert(err, IsNil)
+
+	c.Check(helloWorld.MustBuy, Equals, false)
+	c.Check(funkyApp.MustBuy, Equals, false)
+	c.Check(otherApp.MustBuy, Equals, true)
+	c.Check(otherApp2.MustBuy, Equals, false)
 }
 
-func (s *storeTestSuite) TestDecorateOrdersTokenExpired(c *C) {
+func (s *storeTestSuite) TestDecorateOrdersFailedAccess(c *C) {
 	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", ordersPath)
 		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
-		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
 		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
 		c.Check(r.URL.Path, Equals, ordersPath)
 		w.WriteHeader(401)
-		io.WriteString(w, "")
+		io.WriteString(w, "{}")
 	}))
 
 	c.Assert(mockPurchasesServer, NotNil)
 	defer mockPurchasesServer.Close()
 
 	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
-	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
 	cfg := store.Config{
 		StoreBaseURL: mockServerURL,
 	}
-	sto := store.New(&cfg, dauthCtx)
+	sto := store.New(&cfg, nil)
 
 	helloWorld := &snap.Info{}
 	helloWorld.SnapID = helloWorldSnapID
 	helloWorld.Prices = map[string]float64{"USD": 1.23}
 	helloWorld.Paid = true
 
-	snaps := []*snap.Info{helloWorld}
+	funkyApp := &snap.Info{}
+	funkyApp.SnapID = funkyAppSnapID
+	funkyApp.Prices = map[string]float64{"USD": 2.34}
+	funkyApp.Paid = true
+
+	otherApp := &snap.Info{}
+	otherApp.SnapID = "other"
+	otherApp.Prices = map[string]float64{"USD": 3.45}
+	otherApp.Paid = true
+
+	otherApp2 := &snap.Info{}
+	otherApp2.SnapID = "other2"
+
+	snaps := []*snap.Info{helloWorld, funkyApp, otherApp, otherApp2}
 
 	err := sto.DecorateOrders(snaps, s.user)
 	c.Assert(err, NotNil)
+
 	c.Check(helloWorld.MustBuy, Equals, true)
+	c.Check(funkyApp.MustBuy, Equals, true)
+	c.Check(otherApp.MustBuy, Equals, true)
+	c.Check(otherApp2.MustBuy, Equals, false)
 }
 
-func (s *storeTestSuite) TestMustBuy(c *C) {
-	// Never need to buy a free snap.
-	c.Check(store.MustBuy(false, true), Equals, false)
-	c.Check(store.MustBuy(false, false), Equals, false)
+func (s *storeTestSuite) TestDecorateOrdersNoAuth(c *C) {
+	cfg := store.Config{}
+	sto := store.New(&cfg, nil)
 
-	// Don't need to buy snaps that have been bought.
-	c.Check(store.MustBuy(true, true), Equals, false)
+	helloWorld := &snap.Info{}
+	helloWorld.SnapID = helloWorldSnapID
+	helloWorld.Prices = map[string]float64{"USD": 1.23}
+	helloWorld.Paid = true
 
-	// Need to buy snaps that aren't bought.
-	c.Check(store.MustBuy(true, false), Equals, true)
+	funkyApp := &snap.Info{}
+	funkyApp.SnapID = funkyAppSnapID
+	funkyApp.Prices = map[string]float64{"USD": 2.34}
+	funkyApp.Paid = true
+
+	otherApp := &snap.Info{}
+	otherApp.SnapID = "other"
+	otherApp.Prices = map[string]float64{"USD": 3.45}
+	otherApp.Paid = true
+
+	otherApp2 := &snap.Info{}
+	otherApp2.SnapID = "other2"
+
+	snaps := []*snap.Info{helloWorld, funkyApp, otherApp, otherApp2}
+
+	err := sto.DecorateOrders(snaps, nil)
+	c.Assert(err, IsNil)
+
+	c.Check(helloWorld.MustBuy, Equals, true)
+	c.Check(funkyApp.MustBuy, Equals, true)
+	c.Check(otherApp.MustBuy, Equals, true)
+	c.Check(otherApp2.MustBuy, Equals, false)
 }
 
-var buyTests = []struct {
-	suggestedCurrency string
-	expectedInput     string
-	buyStatus         int
-	buyResponse       string
-	buyErrorMessage   string
-	buyErrorCode      string
-	snapID            string
-	price             float64
-	currency          string
-	expectedResult    *client.BuyResult
-	expectedError     string
-}{
-	{
-		// successful buying
-		suggestedCurrency: "EUR",
-		expectedInput:     `{"snap_id":"` + helloWorldSnapID + `","amount":"0.99","currency":"EUR"}`,
-		buyResponse:       mockOrderResponseJSON,
-		expectedResult:    &client.BuyResult{State: "Complete"},
-	},
-	{
-		// failure due to invalid price
-		suggestedCurrency: "USD",
-		expectedInput:     `{"snap_id":"` + helloWorldSnapID + `","amount":"5.99","currency":"USD"}`,
-		buyStatus:         400,
-		buyErrorCode:      "invalid-field",
-		buyErrorMessage:   "invalid price specified",
-		price:             5.99,
-		expectedError:     "cannot buy snap: bad request: invalid price specified",
-	},
-	{
-		// failure due to unknown snap ID
-		suggestedCurrency: "USD",
-		expectedInput:     `{"snap_id":"invalid snap ID","amount":"0.99","currency":"EUR"}`,
-		buyStatus:         404,
-		buyErrorCode:      "not-found",
-		buyErrorMessage:   "Snap package not found",
-		snapID:            "invalid snap ID",
-		price:             0.99,
-		currency:          "EUR",
-		expectedError:     "cannot buy snap: server says not found: Snap package not found",
-	},
-	{
-		// failure due to "Purchase failed"
-		suggestedCurrency: "USD",
-		expectedInput:     `{"snap_id":"` + helloWorldSnapID + `","amount":"1.23","currency":"USD"}`,
-		buyStatus:         402, // Payment Required
-		buyErrorCode:      "request-failed",
-		buyErrorMessage:   "Purchase failed",
-		expectedError:     "payment declined",
-	},
+func (s *storeTestSuite) TestDecorateOrdersAllFree(c *C) {
+	requestRecieved := false
+
+	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error(r.URL.Path)
+		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
+		requestRecieved = true
+		io.WriteString(w, `{"orders": []}`)
+	}))
+
+	c.Assert(mockPurchasesServer, NotNil)
+	defer mockPurchasesServer.Close()
+
+	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+
+	sto := store.New(&cfg, nil)
+
+	// This snap is free
+	helloWorld := &snap.Info{}
+	helloWorld.SnapID = helloWorldSnapID
+
+	// This snap is also free
+	funkyApp := &snap.Info{}
+	funkyApp.SnapID = funkyAppSnapID
+
+	snaps := []*snap.Info{helloWorld, funkyApp}
+
+	// There should be no request to the purchase server.
+	err := sto.DecorateOrders(snaps, s.user)
+	c.Assert(err, IsNil)
+	c.Check(requestRecieved, Equals, false)
+}
+
+func (s *storeTestSuite) TestDecorateOrdersSkipped(c *C) {
+	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Errorf("unexpected request to %q", r.URL.Path)
+	}))
+	c.Assert(mockPurchasesServer, NotNil)
+	defer mockPurchasesServer.Close()
+
+	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	cfg := store.Config{
+		StoreBaseURL:        mockServerURL,
+		SkipOrderDecoration: true,
+	}
+	sto := store.New(&cfg, dauthCtx)
+
+	helloWorld := &snap.Info{}
+	helloWorld.SnapID = helloWorldSnapID
+	helloWorld.Prices = map[string]float64{"USD": 1.23}
+	helloWorld.Paid = true
+
+	err := sto.DecorateOrders([]*snap.Info{helloWorld}, s.user)
+	c.Assert(err, IsNil)
+	c.Check(helloWorld.MustBuy, Equals, false)
+}
+
+func (s *storeTestSuite) TestFindSkipOrderDecoration(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		n++
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, MockSearchJSONv2)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL:        mockServerURL,
+		SkipOrderDecoration: true,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	sto := store.New(&cfg, dauthCtx)
+
+	snaps, err := sto.Find(s.ctx, &store.Search{Query: "hello"}, s.user)
+	c.Assert(err, IsNil)
+	// no orders request was issued
+	c.Check(n, Equals, 1)
+	c.Assert(snaps, HasLen, 1)
+	c.Check(snaps[0].Paid, Equals, true)
+	c.Check(snaps[0].MustBuy, Equals, false)
+}
+
+func (s *storeTestSuite) TestDecorateOrdersSingle(c *C) {
+	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
+		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
+		c.Check(r.URL.Path, Equals, ordersPath)
+		io.WriteString(w, mockSingleOrderJSON)
+	}))
+
+	c.Assert(mockPurchasesServer, NotNil)
+	defer mockPurchasesServer.Close()
+
+	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, dauthCtx)
+
+	helloWorld := &snap.Info{}
+	helloWorld.SnapID = helloWorldSnapID
+	helloWorld.Prices = map[string]float64{"USD": 1.23}
+	helloWorld.Paid = true
+
+	snaps := []*snap.Info{helloWorld}
+
+	err := sto.DecorateOrders(snaps, s.user)
+	c.Assert(err, IsNil)
+	c.Check(helloWorld.MustBuy, Equals, false)
+}
+
+func (s *storeTestSuite) TestDecorateOrdersSingleFreeSnap(c *C) {
+	cfg := store.Config{}
+	sto := store.New(&cfg, nil)
+
+	helloWorld := &snap.Info{}
+	helloWorld.SnapID = helloWorldSnapID
+
+	snaps := []*snap.Info{helloWorld}
+
+	err := sto.DecorateOrders(snaps, s.user)
+	c.Assert(err, IsNil)
+	c.Check(helloWorld.MustBuy, Equals, false)
+}
+
+func (s *storeTestSuite) TestDecorateOrdersSingleNotFound(c *C) {
+	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", ordersPath)
+		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
+		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
+		c.Check(r.URL.Path, Equals, ordersPath)
+		w.WriteHeader(404)
+		io.WriteString(w, "{}")
+	}))
+
+	c.Assert(mockPurchasesServer, NotNil)
+	defer mockPurchasesServer.Close()
+
+	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, dauthCtx)
+
+	helloWorld := &snap.Info{}
+	helloWorld.SnapID = helloWorldSnapID
+	helloWorld.Prices = map[string]float64{"USD": 1.23}
+	helloWorld.Paid = true
+
+	snaps := []*snap.Info{helloWorld}
+
+	err := sto.DecorateOrders(snaps, s.user)
+	c.Assert(err, NotNil)
+	c.Check(helloWorld.MustBuy, Equals, true)
+}
+
+func (s *storeTestSuite) TestDecorateOrdersTokenExpired(c *C) {
+	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
+		c.Check(r.Header.Get("X-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
+		c.Check(r.URL.Path, Equals, ordersPath)
+		w.WriteHeader(401)
+		io.WriteString(w, "")
+	}))
+
+	c.Assert(mockPurchasesServer, NotNil)
+	defer mockPurchasesServer.Close()
+
+	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, dauthCtx)
+
+	helloWorld := &snap.Info{}
+	helloWorld.SnapID = helloWorldSnapID
+	helloWorld.Prices = map[string]float64{"USD": 1.23}
+	helloWorld.Paid = true
+
+	snaps := []*snap.Info{helloWorld}
+
+	err := sto.DecorateOrders(snaps, s.user)
+	c.Assert(err, NotNil)
+	c.Check(helloWorld.MustBuy, Equals, true)
+}
+
+func (s *storeTestSuite) TestMustBuy(c *C) {
+	// Never need to buy a free snap.
+	c.Check(store.MustBuy(false, true), Equals, false)
+	c.Check(store.MustBuy(false, false), Equals, false)
+
+	// Don't need to buy snaps that have been bought.
+	c.Check(store.MustBuy(true, true), Equals, false)
+
+	// Need to buy snaps that aren't bought.
+	c.Check(store.MustBuy(true, false), Equals, true)
+}
+
+var buyTests = []struct {
+	suggestedCurrency string
+	expectedInput     string
+	buyStatus         int
+	buyResponse       string
+	buyErrorMessage   string
+	buyErrorCode      string
+	snapID            string
+	price             float64
+	currency          string
+	expectedResult    *client.BuyResult
+	expectedError     string
+}{
+	{
+		// successful buying
+		suggestedCurrency: "EUR",
+		expectedInput:     `{"snap_id":"` + helloWorldSnapID + `","amount":"0.99","currency":"EUR"}`,
+		buyResponse:       mockOrderResponseJSON,
+		expectedResult:    &client.BuyResult{State: "Complete"},
+	},
+	{
+		// failure due to invalid price
+		suggestedCurrency: "USD",
+		expectedInput:     `{"snap_id":"` + helloWorldSnapID + `","amount":"5.99","currency":"USD"}`,
+		buyStatus:         400,
+		buyErrorCode:      "invalid-field",
+		buyErrorMessage:   "invalid price specified",
+		price:             5.99,
+		expectedError:     "cannot buy snap: bad request: invalid price specified",
+	},
+	{
+		// failure due to unknown snap ID
+		suggestedCurrency: "USD",
+		expectedInput:     `{"snap_id":"invalid snap ID","amount":"0.99","currency":"EUR"}`,
+		buyStatus:         404,
+		buyErrorCode:      "not-found",
+		buyErrorMessage:   "Snap package not found",
+		snapID:            "invalid snap ID",
+		price:             0.99,
+		currency:          "EUR",
+		expectedError:     "cannot buy snap: server says not found: Snap package not found",
+	},
+	{
+		// failure due to "Purchase failed"
+		suggestedCurrency: "USD",
+		expectedInput:     `{"snap_id":"` + helloWorldSnapID + `","amount":"1.23","currency":"USD"}`,
+		buyStatus:         402, // Payment Required
+		buyErrorCode:      "request-failed",
+		buyErrorMessage:   "Purchase failed",
+		expectedError:     "payment declined",
+	},
 	{
 		// failure due to no payment methods
 		suggestedCurrency: "USD",
@@ -4591,7 +7659,7 @@ func (s *storeTestSuite) TestBuy500(c *C) {
 		Currency: "USD",
 		Price:    1,
 	}
-	_, err := sto.Buy(buyOptions, s.user)
+	_, err := sto.Buy(s.ctx, buyOptions, s.user)
 	c.Assert(err, NotNil)
 }
 
@@ -4680,7 +7748,7 @@ func (s *storeTestSuite) TestBuy(c *C) {
 		if test.price > 0 {
 			buyOptions.Price = test.price
 		}
-		result, err := sto.Buy(buyOptions, s.user)
+		result, err := sto.Buy(s.ctx, buyOptions, s.user)
 
 		c.Check(result, DeepEquals, test.expectedResult)
 		if test.expectedError == "" {
@@ -4700,7 +7768,7 @@ func (s *storeTestSuite) TestBuyFailArgumentChecking(c *C) {
 	sto := store.New(&store.Config{}, nil)
 
 	// no snap ID
-	result, err := sto.Buy(&client.BuyOptions{
+	result, err := sto.Buy(s.ctx, &client.BuyOptions{
 		Price:    1.0,
 		Currency: "USD",
 	}, s.user)
@@ -4709,7 +7777,7 @@ func (s *storeTestSuite) TestBuyFailArgumentChecking(c *C) {
 	c.Check(err.Error(), Equals, "cannot buy snap: snap ID missing")
 
 	// no price
-	result, err = sto.Buy(&client.BuyOptions{
+	result, err = sto.Buy(s.ctx, &client.BuyOptions{
 		SnapID:   "snap ID",
 		Currency: "USD",
 	}, s.user)
@@ -4718,7 +7786,7 @@ func (s *storeTestSuite) TestBuyFailArgumentChecking(c *C) {
 	c.Check(err.Error(), Equals, "cannot buy snap: invalid expected price")
 
 	// no currency
-	result, err = sto.Buy(&client.BuyOptions{
+	result, err = sto.Buy(s.ctx, &client.BuyOptions{
 		SnapID: "snap ID",
 		Price:  1.0,
 	}, s.user)
@@ -4727,7 +7795,7 @@ func (s *storeTestSuite) TestBuyFailArgumentChecking(c *C) {
 	c.Check(err.Error(), Equals, "cannot buy snap: currency missing")
 
 	// no user
-	result, err = sto.Buy(&client.BuyOptions{
+	result, err = sto.Buy(s.ctx, &client.BuyOptions{
 		SnapID:   "snap ID",
 		Price:    1.0,
 		Currency: "USD",
@@ -4737,13 +7805,299 @@ func (s *storeTestSuite) TestBuyFailArgumentChecking(c *C) {
 	c.Check(err.Error(), Equals, "you need to log in first")
 }
 
-var readyToBuyTests = []struct {
-	Input      func(w http.ResponseWriter)
-	Test       func(c *C, err error)
-	NumOfCalls int
-}{
-	{
-		// A user account the is ready for buying
+func (s *storeTestSuite) TestBuyCancelled(c *C) {
+	requested := make(chan struct{})
+	handlerDone := make(chan bool, 1)
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", buyPath)
+		n++
+		// the server only notices the client going away once the
+		// body was read
+		_, err := ioutil.ReadAll(r.Body)
+		c.Check(err, IsNil)
+		close(requested)
+		select {
+		case <-r.Context().Done():
+			// the client went away
+			handlerDone <- true
+		case <-time.After(5 * time.Second):
+			handlerDone <- false
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, dauthCtx)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	go func() {
+		<-requested
+		cancel()
+	}()
+
+	result, err := sto.Buy(ctx, &client.BuyOptions{
+		SnapID:   helloWorldSnapID,
+		Currency: "USD",
+		Price:    1,
+	}, s.user)
+	c.Assert(err, ErrorMatches, ".*context canceled")
+	c.Check(result, IsNil)
+	// the request was not left dangling, nor retried
+	c.Check(<-handlerDone, Equals, true)
+	c.Check(n, Equals, 1)
+}
+
+func (s *storeTestSuite) TestCancelOrder(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", ordersPath)
+		n++
+		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
+		c.Check(r.Header.Get("Content-Type"), Equals, store.JsonContentType)
+		data, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, `{"snap_id":"`+helloWorldSnapID+`","action":"cancel"}`)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		io.WriteString(w, `{"snap_id": "`+helloWorldSnapID+`", "state": "Cancelled"}`)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, dauthCtx)
+
+	err := sto.CancelOrder(s.ctx, helloWorldSnapID, s.user)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+}
+
+func (s *storeTestSuite) TestCancelOrderErrors(c *C) {
+	for _, t := range []struct {
+		status  int
+		body    string
+		snapID  string
+		noUser  bool
+		calls   int
+		errMsg  string
+		errType error
+	}{
+		{snapID: helloWorldSnapID, status: 404, body: `{"error_list": [{"code": "not-found", "message": "Order not found"}]}`, calls: 1, errType: store.ErrOrderNotFound},
+		{snapID: helloWorldSnapID, status: 401, calls: 1, errType: store.ErrInvalidCredentials},
+		{snapID: helloWorldSnapID, status: 400, body: `{"error_list": [{"code": "invalid-state", "message": "Order is complete"}]}`, calls: 1, errMsg: "cannot cancel order: bad request: Order is complete"},
+		{snapID: helloWorldSnapID, status: 409, body: `{"error_list": [{"code": "conflict", "message": "Conflict"}]}`, calls: 1, errMsg: `cannot cancel order: got unexpected HTTP status code 409 via POST to "http://.*/api/v1/snaps/purchases/orders"`},
+		{snapID: helloWorldSnapID, noUser: true, errType: store.ErrUnauthenticated},
+		{snapID: "", errMsg: "cannot cancel order: snap ID missing"},
+	} {
+		n := 0
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertRequest(c, r, "POST", ordersPath)
+			n++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(t.status)
+			io.WriteString(w, t.body)
+		}))
+		c.Assert(mockServer, NotNil)
+		defer mockServer.Close()
+
+		mockServerURL, _ := url.Parse(mockServer.URL)
+		dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+		sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, dauthCtx)
+
+		user := s.user
+		if t.noUser {
+			user = nil
+		}
+		err := sto.CancelOrder(s.ctx, t.snapID, user)
+		if t.errType != nil {
+			c.Check(err, Equals, t.errType)
+		} else {
+			c.Check(err, ErrorMatches, t.errMsg)
+		}
+		c.Check(n, Equals, t.calls)
+	}
+}
+
+func (s *storeTestSuite) TestCloseChannels(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", "/dev/api/snaps/"+helloWorldSnapID+"/close")
+		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
+		// no device authorization for the dashboard
+		c.Check(r.Header.Get("X-Device-Authorization"), Equals, "")
+		c.Check(r.Header.Get("Content-Type"), Equals, store.JsonContentType)
+
+		var req struct {
+			Channels []string `json:"channels"`
+		}
+		c.Assert(json.NewDecoder(r.Body).Decode(&req), IsNil)
+		c.Check(req.Channels, DeepEquals, []string{"beta", "edge"})
+
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"closed_channels": ["beta", "edge"]}`)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	oldDeveloperSnapsAPI := store.DeveloperSnapsAPI
+	store.DeveloperSnapsAPI = mockServer.URL + "/dev/api/snaps/"
+	defer func() { store.DeveloperSnapsAPI = oldDeveloperSnapsAPI }()
+
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	sto := store.New(&store.Config{}, dauthCtx)
+
+	closed, err := sto.CloseChannels(s.ctx, helloWorldSnapID, []string{"beta", "edge"}, s.user)
+	c.Assert(err, IsNil)
+	c.Check(closed, DeepEquals, []string{"beta", "edge"})
+}
+
+func (s *storeTestSuite) TestCloseChannelsErrors(c *C) {
+	for _, t := range []struct {
+		status   int
+		body     string
+		snapID   string
+		channels []string
+		noUser   bool
+		calls    int
+		errMsg   string
+		errType  error
+	}{
+		{snapID: helloWorldSnapID, status: 403, body: `{"error_list": [{"code": "macaroon-permission-required", "message": "Permission is required: package_release"}]}`, calls: 1, errType: store.ErrPermissionDenied},
+		{snapID: helloWorldSnapID, status: 401, calls: 1, errType: store.ErrInvalidCredentials},
+		{snapID: helloWorldSnapID, status: 404, calls: 1, errType: store.ErrSnapNotFound},
+		{snapID: helloWorldSnapID, status: 400, body: `{"error_list": [{"code": "invalid-field", "message": "Invalid channel: foo"}]}`, calls: 1, errMsg: "cannot close channels: bad request: Invalid channel: foo"},
+		{snapID: helloWorldSnapID, status: 409, calls: 1, errMsg: `cannot close channels: got unexpected HTTP status code 409 via POST to "http://.*/dev/api/snaps/.*/close"`},
+		{snapID: helloWorldSnapID, noUser: true, errType: store.ErrUnauthenticated},
+		{snapID: helloWorldSnapID, channels: []string{}, errMsg: "cannot close channels: no channels given"},
+		{snapID: "", errMsg: "cannot close channels: snap ID missing"},
+	} {
+		n := 0
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertRequest(c, r, "POST", "/dev/api/snaps/"+helloWorldSnapID+"/close")
+			n++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(t.status)
+			io.WriteString(w, t.body)
+		}))
+		c.Assert(mockServer, NotNil)
+		defer mockServer.Close()
+
+		oldDeveloperSnapsAPI := store.DeveloperSnapsAPI
+		store.DeveloperSnapsAPI = mockServer.URL + "/dev/api/snaps/"
+		defer func() { store.DeveloperSnapsAPI = oldDeveloperSnapsAPI }()
+
+		dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+		sto := store.New(&store.Config{}, dauthCtx)
+
+		user := s.user
+		if t.noUser {
+			user = nil
+		}
+		channels := t.channels
+		if channels == nil {
+			channels = []string{"beta"}
+		}
+		closed, err := sto.CloseChannels(s.ctx, t.snapID, channels, user)
+		if t.errType != nil {
+			c.Check(err, Equals, t.errType)
+		} else {
+			c.Check(err, ErrorMatches, t.errMsg)
+		}
+		c.Check(closed, IsNil)
+		c.Check(n, Equals, t.calls)
+	}
+}
+
+func (s *storeTestSuite) TestReportSnap(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", reportPath)
+		n++
+		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
+		c.Check(r.Header.Get("Content-Type"), Equals, store.JsonContentType)
+		data, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, `{"snap_id":"`+helloWorldSnapID+`","reason":"malware","message":"it mines coins"}`)
+		w.WriteHeader(202)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, dauthCtx)
+
+	err := sto.ReportSnap(s.ctx, helloWorldSnapID, "malware", "it mines coins", s.user)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+}
+
+func (s *storeTestSuite) TestReportSnapErrors(c *C) {
+	for _, t := range []struct {
+		status  int
+		body    string
+		snapID  string
+		reason  string
+		noUser  bool
+		calls   int
+		errMsg  string
+		errType error
+	}{
+		{snapID: helloWorldSnapID, status: 401, calls: 1, errType: store.ErrInvalidCredentials},
+		{snapID: helloWorldSnapID, status: 404, calls: 1, errType: store.ErrSnapNotFound},
+		{snapID: helloWorldSnapID, status: 429, calls: 1, errType: store.ErrTooManyRequests},
+		{snapID: helloWorldSnapID, status: 400, body: `{"error_list": [{"code": "invalid-field", "message": "Unknown reason"}]}`, calls: 1, errMsg: "cannot report snap: bad request: Unknown reason"},
+		{snapID: helloWorldSnapID, status: 409, calls: 1, errMsg: `cannot report snap: got unexpected HTTP status code 409 via POST to "http://.*/api/v1/snaps/report"`},
+		{snapID: helloWorldSnapID, noUser: true, errType: store.ErrUnauthenticated},
+		{snapID: helloWorldSnapID, reason: "-", errMsg: "cannot report snap: reason missing"},
+		{snapID: "", errMsg: "cannot report snap: snap ID missing"},
+	} {
+		n := 0
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertRequest(c, r, "POST", reportPath)
+			n++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(t.status)
+			io.WriteString(w, t.body)
+		}))
+		c.Assert(mockServer, NotNil)
+		defer mockServer.Close()
+
+		mockServerURL, _ := url.Parse(mockServer.URL)
+		dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+		sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, dauthCtx)
+
+		user := s.user
+		if t.noUser {
+			user = nil
+		}
+		reason := "malware"
+		if t.reason == "-" {
+			reason = ""
+		}
+		err := sto.ReportSnap(s.ctx, t.snapID, reason, "", user)
+		if t.errType != nil {
+			c.Check(err, Equals, t.errType)
+		} else {
+			c.Check(err, ErrorMatches, t.errMsg)
+		}
+		c.Check(n, Equals, t.calls)
+	}
+}
+
+var readyToBuyTests = []struct {
+	Input      func(w http.ResponseWriter)
+	Test       func(c *C, err error)
+	NumOfCalls int
+}{
+	{
+		// A user account the is ready for buying
 		Input: func(w http.ResponseWriter) {
 			io.WriteString(w, `
 {
@@ -4886,6 +8240,139 @@ func (s *storeTestSuite) TestReadyToBuy(c *C) {
 	}
 }
 
+func (s *storeTestSuite) TestTermsOfService(c *C) {
+	n := 0
+	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", customersMePath)
+		c.Check(r.Header.Get("Authorization"), Equals, s.expectedAuthorization(c, s.user))
+		c.Check(r.Header.Get("Accept"), Equals, store.JsonContentType)
+		n++
+		// a newer TOS the user has not accepted yet
+		io.WriteString(w, `
+{
+  "latest_tos_date": "2016-10-14T00:00:00+00:00",
+  "accepted_tos_date": "2016-09-14T15:56:49+00:00",
+  "latest_tos_accepted": false,
+  "latest_tos_url": "https://example.com/tos/2016-10-14",
+  "has_payment_method": true
+}
+`)
+	}))
+	c.Assert(mockPurchasesServer, NotNil)
+	defer mockPurchasesServer.Close()
+
+	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, dauthCtx)
+
+	tos, err := sto.TermsOfService(s.ctx, s.user)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+	c.Check(tos.LatestDate.Equal(time.Date(2016, 10, 14, 0, 0, 0, 0, time.UTC)), Equals, true)
+	c.Check(tos.AcceptedDate.Equal(time.Date(2016, 9, 14, 15, 56, 49, 0, time.UTC)), Equals, true)
+	// the newer terms are not accepted yet
+	c.Check(tos.Accepted, Equals, false)
+	c.Check(tos.URL, Equals, "https://example.com/tos/2016-10-14")
+}
+
+func (s *storeTestSuite) TestTermsOfServiceNeverAcceptedNoURL(c *C) {
+	mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", customersMePath)
+		io.WriteString(w, `
+{
+  "latest_tos_date": "2016-10-14T00:00:00+00:00",
+  "accepted_tos_date": "",
+  "latest_tos_accepted": false,
+  "has_payment_method": false
+}
+`)
+	}))
+	c.Assert(mockPurchasesServer, NotNil)
+	defer mockPurchasesServer.Close()
+
+	mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, dauthCtx)
+
+	tos, err := sto.TermsOfService(s.ctx, s.user)
+	c.Assert(err, IsNil)
+	c.Check(tos.LatestDate.Equal(time.Date(2016, 10, 14, 0, 0, 0, 0, time.UTC)), Equals, true)
+	c.Check(tos.AcceptedDate.IsZero(), Equals, true)
+	c.Check(tos.Accepted, Equals, false)
+	// no made up URL when the store gives none
+	c.Check(tos.URL, Equals, "")
+}
+
+func (s *storeTestSuite) TestTermsOfServiceErrors(c *C) {
+	sto := store.New(&store.Config{}, nil)
+	_, err := sto.TermsOfService(s.ctx, nil)
+	c.Check(err, Equals, store.ErrUnauthenticated)
+
+	for _, t := range []struct {
+		status int
+		body   string
+		err    string
+	}{
+		{404, "", "cannot get terms of service: server says no account exists"},
+		{401, "", "invalid credentials"},
+		{500, "", "cannot get terms of service: unexpected HTTP code 500"},
+		{200, `{"latest_tos_date": "yesterday"}`, "cannot get terms of service: invalid latest date: .*"},
+	} {
+		mockPurchasesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertRequest(c, r, "GET", customersMePath)
+			w.WriteHeader(t.status)
+			io.WriteString(w, t.body)
+		}))
+		mockServerURL, _ := url.Parse(mockPurchasesServer.URL)
+		dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+		sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, dauthCtx)
+
+		_, err := sto.TermsOfService(s.ctx, s.user)
+		mockPurchasesServer.Close()
+		c.Check(err, ErrorMatches, t.err)
+	}
+}
+
+func (s *storeTestSuite) TestBaseContextCancelled(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		c.Errorf("unexpected request: %s", r.URL.String())
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
+	sto := store.New(&store.Config{
+		StoreBaseURL:      mockServerURL,
+		AssertionsBaseURL: mockServerURL,
+		Context:           ctx,
+	}, dauthCtx)
+
+	err := sto.ReadyToBuy(s.user)
+	c.Check(err, ErrorMatches, ".*context canceled")
+
+	_, err = sto.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
+	c.Check(err, ErrorMatches, ".*context canceled")
+
+	connectivity, err := sto.ConnectivityCheck()
+	c.Assert(err, IsNil)
+	c.Check(connectivity, DeepEquals, map[string]bool{
+		mockServerURL.Host: false,
+	})
+
+	c.Check(n, Equals, 0)
+}
+
 func (s *storeTestSuite) TestDoRequestSetRangeHeaderOnRedirect(c *C) {
 	n := 0
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -4917,11 +8404,74 @@ func (s *storeTestSuite) TestDoRequestSetRangeHeaderOnRedirect(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *storeTestSuite) TestVerifyLocalSnap(c *C) {
+	content := []byte("I was copied over")
+	path := filepath.Join(c.MkDir(), "foo_1.snap")
+	c.Assert(ioutil.WriteFile(path, content, 0644), IsNil)
+
+	downloadInfo := &snap.DownloadInfo{
+		Size:     int64(len(content)),
+		Sha3_384: fmt.Sprintf("%x", sha3.Sum384(content)),
+	}
+	c.Check(store.VerifyLocalSnap(path, downloadInfo), IsNil)
+}
+
+func (s *storeTestSuite) TestVerifyLocalSnapUnknownSizeOrHash(c *C) {
+	content := []byte("I was copied over")
+	path := filepath.Join(c.MkDir(), "foo_1.snap")
+	c.Assert(ioutil.WriteFile(path, content, 0644), IsNil)
+
+	// there is nothing to verify against
+	err := store.VerifyLocalSnap(path, &snap.DownloadInfo{
+		Sha3_384: fmt.Sprintf("%x", sha3.Sum384(content)),
+	})
+	c.Check(err, ErrorMatches, `cannot verify ".*/foo_1.snap": no expected size`)
+	err = store.VerifyLocalSnap(path, &snap.DownloadInfo{
+		Size: int64(len(content)),
+	})
+	c.Check(err, ErrorMatches, `cannot verify ".*/foo_1.snap": no expected sha3-384`)
+}
+
+func (s *storeTestSuite) TestVerifyLocalSnapWrongHash(c *C) {
+	content := []byte("I was copied over")
+	path := filepath.Join(c.MkDir(), "foo_1.snap")
+	c.Assert(ioutil.WriteFile(path, content, 0644), IsNil)
+
+	downloadInfo := &snap.DownloadInfo{
+		Size:     int64(len(content)),
+		Sha3_384: "wrong-sha3",
+	}
+	err := store.VerifyLocalSnap(path, downloadInfo)
+	c.Assert(err, FitsTypeOf, store.HashError{})
+	c.Check(err, DeepEquals, store.NewHashError(path, fmt.Sprintf("%x", sha3.Sum384(content)), "wrong-sha3"))
+}
+
+func (s *storeTestSuite) TestVerifyLocalSnapWrongSize(c *C) {
+	content := []byte("I was copied over")
+	path := filepath.Join(c.MkDir(), "foo_1.snap")
+	c.Assert(ioutil.WriteFile(path, content[:5], 0644), IsNil)
+
+	downloadInfo := &snap.DownloadInfo{
+		Size:     int64(len(content)),
+		Sha3_384: fmt.Sprintf("%x", sha3.Sum384(content)),
+	}
+	err := store.VerifyLocalSnap(path, downloadInfo)
+	c.Check(err, DeepEquals, store.NewSizeError(path, 5, int64(len(content))))
+	c.Check(err, ErrorMatches, `size mismatch for ".*/foo_1.snap": got 5 but expected 17`)
+}
+
+func (s *storeTestSuite) TestVerifyLocalSnapMissing(c *C) {
+	path := filepath.Join(c.MkDir(), "foo_1.snap")
+	err := store.VerifyLocalSnap(path, &snap.DownloadInfo{Size: 17, Sha3_384: "some-sha3"})
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
 type cacheObserver struct {
 	inCache map[string]bool
 
-	gets []string
-	puts []string
+	gets    []string
+	puts    []string
+	removes []string
 }
 
 func (co *cacheObserver) Get(cacheKey, targetPath string) error {
@@ -4934,10 +8484,17 @@ func (co *cacheObserver) Get(cacheKey, targetPath string) error {
 func (co *cacheObserver) GetPath(cacheKey string) string {
 	return ""
 }
-func (co *cacheObserver) Put(cacheKey, sourcePath string) error {
+func (co *cacheObserver) Open(cacheKey string) (*store.CachedFile, error) {
+	return nil, os.ErrNotExist
+}
+func (co *cacheObserver) Put(ctx context.Context, cacheKey, sourcePath string) error {
 	co.puts = append(co.puts, fmt.Sprintf("%s:%s", cacheKey, sourcePath))
 	return nil
 }
+func (co *cacheObserver) Remove(cacheKey string) error {
+	co.removes = append(co.removes, cacheKey)
+	return nil
+}
 
 func (s *storeTestSuite) TestDownloadCacheHit(c *C) {
 	obs := &cacheObserver{inCache: map[string]bool{"the-snaps-sha3_384": true}}
@@ -4961,14 +8518,35 @@ func (s *storeTestSuite) TestDownloadCacheHit(c *C) {
 	c.Check(obs.puts, IsNil)
 }
 
-func (s *storeTestSuite) TestDownloadCacheMiss(c *C) {
-	obs := &cacheObserver{inCache: map[string]bool{}}
-	restore := s.store.MockCacher(obs)
+type blockingCache struct {
+	cacheObserver
+
+	putCalled chan struct{}
+	release   chan struct{}
+	aborted   bool
+}
+
+func (bc *blockingCache) Put(ctx context.Context, cacheKey, sourcePath string) error {
+	close(bc.putCalled)
+	select {
+	case <-bc.release:
+	case <-ctx.Done():
+		bc.aborted = true
+		return ctx.Err()
+	}
+	return bc.cacheObserver.Put(ctx, cacheKey, sourcePath)
+}
+
+func (s *storeTestSuite) TestDownloadCancelledDuringCachePut(c *C) {
+	cache := &blockingCache{
+		putCalled: make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	defer close(cache.release)
+	restore := s.store.MockCacher(cache)
 	defer restore()
 
-	downloadWasCalled := false
 	restore = store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
-		downloadWasCalled = true
 		return nil
 	})
 	defer restore()
@@ -4976,10 +8554,228 @@ func (s *storeTestSuite) TestDownloadCacheMiss(c *C) {
 	snap := &snap.Info{}
 	snap.Sha3_384 = "the-snaps-sha3_384"
 
+	ctx, cancel := context.WithCancel(s.ctx)
+	go func() {
+		// cancel as soon as the download was renamed into place
+		// and the caching started
+		<-cache.putCalled
+		cancel()
+	}()
+
 	path := filepath.Join(c.MkDir(), "downloaded-file")
-	err := s.store.Download(s.ctx, "foo", path, &snap.DownloadInfo, nil, nil, nil)
+	err := s.store.Download(ctx, "foo", path, &snap.DownloadInfo, nil, nil, nil)
 	c.Assert(err, IsNil)
-	c.Check(downloadWasCalled, Equals, true)
+	c.Check(path, testutil.FilePresent)
+	// the caching was aborted, not left running
+	c.Check(cache.aborted, Equals, true)
+	c.Check(cache.puts, IsNil)
+}
+
+func (s *storeTestSuite) TestDownloadCancelledBeforeCachePut(c *C) {
+	obs := &cacheObserver{inCache: map[string]bool{}}
+	restore := s.store.MockCacher(obs)
+	defer restore()
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	restore = store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		// the download completes, but the context is cancelled
+		// right after
+		cancel()
+		return nil
+	})
+	defer restore()
+
+	snap := &snap.Info{}
+	snap.Sha3_384 = "the-snaps-sha3_384"
+
+	path := filepath.Join(c.MkDir(), "downloaded-file")
+	err := s.store.Download(ctx, "foo", path, &snap.DownloadInfo, nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(path, testutil.FilePresent)
+	// caching was skipped
+	c.Check(obs.puts, IsNil)
+}
+
+func (s *storeTestSuite) TestDownloadCacheMaxBytes(c *C) {
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		_, err := w.Write([]byte("some content"))
+		return err
+	})
+	defer restore()
+
+	// only the size limit is set
+	sto := store.New(&store.Config{CacheDownloadsMaxBytes: 1024}, nil)
+
+	snap := &snap.Info{}
+	snap.Sha3_384 = "the-snaps-sha3_384"
+
+	path := filepath.Join(c.MkDir(), "downloaded-file")
+	err := sto.Download(s.ctx, "foo", path, &snap.DownloadInfo, nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(filepath.Join(dirs.SnapDownloadCacheDir, "the-snaps-sha3_384"), testutil.FileEquals, "some content")
+}
+
+func (s *storeTestSuite) TestDownloadCacheNamespaces(c *C) {
+	var downloads []string
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		downloads = append(downloads, name)
+		_, err := w.Write([]byte("content for " + name))
+		return err
+	})
+	defer restore()
+
+	stoA := store.New(&store.Config{CacheDownloads: 5, CacheNamespace: "store-a"}, nil)
+	stoB := store.New(&store.Config{CacheDownloads: 5, CacheNamespace: "store-b"}, nil)
+	stoDefault := store.New(&store.Config{CacheDownloads: 5}, nil)
+
+	snap := &snap.Info{}
+	snap.Sha3_384 = "the-snaps-sha3_384"
+
+	for _, t := range []struct {
+		sto  *store.Store
+		name string
+	}{
+		{stoA, "from-a"},
+		{stoB, "from-b"},
+		{stoDefault, "from-default"},
+		// a cache hit within the namespace
+		{stoA, "from-a-again"},
+	} {
+		path := filepath.Join(c.MkDir(), "downloaded-file")
+		err := t.sto.Download(s.ctx, t.name, path, &snap.DownloadInfo, nil, nil, nil)
+		c.Assert(err, IsNil)
+	}
+	// the same blob was downloaded once per namespace
+	c.Check(downloads, DeepEquals, []string{"from-a", "from-b", "from-default"})
+
+	c.Check(filepath.Join(dirs.SnapDownloadCacheDir, "store-a", "the-snaps-sha3_384"), testutil.FileEquals, "content for from-a")
+	c.Check(filepath.Join(dirs.SnapDownloadCacheDir, "store-b", "the-snaps-sha3_384"), testutil.FileEquals, "content for from-b")
+	c.Check(filepath.Join(dirs.SnapDownloadCacheDir, "the-snaps-sha3_384"), testutil.FileEquals, "content for from-default")
+}
+
+func (s *storeTestSuite) TestDownloadCacheInvalidNamespace(c *C) {
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		_, err := w.Write([]byte("some content"))
+		return err
+	})
+	defer restore()
+
+	snap := &snap.Info{}
+	snap.Sha3_384 = "the-snaps-sha3_384"
+
+	for _, ns := range []string{"..", ".", "a/b", "../escape"} {
+		sto := store.New(&store.Config{CacheDownloads: 5, CacheNamespace: ns}, nil)
+
+		path := filepath.Join(c.MkDir(), "downloaded-file")
+		err := sto.Download(s.ctx, "foo", path, &snap.DownloadInfo, nil, nil, nil)
+		c.Assert(err, IsNil)
+		c.Check(path, testutil.FileEquals, "some content")
+	}
+	// nothing was cached anywhere
+	c.Check(dirs.SnapDownloadCacheDir, testutil.FileAbsent)
+}
+
+func (s *storeTestSuite) TestDownloadVerifyCacheHit(c *C) {
+	h := crypto.SHA3_384.New()
+	io.WriteString(h, "snap content")
+	sha3 := fmt.Sprintf("%x", h.Sum(nil))
+
+	downloads := 0
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		downloads++
+		_, err := w.Write([]byte("snap content"))
+		return err
+	})
+	defer restore()
+
+	sto := store.New(&store.Config{CacheDownloads: 5}, nil)
+	cachePath := filepath.Join(dirs.SnapDownloadCacheDir, sha3)
+	c.Assert(os.MkdirAll(dirs.SnapDownloadCacheDir, 0700), IsNil)
+
+	dlInfo := &snap.DownloadInfo{Sha3_384: sha3}
+	dlOpts := &store.DownloadOptions{VerifyCacheHit: true}
+
+	// a good cache entry is used
+	c.Assert(ioutil.WriteFile(cachePath, []byte("snap content"), 0600), IsNil)
+	path := filepath.Join(c.MkDir(), "downloaded-file")
+	err := sto.Download(s.ctx, "foo", path, dlInfo, nil, nil, dlOpts)
+	c.Assert(err, IsNil)
+	c.Check(downloads, Equals, 0)
+	c.Check(path, testutil.FileEquals, "snap content")
+
+	// a corrupted one is evicted and the snap downloaded again
+	c.Assert(os.Remove(cachePath), IsNil)
+	c.Assert(ioutil.WriteFile(cachePath, []byte("snap c0ntent"), 0600), IsNil)
+	path = filepath.Join(c.MkDir(), "downloaded-file")
+	err = sto.Download(s.ctx, "foo", path, dlInfo, nil, nil, dlOpts)
+	c.Assert(err, IsNil)
+	c.Check(downloads, Equals, 1)
+	c.Check(path, testutil.FileEquals, "snap content")
+	// and cached anew
+	c.Check(cachePath, testutil.FileEquals, "snap content")
+}
+
+func (s *storeTestSuite) TestDownloadCorruptedCacheHitNotVerifiedByDefault(c *C) {
+	h := crypto.SHA3_384.New()
+	io.WriteString(h, "snap content")
+	sha3 := fmt.Sprintf("%x", h.Sum(nil))
+
+	restore := store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		c.Fatalf("download should not be called when results come from the cache")
+		return nil
+	})
+	defer restore()
+
+	sto := store.New(&store.Config{CacheDownloads: 5}, nil)
+	c.Assert(os.MkdirAll(dirs.SnapDownloadCacheDir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dirs.SnapDownloadCacheDir, sha3), []byte("snap c0ntent"), 0600), IsNil)
+
+	path := filepath.Join(c.MkDir(), "downloaded-file")
+	err := sto.Download(s.ctx, "foo", path, &snap.DownloadInfo{Sha3_384: sha3}, nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(path, testutil.FileEquals, "snap c0ntent")
+}
+
+func (s *storeTestSuite) TestDownloadVerifyCacheHitEvicts(c *C) {
+	obs := &cacheObserver{inCache: map[string]bool{"the-snaps-sha3_384": true}}
+	restore := s.store.MockCacher(obs)
+	defer restore()
+
+	restore = store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		return nil
+	})
+	defer restore()
+
+	path := filepath.Join(c.MkDir(), "downloaded-file")
+	// what the cache "provided"
+	c.Assert(ioutil.WriteFile(path, []byte("corrupted"), 0600), IsNil)
+
+	dlInfo := &snap.DownloadInfo{Sha3_384: "the-snaps-sha3_384"}
+	err := s.store.Download(s.ctx, "foo", path, dlInfo, nil, nil, &store.DownloadOptions{VerifyCacheHit: true})
+	c.Assert(err, IsNil)
+	c.Check(obs.removes, DeepEquals, []string{"the-snaps-sha3_384"})
+	c.Check(obs.puts, DeepEquals, []string{fmt.Sprintf("the-snaps-sha3_384:%s", path)})
+}
+
+func (s *storeTestSuite) TestDownloadCacheMiss(c *C) {
+	obs := &cacheObserver{inCache: map[string]bool{}}
+	restore := s.store.MockCacher(obs)
+	defer restore()
+
+	downloadWasCalled := false
+	restore = store.MockDownload(func(ctx context.Context, name, sha3, url string, user *auth.UserState, s *store.Store, w io.ReadWriteSeeker, resume int64, pbar progress.Meter, dlOpts *store.DownloadOptions) error {
+		downloadWasCalled = true
+		return nil
+	})
+	defer restore()
+
+	snap := &snap.Info{}
+	snap.Sha3_384 = "the-snaps-sha3_384"
+
+	path := filepath.Join(c.MkDir(), "downloaded-file")
+	err := s.store.Download(s.ctx, "foo", path, &snap.DownloadInfo, nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(downloadWasCalled, Equals, true)
 
 	c.Check(obs.gets, DeepEquals, []string{fmt.Sprintf("the-snaps-sha3_384:%s", path)})
 	c.Check(obs.puts, DeepEquals, []string{fmt.Sprintf("the-snaps-sha3_384:%s", path)})
@@ -4998,56 +8794,910 @@ func init() {
 	helloRefreshedDate = t
 }
 
-const helloCohortKey = "this is a very short cohort key, as cohort keys go, because those are *long*"
-
-func (s *storeTestSuite) TestSnapAction(c *C) {
-	restore := release.MockOnClassic(false)
-	defer restore()
-
+const helloCohortKey = "this is a very short cohort key, as cohort keys go, because those are *long*"
+
+func (s *storeTestSuite) TestSnapAction(c *C) {
+	restore := release.MockOnClassic(false)
+	defer restore()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		// check device authorization is set, implicitly checking doRequest was used
+		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+
+		c.Check(r.Header.Get("Snap-Refresh-Managed"), Equals, "")
+		c.Check(r.Header.Get("Snap-Refresh-Reason"), Equals, "")
+
+		// no store ID by default
+		storeID := r.Header.Get("Snap-Device-Store")
+		c.Check(storeID, Equals, "")
+
+		c.Check(r.Header.Get("Snap-Device-Series"), Equals, release.Series)
+		c.Check(r.Header.Get("Snap-Device-Architecture"), Equals, arch.DpkgArchitecture())
+		c.Check(r.Header.Get("Snap-Classic"), Equals, "false")
+
+		jsonReq, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		var req struct {
+			Context []map[string]interface{} `json:"context"`
+			Fields  []string                 `json:"fields"`
+			Actions []map[string]interface{} `json:"actions"`
+		}
+
+		err = json.Unmarshal(jsonReq, &req)
+		c.Assert(err, IsNil)
+
+		c.Check(req.Fields, DeepEquals, store.SnapActionFields)
+
+		c.Assert(req.Context, HasLen, 1)
+		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
+			"snap-id":          helloWorldSnapID,
+			"instance-key":     helloWorldSnapID,
+			"revision":         float64(1),
+			"tracking-channel": "beta",
+			"refreshed-date":   helloRefreshedDateStr,
+			"epoch":            iZeroEpoch,
+		})
+		c.Assert(req.Actions, HasLen, 1)
+		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
+			"action":       "refresh",
+			"instance-key": helloWorldSnapID,
+			"snap-id":      helloWorldSnapID,
+			"cohort-key":   helloCohortKey,
+		})
+
+		io.WriteString(w, `{
+  "results": [{
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "epoch": {"read": [0], "write": [0]},
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "beta",
+			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
+		},
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			SnapID:       helloWorldSnapID,
+			InstanceName: "hello-world",
+			CohortKey:    helloCohortKey,
+		},
+	}, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].InstanceName(), Equals, "hello-world")
+	c.Assert(results[0].Revision, Equals, snap.R(26))
+	c.Assert(results[0].Version, Equals, "6.1")
+	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
+	c.Assert(results[0].Publisher.ID, Equals, helloWorldDeveloperID)
+	c.Assert(results[0].Deltas, HasLen, 0)
+	c.Assert(results[0].Epoch, DeepEquals, snap.E("0"))
+}
+
+func (s *storeTestSuite) TestSnapActionNonZeroEpochAndEpochBump(c *C) {
+	restore := release.MockOnClassic(false)
+	defer restore()
+
+	numReqs := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numReqs++
+		assertRequest(c, r, "POST", snapActionPath)
+		// check device authorization is set, implicitly checking doRequest was used
+		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+
+		c.Check(r.Header.Get("Snap-Refresh-Managed"), Equals, "")
+
+		// no store ID by default
+		storeID := r.Header.Get("Snap-Device-Store")
+		c.Check(storeID, Equals, "")
+
+		c.Check(r.Header.Get("Snap-Device-Series"), Equals, release.Series)
+		c.Check(r.Header.Get("Snap-Device-Architecture"), Equals, arch.DpkgArchitecture())
+		c.Check(r.Header.Get("Snap-Classic"), Equals, "false")
+
+		jsonReq, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		var req struct {
+			Context []map[string]interface{} `json:"context"`
+			Fields  []string                 `json:"fields"`
+			Actions []map[string]interface{} `json:"actions"`
+		}
+
+		err = json.Unmarshal(jsonReq, &req)
+		c.Assert(err, IsNil)
+
+		c.Check(req.Fields, DeepEquals, store.SnapActionFields)
+
+		c.Assert(req.Context, HasLen, 1)
+		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
+			"snap-id":          helloWorldSnapID,
+			"instance-key":     helloWorldSnapID,
+			"revision":         float64(1),
+			"tracking-channel": "beta",
+			"refreshed-date":   helloRefreshedDateStr,
+			"epoch":            iFiveStarEpoch,
+		})
+		c.Assert(req.Actions, HasLen, 1)
+		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
+			"action":       "refresh",
+			"instance-key": helloWorldSnapID,
+			"snap-id":      helloWorldSnapID,
+		})
+
+		io.WriteString(w, `{
+  "results": [{
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "epoch": {"read": [5, 6], "write": [6]},
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "beta",
+			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
+			Epoch:           snap.E("5*"),
+		},
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			SnapID:       helloWorldSnapID,
+			InstanceName: "hello-world",
+		},
+	}, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].InstanceName(), Equals, "hello-world")
+	c.Assert(results[0].Revision, Equals, snap.R(26))
+	c.Assert(results[0].Version, Equals, "6.1")
+	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
+	c.Assert(results[0].Publisher.ID, Equals, helloWorldDeveloperID)
+	c.Assert(results[0].Deltas, HasLen, 0)
+	c.Assert(results[0].Epoch, DeepEquals, snap.E("6*"))
+
+	c.Assert(numReqs, Equals, 1) // should be >1 soon :-)
+}
+
+func (s *storeTestSuite) TestSnapActionNoResults(c *C) {
+	restore := release.MockOnClassic(false)
+	defer restore()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		// check device authorization is set, implicitly checking doRequest was used
+		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+
+		jsonReq, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		var req struct {
+			Context []map[string]interface{} `json:"context"`
+			Actions []map[string]interface{} `json:"actions"`
+		}
+
+		err = json.Unmarshal(jsonReq, &req)
+		c.Assert(err, IsNil)
+
+		c.Assert(req.Context, HasLen, 1)
+		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
+			"snap-id":          helloWorldSnapID,
+			"instance-key":     helloWorldSnapID,
+			"revision":         float64(1),
+			"tracking-channel": "beta",
+			"refreshed-date":   helloRefreshedDateStr,
+			"epoch":            iZeroEpoch,
+		})
+		c.Assert(req.Actions, HasLen, 0)
+		io.WriteString(w, `{
+  "results": []
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "beta",
+			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
+		},
+	}, nil, nil, nil)
+	c.Check(results, HasLen, 0)
+	c.Check(err, DeepEquals, &store.SnapActionError{NoResults: true})
+
+	// local no-op
+	results, err = sto.SnapAction(s.ctx, nil, nil, nil, nil)
+	c.Check(results, HasLen, 0)
+	c.Check(err, DeepEquals, &store.SnapActionError{NoResults: true})
+
+	c.Check(err.Error(), Equals, "no install/refresh information results from the store")
+}
+
+func (s *storeTestSuite) TestSnapActionRefreshHints(c *C) {
+	restore := release.MockOnClassic(false)
+	defer restore()
+
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		n++
+		if n == 1 {
+			w.Header().Set("Snap-Refresh-Retry-After", "3600")
+			w.Header().Set("Snap-Refresh-Window", "02:00-04:00")
+		}
+		io.WriteString(w, `{
+  "results": [{
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	// no hints before talking to the store
+	c.Check(sto.RefreshHints(), IsNil)
+
+	current := []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "beta",
+			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
+		},
+	}
+	action := []*store.SnapAction{
+		{
+			Action:       "refresh",
+			SnapID:       helloWorldSnapID,
+			InstanceName: "hello-world",
+		},
+	}
+
+	results, err := sto.SnapAction(s.ctx, current, action, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	hints := sto.RefreshHints()
+	c.Check(hints, DeepEquals, map[string]string{
+		"retry-after": "3600",
+		"window":      "02:00-04:00",
+	})
+	// a copy is returned
+	hints["retry-after"] = "0"
+	c.Check(sto.RefreshHints()["retry-after"], Equals, "3600")
+
+	// a response without hints clears them
+	results, err = sto.SnapAction(s.ctx, current, action, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Check(sto.RefreshHints(), IsNil)
+	c.Check(n, Equals, 2)
+}
+
+func (s *storeTestSuite) TestExperiments(c *C) {
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		n++
+		switch n {
+		case 1:
+			w.Header().Add("Snap-Store-Experiment", "search-ranking=b, new-cdn=control")
+			w.Header().Add("Snap-Store-Experiment", "no-variant,")
+		case 3:
+			w.Header().Set("Snap-Store-Experiment", "search-ranking=a")
+		}
+		io.WriteString(w, mockInfoJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	// nothing before talking to the store
+	c.Check(sto.Experiments(), IsNil)
+
+	spec := store.SnapSpec{Name: "hello-world"}
+	_, err := sto.SnapInfo(s.ctx, spec, nil)
+	c.Assert(err, IsNil)
+	experiments := sto.Experiments()
+	c.Check(experiments, DeepEquals, map[string]string{
+		"search-ranking": "b",
+		"new-cdn":        "control",
+		"no-variant":     "",
+	})
+	// a copy is returned
+	experiments["search-ranking"] = "z"
+
+	// responses without experiments keep the previous ones
+	_, err = sto.SnapInfo(s.ctx, spec, nil)
+	c.Assert(err, IsNil)
+	c.Check(sto.Experiments(), DeepEquals, map[string]string{
+		"search-ranking": "b",
+		"new-cdn":        "control",
+		"no-variant":     "",
+	})
+
+	// the most recent set replaces them
+	_, err = sto.SnapInfo(s.ctx, spec, nil)
+	c.Assert(err, IsNil)
+	c.Check(sto.Experiments(), DeepEquals, map[string]string{
+		"search-ranking": "a",
+	})
+	c.Check(n, Equals, 3)
+}
+
+func (s *storeTestSuite) TestExperimentsConcurrent(c *C) {
+	n := int32(0)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Snap-Store-Experiment", fmt.Sprintf("exp=%d", atomic.AddInt32(&n, 1)))
+		io.WriteString(w, mockInfoJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// different fields so that the requests are not coalesced
+			_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world", Fields: []string{fmt.Sprintf("f%d", i)}}, nil)
+			c.Check(err, IsNil)
+			sto.Experiments()
+		}(i)
+	}
+	wg.Wait()
+	c.Check(sto.Experiments(), HasLen, 1)
+	c.Check(sto.Experiments()["exp"], Matches, "[1-5]")
+}
+
+const snapActionRefreshHelloWorldJSON = `{
+  "results": [{
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }]
+}`
+
+func (s *storeTestSuite) testSnapActionCaptureTranscript(c *C, check func(reqBody, respBody []byte, sentBody []byte)) {
+	restore := release.MockOnClassic(false)
+	defer restore()
+
+	var sentBody []byte
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			assertRequest(c, r, "GET", infoPathPattern)
+			w.WriteHeader(404)
+			return
+		}
+		assertRequest(c, r, "POST", snapActionPath)
+		var err error
+		sentBody, err = ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		io.WriteString(w, snapActionRefreshHelloWorldJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	type transcript struct {
+		reqBody, respBody []byte
+		url               string
+	}
+	var transcripts []transcript
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+		CaptureTranscript: func(reqBody, respBody []byte, url string) {
+			transcripts = append(transcripts, transcript{reqBody, respBody, url})
+		},
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
+		},
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			SnapID:       helloWorldSnapID,
+			InstanceName: "hello-world",
+		},
+	}, s.user, nil)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Check(results[0].Revision, Equals, snap.R(26))
+
+	c.Assert(transcripts, HasLen, 1)
+	c.Check(transcripts[0].url, Equals, mockServer.URL+snapActionPath)
+	// no credentials
+	c.Check(string(transcripts[0].reqBody), Not(Matches), "(?is).*macaroon.*")
+	c.Check(string(transcripts[0].respBody), Not(Matches), "(?is).*macaroon.*")
+	check(transcripts[0].reqBody, transcripts[0].respBody, sentBody)
+
+	// other requests are not captured
+	_, err = sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, NotNil)
+	c.Check(transcripts, HasLen, 1)
+}
+
+func (s *storeTestSuite) TestSnapActionCaptureTranscript(c *C) {
+	s.testSnapActionCaptureTranscript(c, func(reqBody, respBody []byte, sentBody []byte) {
+		c.Check(reqBody, DeepEquals, sentBody)
+		c.Check(string(respBody), Equals, snapActionRefreshHelloWorldJSON)
+	})
+}
+
+func (s *storeTestSuite) TestSnapActionCaptureTranscriptCapped(c *C) {
+	defer store.MockMaxTranscriptBodySize(20)()
+
+	s.testSnapActionCaptureTranscript(c, func(reqBody, respBody []byte, sentBody []byte) {
+		c.Check(reqBody, DeepEquals, sentBody[:20])
+		c.Check(string(respBody), Equals, snapActionRefreshHelloWorldJSON[:20])
+	})
+}
+
+func (s *storeTestSuite) TestSnapActionRefreshedDateIsOptional(c *C) {
+	restore := release.MockOnClassic(false)
+	defer restore()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		// check device authorization is set, implicitly checking doRequest was used
+		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+
+		jsonReq, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		var req struct {
+			Context []map[string]interface{} `json:"context"`
+			Actions []map[string]interface{} `json:"actions"`
+		}
+
+		err = json.Unmarshal(jsonReq, &req)
+		c.Assert(err, IsNil)
+
+		c.Assert(req.Context, HasLen, 1)
+		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
+			"snap-id":      helloWorldSnapID,
+			"instance-key": helloWorldSnapID,
+
+			"revision":         float64(1),
+			"tracking-channel": "beta",
+			"epoch":            iZeroEpoch,
+		})
+		c.Assert(req.Actions, HasLen, 0)
+		io.WriteString(w, `{
+  "results": []
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "beta",
+			Revision:        snap.R(1),
+		},
+	}, nil, nil, nil)
+	c.Check(results, HasLen, 0)
+	c.Check(err, DeepEquals, &store.SnapActionError{NoResults: true})
+}
+
+func (s *storeTestSuite) TestSnapActionSkipBlocked(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		// check device authorization is set, implicitly checking doRequest was used
+		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+
+		jsonReq, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		var req struct {
+			Context []map[string]interface{} `json:"context"`
+			Actions []map[string]interface{} `json:"actions"`
+		}
+
+		err = json.Unmarshal(jsonReq, &req)
+		c.Assert(err, IsNil)
+
+		c.Assert(req.Context, HasLen, 1)
+		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
+			"snap-id":          helloWorldSnapID,
+			"instance-key":     helloWorldSnapID,
+			"revision":         float64(1),
+			"tracking-channel": "stable",
+			"refreshed-date":   helloRefreshedDateStr,
+			"epoch":            iZeroEpoch,
+		})
+		c.Assert(req.Actions, HasLen, 1)
+		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
+			"action":       "refresh",
+			"instance-key": helloWorldSnapID,
+			"snap-id":      helloWorldSnapID,
+			"channel":      "stable",
+		})
+
+		io.WriteString(w, `{
+  "results": [{
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
+			Block:           []snap.Revision{snap.R(26)},
+		},
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			SnapID:       helloWorldSnapID,
+			InstanceName: "hello-world",
+			Channel:      "stable",
+		},
+	}, nil, nil)
+	c.Assert(results, HasLen, 0)
+	c.Check(err, DeepEquals, &store.SnapActionError{
+		Refresh: map[string]error{
+			"hello-world": &store.RevisionBlockedError{Revision: snap.R(26)},
+		},
+	})
+	c.Check(err, ErrorMatches, `cannot refresh snap "hello-world": snap has no updates available: revision 26 is blocked`)
+}
+
+func (s *storeTestSuite) TestSnapActionSkipCurrent(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		// check device authorization is set, implicitly checking doRequest was used
+		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
+
+		jsonReq, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		var req struct {
+			Context []map[string]interface{} `json:"context"`
+			Actions []map[string]interface{} `json:"actions"`
+		}
+
+		err = json.Unmarshal(jsonReq, &req)
+		c.Assert(err, IsNil)
+
+		c.Assert(req.Context, HasLen, 1)
+		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
+			"snap-id":          helloWorldSnapID,
+			"instance-key":     helloWorldSnapID,
+			"revision":         float64(26),
+			"tracking-channel": "stable",
+			"refreshed-date":   helloRefreshedDateStr,
+			"epoch":            iZeroEpoch,
+		})
+		c.Assert(req.Actions, HasLen, 1)
+		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
+			"action":       "refresh",
+			"instance-key": helloWorldSnapID,
+			"snap-id":      helloWorldSnapID,
+			"channel":      "stable",
+		})
+
+		io.WriteString(w, `{
+  "results": [{
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(26),
+			RefreshedDate:   helloRefreshedDate,
+		},
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			SnapID:       helloWorldSnapID,
+			InstanceName: "hello-world",
+			Channel:      "stable",
+		},
+	}, nil, nil)
+	c.Assert(results, HasLen, 0)
+	c.Check(err, DeepEquals, &store.SnapActionError{
+		Refresh: map[string]error{
+			"hello-world": store.ErrNoUpdateAvailable,
+		},
+	})
+}
+
+func (s *storeTestSuite) TestSnapActionRetryOnEOF(c *C) {
+	n := 0
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		n++
+		if n < 4 {
+			io.WriteString(w, "{")
+			mockServer.CloseClientConnections()
+			return
+		}
+
+		var req struct {
+			Context []map[string]interface{} `json:"context"`
+			Actions []map[string]interface{} `json:"actions"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		c.Assert(err, IsNil)
+		c.Assert(req.Context, HasLen, 1)
+		c.Assert(req.Actions, HasLen, 1)
+		io.WriteString(w, `{
+  "results": [{
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(1),
+		},
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			SnapID:       helloWorldSnapID,
+			InstanceName: "hello-world",
+			Channel:      "stable",
+		},
+	}, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 4)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].InstanceName(), Equals, "hello-world")
+}
+
+func (s *storeTestSuite) TestSnapActionIgnoreValidation(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
 		// check device authorization is set, implicitly checking doRequest was used
 		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
 
-		c.Check(r.Header.Get("Snap-Refresh-Managed"), Equals, "")
-		c.Check(r.Header.Get("Snap-Refresh-Reason"), Equals, "")
-
-		// no store ID by default
-		storeID := r.Header.Get("Snap-Device-Store")
-		c.Check(storeID, Equals, "")
-
-		c.Check(r.Header.Get("Snap-Device-Series"), Equals, release.Series)
-		c.Check(r.Header.Get("Snap-Device-Architecture"), Equals, arch.DpkgArchitecture())
-		c.Check(r.Header.Get("Snap-Classic"), Equals, "false")
-
 		jsonReq, err := ioutil.ReadAll(r.Body)
 		c.Assert(err, IsNil)
 		var req struct {
 			Context []map[string]interface{} `json:"context"`
-			Fields  []string                 `json:"fields"`
 			Actions []map[string]interface{} `json:"actions"`
 		}
 
 		err = json.Unmarshal(jsonReq, &req)
 		c.Assert(err, IsNil)
 
-		c.Check(req.Fields, DeepEquals, store.SnapActionFields)
-
 		c.Assert(req.Context, HasLen, 1)
 		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
-			"snap-id":          helloWorldSnapID,
-			"instance-key":     helloWorldSnapID,
-			"revision":         float64(1),
-			"tracking-channel": "beta",
-			"refreshed-date":   helloRefreshedDateStr,
-			"epoch":            iZeroEpoch,
+			"snap-id":           helloWorldSnapID,
+			"instance-key":      helloWorldSnapID,
+			"revision":          float64(1),
+			"tracking-channel":  "stable",
+			"refreshed-date":    helloRefreshedDateStr,
+			"ignore-validation": true,
+			"epoch":             iZeroEpoch,
 		})
 		c.Assert(req.Actions, HasLen, 1)
 		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
-			"action":       "refresh",
-			"instance-key": helloWorldSnapID,
-			"snap-id":      helloWorldSnapID,
-			"cohort-key":   helloCohortKey,
+			"action":            "refresh",
+			"instance-key":      helloWorldSnapID,
+			"snap-id":           helloWorldSnapID,
+			"channel":           "stable",
+			"ignore-validation": false,
 		})
 
 		io.WriteString(w, `{
@@ -5061,7 +9711,6 @@ func (s *storeTestSuite) TestSnapAction(c *C) {
        "name": "hello-world",
        "revision": 26,
        "version": "6.1",
-       "epoch": {"read": [0], "write": [0]},
        "publisher": {
           "id": "canonical",
           "username": "canonical",
@@ -5084,80 +9733,58 @@ func (s *storeTestSuite) TestSnapAction(c *C) {
 
 	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
 		{
-			InstanceName:    "hello-world",
-			SnapID:          helloWorldSnapID,
-			TrackingChannel: "beta",
-			Revision:        snap.R(1),
-			RefreshedDate:   helloRefreshedDate,
+			InstanceName:     "hello-world",
+			SnapID:           helloWorldSnapID,
+			TrackingChannel:  "stable",
+			Revision:         snap.R(1),
+			RefreshedDate:    helloRefreshedDate,
+			IgnoreValidation: true,
 		},
 	}, []*store.SnapAction{
 		{
 			Action:       "refresh",
 			SnapID:       helloWorldSnapID,
 			InstanceName: "hello-world",
-			CohortKey:    helloCohortKey,
+			Channel:      "stable",
+			Flags:        store.SnapActionEnforceValidation,
 		},
 	}, nil, nil)
 	c.Assert(err, IsNil)
 	c.Assert(results, HasLen, 1)
 	c.Assert(results[0].InstanceName(), Equals, "hello-world")
 	c.Assert(results[0].Revision, Equals, snap.R(26))
-	c.Assert(results[0].Version, Equals, "6.1")
-	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
-	c.Assert(results[0].Publisher.ID, Equals, helloWorldDeveloperID)
-	c.Assert(results[0].Deltas, HasLen, 0)
-	c.Assert(results[0].Epoch, DeepEquals, snap.E("0"))
 }
 
-func (s *storeTestSuite) TestSnapActionNonZeroEpochAndEpochBump(c *C) {
-	restore := release.MockOnClassic(false)
-	defer restore()
-
-	numReqs := 0
+func (s *storeTestSuite) testSnapActionValidationSets(c *C, validationSets []string) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		numReqs++
 		assertRequest(c, r, "POST", snapActionPath)
-		// check device authorization is set, implicitly checking doRequest was used
-		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
-
-		c.Check(r.Header.Get("Snap-Refresh-Managed"), Equals, "")
-
-		// no store ID by default
-		storeID := r.Header.Get("Snap-Device-Store")
-		c.Check(storeID, Equals, "")
-
-		c.Check(r.Header.Get("Snap-Device-Series"), Equals, release.Series)
-		c.Check(r.Header.Get("Snap-Device-Architecture"), Equals, arch.DpkgArchitecture())
-		c.Check(r.Header.Get("Snap-Classic"), Equals, "false")
 
 		jsonReq, err := ioutil.ReadAll(r.Body)
 		c.Assert(err, IsNil)
 		var req struct {
 			Context []map[string]interface{} `json:"context"`
-			Fields  []string                 `json:"fields"`
-			Actions []map[string]interface{} `json:"actions"`
 		}
 
 		err = json.Unmarshal(jsonReq, &req)
 		c.Assert(err, IsNil)
 
-		c.Check(req.Fields, DeepEquals, store.SnapActionFields)
-
-		c.Assert(req.Context, HasLen, 1)
-		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
+		expectedContext := map[string]interface{}{
 			"snap-id":          helloWorldSnapID,
 			"instance-key":     helloWorldSnapID,
 			"revision":         float64(1),
-			"tracking-channel": "beta",
+			"tracking-channel": "stable",
 			"refreshed-date":   helloRefreshedDateStr,
-			"epoch":            iFiveStarEpoch,
-		})
-		c.Assert(req.Actions, HasLen, 1)
-		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
-			"action":       "refresh",
-			"instance-key": helloWorldSnapID,
-			"snap-id":      helloWorldSnapID,
-		})
+			"epoch":            iZeroEpoch,
+		}
+		if len(validationSets) != 0 {
+			sets := make([]interface{}, len(validationSets))
+			for i, vs := range validationSets {
+				sets[i] = vs
+			}
+			expectedContext["validation-sets"] = sets
+		}
+		c.Assert(req.Context, HasLen, 1)
+		c.Assert(req.Context[0], DeepEquals, expectedContext)
 
 		io.WriteString(w, `{
   "results": [{
@@ -5170,7 +9797,6 @@ func (s *storeTestSuite) TestSnapActionNonZeroEpochAndEpochBump(c *C) {
        "name": "hello-world",
        "revision": 26,
        "version": "6.1",
-       "epoch": {"read": [5, 6], "write": [6]},
        "publisher": {
           "id": "canonical",
           "username": "canonical",
@@ -5195,10 +9821,10 @@ func (s *storeTestSuite) TestSnapActionNonZeroEpochAndEpochBump(c *C) {
 		{
 			InstanceName:    "hello-world",
 			SnapID:          helloWorldSnapID,
-			TrackingChannel: "beta",
+			TrackingChannel: "stable",
 			Revision:        snap.R(1),
 			RefreshedDate:   helloRefreshedDate,
-			Epoch:           snap.E("5*"),
+			ValidationSets:  validationSets,
 		},
 	}, []*store.SnapAction{
 		{
@@ -5209,48 +9835,63 @@ func (s *storeTestSuite) TestSnapActionNonZeroEpochAndEpochBump(c *C) {
 	}, nil, nil)
 	c.Assert(err, IsNil)
 	c.Assert(results, HasLen, 1)
-	c.Assert(results[0].InstanceName(), Equals, "hello-world")
 	c.Assert(results[0].Revision, Equals, snap.R(26))
-	c.Assert(results[0].Version, Equals, "6.1")
-	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
-	c.Assert(results[0].Publisher.ID, Equals, helloWorldDeveloperID)
-	c.Assert(results[0].Deltas, HasLen, 0)
-	c.Assert(results[0].Epoch, DeepEquals, snap.E("6*"))
+}
 
-	c.Assert(numReqs, Equals, 1) // should be >1 soon :-)
+func (s *storeTestSuite) TestSnapActionValidationSets(c *C) {
+	s.testSnapActionValidationSets(c, []string{"foo/bar", "foo/baz"})
 }
 
-func (s *storeTestSuite) TestSnapActionNoResults(c *C) {
-	restore := release.MockOnClassic(false)
-	defer restore()
+func (s *storeTestSuite) TestSnapActionValidationSetsEmptyOmitted(c *C) {
+	s.testSnapActionValidationSets(c, nil)
+	s.testSnapActionValidationSets(c, []string{})
+}
 
+func (s *storeTestSuite) testSnapActionHeld(c *C, held bool, heldUntil time.Time, expectedHold map[string]interface{}) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
-		// check device authorization is set, implicitly checking doRequest was used
-		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
 
 		jsonReq, err := ioutil.ReadAll(r.Body)
 		c.Assert(err, IsNil)
 		var req struct {
 			Context []map[string]interface{} `json:"context"`
-			Actions []map[string]interface{} `json:"actions"`
 		}
 
 		err = json.Unmarshal(jsonReq, &req)
 		c.Assert(err, IsNil)
 
-		c.Assert(req.Context, HasLen, 1)
-		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
+		expectedContext := map[string]interface{}{
 			"snap-id":          helloWorldSnapID,
 			"instance-key":     helloWorldSnapID,
 			"revision":         float64(1),
-			"tracking-channel": "beta",
+			"tracking-channel": "stable",
 			"refreshed-date":   helloRefreshedDateStr,
 			"epoch":            iZeroEpoch,
-		})
-		c.Assert(req.Actions, HasLen, 0)
+		}
+		for k, v := range expectedHold {
+			expectedContext[k] = v
+		}
+		c.Assert(req.Context, HasLen, 1)
+		c.Assert(req.Context[0], DeepEquals, expectedContext)
+
 		io.WriteString(w, `{
-  "results": []
+  "results": [{
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }]
 }`)
 	}))
 
@@ -5268,53 +9909,72 @@ func (s *storeTestSuite) TestSnapActionNoResults(c *C) {
 		{
 			InstanceName:    "hello-world",
 			SnapID:          helloWorldSnapID,
-			TrackingChannel: "beta",
+			TrackingChannel: "stable",
 			Revision:        snap.R(1),
 			RefreshedDate:   helloRefreshedDate,
+			Held:            held,
+			HeldUntil:       heldUntil,
 		},
-	}, nil, nil, nil)
-	c.Check(results, HasLen, 0)
-	c.Check(err, DeepEquals, &store.SnapActionError{NoResults: true})
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			SnapID:       helloWorldSnapID,
+			InstanceName: "hello-world",
+		},
+	}, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Revision, Equals, snap.R(26))
+}
 
-	// local no-op
-	results, err = sto.SnapAction(s.ctx, nil, nil, nil, nil)
-	c.Check(results, HasLen, 0)
-	c.Check(err, DeepEquals, &store.SnapActionError{NoResults: true})
+func (s *storeTestSuite) TestSnapActionHeld(c *C) {
+	heldUntil := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	s.testSnapActionHeld(c, true, heldUntil, map[string]interface{}{
+		"held":       true,
+		"held-until": "2021-03-04T05:06:07Z",
+	})
+	// held indefinitely
+	s.testSnapActionHeld(c, true, time.Time{}, map[string]interface{}{
+		"held": true,
+	})
+}
 
-	c.Check(err.Error(), Equals, "no install/refresh information results from the store")
+func (s *storeTestSuite) TestSnapActionNotHeldOmitted(c *C) {
+	s.testSnapActionHeld(c, false, time.Time{}, nil)
+	// the hold expiry alone means nothing
+	s.testSnapActionHeld(c, false, time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), nil)
 }
 
-func (s *storeTestSuite) TestSnapActionRefreshedDateIsOptional(c *C) {
+func (s *storeTestSuite) TestSnapActionAutoRefresh(c *C) {
+	// the bare TestSnapAction does more SnapAction checks; look there
+	// this one mostly just checks the refresh-reason header
+
 	restore := release.MockOnClassic(false)
 	defer restore()
 
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
-		// check device authorization is set, implicitly checking doRequest was used
-		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
-
-		jsonReq, err := ioutil.ReadAll(r.Body)
-		c.Assert(err, IsNil)
-		var req struct {
-			Context []map[string]interface{} `json:"context"`
-			Actions []map[string]interface{} `json:"actions"`
-		}
-
-		err = json.Unmarshal(jsonReq, &req)
-		c.Assert(err, IsNil)
-
-		c.Assert(req.Context, HasLen, 1)
-		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
-			"snap-id":      helloWorldSnapID,
-			"instance-key": helloWorldSnapID,
+		c.Check(r.Header.Get("Snap-Refresh-Reason"), Equals, "scheduled")
 
-			"revision":         float64(1),
-			"tracking-channel": "beta",
-			"epoch":            iZeroEpoch,
-		})
-		c.Assert(req.Actions, HasLen, 0)
 		io.WriteString(w, `{
-  "results": []
+  "results": [{
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "epoch": {"read": [0], "write": [0]},
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }]
 }`)
 	}))
 
@@ -5334,13 +9994,76 @@ func (s *storeTestSuite) TestSnapActionRefreshedDateIsOptional(c *C) {
 			SnapID:          helloWorldSnapID,
 			TrackingChannel: "beta",
 			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
 		},
-	}, nil, nil, nil)
-	c.Check(results, HasLen, 0)
-	c.Check(err, DeepEquals, &store.SnapActionError{NoResults: true})
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			SnapID:       helloWorldSnapID,
+			InstanceName: "hello-world",
+		},
+	}, nil, &store.RefreshOptions{IsAutoRefresh: true})
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+}
+
+func (s *storeTestSuite) TestSnapActionRefreshReason(c *C) {
+	restore := release.MockOnClassic(false)
+	defer restore()
+
+	var expected string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		c.Check(r.Header.Get("Snap-Refresh-Reason"), Equals, expected)
+
+		io.WriteString(w, snapActionRefreshHelloWorldJSON)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	for _, t := range []struct {
+		opts     *store.RefreshOptions
+		expected string
+	}{
+		{nil, ""},
+		{&store.RefreshOptions{}, ""},
+		{&store.RefreshOptions{IsAutoRefresh: true}, "scheduled"},
+		{&store.RefreshOptions{RefreshReason: store.RefreshReasonScheduled}, "scheduled"},
+		{&store.RefreshOptions{RefreshReason: store.RefreshReasonManual}, "manual"},
+		{&store.RefreshOptions{RefreshReason: store.RefreshReasonPrereq}, "prereq"},
+		// an explicit reason wins
+		{&store.RefreshOptions{IsAutoRefresh: true, RefreshReason: store.RefreshReasonPrereq}, "prereq"},
+	} {
+		expected = t.expected
+		results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+			{
+				InstanceName:    "hello-world",
+				SnapID:          helloWorldSnapID,
+				TrackingChannel: "stable",
+				Revision:        snap.R(1),
+				RefreshedDate:   helloRefreshedDate,
+			},
+		}, []*store.SnapAction{
+			{
+				Action:       "refresh",
+				SnapID:       helloWorldSnapID,
+				InstanceName: "hello-world",
+			},
+		}, nil, t.opts)
+		c.Assert(err, IsNil)
+		c.Assert(results, HasLen, 1)
+	}
 }
 
-func (s *storeTestSuite) TestSnapActionSkipBlocked(c *C) {
+func (s *storeTestSuite) TestInstallFallbackChannelIsStable(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
 		// check device authorization is set, implicitly checking doRequest was used
@@ -5370,7 +10093,6 @@ func (s *storeTestSuite) TestSnapActionSkipBlocked(c *C) {
 			"action":       "refresh",
 			"instance-key": helloWorldSnapID,
 			"snap-id":      helloWorldSnapID,
-			"channel":      "stable",
 		})
 
 		io.WriteString(w, `{
@@ -5406,35 +10128,41 @@ func (s *storeTestSuite) TestSnapActionSkipBlocked(c *C) {
 
 	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
 		{
-			InstanceName:    "hello-world",
-			SnapID:          helloWorldSnapID,
-			TrackingChannel: "stable",
-			Revision:        snap.R(1),
-			RefreshedDate:   helloRefreshedDate,
-			Block:           []snap.Revision{snap.R(26)},
+			InstanceName:  "hello-world",
+			SnapID:        helloWorldSnapID,
+			RefreshedDate: helloRefreshedDate,
+			Revision:      snap.R(1),
 		},
 	}, []*store.SnapAction{
 		{
 			Action:       "refresh",
 			SnapID:       helloWorldSnapID,
 			InstanceName: "hello-world",
-			Channel:      "stable",
 		},
 	}, nil, nil)
-	c.Assert(results, HasLen, 0)
-	c.Check(err, DeepEquals, &store.SnapActionError{
-		Refresh: map[string]error{
-			"hello-world": store.ErrNoUpdateAvailable,
-		},
-	})
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].InstanceName(), Equals, "hello-world")
+	c.Assert(results[0].Revision, Equals, snap.R(26))
+	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
 }
 
-func (s *storeTestSuite) TestSnapActionSkipCurrent(c *C) {
+func (s *storeTestSuite) TestSnapActionNonDefaultsHeaders(c *C) {
+	restore := release.MockOnClassic(true)
+	defer restore()
+
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
 		// check device authorization is set, implicitly checking doRequest was used
 		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
 
+		storeID := r.Header.Get("Snap-Device-Store")
+		c.Check(storeID, Equals, "foo")
+
+		c.Check(r.Header.Get("Snap-Device-Series"), Equals, "21")
+		c.Check(r.Header.Get("Snap-Device-Architecture"), Equals, "archXYZ")
+		c.Check(r.Header.Get("Snap-Classic"), Equals, "true")
+
 		jsonReq, err := ioutil.ReadAll(r.Body)
 		c.Assert(err, IsNil)
 		var req struct {
@@ -5449,8 +10177,8 @@ func (s *storeTestSuite) TestSnapActionSkipCurrent(c *C) {
 		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
 			"snap-id":          helloWorldSnapID,
 			"instance-key":     helloWorldSnapID,
-			"revision":         float64(26),
-			"tracking-channel": "stable",
+			"revision":         float64(1),
+			"tracking-channel": "beta",
 			"refreshed-date":   helloRefreshedDateStr,
 			"epoch":            iZeroEpoch,
 		})
@@ -5459,7 +10187,6 @@ func (s *storeTestSuite) TestSnapActionSkipCurrent(c *C) {
 			"action":       "refresh",
 			"instance-key": helloWorldSnapID,
 			"snap-id":      helloWorldSnapID,
-			"channel":      "stable",
 		})
 
 		io.WriteString(w, `{
@@ -5487,84 +10214,57 @@ func (s *storeTestSuite) TestSnapActionSkipCurrent(c *C) {
 	defer mockServer.Close()
 
 	mockServerURL, _ := url.Parse(mockServer.URL)
-	cfg := store.Config{
-		StoreBaseURL: mockServerURL,
-	}
+	cfg := store.DefaultConfig()
+	cfg.StoreBaseURL = mockServerURL
+	cfg.Series = "21"
+	cfg.Architecture = "archXYZ"
+	cfg.StoreID = "foo"
 	dauthCtx := &testDauthContext{c: c, device: s.device}
-	sto := store.New(&cfg, dauthCtx)
+	sto := store.New(cfg, dauthCtx)
 
 	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
 		{
 			InstanceName:    "hello-world",
 			SnapID:          helloWorldSnapID,
-			TrackingChannel: "stable",
-			Revision:        snap.R(26),
+			TrackingChannel: "beta",
 			RefreshedDate:   helloRefreshedDate,
+			Revision:        snap.R(1),
 		},
 	}, []*store.SnapAction{
 		{
 			Action:       "refresh",
 			SnapID:       helloWorldSnapID,
 			InstanceName: "hello-world",
-			Channel:      "stable",
 		},
 	}, nil, nil)
-	c.Assert(results, HasLen, 0)
-	c.Check(err, DeepEquals, &store.SnapActionError{
-		Refresh: map[string]error{
-			"hello-world": store.ErrNoUpdateAvailable,
-		},
-	})
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].InstanceName(), Equals, "hello-world")
+	c.Assert(results[0].Revision, Equals, snap.R(26))
+	c.Assert(results[0].Version, Equals, "6.1")
+	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
+	c.Assert(results[0].Publisher.ID, Equals, helloWorldDeveloperID)
+	c.Assert(results[0].Deltas, HasLen, 0)
 }
 
-func (s *storeTestSuite) TestSnapActionRetryOnEOF(c *C) {
-	n := 0
-	var mockServer *httptest.Server
-	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "POST", snapActionPath)
-		n++
-		if n < 4 {
-			io.WriteString(w, "{")
-			mockServer.CloseClientConnections()
-			return
-		}
-
-		var req struct {
-			Context []map[string]interface{} `json:"context"`
-			Actions []map[string]interface{} `json:"actions"`
-		}
+func (s *storeTestSuite) TestSnapActionWithDeltasDisabled(c *C) {
+	origUseDeltas := os.Getenv("SNAPD_USE_DELTAS_EXPERIMENTAL")
+	defer os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", origUseDeltas)
+	c.Assert(os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", "1"), IsNil)
 
-		err := json.NewDecoder(r.Body).Decode(&req)
-		c.Assert(err, IsNil)
-		c.Assert(req.Context, HasLen, 1)
-		c.Assert(req.Actions, HasLen, 1)
-		io.WriteString(w, `{
-  "results": [{
-     "result": "refresh",
-     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
-     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
-     "name": "hello-world",
-     "snap": {
-       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
-       "name": "hello-world",
-       "revision": 26,
-       "version": "6.1",
-       "publisher": {
-          "id": "canonical",
-          "username": "canonical",
-          "display-name": "Canonical"
-       }
-     }
-  }]
-}`)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		// no deltas are asked for
+		c.Check(r.Header.Get("Snap-Accept-Delta-Format"), Equals, "")
+		io.WriteString(w, snapActionRefreshHelloWorldJSON)
 	}))
-
 	c.Assert(mockServer, NotNil)
 	defer mockServer.Close()
 
 	mockServerURL, _ := url.Parse(mockServer.URL)
 	cfg := store.Config{
-		StoreBaseURL: mockServerURL,
+		StoreBaseURL:  mockServerURL,
+		DisableDeltas: true,
 	}
 	dauthCtx := &testDauthContext{c: c, device: s.device}
 	sto := store.New(&cfg, dauthCtx)
@@ -5573,29 +10273,32 @@ func (s *storeTestSuite) TestSnapActionRetryOnEOF(c *C) {
 		{
 			InstanceName:    "hello-world",
 			SnapID:          helloWorldSnapID,
-			TrackingChannel: "stable",
+			TrackingChannel: "beta",
 			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
 		},
 	}, []*store.SnapAction{
 		{
 			Action:       "refresh",
 			SnapID:       helloWorldSnapID,
 			InstanceName: "hello-world",
-			Channel:      "stable",
 		},
 	}, nil, nil)
 	c.Assert(err, IsNil)
-	c.Assert(n, Equals, 4)
 	c.Assert(results, HasLen, 1)
-	c.Assert(results[0].InstanceName(), Equals, "hello-world")
 }
 
-func (s *storeTestSuite) TestSnapActionIgnoreValidation(c *C) {
+func (s *storeTestSuite) TestSnapActionWithDeltas(c *C) {
+	origUseDeltas := os.Getenv("SNAPD_USE_DELTAS_EXPERIMENTAL")
+	defer os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", origUseDeltas)
+	c.Assert(os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", "1"), IsNil)
+
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
 		// check device authorization is set, implicitly checking doRequest was used
 		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
 
+		c.Check(r.Header.Get("Snap-Accept-Delta-Format"), Equals, "xdelta3")
 		jsonReq, err := ioutil.ReadAll(r.Body)
 		c.Assert(err, IsNil)
 		var req struct {
@@ -5608,21 +10311,18 @@ func (s *storeTestSuite) TestSnapActionIgnoreValidation(c *C) {
 
 		c.Assert(req.Context, HasLen, 1)
 		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
-			"snap-id":           helloWorldSnapID,
-			"instance-key":      helloWorldSnapID,
-			"revision":          float64(1),
-			"tracking-channel":  "stable",
-			"refreshed-date":    helloRefreshedDateStr,
-			"ignore-validation": true,
-			"epoch":             iZeroEpoch,
+			"snap-id":          helloWorldSnapID,
+			"instance-key":     helloWorldSnapID,
+			"revision":         float64(1),
+			"tracking-channel": "beta",
+			"refreshed-date":   helloRefreshedDateStr,
+			"epoch":            iZeroEpoch,
 		})
 		c.Assert(req.Actions, HasLen, 1)
 		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
-			"action":            "refresh",
-			"instance-key":      helloWorldSnapID,
-			"snap-id":           helloWorldSnapID,
-			"channel":           "stable",
-			"ignore-validation": false,
+			"action":       "refresh",
+			"instance-key": helloWorldSnapID,
+			"snap-id":      helloWorldSnapID,
 		})
 
 		io.WriteString(w, `{
@@ -5656,73 +10356,6 @@ func (s *storeTestSuite) TestSnapActionIgnoreValidation(c *C) {
 	dauthCtx := &testDauthContext{c: c, device: s.device}
 	sto := store.New(&cfg, dauthCtx)
 
-	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
-		{
-			InstanceName:     "hello-world",
-			SnapID:           helloWorldSnapID,
-			TrackingChannel:  "stable",
-			Revision:         snap.R(1),
-			RefreshedDate:    helloRefreshedDate,
-			IgnoreValidation: true,
-		},
-	}, []*store.SnapAction{
-		{
-			Action:       "refresh",
-			SnapID:       helloWorldSnapID,
-			InstanceName: "hello-world",
-			Channel:      "stable",
-			Flags:        store.SnapActionEnforceValidation,
-		},
-	}, nil, nil)
-	c.Assert(err, IsNil)
-	c.Assert(results, HasLen, 1)
-	c.Assert(results[0].InstanceName(), Equals, "hello-world")
-	c.Assert(results[0].Revision, Equals, snap.R(26))
-}
-
-func (s *storeTestSuite) TestSnapActionAutoRefresh(c *C) {
-	// the bare TestSnapAction does more SnapAction checks; look there
-	// this one mostly just checks the refresh-reason header
-
-	restore := release.MockOnClassic(false)
-	defer restore()
-
-	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "POST", snapActionPath)
-		c.Check(r.Header.Get("Snap-Refresh-Reason"), Equals, "scheduled")
-
-		io.WriteString(w, `{
-  "results": [{
-     "result": "refresh",
-     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
-     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
-     "name": "hello-world",
-     "snap": {
-       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
-       "name": "hello-world",
-       "revision": 26,
-       "version": "6.1",
-       "epoch": {"read": [0], "write": [0]},
-       "publisher": {
-          "id": "canonical",
-          "username": "canonical",
-          "display-name": "Canonical"
-       }
-     }
-  }]
-}`)
-	}))
-
-	c.Assert(mockServer, NotNil)
-	defer mockServer.Close()
-
-	mockServerURL, _ := url.Parse(mockServer.URL)
-	cfg := store.Config{
-		StoreBaseURL: mockServerURL,
-	}
-	dauthCtx := &testDauthContext{c: c, device: s.device}
-	sto := store.New(&cfg, dauthCtx)
-
 	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
 		{
 			InstanceName:    "hello-world",
@@ -5737,17 +10370,21 @@ func (s *storeTestSuite) TestSnapActionAutoRefresh(c *C) {
 			SnapID:       helloWorldSnapID,
 			InstanceName: "hello-world",
 		},
-	}, nil, &store.RefreshOptions{IsAutoRefresh: true})
+	}, nil, nil)
 	c.Assert(err, IsNil)
 	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].InstanceName(), Equals, "hello-world")
+	c.Assert(results[0].Revision, Equals, snap.R(26))
 }
 
-func (s *storeTestSuite) TestInstallFallbackChannelIsStable(c *C) {
+func (s *storeTestSuite) TestSnapActionOptions(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
 		// check device authorization is set, implicitly checking doRequest was used
 		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
 
+		c.Check(r.Header.Get("Snap-Refresh-Managed"), Equals, "true")
+
 		jsonReq, err := ioutil.ReadAll(r.Body)
 		c.Assert(err, IsNil)
 		var req struct {
@@ -5772,6 +10409,7 @@ func (s *storeTestSuite) TestInstallFallbackChannelIsStable(c *C) {
 			"action":       "refresh",
 			"instance-key": helloWorldSnapID,
 			"snap-id":      helloWorldSnapID,
+			"channel":      "stable",
 		})
 
 		io.WriteString(w, `{
@@ -5807,27 +10445,47 @@ func (s *storeTestSuite) TestInstallFallbackChannelIsStable(c *C) {
 
 	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
 		{
-			InstanceName:  "hello-world",
-			SnapID:        helloWorldSnapID,
-			RefreshedDate: helloRefreshedDate,
-			Revision:      snap.R(1),
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
 		},
 	}, []*store.SnapAction{
 		{
 			Action:       "refresh",
 			SnapID:       helloWorldSnapID,
 			InstanceName: "hello-world",
+			Channel:      "stable",
 		},
-	}, nil, nil)
+	}, nil, &store.RefreshOptions{RefreshManaged: true})
 	c.Assert(err, IsNil)
 	c.Assert(results, HasLen, 1)
 	c.Assert(results[0].InstanceName(), Equals, "hello-world")
 	c.Assert(results[0].Revision, Equals, snap.R(26))
-	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
 }
-
-func (s *storeTestSuite) TestSnapActionNonDefaultsHeaders(c *C) {
-	restore := release.MockOnClassic(true)
+
+func (s *storeTestSuite) TestSnapActionInstall(c *C) {
+	s.testSnapActionGet("install", "", "", c)
+}
+func (s *storeTestSuite) TestSnapActionInstallWithCohort(c *C) {
+	s.testSnapActionGet("install", "what", "", c)
+}
+func (s *storeTestSuite) TestSnapActionDownload(c *C) {
+	s.testSnapActionGet("download", "", "", c)
+}
+func (s *storeTestSuite) TestSnapActionDownloadWithCohort(c *C) {
+	s.testSnapActionGet("download", "here", "", c)
+}
+func (s *storeTestSuite) TestSnapActionInstallRedirect(c *C) {
+	s.testSnapActionGet("install", "", "2.0/candidate", c)
+}
+func (s *storeTestSuite) TestSnapActionDownloadRedirect(c *C) {
+	s.testSnapActionGet("download", "", "2.0/candidate", c)
+}
+func (s *storeTestSuite) testSnapActionGet(action, cohort, redirectChannel string, c *C) {
+	// action here is one of install or download
+	restore := release.MockOnClassic(false)
 	defer restore()
 
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -5835,12 +10493,15 @@ func (s *storeTestSuite) TestSnapActionNonDefaultsHeaders(c *C) {
 		// check device authorization is set, implicitly checking doRequest was used
 		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
 
+		c.Check(r.Header.Get("Snap-Refresh-Managed"), Equals, "")
+
+		// no store ID by default
 		storeID := r.Header.Get("Snap-Device-Store")
-		c.Check(storeID, Equals, "foo")
+		c.Check(storeID, Equals, "")
 
-		c.Check(r.Header.Get("Snap-Device-Series"), Equals, "21")
-		c.Check(r.Header.Get("Snap-Device-Architecture"), Equals, "archXYZ")
-		c.Check(r.Header.Get("Snap-Classic"), Equals, "true")
+		c.Check(r.Header.Get("Snap-Device-Series"), Equals, release.Series)
+		c.Check(r.Header.Get("Snap-Device-Architecture"), Equals, arch.DpkgArchitecture())
+		c.Check(r.Header.Get("Snap-Classic"), Equals, "false")
 
 		jsonReq, err := ioutil.ReadAll(r.Body)
 		c.Assert(err, IsNil)
@@ -5852,28 +10513,28 @@ func (s *storeTestSuite) TestSnapActionNonDefaultsHeaders(c *C) {
 		err = json.Unmarshal(jsonReq, &req)
 		c.Assert(err, IsNil)
 
-		c.Assert(req.Context, HasLen, 1)
-		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
-			"snap-id":          helloWorldSnapID,
-			"instance-key":     helloWorldSnapID,
-			"revision":         float64(1),
-			"tracking-channel": "beta",
-			"refreshed-date":   helloRefreshedDateStr,
-			"epoch":            iZeroEpoch,
-		})
+		c.Assert(req.Context, HasLen, 0)
 		c.Assert(req.Actions, HasLen, 1)
-		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
-			"action":       "refresh",
-			"instance-key": helloWorldSnapID,
-			"snap-id":      helloWorldSnapID,
-		})
+		expectedAction := map[string]interface{}{
+			"action":       action,
+			"instance-key": action + "-1",
+			"name":         "hello-world",
+			"channel":      "beta",
+			"epoch":        nil,
+		}
+		if cohort != "" {
+			expectedAction["cohort-key"] = cohort
+		}
+		c.Assert(req.Actions[0], DeepEquals, expectedAction)
 
-		io.WriteString(w, `{
+		fmt.Fprintf(w, `{
   "results": [{
-     "result": "refresh",
-     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "result": "%s",
+     "instance-key": "%[1]s-1",
      "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
      "name": "hello-world",
+     "effective-channel": "candidate",
+     "redirect-channel": "%s",
      "snap": {
        "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
        "name": "hello-world",
@@ -5886,36 +10547,28 @@ func (s *storeTestSuite) TestSnapActionNonDefaultsHeaders(c *C) {
        }
      }
   }]
-}`)
+}`, action, redirectChannel)
 	}))
 
 	c.Assert(mockServer, NotNil)
 	defer mockServer.Close()
 
 	mockServerURL, _ := url.Parse(mockServer.URL)
-	cfg := store.DefaultConfig()
-	cfg.StoreBaseURL = mockServerURL
-	cfg.Series = "21"
-	cfg.Architecture = "archXYZ"
-	cfg.StoreID = "foo"
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
 	dauthCtx := &testDauthContext{c: c, device: s.device}
-	sto := store.New(cfg, dauthCtx)
+	sto := store.New(&cfg, dauthCtx)
 
-	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
-		{
-			InstanceName:    "hello-world",
-			SnapID:          helloWorldSnapID,
-			TrackingChannel: "beta",
-			RefreshedDate:   helloRefreshedDate,
-			Revision:        snap.R(1),
-		},
-	}, []*store.SnapAction{
-		{
-			Action:       "refresh",
-			SnapID:       helloWorldSnapID,
-			InstanceName: "hello-world",
-		},
-	}, nil, nil)
+	results, err := sto.SnapAction(s.ctx, nil,
+		[]*store.SnapAction{
+			{
+				Action:       action,
+				InstanceName: "hello-world",
+				Channel:      "beta",
+				CohortKey:    cohort,
+			},
+		}, nil, nil)
 	c.Assert(err, IsNil)
 	c.Assert(results, HasLen, 1)
 	c.Assert(results[0].InstanceName(), Equals, "hello-world")
@@ -5924,19 +10577,31 @@ func (s *storeTestSuite) TestSnapActionNonDefaultsHeaders(c *C) {
 	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
 	c.Assert(results[0].Publisher.ID, Equals, helloWorldDeveloperID)
 	c.Assert(results[0].Deltas, HasLen, 0)
+	// effective-channel
+	c.Assert(results[0].Channel, Equals, "candidate")
+	c.Assert(results[0].RedirectChannel, Equals, redirectChannel)
 }
 
-func (s *storeTestSuite) TestSnapActionWithDeltas(c *C) {
-	origUseDeltas := os.Getenv("SNAPD_USE_DELTAS_EXPERIMENTAL")
-	defer os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", origUseDeltas)
-	c.Assert(os.Setenv("SNAPD_USE_DELTAS_EXPERIMENTAL", "1"), IsNil)
+func (s *storeTestSuite) TestSnapActionInstallAmend(c *C) {
+	// this is what amend would look like
+	restore := release.MockOnClassic(false)
+	defer restore()
 
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
 		// check device authorization is set, implicitly checking doRequest was used
 		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
 
-		c.Check(r.Header.Get("Snap-Accept-Delta-Format"), Equals, "xdelta3")
+		c.Check(r.Header.Get("Snap-Refresh-Managed"), Equals, "")
+
+		// no store ID by default
+		storeID := r.Header.Get("Snap-Device-Store")
+		c.Check(storeID, Equals, "")
+
+		c.Check(r.Header.Get("Snap-Device-Series"), Equals, release.Series)
+		c.Check(r.Header.Get("Snap-Device-Architecture"), Equals, arch.DpkgArchitecture())
+		c.Check(r.Header.Get("Snap-Classic"), Equals, "false")
+
 		jsonReq, err := ioutil.ReadAll(r.Body)
 		c.Assert(err, IsNil)
 		var req struct {
@@ -5947,28 +10612,23 @@ func (s *storeTestSuite) TestSnapActionWithDeltas(c *C) {
 		err = json.Unmarshal(jsonReq, &req)
 		c.Assert(err, IsNil)
 
-		c.Assert(req.Context, HasLen, 1)
-		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
-			"snap-id":          helloWorldSnapID,
-			"instance-key":     helloWorldSnapID,
-			"revision":         float64(1),
-			"tracking-channel": "beta",
-			"refreshed-date":   helloRefreshedDateStr,
-			"epoch":            iZeroEpoch,
-		})
+		c.Assert(req.Context, HasLen, 0)
 		c.Assert(req.Actions, HasLen, 1)
 		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
-			"action":       "refresh",
-			"instance-key": helloWorldSnapID,
-			"snap-id":      helloWorldSnapID,
+			"action":       "install",
+			"instance-key": "install-1",
+			"name":         "hello-world",
+			"channel":      "beta",
+			"epoch":        map[string]interface{}{"read": []interface{}{0., 1.}, "write": []interface{}{1.}},
 		})
 
-		io.WriteString(w, `{
+		fmt.Fprint(w, `{
   "results": [{
-     "result": "refresh",
-     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "result": "install",
+     "instance-key": "install-1",
      "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
      "name": "hello-world",
+     "effective-channel": "candidate",
      "snap": {
        "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
        "name": "hello-world",
@@ -5994,34 +10654,30 @@ func (s *storeTestSuite) TestSnapActionWithDeltas(c *C) {
 	dauthCtx := &testDauthContext{c: c, device: s.device}
 	sto := store.New(&cfg, dauthCtx)
 
-	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
-		{
-			InstanceName:    "hello-world",
-			SnapID:          helloWorldSnapID,
-			TrackingChannel: "beta",
-			Revision:        snap.R(1),
-			RefreshedDate:   helloRefreshedDate,
-		},
-	}, []*store.SnapAction{
-		{
-			Action:       "refresh",
-			SnapID:       helloWorldSnapID,
-			InstanceName: "hello-world",
-		},
-	}, nil, nil)
+	results, err := sto.SnapAction(s.ctx, nil,
+		[]*store.SnapAction{
+			{
+				Action:       "install",
+				InstanceName: "hello-world",
+				Channel:      "beta",
+				Epoch:        snap.E("1*"),
+			},
+		}, nil, nil)
 	c.Assert(err, IsNil)
 	c.Assert(results, HasLen, 1)
 	c.Assert(results[0].InstanceName(), Equals, "hello-world")
 	c.Assert(results[0].Revision, Equals, snap.R(26))
+	c.Assert(results[0].Version, Equals, "6.1")
+	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
+	c.Assert(results[0].Publisher.ID, Equals, helloWorldDeveloperID)
+	c.Assert(results[0].Deltas, HasLen, 0)
+	// effective-channel
+	c.Assert(results[0].Channel, Equals, "candidate")
 }
 
-func (s *storeTestSuite) TestSnapActionOptions(c *C) {
+func (s *storeTestSuite) testSnapActionRefreshEpoch(c *C, flags store.SnapActionFlags, expectedEpoch interface{}) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
-		// check device authorization is set, implicitly checking doRequest was used
-		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
-
-		c.Check(r.Header.Get("Snap-Refresh-Managed"), Equals, "true")
 
 		jsonReq, err := ioutil.ReadAll(r.Body)
 		c.Assert(err, IsNil)
@@ -6034,23 +10690,18 @@ func (s *storeTestSuite) TestSnapActionOptions(c *C) {
 		c.Assert(err, IsNil)
 
 		c.Assert(req.Context, HasLen, 1)
-		c.Assert(req.Context[0], DeepEquals, map[string]interface{}{
-			"snap-id":          helloWorldSnapID,
-			"instance-key":     helloWorldSnapID,
-			"revision":         float64(1),
-			"tracking-channel": "stable",
-			"refreshed-date":   helloRefreshedDateStr,
-			"epoch":            iZeroEpoch,
-		})
 		c.Assert(req.Actions, HasLen, 1)
-		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
+		expectedAction := map[string]interface{}{
 			"action":       "refresh",
 			"instance-key": helloWorldSnapID,
 			"snap-id":      helloWorldSnapID,
-			"channel":      "stable",
-		})
+		}
+		if expectedEpoch != nil {
+			expectedAction["epoch"] = expectedEpoch
+		}
+		c.Assert(req.Actions[0], DeepEquals, expectedAction)
 
-		io.WriteString(w, `{
+		fmt.Fprint(w, `{
   "results": [{
      "result": "refresh",
      "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
@@ -6092,87 +10743,72 @@ func (s *storeTestSuite) TestSnapActionOptions(c *C) {
 	}, []*store.SnapAction{
 		{
 			Action:       "refresh",
-			SnapID:       helloWorldSnapID,
 			InstanceName: "hello-world",
-			Channel:      "stable",
+			SnapID:       helloWorldSnapID,
+			Epoch:        snap.E("1*"),
+			Flags:        flags,
 		},
-	}, nil, &store.RefreshOptions{RefreshManaged: true})
+	}, nil, nil)
 	c.Assert(err, IsNil)
 	c.Assert(results, HasLen, 1)
 	c.Assert(results[0].InstanceName(), Equals, "hello-world")
 	c.Assert(results[0].Revision, Equals, snap.R(26))
 }
 
-func (s *storeTestSuite) TestSnapActionInstall(c *C) {
-	s.testSnapActionGet("install", "", "", c)
-}
-func (s *storeTestSuite) TestSnapActionInstallWithCohort(c *C) {
-	s.testSnapActionGet("install", "what", "", c)
-}
-func (s *storeTestSuite) TestSnapActionDownload(c *C) {
-	s.testSnapActionGet("download", "", "", c)
-}
-func (s *storeTestSuite) TestSnapActionDownloadWithCohort(c *C) {
-	s.testSnapActionGet("download", "here", "", c)
-}
-func (s *storeTestSuite) TestSnapActionInstallRedirect(c *C) {
-	s.testSnapActionGet("install", "", "2.0/candidate", c)
-}
-func (s *storeTestSuite) TestSnapActionDownloadRedirect(c *C) {
-	s.testSnapActionGet("download", "", "2.0/candidate", c)
+func (s *storeTestSuite) TestSnapActionRefreshAmend(c *C) {
+	s.testSnapActionRefreshEpoch(c, store.SnapActionRefreshAmend,
+		map[string]interface{}{"read": []interface{}{0., 1.}, "write": []interface{}{1.}})
 }
-func (s *storeTestSuite) testSnapActionGet(action, cohort, redirectChannel string, c *C) {
-	// action here is one of install or download
-	restore := release.MockOnClassic(false)
-	defer restore()
-
-	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assertRequest(c, r, "POST", snapActionPath)
-		// check device authorization is set, implicitly checking doRequest was used
-		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
-
-		c.Check(r.Header.Get("Snap-Refresh-Managed"), Equals, "")
 
-		// no store ID by default
-		storeID := r.Header.Get("Snap-Device-Store")
-		c.Check(storeID, Equals, "")
+func (s *storeTestSuite) TestSnapActionRefreshEpochIgnoredWithoutAmend(c *C) {
+	// the epoch of the snap in the context is used
+	s.testSnapActionRefreshEpoch(c, 0, nil)
+}
 
-		c.Check(r.Header.Get("Snap-Device-Series"), Equals, release.Series)
-		c.Check(r.Header.Get("Snap-Device-Architecture"), Equals, arch.DpkgArchitecture())
-		c.Check(r.Header.Get("Snap-Classic"), Equals, "false")
+func (s *storeTestSuite) TestSnapActionRefreshAmendErrors(c *C) {
+	sto := store.New(&store.Config{}, nil)
 
-		jsonReq, err := ioutil.ReadAll(r.Body)
-		c.Assert(err, IsNil)
-		var req struct {
-			Context []map[string]interface{} `json:"context"`
-			Actions []map[string]interface{} `json:"actions"`
-		}
+	_, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(1),
+		},
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			InstanceName: "hello-world",
+			SnapID:       helloWorldSnapID,
+			Flags:        store.SnapActionRefreshAmend,
+		},
+	}, nil, nil)
+	c.Check(err, ErrorMatches, `internal error: refresh amend of "hello-world" without an epoch`)
 
-		err = json.Unmarshal(jsonReq, &req)
-		c.Assert(err, IsNil)
+	_, err = sto.SnapAction(s.ctx, nil, []*store.SnapAction{
+		{
+			Action:       "install",
+			InstanceName: "hello-world",
+			Epoch:        snap.E("1*"),
+			Flags:        store.SnapActionRefreshAmend,
+		},
+	}, nil, nil)
+	c.Check(err, ErrorMatches, `internal error: refresh amend flag on "install" action for "hello-world"`)
+}
 
-		c.Assert(req.Context, HasLen, 0)
-		c.Assert(req.Actions, HasLen, 1)
-		expectedAction := map[string]interface{}{
-			"action":       action,
-			"instance-key": action + "-1",
-			"name":         "hello-world",
-			"channel":      "beta",
-			"epoch":        nil,
-		}
-		if cohort != "" {
-			expectedAction["cohort-key"] = cohort
-		}
-		c.Assert(req.Actions[0], DeepEquals, expectedAction)
+func (s *storeTestSuite) TestSnapActionAnonDownloadURLs(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+		// no user authorization, but device authorization is set
+		c.Check(r.Header.Get("Authorization"), Equals, "")
+		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
 
-		fmt.Fprintf(w, `{
+		io.WriteString(w, `{
   "results": [{
-     "result": "%s",
-     "instance-key": "%[1]s-1",
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
      "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
      "name": "hello-world",
-     "effective-channel": "candidate",
-     "redirect-channel": "%s",
      "snap": {
        "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
        "name": "hello-world",
@@ -6182,10 +10818,19 @@ func (s *storeTestSuite) testSnapActionGet(action, cohort, redirectChannel strin
           "id": "canonical",
           "username": "canonical",
           "display-name": "Canonical"
+       },
+       "download": {
+         "url": "https://example.com/anon/hello-world_26.snap",
+         "deltas": [{
+           "format": "xdelta3",
+           "source": 1,
+           "target": 26,
+           "url": "https://example.com/anon/hello-world_1_26.delta"
+         }]
        }
      }
   }]
-}`, action, redirectChannel)
+}`)
 	}))
 
 	c.Assert(mockServer, NotNil)
@@ -6195,83 +10840,67 @@ func (s *storeTestSuite) testSnapActionGet(action, cohort, redirectChannel strin
 	cfg := store.Config{
 		StoreBaseURL: mockServerURL,
 	}
-	dauthCtx := &testDauthContext{c: c, device: s.device}
+	dauthCtx := &testDauthContext{c: c, device: s.device, user: s.user}
 	sto := store.New(&cfg, dauthCtx)
 
-	results, err := sto.SnapAction(s.ctx, nil,
-		[]*store.SnapAction{
-			{
-				Action:       action,
-				InstanceName: "hello-world",
-				Channel:      "beta",
-				CohortKey:    cohort,
-			},
-		}, nil, nil)
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
+		},
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			InstanceName: "hello-world",
+			SnapID:       helloWorldSnapID,
+		},
+	}, s.user, &store.RefreshOptions{AnonDownloadURLs: true})
 	c.Assert(err, IsNil)
 	c.Assert(results, HasLen, 1)
-	c.Assert(results[0].InstanceName(), Equals, "hello-world")
-	c.Assert(results[0].Revision, Equals, snap.R(26))
-	c.Assert(results[0].Version, Equals, "6.1")
-	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
-	c.Assert(results[0].Publisher.ID, Equals, helloWorldDeveloperID)
-	c.Assert(results[0].Deltas, HasLen, 0)
-	// effective-channel
-	c.Assert(results[0].Channel, Equals, "candidate")
-	c.Assert(results[0].RedirectChannel, Equals, redirectChannel)
+	c.Check(results[0].AnonDownloadURL, Equals, "https://example.com/anon/hello-world_26.snap")
+	c.Check(results[0].DownloadURL, Equals, results[0].AnonDownloadURL)
+	c.Assert(results[0].Deltas, HasLen, 1)
+	c.Check(results[0].Deltas[0].AnonDownloadURL, Equals, "https://example.com/anon/hello-world_1_26.delta")
+	c.Check(results[0].Deltas[0].DownloadURL, Equals, results[0].Deltas[0].AnonDownloadURL)
 }
 
-func (s *storeTestSuite) TestSnapActionInstallAmend(c *C) {
-	// this is what amend would look like
-	restore := release.MockOnClassic(false)
-	defer restore()
-
+func (s *storeTestSuite) TestSnapActionRefreshConfinementChange(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
-		// check device authorization is set, implicitly checking doRequest was used
-		c.Check(r.Header.Get("Snap-Device-Authorization"), Equals, `Macaroon root="device-macaroon"`)
-
-		c.Check(r.Header.Get("Snap-Refresh-Managed"), Equals, "")
-
-		// no store ID by default
-		storeID := r.Header.Get("Snap-Device-Store")
-		c.Check(storeID, Equals, "")
-
-		c.Check(r.Header.Get("Snap-Device-Series"), Equals, release.Series)
-		c.Check(r.Header.Get("Snap-Device-Architecture"), Equals, arch.DpkgArchitecture())
-		c.Check(r.Header.Get("Snap-Classic"), Equals, "false")
-
-		jsonReq, err := ioutil.ReadAll(r.Body)
-		c.Assert(err, IsNil)
-		var req struct {
-			Context []map[string]interface{} `json:"context"`
-			Actions []map[string]interface{} `json:"actions"`
-		}
-
-		err = json.Unmarshal(jsonReq, &req)
-		c.Assert(err, IsNil)
-
-		c.Assert(req.Context, HasLen, 0)
-		c.Assert(req.Actions, HasLen, 1)
-		c.Assert(req.Actions[0], DeepEquals, map[string]interface{}{
-			"action":       "install",
-			"instance-key": "install-1",
-			"name":         "hello-world",
-			"channel":      "beta",
-			"epoch":        map[string]interface{}{"read": []interface{}{0., 1.}, "write": []interface{}{1.}},
-		})
 
-		fmt.Fprint(w, `{
+		io.WriteString(w, `{
   "results": [{
-     "result": "install",
-     "instance-key": "install-1",
+     "result": "refresh",
+     "instance-key": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
      "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
      "name": "hello-world",
-     "effective-channel": "candidate",
+     "confinement-change": {"from": "strict", "to": "classic"},
      "snap": {
        "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
        "name": "hello-world",
        "revision": 26,
        "version": "6.1",
+       "confinement": "classic",
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }, {
+     "result": "refresh",
+     "instance-key": "other-snap-id",
+     "snap-id": "other-snap-id",
+     "name": "other",
+     "snap": {
+       "snap-id": "other-snap-id",
+       "name": "other",
+       "revision": 3,
+       "version": "1.1",
+       "confinement": "strict",
        "publisher": {
           "id": "canonical",
           "username": "canonical",
@@ -6292,25 +10921,57 @@ func (s *storeTestSuite) TestSnapActionInstallAmend(c *C) {
 	dauthCtx := &testDauthContext{c: c, device: s.device}
 	sto := store.New(&cfg, dauthCtx)
 
-	results, err := sto.SnapAction(s.ctx, nil,
-		[]*store.SnapAction{
-			{
-				Action:       "install",
-				InstanceName: "hello-world",
-				Channel:      "beta",
-				Epoch:        snap.E("1*"),
-			},
-		}, nil, nil)
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(1),
+			RefreshedDate:   helloRefreshedDate,
+		}, {
+			InstanceName:    "other",
+			SnapID:          "other-snap-id",
+			TrackingChannel: "stable",
+			Revision:        snap.R(2),
+			RefreshedDate:   helloRefreshedDate,
+		},
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			InstanceName: "hello-world",
+			SnapID:       helloWorldSnapID,
+		}, {
+			Action:       "refresh",
+			InstanceName: "other",
+			SnapID:       "other-snap-id",
+		},
+	}, nil, nil)
 	c.Assert(err, IsNil)
-	c.Assert(results, HasLen, 1)
-	c.Assert(results[0].InstanceName(), Equals, "hello-world")
-	c.Assert(results[0].Revision, Equals, snap.R(26))
-	c.Assert(results[0].Version, Equals, "6.1")
-	c.Assert(results[0].SnapID, Equals, helloWorldSnapID)
-	c.Assert(results[0].Publisher.ID, Equals, helloWorldDeveloperID)
-	c.Assert(results[0].Deltas, HasLen, 0)
-	// effective-channel
-	c.Assert(results[0].Channel, Equals, "candidate")
+	c.Assert(results, HasLen, 2)
+	c.Check(results[0].InstanceName(), Equals, "hello-world")
+	c.Check(results[0].Confinement, Equals, snap.ClassicConfinement)
+	c.Check(results[0].ConfinementChange, DeepEquals, &store.ConfinementChange{
+		From: snap.StrictConfinement,
+		To:   snap.ClassicConfinement,
+	})
+	c.Check(results[0].ConfinementChange.ToClassic(), Equals, true)
+	c.Check(results[1].InstanceName(), Equals, "other")
+	c.Check(results[1].ConfinementChange, IsNil)
+}
+
+func (s *storeTestSuite) TestConfinementChangeToClassic(c *C) {
+	for _, t := range []struct {
+		from, to  snap.ConfinementType
+		toClassic bool
+	}{
+		{snap.StrictConfinement, snap.ClassicConfinement, true},
+		{snap.DevModeConfinement, snap.ClassicConfinement, true},
+		{snap.ClassicConfinement, snap.StrictConfinement, false},
+		{snap.DevModeConfinement, snap.StrictConfinement, false},
+	} {
+		cc := &store.ConfinementChange{From: t.from, To: t.to}
+		c.Check(cc.ToClassic(), Equals, t.toClassic, Commentf("%s -> %s", t.from, t.to))
+	}
 }
 
 func (s *storeTestSuite) TestSnapActionWithClientUserAgent(c *C) {
@@ -7271,14 +11932,119 @@ func (s *storeTestSuite) TestConnectivityCheckUnhappy(c *C) {
 	}, nil)
 	connectivity, err := sto.ConnectivityCheck()
 	c.Assert(err, IsNil)
-	// everything is the test server, here
+	// everything is the test server, here
+	c.Check(connectivity, DeepEquals, map[string]bool{
+		mockServerURL.Host: false,
+	})
+	// three because retries
+	c.Check(seenPaths, DeepEquals, map[string]int{
+		"/v2/snaps/info/core": 3,
+	})
+}
+
+const captivePortalLoginPage = `<!DOCTYPE html>
+<html>
+<head><title>Login required</title></head>
+<body><form action="/login" method="post">Please log in to access the internet</form></body>
+</html>
+`
+
+func (s *storeTestSuite) TestConnectivityCheckCaptivePortalInfo(c *C) {
+	seenPaths := make(map[string]int, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/snaps/info/core":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(200)
+			io.WriteString(w, captivePortalLoginPage)
+		default:
+			c.Fatalf("unexpected request: %s", r.URL.String())
+			return
+		}
+		seenPaths[r.URL.Path]++
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+	mockServerURL, _ := url.Parse(mockServer.URL)
+
+	sto := store.New(&store.Config{
+		StoreBaseURL: mockServerURL,
+	}, nil)
+	connectivity, err := sto.ConnectivityCheck()
+	c.Assert(err, IsNil)
+	c.Check(connectivity, DeepEquals, map[string]bool{
+		mockServerURL.Host: false,
+	})
+	// a portal is not a transient error, no retries
+	c.Check(seenPaths, DeepEquals, map[string]int{
+		"/v2/snaps/info/core": 1,
+	})
+}
+
+func (s *storeTestSuite) TestConnectivityCheckCaptivePortalDownload(c *C) {
+	seenPaths := make(map[string]int, 3)
+	var mockServerURL *url.URL
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/snaps/info/core":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, fmt.Sprintf(`{"channel-map": [{"download": {"url": %q}}]}`, mockServerURL.String()+"/download/core"))
+		case "/download/core":
+			c.Check(r.Method, Equals, "HEAD")
+			// the portal intercepts the download and redirects
+			// to its login page
+			http.Redirect(w, r, "/portal/login", 302)
+		case "/portal/login":
+			c.Check(r.Method, Equals, "HEAD")
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(200)
+		default:
+			c.Fatalf("unexpected request: %s", r.URL.String())
+			return
+		}
+		seenPaths[r.URL.Path]++
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+	mockServerURL, _ = url.Parse(mockServer.URL)
+
+	sto := store.New(&store.Config{
+		StoreBaseURL: mockServerURL,
+	}, nil)
+	connectivity, err := sto.ConnectivityCheck()
+	c.Assert(err, IsNil)
+	c.Check(connectivity, DeepEquals, map[string]bool{
+		mockServerURL.Host: false,
+	})
+	c.Check(seenPaths, DeepEquals, map[string]int{
+		"/v2/snaps/info/core": 1,
+		"/download/core":      1,
+		"/portal/login":       1,
+	})
+}
+
+func (s *storeTestSuite) TestConnectivityCheckNoDownloadURL(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/snaps/info/core":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"channel-map": []}`)
+		default:
+			c.Fatalf("unexpected request: %s", r.URL.String())
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+	mockServerURL, _ := url.Parse(mockServer.URL)
+
+	sto := store.New(&store.Config{
+		StoreBaseURL: mockServerURL,
+	}, nil)
+	connectivity, err := sto.ConnectivityCheck()
+	c.Assert(err, IsNil)
 	c.Check(connectivity, DeepEquals, map[string]bool{
 		mockServerURL.Host: false,
 	})
-	// three because retries
-	c.Check(seenPaths, DeepEquals, map[string]int{
-		"/v2/snaps/info/core": 3,
-	})
 }
 
 func (s *storeTestSuite) TestSnapActionRefreshParallelInstall(c *C) {
@@ -7495,6 +12261,227 @@ func (s *storeTestSuite) TestSnapActionRefreshStableInstanceKey(c *C) {
 	c.Assert(resultsAgain, DeepEquals, results)
 }
 
+func (s *storeTestSuite) TestSnapActionCustomInstanceKeyFunc(c *C) {
+	customKey := helloWorldSnapID + ":custom-" + helloWorldSnapID + "-foo"
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+
+		jsonReq, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		var req struct {
+			Context []map[string]interface{} `json:"context"`
+			Actions []map[string]interface{} `json:"actions"`
+		}
+
+		err = json.Unmarshal(jsonReq, &req)
+		c.Assert(err, IsNil)
+
+		c.Assert(req.Context, HasLen, 2)
+		c.Check(req.Context[0]["instance-key"], Equals, helloWorldSnapID)
+		c.Check(req.Context[1]["instance-key"], Equals, customKey)
+		c.Assert(req.Actions, HasLen, 1)
+		c.Check(req.Actions[0]["instance-key"], Equals, customKey)
+
+		io.WriteString(w, `{
+  "results": [{
+     "result": "refresh",
+     "instance-key": "`+customKey+`",
+     "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+     "name": "hello-world",
+     "snap": {
+       "snap-id": "buPKUD3TKqCOgLEjjHx5kSiCpIs5cMuQ",
+       "name": "hello-world",
+       "revision": 26,
+       "version": "6.1",
+       "publisher": {
+          "id": "canonical",
+          "username": "canonical",
+          "display-name": "Canonical"
+       }
+     }
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	var calls []string
+	opts := &store.RefreshOptions{
+		// no PrivacyKey needed
+		InstanceKeyFunc: func(snapID, instanceKey string) (string, error) {
+			calls = append(calls, snapID+"_"+instanceKey)
+			return "custom-" + snapID + "-" + instanceKey, nil
+		},
+	}
+	results, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(26),
+			RefreshedDate:   helloRefreshedDate,
+		}, {
+			InstanceName:    "hello-world_foo",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(2),
+			RefreshedDate:   helloRefreshedDate,
+		},
+	}, []*store.SnapAction{
+		{
+			Action:       "refresh",
+			SnapID:       helloWorldSnapID,
+			Channel:      "stable",
+			InstanceName: "hello-world_foo",
+		},
+	}, nil, opts)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Check(results[0].InstanceName(), Equals, "hello-world_foo")
+	c.Check(results[0].Revision, Equals, snap.R(26))
+	// only used, once, for the parallel instance
+	c.Check(calls, DeepEquals, []string{helloWorldSnapID + "_foo"})
+}
+
+func (s *storeTestSuite) TestSnapActionCorrelationIDs(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", snapActionPath)
+
+		jsonReq, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		// the correlation ids are not sent to the store
+		c.Check(string(jsonReq), Not(Matches), "(?s).*corr-.*")
+		var req struct {
+			Actions []map[string]interface{} `json:"actions"`
+		}
+		err = json.Unmarshal(jsonReq, &req)
+		c.Assert(err, IsNil)
+		c.Assert(req.Actions, HasLen, 3)
+		c.Check(req.Actions[0]["instance-key"], Equals, helloWorldSnapID)
+		c.Check(req.Actions[1]["instance-key"], Equals, "install-1")
+		c.Check(req.Actions[2]["instance-key"], Equals, "download-1")
+
+		// results come back in a different order than the actions
+		io.WriteString(w, `{
+  "results": [{
+     "result": "download",
+     "instance-key": "download-1",
+     "snap-id": "bar-id",
+     "name": "bar",
+     "snap": {"snap-id": "bar-id", "name": "bar", "revision": 3}
+  }, {
+     "result": "refresh",
+     "instance-key": "`+helloWorldSnapID+`",
+     "snap-id": "`+helloWorldSnapID+`",
+     "name": "hello-world",
+     "snap": {"snap-id": "`+helloWorldSnapID+`", "name": "hello-world", "revision": 27}
+  }, {
+     "result": "install",
+     "instance-key": "install-1",
+     "snap-id": "foo-id",
+     "name": "foo",
+     "snap": {"snap-id": "foo-id", "name": "foo", "revision": 5}
+  }]
+}`)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	currentSnaps := []*store.CurrentSnap{
+		{
+			InstanceName:    "hello-world",
+			SnapID:          helloWorldSnapID,
+			TrackingChannel: "stable",
+			Revision:        snap.R(26),
+			RefreshedDate:   helloRefreshedDate,
+		},
+	}
+	actions := []*store.SnapAction{
+		{
+			Action:        "refresh",
+			SnapID:        helloWorldSnapID,
+			InstanceName:  "hello-world",
+			CorrelationID: "corr-refresh",
+		}, {
+			Action:        "install",
+			InstanceName:  "foo",
+			CorrelationID: "corr-install",
+		}, {
+			Action:        "download",
+			InstanceName:  "bar",
+			CorrelationID: "corr-download",
+		},
+	}
+	results, err := sto.SnapAction(s.ctx, currentSnaps, actions, nil, &store.RefreshOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 3)
+
+	correlationIDs := make(map[string]string, len(results))
+	for _, res := range results {
+		correlationIDs[res.SnapName()] = res.CorrelationID
+	}
+	c.Check(correlationIDs, DeepEquals, map[string]string{
+		"hello-world": "corr-refresh",
+		"foo":         "corr-install",
+		"bar":         "corr-download",
+	})
+}
+
+func (s *storeTestSuite) TestSnapActionCustomInstanceKeyFuncInvalid(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Fatalf("no request expected")
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	sto := store.New(&cfg, nil)
+
+	for _, t := range []struct {
+		keyFunc func(snapID, instanceKey string) (string, error)
+		err     string
+	}{
+		{func(string, string) (string, error) { return "", nil }, "empty key"},
+		{func(string, string) (string, error) { return "", errors.New("boom") }, "boom"},
+	} {
+		_, err := sto.SnapAction(s.ctx, []*store.CurrentSnap{
+			{
+				InstanceName:    "hello-world_foo",
+				SnapID:          helloWorldSnapID,
+				TrackingChannel: "stable",
+				Revision:        snap.R(2),
+			},
+		}, []*store.SnapAction{
+			{
+				Action:       "refresh",
+				SnapID:       helloWorldSnapID,
+				InstanceName: "hello-world_foo",
+			},
+		}, nil, &store.RefreshOptions{InstanceKeyFunc: t.keyFunc})
+		c.Check(err, ErrorMatches, `cannot derive instance key for "hello-world_foo": `+t.err)
+	}
+}
+
 func (s *storeTestSuite) TestSnapActionRevisionNotAvailableParallelInstall(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assertRequest(c, r, "POST", snapActionPath)
@@ -8072,3 +13059,178 @@ func (s *storeTestSuite) TestCreateCohort(c *C) {
 		"potato": "U3VwZXIgc2VjcmV0IHN0dWZmIGVuY3J5cHRlZCBoZXJlLg==",
 	})
 }
+
+func (s *storeTestSuite) mockCohortsServer(c *C, requested *[][]string) *httptest.Server {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "POST", cohortsPath)
+
+		var req struct {
+			Snaps []string
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		c.Assert(err, IsNil)
+		*requested = append(*requested, req.Snaps)
+
+		keys := make(map[string]string, len(req.Snaps))
+		for _, name := range req.Snaps {
+			keys[name] = fmt.Sprintf("%s-key-%d", name, len(*requested))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"cohort-keys": keys,
+		})
+	}))
+	c.Assert(mockServer, NotNil)
+	return mockServer
+}
+
+func (s *storeTestSuite) TestEnsureCohorts(c *C) {
+	var requested [][]string
+	mockServer := s.mockCohortsServer(c, &requested)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	cohorts, err := sto.EnsureCohorts(s.ctx, []string{"foo", "bar"}, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(cohorts, DeepEquals, map[string]string{
+		"foo": "foo-key-1",
+		"bar": "bar-key-1",
+	})
+	c.Check(requested, DeepEquals, [][]string{{"foo", "bar"}})
+
+	// within the ttl the store is not asked again
+	cohorts, err = sto.EnsureCohorts(s.ctx, []string{"bar", "foo"}, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(cohorts, DeepEquals, map[string]string{
+		"foo": "foo-key-1",
+		"bar": "bar-key-1",
+	})
+	c.Check(requested, HasLen, 1)
+
+	// only the missing keys are created
+	cohorts, err = sto.EnsureCohorts(s.ctx, []string{"foo", "baz"}, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(cohorts, DeepEquals, map[string]string{
+		"foo": "foo-key-1",
+		"baz": "baz-key-2",
+	})
+	c.Check(requested, DeepEquals, [][]string{{"foo", "bar"}, {"baz"}})
+
+	// CreateCohorts itself is not cached
+	cohorts, err = sto.CreateCohorts(s.ctx, []string{"foo"})
+	c.Assert(err, IsNil)
+	c.Check(cohorts, DeepEquals, map[string]string{"foo": "foo-key-3"})
+	c.Check(requested, HasLen, 3)
+}
+
+func (s *storeTestSuite) TestEnsureCohortsExpired(c *C) {
+	fc := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.AddCleanup(httputil.MockClock(fc))
+
+	var requested [][]string
+	mockServer := s.mockCohortsServer(c, &requested)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	cohorts, err := sto.EnsureCohorts(s.ctx, []string{"foo"}, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(cohorts, DeepEquals, map[string]string{"foo": "foo-key-1"})
+
+	fc.now = fc.now.Add(time.Hour - time.Second)
+	cohorts, err = sto.EnsureCohorts(s.ctx, []string{"foo"}, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(cohorts, DeepEquals, map[string]string{"foo": "foo-key-1"})
+	c.Check(requested, HasLen, 1)
+
+	fc.now = fc.now.Add(time.Second)
+	cohorts, err = sto.EnsureCohorts(s.ctx, []string{"foo"}, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(cohorts, DeepEquals, map[string]string{"foo": "foo-key-2"})
+	c.Check(requested, HasLen, 2)
+}
+
+func (s *storeTestSuite) TestEnsureCohortsShorterTTL(c *C) {
+	fc := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.AddCleanup(httputil.MockClock(fc))
+
+	var requested [][]string
+	mockServer := s.mockCohortsServer(c, &requested)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	cohorts, err := sto.EnsureCohorts(s.ctx, []string{"foo"}, 24*time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(cohorts, DeepEquals, map[string]string{"foo": "foo-key-1"})
+
+	// the key is older than the ttl of this call even though it
+	// was created with a longer one
+	fc.now = fc.now.Add(2 * time.Hour)
+	cohorts, err = sto.EnsureCohorts(s.ctx, []string{"foo"}, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(cohorts, DeepEquals, map[string]string{"foo": "foo-key-2"})
+	c.Check(requested, HasLen, 2)
+}
+
+func (s *storeTestSuite) TestEnsureCohortsPrunesExpired(c *C) {
+	fc := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.AddCleanup(httputil.MockClock(fc))
+
+	var requested [][]string
+	mockServer := s.mockCohortsServer(c, &requested)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	_, err := sto.EnsureCohorts(s.ctx, []string{"foo", "bar"}, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(sto.CachedCohortKeys(), DeepEquals, []string{"bar", "foo"})
+
+	// keys of snaps that are not asked for anymore are dropped too
+	fc.now = fc.now.Add(time.Hour)
+	cohorts, err := sto.EnsureCohorts(s.ctx, []string{"baz"}, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(cohorts, DeepEquals, map[string]string{"baz": "baz-key-2"})
+	c.Check(sto.CachedCohortKeys(), DeepEquals, []string{"baz"})
+}
+
+func (s *storeTestSuite) TestEnsureCohortsNoTTL(c *C) {
+	var requested [][]string
+	mockServer := s.mockCohortsServer(c, &requested)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	for i := 1; i <= 2; i++ {
+		cohorts, err := sto.EnsureCohorts(s.ctx, []string{"foo"}, 0)
+		c.Assert(err, IsNil)
+		c.Check(cohorts, DeepEquals, map[string]string{"foo": fmt.Sprintf("foo-key-%d", i)})
+	}
+	c.Check(requested, HasLen, 2)
+}
@@ -0,0 +1,44 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+)
+
+type storeIDContextKey struct{}
+
+// WithStoreID returns a context for store requests that makes them
+// use the given store ID instead of the one of the device or the
+// store configuration.
+func WithStoreID(parent context.Context, storeID string) context.Context {
+	return context.WithValue(parent, storeIDContextKey{}, storeID)
+}
+
+func storeIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	storeID, ok := ctx.Value(storeIDContextKey{}).(string)
+	if ok {
+		return storeID
+	}
+	return ""
+}
@@ -69,7 +69,7 @@ func (Store) SuggestedCurrency() string {
 	panic("Store.SuggestedCurrency not expected")
 }
 
-func (Store) Buy(*client.BuyOptions, *auth.UserState) (*client.BuyResult, error) {
+func (Store) Buy(context.Context, *client.BuyOptions, *auth.UserState) (*client.BuyResult, error) {
 	panic("Store.Buy not expected")
 }
 
@@ -0,0 +1,83 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/snapcore/snapd/overlord/auth"
+	"github.com/snapcore/snapd/release"
+)
+
+// Suggest returns the names of the snaps whose name starts with the
+// given prefix, in the order ranked by the store, for suggestions as
+// the user types. At most limit names are returned if limit is
+// positive. The prefix is validated like a Find query.
+func (s *Store) Suggest(ctx context.Context, prefix string, limit int, user *auth.UserState) ([]string, error) {
+	prefix = strings.TrimSpace(prefix)
+	if strings.ContainsAny(prefix, findBadQueryChars) {
+		return nil, ErrBadQuery
+	}
+	if prefix == "" {
+		return []string{}, nil
+	}
+
+	q := url.Values{}
+	q.Set("name", prefix)
+	// the names are always included, ask for as little as possible
+	// on top of them
+	q.Set("fields", "title")
+	q.Set("architecture", s.architecture)
+	q.Set("channel", "stable")
+	if release.OnClassic {
+		q.Set("confinement", "strict,classic")
+	} else {
+		q.Set("confinement", "strict")
+	}
+
+	reqOptions := &requestOptions{
+		Method:   "GET",
+		URL:      s.endpointURL(findEndpPath, q),
+		Accept:   jsonContentType,
+		APILevel: apiV2Endps,
+	}
+
+	var searchData searchV2Results
+	resp, err := s.retryRequestDecodeJSON(ctx, reqOptions, user, &searchData, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, respToError(resp, "get search suggestions")
+	}
+
+	n := len(searchData.Results)
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	names := make([]string, 0, n)
+	for _, res := range searchData.Results[:n] {
+		names = append(names, res.Name)
+	}
+
+	return names, nil
+}
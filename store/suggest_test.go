@@ -0,0 +1,130 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/release"
+	"github.com/snapcore/snapd/store"
+)
+
+const mockSuggestJSON = `{
+  "results": [
+    {"name": "hello", "snap-id": "hello-id", "snap": {"title": "Hello"}},
+    {"name": "hello-world", "snap-id": "hello-world-id", "snap": {"title": "Hello World"}},
+    {"name": "hellogram", "snap-id": "hellogram-id", "snap": {"title": "Hellogram"}}
+  ]
+}`
+
+func (s *storeTestSuite) mockSuggestServer(c *C, body string, n *int) *url.URL {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		c.Check(r.URL.Query(), DeepEquals, url.Values{
+			"name":         {"hel"},
+			"fields":       {"title"},
+			"architecture": {"amd64"},
+			"channel":      {"stable"},
+			"confinement":  {"strict"},
+		})
+		*n++
+
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	c.Assert(mockServer, NotNil)
+	s.AddCleanup(mockServer.Close)
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	return mockServerURL
+}
+
+func (s *storeTestSuite) TestSuggest(c *C) {
+	defer release.MockOnClassic(false)()
+
+	n := 0
+	mockServerURL := s.mockSuggestServer(c, mockSuggestJSON, &n)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL, Architecture: "amd64"}, nil)
+
+	names, err := sto.Suggest(s.ctx, "hel", 0, nil)
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"hello", "hello-world", "hellogram"})
+
+	// the store ranking is kept when limiting
+	names, err = sto.Suggest(s.ctx, " hel ", 2, nil)
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"hello", "hello-world"})
+
+	c.Check(n, Equals, 2)
+}
+
+func (s *storeTestSuite) TestSuggestNoMatches(c *C) {
+	defer release.MockOnClassic(false)()
+
+	n := 0
+	mockServerURL := s.mockSuggestServer(c, `{"results": []}`, &n)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL, Architecture: "amd64"}, nil)
+
+	names, err := sto.Suggest(s.ctx, "hel", 5, nil)
+	c.Assert(err, IsNil)
+	c.Check(names, NotNil)
+	c.Check(names, HasLen, 0)
+	c.Check(n, Equals, 1)
+}
+
+func (s *storeTestSuite) TestSuggestBadOrEmptyPrefix(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Fatalf("no request expected")
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	for _, prefix := range []string{"hel:", "hel*", "a&b", `"hel"`} {
+		_, err := sto.Suggest(s.ctx, prefix, 5, nil)
+		c.Check(err, Equals, store.ErrBadQuery, Commentf("%q", prefix))
+	}
+
+	names, err := sto.Suggest(s.ctx, "  ", 5, nil)
+	c.Assert(err, IsNil)
+	c.Check(names, HasLen, 0)
+}
+
+func (s *storeTestSuite) TestSuggestError(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", findPath)
+		w.WriteHeader(418)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	sto := store.New(&store.Config{StoreBaseURL: mockServerURL}, nil)
+
+	_, err := sto.Suggest(s.ctx, "hel", 5, nil)
+	c.Check(err, ErrorMatches, `cannot get search suggestions: got unexpected HTTP status code 418 via GET to "http://.*/v2/snaps/find.*"`)
+}
@@ -0,0 +1,123 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// RequestTrace is the timing breakdown of a single attempt of a
+// request to the store, as passed to Config.TraceRequest.
+type RequestTrace struct {
+	Method string
+	URL    string
+
+	// DNS, Connect and TLSHandshake are left zero when the phase did
+	// not happen, e.g. for reused connections.
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// FirstByte is the time from starting the request until the
+	// first byte of the response arrived.
+	FirstByte time.Duration
+
+	ReusedConn bool
+	// Err is the error, if any, from sending the request.
+	Err error
+}
+
+type requestTracer struct {
+	mu sync.Mutex
+
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+
+	trace RequestTrace
+}
+
+func newRequestTracer(req *http.Request) *requestTracer {
+	return &requestTracer{
+		start: time.Now(),
+		trace: RequestTrace{
+			Method: req.Method,
+			URL:    req.URL.String(),
+		},
+	}
+}
+
+func (t *requestTracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.trace.DNS = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.trace.Connect = time.Since(t.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.trace.TLSHandshake = time.Since(t.tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.trace.ReusedConn = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.trace.FirstByte = time.Since(t.start)
+		},
+	}
+}
+
+// done returns the collected trace once the request was sent.
+func (t *requestTracer) done(err error) *RequestTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	trace := t.trace
+	trace.Err = err
+	return &trace
+}
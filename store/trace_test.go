@@ -0,0 +1,135 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2020 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package store_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/store"
+)
+
+func (s *storeTestSuite) TestTraceRequest(c *C) {
+	n := 0
+	mockServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		n++
+		if n == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		io.WriteString(w, mockInfoJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(mockServer.Certificate())
+
+	var traces []*store.RequestTrace
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+		TLSConfig:    &tls.Config{RootCAs: roots},
+		TraceRequest: func(t *store.RequestTrace) {
+			traces = append(traces, t)
+		},
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	result, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(result.InstanceName(), Equals, "hello-world")
+	c.Check(n, Equals, 2)
+
+	// one trace per attempt
+	c.Assert(traces, HasLen, 2)
+	for _, t := range traces {
+		c.Check(t.Method, Equals, "GET")
+		c.Check(t.URL, Matches, mockServer.URL+"/v2/snaps/info/hello-world.*")
+		c.Check(t.Err, IsNil)
+		c.Check(t.FirstByte > 0, Equals, true)
+	}
+	// the first attempt needed a new connection
+	c.Check(traces[0].ReusedConn, Equals, false)
+	c.Check(traces[0].Connect > 0, Equals, true)
+	c.Check(traces[0].TLSHandshake > 0, Equals, true)
+}
+
+func (s *storeTestSuite) TestTraceRequestPlainHTTP(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertRequest(c, r, "GET", infoPathPattern)
+		io.WriteString(w, mockInfoJSON)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	var traces []*store.RequestTrace
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+		TraceRequest: func(t *store.RequestTrace) {
+			traces = append(traces, t)
+		},
+	}
+	dauthCtx := &testDauthContext{c: c, device: s.device}
+	sto := store.New(&cfg, dauthCtx)
+
+	_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(traces, HasLen, 1)
+	c.Check(traces[0].ReusedConn, Equals, false)
+	c.Check(traces[0].Connect > 0, Equals, true)
+	c.Check(traces[0].FirstByte > traces[0].Connect, Equals, true)
+	c.Check(traces[0].TLSHandshake, Equals, time.Duration(0))
+}
+
+func (s *storeTestSuite) TestTraceRequestError(c *C) {
+	mockServer := httptest.NewServer(nil)
+	mockServerURL, _ := url.Parse(mockServer.URL)
+	// nothing listening anymore
+	mockServer.Close()
+
+	var traces []*store.RequestTrace
+	cfg := store.Config{
+		StoreBaseURL: mockServerURL,
+		TraceRequest: func(t *store.RequestTrace) {
+			traces = append(traces, t)
+		},
+	}
+	sto := store.New(&cfg, nil)
+
+	_, err := sto.SnapInfo(s.ctx, store.SnapSpec{Name: "hello-world"}, nil)
+	c.Assert(err, NotNil)
+	c.Assert(len(traces) > 0, Equals, true)
+	for _, t := range traces {
+		c.Check(t.Err, NotNil)
+		c.Check(t.FirstByte, Equals, time.Duration(0))
+	}
+}